@@ -0,0 +1,68 @@
+// Command decrypt decrypts an object written with ENCRYPTION_KEY_FILE set, e.g.
+//
+//	decrypt -keyfile master.key -key "$ENCRYPTION_KEY" -in content_logs.ndjson.gz.enc -gunzip > content_logs.ndjson
+//
+// where the key is the encryption_key metadata of the object
+package main
+
+import (
+	"compress/gzip"
+	"fasthttp-server/pipe"
+	"flag"
+	"io"
+	"log"
+	"os"
+)
+
+func main() {
+	keyFile := flag.String("keyfile", "", "path of the master keyfile")
+	wrappedKey := flag.String("key", "", "the encryption_key metadata of the object")
+	in := flag.String("in", "", "path of the encrypted object, defaults to stdin")
+	out := flag.String("out", "", "path to write the decrypted object to, defaults to stdout")
+	gunzip := flag.Bool("gunzip", false, "decompress the decrypted object to NDJSON")
+	flag.Parse()
+
+	if *keyFile == "" || *wrappedKey == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	k, err := pipe.NewLocalKeyWrapper(*keyFile)
+	if err != nil {
+		log.Fatalf("Cannot load keyfile: %s", err)
+	}
+
+	var reader io.Reader = os.Stdin
+	if *in != "" {
+		file, err := os.Open(*in)
+		if err != nil {
+			log.Fatalf("Cannot open %s: %s", *in, err)
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	var writer io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("Cannot create %s: %s", *out, err)
+		}
+		defer file.Close()
+		writer = file
+	}
+
+	reader, err = pipe.NewDecryptReader(reader, k, *wrappedKey)
+	if err != nil {
+		log.Fatalf("Cannot decrypt: %s", err)
+	}
+	if *gunzip {
+		if reader, err = gzip.NewReader(reader); err != nil {
+			log.Fatalf("Cannot decompress: %s", err)
+		}
+	}
+
+	if _, err = io.Copy(writer, reader); err != nil {
+		log.Fatalf("Cannot decrypt: %s", err)
+	}
+}
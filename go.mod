@@ -1,18 +1,40 @@
 module fasthttp-server
 
-go 1.12
+go 1.17
 
 require (
 	github.com/Azure/azure-pipeline-go v0.2.1
 	github.com/Azure/azure-storage-blob-go v0.8.0
-	github.com/Azure/go-autorest/autorest/adal v0.8.3 // indirect
 	github.com/aws/aws-sdk-go v1.30.4
+	github.com/fasthttp/websocket v1.4.3-rc.6
 	github.com/golang/mock v1.4.3
-	github.com/json-iterator/go v1.1.9
+	github.com/json-iterator/go v1.1.12
+	github.com/klauspost/compress v1.12.2
+	github.com/segmentio/kafka-go v0.3.5
+	github.com/valyala/fasthttp v1.27.0
+	github.com/xeipuuv/gojsonschema v1.2.0
+	google.golang.org/grpc v1.56.3
+	google.golang.org/protobuf v1.31.0
+)
+
+require (
+	github.com/Azure/go-autorest/autorest/adal v0.8.3 // indirect
+	github.com/andybalholm/brotli v1.0.2 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/golang/snappy v0.0.3 // indirect
+	github.com/jmespath/go-jmespath v0.3.0 // indirect
+	github.com/klauspost/cpuid v1.2.1 // indirect
+	github.com/mattn/go-ieproxy v0.0.0-20190610004146-91bb50d98149 // indirect
 	github.com/mattn/goveralls v0.0.5 // indirect
-	github.com/valyala/fasthttp v1.9.0
-	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e // indirect
-	golang.org/x/sys v0.0.0-20200406155108-e3b113bbe6a4 // indirect
-	golang.org/x/text v0.3.2 // indirect
-	golang.org/x/tools v0.0.0-20200410194907-79a7a3126eef // indirect
+	github.com/modern-go/concurrent v0.0.0-20180228061459-e0a39a4cb421 // indirect
+	github.com/modern-go/reflect2 v1.0.2 // indirect
+	github.com/savsgio/gotils v0.0.0-20210617111740-97865ed5a873 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	github.com/xeipuuv/gojsonpointer v0.0.0-20180127040702-4e3ac2762d5f // indirect
+	github.com/xeipuuv/gojsonreference v0.0.0-20180127040603-bd5ef7bd5415 // indirect
+	golang.org/x/net v0.11.0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	golang.org/x/tools v0.6.0 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
 )
@@ -0,0 +1,187 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: ingest/ingest.proto
+
+package ingest
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Ingester_Ingest_FullMethodName       = "/fasthttpserver.ingest.v1.Ingester/Ingest"
+	Ingester_IngestStream_FullMethodName = "/fasthttpserver.ingest.v1.Ingester/IngestStream"
+)
+
+// IngesterClient is the client API for Ingester service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type IngesterClient interface {
+	// Ingest stores a single message
+	Ingest(ctx context.Context, in *IngestRequest, opts ...grpc.CallOption) (*IngestResponse, error)
+	// IngestStream stores every message sent on the stream, invalid messages are reported in the response and do
+	// not end the stream
+	IngestStream(ctx context.Context, opts ...grpc.CallOption) (Ingester_IngestStreamClient, error)
+}
+
+type ingesterClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewIngesterClient(cc grpc.ClientConnInterface) IngesterClient {
+	return &ingesterClient{cc}
+}
+
+func (c *ingesterClient) Ingest(ctx context.Context, in *IngestRequest, opts ...grpc.CallOption) (*IngestResponse, error) {
+	out := new(IngestResponse)
+	err := c.cc.Invoke(ctx, Ingester_Ingest_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ingesterClient) IngestStream(ctx context.Context, opts ...grpc.CallOption) (Ingester_IngestStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Ingester_ServiceDesc.Streams[0], Ingester_IngestStream_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &ingesterIngestStreamClient{stream}
+	return x, nil
+}
+
+type Ingester_IngestStreamClient interface {
+	Send(*IngestRequest) error
+	CloseAndRecv() (*IngestStreamResponse, error)
+	grpc.ClientStream
+}
+
+type ingesterIngestStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *ingesterIngestStreamClient) Send(m *IngestRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *ingesterIngestStreamClient) CloseAndRecv() (*IngestStreamResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(IngestStreamResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// IngesterServer is the server API for Ingester service.
+// All implementations must embed UnimplementedIngesterServer
+// for forward compatibility
+type IngesterServer interface {
+	// Ingest stores a single message
+	Ingest(context.Context, *IngestRequest) (*IngestResponse, error)
+	// IngestStream stores every message sent on the stream, invalid messages are reported in the response and do
+	// not end the stream
+	IngestStream(Ingester_IngestStreamServer) error
+	mustEmbedUnimplementedIngesterServer()
+}
+
+// UnimplementedIngesterServer must be embedded to have forward compatible implementations.
+type UnimplementedIngesterServer struct {
+}
+
+func (UnimplementedIngesterServer) Ingest(context.Context, *IngestRequest) (*IngestResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Ingest not implemented")
+}
+func (UnimplementedIngesterServer) IngestStream(Ingester_IngestStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method IngestStream not implemented")
+}
+func (UnimplementedIngesterServer) mustEmbedUnimplementedIngesterServer() {}
+
+// UnsafeIngesterServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to IngesterServer will
+// result in compilation errors.
+type UnsafeIngesterServer interface {
+	mustEmbedUnimplementedIngesterServer()
+}
+
+func RegisterIngesterServer(s grpc.ServiceRegistrar, srv IngesterServer) {
+	s.RegisterService(&Ingester_ServiceDesc, srv)
+}
+
+func _Ingester_Ingest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IngestRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IngesterServer).Ingest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Ingester_Ingest_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IngesterServer).Ingest(ctx, req.(*IngestRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Ingester_IngestStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(IngesterServer).IngestStream(&ingesterIngestStreamServer{stream})
+}
+
+type Ingester_IngestStreamServer interface {
+	SendAndClose(*IngestStreamResponse) error
+	Recv() (*IngestRequest, error)
+	grpc.ServerStream
+}
+
+type ingesterIngestStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *ingesterIngestStreamServer) SendAndClose(m *IngestStreamResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *ingesterIngestStreamServer) Recv() (*IngestRequest, error) {
+	m := new(IngestRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Ingester_ServiceDesc is the grpc.ServiceDesc for Ingester service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Ingester_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "fasthttpserver.ingest.v1.Ingester",
+	HandlerType: (*IngesterServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Ingest",
+			Handler:    _Ingester_Ingest_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "IngestStream",
+			Handler:       _Ingester_IngestStream_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "ingest/ingest.proto",
+}
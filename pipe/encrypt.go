@@ -0,0 +1,280 @@
+package pipe
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Metadata stored with an encrypted object, underscores are used as Azure metadata names cannot contain hyphens
+const (
+	MetadataKey         = "encryption_key"
+	MetadataKeyID       = "encryption_key_id"
+	MetadataAlgorithm   = "encryption_algorithm"
+	EncryptionAlgorithm = "AES256-GCM-STREAM"
+	EncryptedExtension  = "ndjson.gz.enc"
+)
+
+const (
+	encryptionMagic      = "FHE1"
+	encryptionChunkSize  = 64 * 1024
+	encryptionHeaderSize = 5 // flag byte and big endian uint32 ciphertext length
+	dataKeySize          = 32
+	finalChunk           = 1
+)
+
+var (
+	randReader = rand.Reader
+
+	errTruncated = errors.New("encrypted stream is truncated")
+)
+
+// KeyWrapper wraps and unwraps data keys with a master key, it is compatible with KMS style
+// Encrypt and Decrypt APIs
+type KeyWrapper interface {
+	KeyID() string
+	Wrap(dataKey []byte) ([]byte, error)
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// NewLocalKeyWrapper returns a KeyWrapper using a 256 bit master key read from a local keyfile,
+// the key may be stored raw, hex or base64 encoded. It stands in for a KMS
+func NewLocalKeyWrapper(path string) (KeyWrapper, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key := content
+	if len(key) != dataKeySize {
+		encoded := strings.TrimSpace(string(content))
+		if key, err = hex.DecodeString(encoded); err != nil || len(key) != dataKeySize {
+			key, err = base64.StdEncoding.DecodeString(encoded)
+		}
+		if err != nil || len(key) != dataKeySize {
+			return nil, fmt.Errorf("keyfile %s must contain a 256 bit key", path)
+		}
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	id := sha256.Sum256(key)
+	return &localKeyWrapper{aead: aead, id: "local:" + hex.EncodeToString(id[:4])}, nil
+}
+
+type localKeyWrapper struct {
+	aead cipher.AEAD
+	id   string
+}
+
+func (l *localKeyWrapper) KeyID() string {
+	return l.id
+}
+
+func (l *localKeyWrapper) Wrap(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, l.aead.NonceSize())
+	if _, err := io.ReadFull(randReader, nonce); err != nil {
+		return nil, err
+	}
+	return l.aead.Seal(nonce, nonce, dataKey, []byte(l.id)), nil
+}
+
+func (l *localKeyWrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < l.aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	nonce, ciphertext := wrapped[:l.aead.NonceSize()], wrapped[l.aead.NonceSize():]
+	return l.aead.Open(nil, nonce, ciphertext, []byte(l.id))
+}
+
+// NewEncryptedGzipWriter returns a GzipWriter which encrypts the compressed stream with AES-256-GCM using a
+// new data key, and the metadata to store with the object which holds the data key wrapped by the KeyWrapper
+func NewEncryptedGzipWriter(k KeyWrapper) (GzipWriter, map[string]string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(randReader, dataKey); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := k.Wrap(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, w := io.Pipe()
+	cw := &countingWriter{w: w}
+	enc := &encrypter{w: cw, aead: aead}
+	metadata := map[string]string{
+		MetadataKey:       base64.StdEncoding.EncodeToString(wrapped),
+		MetadataKeyID:     k.KeyID(),
+		MetadataAlgorithm: EncryptionAlgorithm,
+	}
+	return &pipe{r: r, w: w, cw: cw, gw: gzip.NewWriter(enc), enc: enc, closed: make(chan struct{}), commits: make(chan struct{})}, metadata, nil
+}
+
+func newAEAD(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of a chunk, made of its counter and whether it is the final chunk
+// so chunks cannot be reordered and the stream cannot be truncated without detection
+func chunkNonce(aead cipher.AEAD, counter uint64, flag byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], counter)
+	nonce[len(nonce)-1] = flag
+	return nonce
+}
+
+// encrypter seals the stream in chunks of up to 64KiB, each prefixed with a flag and its length
+type encrypter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	started bool
+}
+
+func (e *encrypter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		space := encryptionChunkSize - len(e.buf)
+		if space > len(b) {
+			space = len(b)
+		}
+		e.buf = append(e.buf, b[:space]...)
+		b = b[space:]
+		if len(e.buf) == encryptionChunkSize {
+			if err := e.seal(0); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush seals the buffered data so it is passed on, without ending the stream
+func (e *encrypter) Flush() error {
+	if len(e.buf) == 0 {
+		return nil
+	}
+	return e.seal(0)
+}
+
+// Close seals the remaining data as the final chunk
+func (e *encrypter) Close() error {
+	return e.seal(finalChunk)
+}
+
+func (e *encrypter) seal(flag byte) error {
+	out := make([]byte, 0, len(encryptionMagic)+encryptionHeaderSize+len(e.buf)+e.aead.Overhead())
+	if !e.started {
+		out = append(out, encryptionMagic...)
+		e.started = true
+	}
+	header := make([]byte, encryptionHeaderSize)
+	header[0] = flag
+	binary.BigEndian.PutUint32(header[1:], uint32(len(e.buf)+e.aead.Overhead()))
+	out = append(out, header...)
+	out = e.aead.Seal(out, chunkNonce(e.aead, e.counter, flag), e.buf, nil)
+
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(out)
+	return err
+}
+
+// NewDecryptReader returns a reader of the compressed stream of an object written by an encrypted GzipWriter,
+// wrappedKey is the base64 encoded encryption_key metadata of the object
+func NewDecryptReader(r io.Reader, k KeyWrapper, wrappedKey string) (io.Reader, error) {
+	wrapped, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := k.Unwrap(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unwrap data key: %s", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(encryptionMagic))
+	if _, err = io.ReadFull(br, magic); err != nil || string(magic) != encryptionMagic {
+		return nil, errors.New("not an encrypted stream")
+	}
+	return &decrypter{r: br, aead: aead}, nil
+}
+
+type decrypter struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	final   bool
+}
+
+func (d *decrypter) Read(b []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.final {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decrypter) open() error {
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errTruncated
+		}
+		return err
+	}
+	flag, size := header[0], binary.BigEndian.Uint32(header[1:])
+	if size > encryptionChunkSize+uint32(d.aead.Overhead()) {
+		return errors.New("encrypted chunk is too large")
+	}
+
+	ciphertext := make([]byte, size)
+	if _, err := io.ReadFull(d.r, ciphertext); err != nil {
+		return errTruncated
+	}
+	plaintext, err := d.aead.Open(ciphertext[:0], chunkNonce(d.aead, d.counter, flag), ciphertext, nil)
+	if err != nil {
+		return fmt.Errorf("cannot decrypt chunk %d: %s", d.counter, err)
+	}
+	d.counter++
+	d.buf = plaintext
+	d.final = flag == finalChunk
+	return nil
+}
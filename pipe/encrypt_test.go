@@ -0,0 +1,154 @@
+package pipe
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func writeKeyFile(t *testing.T, content []byte) string {
+	file, err := ioutil.TempFile("", "master.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	return file.Name()
+}
+
+func newTestKeyWrapper(t *testing.T, b byte) KeyWrapper {
+	path := writeKeyFile(t, bytes.Repeat([]byte{b}, dataKeySize))
+	defer os.Remove(path)
+	k, err := NewLocalKeyWrapper(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// encrypt writes the data through an encrypted pipe and returns the stored object and its metadata
+func encrypt(t *testing.T, k KeyWrapper, data []byte) ([]byte, map[string]string) {
+	p, metadata, err := NewEncryptedGzipWriter(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if _, err := p.Write(data); err != nil {
+			t.Errorf("write: %v", err)
+		}
+		p.Close()
+	}()
+	object, err := ioutil.ReadAll(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return object, metadata
+}
+
+func TestNewLocalKeyWrapper(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, dataKeySize)
+	tests := []struct {
+		name    string
+		content []byte
+		wantErr bool
+	}{
+		{"raw", key, false},
+		{"hex", []byte(hex.EncodeToString(key) + "\n"), false},
+		{"base64", []byte(base64.StdEncoding.EncodeToString(key) + "\n"), false},
+		{"too short", []byte("short"), true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			path := writeKeyFile(t, test.content)
+			defer os.Remove(path)
+
+			k, err := NewLocalKeyWrapper(path)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("NewLocalKeyWrapper() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(k.KeyID(), "local:") {
+				t.Errorf("KeyID() = %v", k.KeyID())
+			}
+			wrapped, err := k.Wrap([]byte("data key"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unwrapped, err := k.Unwrap(wrapped); err != nil || string(unwrapped) != "data key" {
+				t.Errorf("Unwrap() = %s, %v", unwrapped, err)
+			}
+		})
+	}
+
+	if _, err := NewLocalKeyWrapper("/does/not/exist"); err == nil {
+		t.Error("expected an error for a missing keyfile")
+	}
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	k := newTestKeyWrapper(t, 1)
+	data := bytes.Repeat([]byte(`{"message":"hello"}`+"\n"), 10000)
+
+	object, metadata := encrypt(t, k, data)
+	if metadata[MetadataKeyID] != k.KeyID() || metadata[MetadataAlgorithm] != EncryptionAlgorithm {
+		t.Errorf("unexpected metadata %v", metadata)
+	}
+	if bytes.Contains(object, []byte("hello")) {
+		t.Error("object is not encrypted")
+	}
+
+	r, err := NewDecryptReader(bytes.NewReader(object), k, metadata[MetadataKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, append(data, '\n')) {
+		t.Errorf("decrypted %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestNewDecryptReader_errors(t *testing.T) {
+	k := newTestKeyWrapper(t, 1)
+	object, metadata := encrypt(t, k, bytes.Repeat([]byte("a"), 3*encryptionChunkSize))
+
+	tests := []struct {
+		name   string
+		k      KeyWrapper
+		object []byte
+	}{
+		{"wrong key", newTestKeyWrapper(t, 2), object},
+		{"not encrypted", k, []byte("plain text")},
+		{"truncated", k, object[:len(object)/2]},
+		{"final chunk dropped", k, object[:len(object)-encryptionHeaderSize-k.(*localKeyWrapper).aead.Overhead()-1]},
+		{"tampered", k, append(append([]byte{}, object[:20]...), append([]byte{object[20] ^ 1}, object[21:]...)...)},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			r, err := NewDecryptReader(bytes.NewReader(test.object), test.k, metadata[MetadataKey])
+			if err == nil {
+				_, err = ioutil.ReadAll(r)
+			}
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var newLineBytes = []byte("\n")
@@ -16,14 +19,108 @@ type GzipWriter interface {
 
 func NewGzipWriter() GzipWriter {
 	r, w := io.Pipe()
-	gw := gzip.NewWriter(w)
-	return &pipe{r, w, gw}
+	cw := &countingWriter{w: w}
+	return &pipe{r: r, w: w, cw: cw, gw: gzip.NewWriter(cw), closed: make(chan struct{}), commits: make(chan struct{})}
+}
+
+// AutoFlush ends the current gzip member of the pipe every interval and once size uncompressed bytes have been
+// written to it, so every member can be decompressed on its own and a truncated stream is still mostly readable.
+// A zero interval or size disables that trigger
+func AutoFlush(w GzipWriter, interval time.Duration, size int) {
+	p, ok := w.(*pipe)
+	if !ok {
+		return
+	}
+	p.mutex.Lock()
+	p.flushSize = size
+	p.mutex.Unlock()
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.closed:
+				return
+			case <-ticker.C:
+				if err := p.Flush(); err != nil {
+					fmt.Println("Got error when flushing gzip writer stream ", err)
+				}
+			}
+		}
+	}()
+}
+
+// RequireDurable makes the backends of the pipe commit the stream as soon as they can, so Sync returns quickly
+func RequireDurable(w GzipWriter) {
+	if p, ok := w.(*pipe); ok {
+		atomic.StoreInt32(&p.durable, 1)
+	}
+}
+
+// GroupSyncs makes Sync end the gzip member at most once per interval for every request waiting within it, rather
+// than once per request, so synced requests do not each add a member to the stream
+func GroupSyncs(w GzipWriter, interval time.Duration) {
+	if p, ok := w.(*pipe); ok {
+		p.syncMutex.Lock()
+		p.syncInterval = interval
+		p.syncMutex.Unlock()
+	}
+}
+
+// CloseWithError closes a pipe whose reader has failed, the writes to it return the error rather than blocking as
+// nothing reads the pipe anymore
+func CloseWithError(w GzipWriter, err error) {
+	p, ok := w.(*pipe)
+	if !ok {
+		w.Close()
+		return
+	}
+	p.r.CloseWithError(err)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	select {
+	case <-p.closed:
+	default:
+		close(p.closed)
+	}
 }
 
 type pipe struct {
-	r  *io.PipeReader
-	w  *io.PipeWriter
-	gw *gzip.Writer
+	// messages, boundary, committed and durable are accessed atomically and kept first for alignment
+	messages  int64
+	boundary  int64
+	committed int64
+	durable   int32
+	r         *io.PipeReader
+	w         *io.PipeWriter
+	cw        *countingWriter
+	gw        *gzip.Writer
+	enc       *encrypter
+	mutex     sync.Mutex
+	dirty     bool
+	// unflushed is the number of bytes written to the current member, which is ended once it reaches flushSize
+	unflushed int
+	flushSize int
+	closed    chan struct{}
+	// commits is closed and replaced each time the committed offset moves
+	commitMutex sync.Mutex
+	commits     chan struct{}
+	// group is the flush the next Sync waits for, it is started by the first Sync after the previous flush
+	syncMutex    sync.Mutex
+	syncInterval time.Duration
+	group        *syncGroup
+}
+
+// syncGroup is a flush shared by the Sync calls of an interval, done is closed once the member has ended
+type syncGroup struct {
+	done     chan struct{}
+	messages int64
+	offset   int64
+	err      error
 }
 
 func (p *pipe) Read(b []byte) (int, error) {
@@ -31,18 +128,178 @@ func (p *pipe) Read(b []byte) (int, error) {
 }
 
 func (p *pipe) Write(b []byte) (n int, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.dirty = true
 	n, err = p.gw.Write(b)
 	if err != nil {
 		return
 	}
-	return p.gw.Write(newLineBytes)
+	atomic.AddInt64(&p.messages, 1)
+	if n, err = p.gw.Write(newLineBytes); err != nil {
+		return
+	}
+	p.unflushed += len(b) + len(newLineBytes)
+	if p.flushSize > 0 && p.unflushed >= p.flushSize {
+		err = p.flush()
+	}
+	return
 }
 
-func (p *pipe) Close() {
+// Sync ends the gzip member and waits until the stream has been committed past it or the timeout has passed. It
+// returns the number of messages written to the pipe before the member ended and whether they were committed.
+// The member is ended for every Sync waiting within the interval of GroupSyncs
+func (p *pipe) Sync(timeout time.Duration) (messages int64, committed bool, err error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	g := p.syncGroup()
+	select {
+	case <-g.done:
+	case <-timer.C:
+		return p.Messages(), false, nil
+	}
+	messages, offset := g.messages, g.offset
+	if g.err != nil {
+		return messages, false, g.err
+	}
+
+	for {
+		p.commitMutex.Lock()
+		commits := p.commits
+		p.commitMutex.Unlock()
+		if atomic.LoadInt64(&p.committed) >= offset {
+			return messages, true, nil
+		}
+		select {
+		case <-commits:
+		case <-timer.C:
+			return messages, false, nil
+		}
+	}
+}
+
+// syncGroup returns the flush of the current interval, starting one if there is none
+func (p *pipe) syncGroup() *syncGroup {
+	p.syncMutex.Lock()
+	defer p.syncMutex.Unlock()
+	if p.group != nil {
+		return p.group
+	}
+	g := &syncGroup{done: make(chan struct{})}
+	p.group = g
+	time.AfterFunc(p.syncInterval, func() {
+		// later calls start the next flush, as their messages may be written after this one
+		p.syncMutex.Lock()
+		p.group = nil
+		p.syncMutex.Unlock()
+
+		p.mutex.Lock()
+		g.err = p.flush()
+		g.messages, g.offset = p.Messages(), p.cw.written()
+		p.mutex.Unlock()
+		close(g.done)
+	})
+	return g
+}
+
+// Commit is called by the storage backend once the stream is stored up to the offset
+func (p *pipe) Commit(offset int64) {
+	p.commitMutex.Lock()
+	defer p.commitMutex.Unlock()
+	if offset <= atomic.LoadInt64(&p.committed) {
+		return
+	}
+	atomic.StoreInt64(&p.committed, offset)
+	close(p.commits)
+	p.commits = make(chan struct{})
+}
+
+// Durable returns true if the backends should store the stream as it is read where they can, e.g. by syncing
+// files, as writers wait for it to be committed
+func (p *pipe) Durable() bool {
+	return atomic.LoadInt32(&p.durable) == 1
+}
+
+// Messages returns the number of messages written to the pipe
+func (p *pipe) Messages() int64 {
+	return atomic.LoadInt64(&p.messages)
+}
+
+// Flush ends the current gzip member so everything written so far can be decompressed on its own, the next
+// write starts a new member. It blocks until the member has been read from the pipe
+func (p *pipe) Flush() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.flush()
+}
+
+func (p *pipe) flush() error {
+	if !p.dirty {
+		return nil
+	}
 	if err := p.gw.Close(); err != nil {
-		fmt.Println("Got error when closing gzip writer stream ", err)
+		return err
+	}
+	if p.enc != nil {
+		if err := p.enc.Flush(); err != nil {
+			return err
+		}
+		p.gw.Reset(p.enc)
+	} else {
+		p.gw.Reset(p.cw)
+	}
+	p.dirty = false
+	p.unflushed = 0
+	atomic.StoreInt64(&p.boundary, p.cw.written())
+	return nil
+}
+
+// Boundary returns the offset in the stream at which the last flushed gzip member ends
+func (p *pipe) Boundary() int64 {
+	return atomic.LoadInt64(&p.boundary)
+}
+
+func (p *pipe) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// do not end the stream with an empty member if everything has been flushed
+	if p.dirty || p.Boundary() == 0 {
+		if err := p.gw.Close(); err != nil {
+			fmt.Println("Got error when closing gzip writer stream ", err)
+		}
+	}
+	if p.enc != nil {
+		if err := p.enc.Close(); err != nil {
+			fmt.Println("Got error when closing encryption stream ", err)
+		}
+	}
+	p.dirty = false
+	atomic.StoreInt64(&p.boundary, p.cw.written())
+	select {
+	case <-p.closed:
+	default:
+		close(p.closed)
 	}
 	if err := p.w.Close(); err != nil {
 		fmt.Println("Got error when closing writer stream ", err)
 	}
 }
+
+// countingWriter counts the bytes written to the pipe
+type countingWriter struct {
+	n int64
+	w io.Writer
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (c *countingWriter) written() int64 {
+	return atomic.LoadInt64(&c.n)
+}
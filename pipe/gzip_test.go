@@ -1,7 +1,13 @@
 package pipe
 
 import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestRoundTrip(t *testing.T) {
@@ -24,3 +30,207 @@ func TestRoundTrip(t *testing.T) {
 	}
 	// TODO gunzip and check output
 }
+
+func TestMessages(t *testing.T) {
+	p := NewGzipWriter()
+	go func() {
+		p.Write([]byte("a"))
+		p.Write([]byte("b"))
+		p.Close()
+	}()
+	if _, err := ioutil.ReadAll(p); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.(*pipe).Messages(); got != 2 {
+		t.Errorf("Messages() = %d, want 2", got)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	p := NewGzipWriter()
+	boundaries := make(chan int64, 2)
+	go func() {
+		p.Write([]byte("a"))
+		p.(*pipe).Flush()
+		boundaries <- p.(*pipe).Boundary()
+		p.(*pipe).Flush()
+		boundaries <- p.(*pipe).Boundary()
+		p.Write([]byte("b"))
+		p.Close()
+	}()
+	content, err := ioutil.ReadAll(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := <-boundaries, <-boundaries
+	if first == 0 || first != second {
+		t.Fatalf("boundaries = %d %d, flushing without writes must not start a member", first, second)
+	}
+	for _, member := range []struct {
+		data []byte
+		want string
+	}{{content[:first], "a\n"}, {content, "a\nb\n"}} {
+		r, err := gzip.NewReader(bytes.NewReader(member.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil || string(got) != member.want {
+			t.Errorf("got %q %v, want %q", got, err, member.want)
+		}
+	}
+}
+
+func TestAutoFlush(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		size     int
+	}{
+		{"size", 0, 4},
+		{"interval", time.Millisecond, 0},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			p := NewGzipWriter()
+			AutoFlush(p, test.interval, test.size)
+			go func() {
+				p.Write([]byte("abc"))
+				time.Sleep(20 * time.Millisecond)
+				p.Write([]byte("def"))
+				p.Close()
+			}()
+			content, err := ioutil.ReadAll(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			boundary := p.(*pipe).Boundary()
+			r, err := gzip.NewReader(bytes.NewReader(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Multistream(false)
+			first, err := ioutil.ReadAll(r)
+			if err != nil || string(first) != "abc\n" {
+				t.Errorf("first member = %q %v, want %q", first, err, "abc\n")
+			}
+			if boundary != int64(len(content)) {
+				t.Errorf("Boundary() = %d, want %d", boundary, len(content))
+			}
+		})
+	}
+}
+
+func TestSync(t *testing.T) {
+	tests := []struct {
+		name          string
+		durable       bool
+		wantCommitted bool
+	}{
+		{"committed", true, true},
+		{"times out", false, false},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			p := NewGzipWriter().(*pipe)
+			if test.durable {
+				RequireDurable(p)
+			}
+			read := make(chan []byte)
+			go func() {
+				// a backend committing what it read if the pipe is durable
+				var content []byte
+				buf := make([]byte, 64)
+				for {
+					n, err := p.Read(buf)
+					content = append(content, buf[:n]...)
+					if n > 0 && p.Durable() {
+						p.Commit(int64(len(content)))
+					}
+					if err != nil {
+						read <- content
+						return
+					}
+				}
+			}()
+
+			p.Write([]byte("a"))
+			p.Write([]byte("b"))
+			messages, committed, err := p.Sync(100 * time.Millisecond)
+			if err != nil || messages != 2 || committed != test.wantCommitted {
+				t.Errorf("Sync() = %d, %v, %v, want 2, %v", messages, committed, err, test.wantCommitted)
+			}
+			// nothing was written since, so the stream is committed already
+			if _, committed, _ := p.Sync(time.Millisecond); committed != test.wantCommitted {
+				t.Errorf("Sync() committed = %v, want %v", committed, test.wantCommitted)
+			}
+			p.Close()
+
+			r, err := gzip.NewReader(bytes.NewReader(<-read))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := ioutil.ReadAll(r); err != nil || string(got) != "a\nb\n" {
+				t.Errorf("got %q %v, want %q", got, err, "a\nb\n")
+			}
+		})
+	}
+}
+
+func TestGroupSyncs(t *testing.T) {
+	p := NewGzipWriter().(*pipe)
+	RequireDurable(p)
+	GroupSyncs(p, 50*time.Millisecond)
+	read := make(chan []byte)
+	go func() {
+		// a backend committing what it read
+		var content []byte
+		buf := make([]byte, 64)
+		for {
+			n, err := p.Read(buf)
+			content = append(content, buf[:n]...)
+			p.Commit(int64(len(content)))
+			if err != nil {
+				read <- content
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Write([]byte("a"))
+			if _, committed, err := p.Sync(time.Second); err != nil || !committed {
+				t.Errorf("Sync() = %v, %v", committed, err)
+			}
+		}()
+	}
+	wg.Wait()
+	p.Close()
+
+	// the requests synced within the interval end a single member
+	content := bytes.NewReader(<-read)
+	r, err := gzip.NewReader(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	members := 0
+	for err == nil {
+		r.Multistream(false)
+		if _, err := ioutil.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+		members++
+		err = r.Reset(content)
+	}
+	if err != io.EOF || members != 1 {
+		t.Errorf("synced requests ended %d members, %v, want 1", members, err)
+	}
+}
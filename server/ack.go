@@ -0,0 +1,126 @@
+package server
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	ackMode        = "ACK_MODE"
+	ackModeAsync   = "async"
+	ackModeSync    = "sync"
+	syncAckTimeout = "SYNC_ACK_TIMEOUT"
+	syncInterval   = "SYNC_ACK_INTERVAL"
+	azureBlobType  = "AZURE_BLOB_TYPE"
+	blobTypeAppend = "append"
+
+	defaultSyncAckTimeout = 30 * time.Second
+	defaultSyncInterval   = 50 * time.Millisecond
+)
+
+// syncer is implemented by pipes which report when the messages written to them have been stored
+type syncer interface {
+	Sync(timeout time.Duration) (messages int64, committed bool, err error)
+}
+
+// newAckTimeout returns how long requests wait for their messages to be stored if ACK_MODE is sync, or 0 if
+// requests are acknowledged once their messages are written to the pipe
+func newAckTimeout() time.Duration {
+	switch mode := os.Getenv(ackMode); mode {
+	case "", ackModeAsync:
+		return 0
+	case ackModeSync:
+	default:
+		logFatalf("%s must be %s or %s", ackMode, ackModeAsync, ackModeSync)
+		return 0
+	}
+	timeout := defaultSyncAckTimeout
+	if value := os.Getenv(syncAckTimeout); value != "" {
+		var err error
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+			logFatalf("%s must be a positive duration e.g. 30s", syncAckTimeout)
+		}
+	}
+	requireCommits()
+	return timeout
+}
+
+// newSyncInterval returns how long the first synced request of a partition waits for others before the gzip member
+// is ended for all of them
+func newSyncInterval() time.Duration {
+	interval := defaultSyncInterval
+	if value := os.Getenv(syncInterval); value != "" {
+		var err error
+		if interval, err = time.ParseDuration(value); err != nil || interval < 0 {
+			logFatalf("%s must be a duration e.g. 50ms", syncInterval)
+		}
+	}
+	return interval
+}
+
+// requireCommits fails for STORAGE_TYPE backends which only commit once the stream ends, as every request would
+// time out. A failover spool does not commit as it is a temporary file which is lost if the server stops
+func requireCommits() {
+	for _, name := range strings.Split(os.Getenv(storageType), ",") {
+		switch strings.TrimSpace(name) {
+		case "", storageS3:
+			logFatalf("%s=%s is not supported by S3 as uploads are only committed once the stream ends", ackMode,
+				ackModeSync)
+		case storageAzure:
+			if os.Getenv(azureBlobType) != blobTypeAppend {
+				logFatalf("%s=%s requires %s=%s as block blobs are only committed once the stream ends", ackMode,
+					ackModeSync, azureBlobType, blobTypeAppend)
+			}
+		}
+	}
+}
+
+// commit waits until the messages are stored in the pipes they were written to or the ack timeout has passed. It
+// returns the number of messages stored in each partition, which a client can resume after. Duplicates of stored
+// messages were not written and are not waited for
+func (s *server) commit(writes []written) (offsets map[string]int64, committed bool) {
+	deadline := time.Now().Add(s.ackTimeout)
+	offsets = map[string]int64{}
+	committed = true
+	for _, w := range writes {
+		if w.dataPipe == nil {
+			continue
+		}
+		p, ok := w.dataPipe.(syncer)
+		if !ok {
+			committed = false
+			continue
+		}
+		messages, ok, err := p.Sync(time.Until(deadline))
+		if err != nil || !ok {
+			committed = false
+			continue
+		}
+		offsets[w.partition] = messages
+	}
+	if !committed {
+		metrics.Add(metricAckTimeout, 1)
+	}
+	return offsets, committed
+}
+
+// respondCommitted waits for the written messages to be stored. It responds with their offsets once they are, or
+// with 202 Accepted if they are not stored within the ack timeout and may be lost if the server stops
+func (s *server) respondCommitted(ctx *fasthttp.RequestCtx, writes []written) {
+	offsets, committed := s.commit(writes)
+	if !committed {
+		ctx.SetStatusCode(fasthttp.StatusAccepted)
+		return
+	}
+	body, err := json.Marshal(struct {
+		Offsets map[string]int64 `json:"offsets"`
+	}{offsets})
+	if err != nil {
+		return
+	}
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"errors"
+	"fasthttp-server/mocks"
+	"fasthttp-server/pipe"
+	"fasthttp-server/storage"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_newAckTimeout(t *testing.T) {
+	tests := []struct {
+		name            string
+		env             map[string]string
+		want            time.Duration
+		shouldCallFatal bool
+	}{
+		{"async by default", map[string]string{}, 0, false},
+		{"async", map[string]string{ackMode: ackModeAsync, syncAckTimeout: "5s"}, 0, false},
+		{"sync", map[string]string{ackMode: ackModeSync, storageType: "local,kafka"}, defaultSyncAckTimeout, false},
+		{"sync timeout", map[string]string{ackMode: ackModeSync, storageType: storageLocal, syncAckTimeout: "5s"}, 5 * time.Second, false},
+		{"sync with append blobs", map[string]string{ackMode: ackModeSync, storageType: storageAzure, azureBlobType: blobTypeAppend},
+			defaultSyncAckTimeout, false},
+		{"should call fatal for s3 with a failover spool", map[string]string{ackMode: ackModeSync, failoverStorageType: storageLocal},
+			defaultSyncAckTimeout, true},
+		{"should call fatal for invalid modes", map[string]string{ackMode: "later"}, 0, true},
+		{"should call fatal for invalid timeouts", map[string]string{ackMode: ackModeSync, storageType: storageLocal, syncAckTimeout: "5"},
+			0, true},
+		{"should call fatal for s3", map[string]string{ackMode: ackModeSync}, defaultSyncAckTimeout, true},
+		{"should call fatal for block blobs", map[string]string{ackMode: ackModeSync, storageType: "local,azure"}, defaultSyncAckTimeout, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				os.Setenv(name, value)
+			}
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				for name := range test.env {
+					os.Unsetenv(name)
+				}
+			}()
+
+			if got := newAckTimeout(); got != test.want {
+				t.Errorf("newAckTimeout() = %v, want %v", got, test.want)
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+func Test_newSyncInterval(t *testing.T) {
+	tests := []struct {
+		name            string
+		interval        string
+		want            time.Duration
+		shouldCallFatal bool
+	}{
+		{"default", "", defaultSyncInterval, false},
+		{"interval", "10ms", 10 * time.Millisecond, false},
+		{"no grouping", "0s", 0, false},
+		{"should call fatal for invalid intervals", "10", 0, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv(syncInterval, test.interval)
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				os.Unsetenv(syncInterval)
+			}()
+
+			if got := newSyncInterval(); got != test.want {
+				t.Errorf("newSyncInterval() = %v, want %v", got, test.want)
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+// committingStreamer reads the stream and commits what it has read if commits is set and the stream is durable
+type committingStreamer struct {
+	commits bool
+}
+
+func (c *committingStreamer) Stream(reader io.Reader) error {
+	committer, _ := reader.(interface {
+		Commit(offset int64)
+		Durable() bool
+	})
+	var read int64
+	buf := make([]byte, 1024)
+	for {
+		n, err := reader.Read(buf)
+		read += int64(n)
+		if n > 0 && c.commits && committer != nil && committer.Durable() {
+			committer.Commit(read)
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+func (c *committingStreamer) Wait() {}
+
+func Test_server_requestHandler_syncAck(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		commits     bool
+		wantStatus  int
+		wantBody    string
+		wantTimeout int64
+	}{
+		{"messages", "", `{"client_id":1}`, true, fasthttp.StatusOK, `{"offsets":{"1":1}}`, 0},
+		{"batches", ndjsonContentType, "{\"client_id\":1}\n{\"client_id\":2}\n{\"client_id\":1}", true, fasthttp.StatusOK,
+			`{"offsets":{"1":2,"2":1}}`, 0},
+		{"invalid lines of batches", ndjsonContentType, "{\"client_id\":1}\n{\"client_id\":42}", true,
+			fasthttp.StatusUnprocessableEntity, `{"errors":["line 2: (root): text is required"]}`, 0},
+		{"messages which are not committed", "", `{"client_id":1}`, false, fasthttp.StatusAccepted, "", 1},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv(schemaDir, writeSchemas(t, map[string]string{"42.json": testSchema}))
+			defer os.Unsetenv(schemaDir)
+			streamer := &committingStreamer{commits: test.commits}
+			s3New = func(storage.Object, int, int) storage.MessageStreamer {
+				return streamer
+			}
+			defer func() {
+				s3New = storage.NewS3Streamer
+			}()
+
+			s := &server{
+				dataPipes:   map[string]pipe.GzipWriter{},
+				streamers:   map[string]storage.MessageStreamer{},
+				router:      newRouter(),
+				pipes:       &pipeFactory{},
+				validator:   newValidator(),
+				redactor:    newRedactor(),
+				enricher:    newEnricher(),
+				deadLetters: newDeadLetters(&pipeFactory{}),
+				decoder:     newDecoder(),
+				ackTimeout:  100 * time.Millisecond,
+			}
+			defer func() {
+				for _, dataPipe := range s.dataPipes {
+					dataPipe.Close()
+				}
+			}()
+			before := counter(metricAckTimeout)
+			var ctx fasthttp.RequestCtx
+			ctx.Request.Header.SetMethod("POST")
+			ctx.Request.Header.SetContentType(test.contentType)
+			ctx.Request.SetBodyString(test.body)
+			s.requestHandler(&ctx)
+
+			if ctx.Response.StatusCode() != test.wantStatus {
+				t.Errorf("unexpected status code: %d. Expecting %d", ctx.Response.StatusCode(), test.wantStatus)
+			}
+			if test.wantBody != "" && string(ctx.Response.Body()) != test.wantBody {
+				t.Errorf("body = %s, want %s", ctx.Response.Body(), test.wantBody)
+			}
+			if counter(metricAckTimeout) != before+test.wantTimeout {
+				t.Errorf("%s = %d, want %d", metricAckTimeout, counter(metricAckTimeout), before+test.wantTimeout)
+			}
+		})
+	}
+}
+
+func Test_server_commit(t *testing.T) {
+	s := &server{ackTimeout: 50 * time.Millisecond}
+
+	// the stream of the pipe failed after the message was written, and the pipe of the partition was replaced
+	failed := pipe.NewGzipWriter()
+	go io.Copy(ioutil.Discard, failed)
+	if _, err := failed.Write([]byte(`{"client_id":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	pipe.CloseWithError(failed, errors.New("stream failed"))
+	if offsets, committed := s.commit([]written{{"1", failed}}); committed || len(offsets) != 0 {
+		t.Errorf("commit() = %v, %v, want not committed", offsets, committed)
+	}
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	if _, committed := s.commit([]written{{"1", mocks.NewMockGzipWriter(mockCtrl)}}); committed {
+		t.Error("pipes which cannot sync should not be committed")
+	}
+
+	if offsets, committed := s.commit([]written{{partition: "1"}}); !committed || len(offsets) != 0 {
+		t.Errorf("commit() of duplicates = %v, %v, want committed", offsets, committed)
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fasthttp-server/pipe"
+	"fasthttp-server/storage"
+	"log"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	deadLetterTemplate        = "DEAD_LETTER_KEY_TEMPLATE"
+	deadLetterPartition       = "dead-letter"
+	defaultDeadLetterTemplate = "dead-letter/{date}/rejected_{date}_{instance}_{seq}.{ext}"
+)
+
+// rejection is the dead letter record of a rejected message, payloads which are not valid UTF-8
+// are stored base64 encoded in payload_base64 so they can be replayed byte for byte
+type rejection struct {
+	Reason        string    `json:"reason"`
+	ReceivedAt    time.Time `json:"received_at"`
+	RemoteAddr    string    `json:"remote_addr"`
+	Payload       string    `json:"payload,omitempty"`
+	PayloadBase64 []byte    `json:"payload_base64,omitempty"`
+}
+
+// deadLetters streams rejected messages to a dedicated object or blob per day
+type deadLetters struct {
+	mutex     sync.Mutex
+	template  storage.KeyTemplate
+	pipes     *pipeFactory
+	date      string
+	dataPipe  pipe.GzipWriter
+	streamers []storage.MessageStreamer
+}
+
+func newDeadLetters(pipes *pipeFactory) *deadLetters {
+	d := &deadLetters{template: defaultDeadLetterTemplate, pipes: pipes}
+	if template := os.Getenv(deadLetterTemplate); template != "" {
+		d.template = storage.KeyTemplate(template)
+		if err := d.template.Validate(); err != nil {
+			logFatalf("Invalid key template in %s: %s", deadLetterTemplate, err)
+		}
+	}
+	return d
+}
+
+func (d *deadLetters) reject(payload []byte, reason, remoteAddr string, received time.Time) {
+	record := rejection{
+		Reason:     reason,
+		ReceivedAt: received,
+		RemoteAddr: remoteAddr,
+	}
+	if utf8.Valid(payload) {
+		record.Payload = string(payload)
+	} else {
+		record.PayloadBase64 = payload
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Println("Error encoding dead letter: ", err)
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// start a new object when the day changes, closing the pipe finishes the previous upload
+	date := received.Format("2006-01-02")
+	if d.dataPipe != nil && d.date != date {
+		d.dataPipe.Close()
+		d.dataPipe = nil
+	}
+	if d.dataPipe == nil {
+		object := storage.Object{
+			Partition: deadLetterPartition,
+			Created:   received,
+			Template:  d.template,
+		}
+		object.Sequence = storage.NextSequence(object)
+		if d.dataPipe, err = d.pipes.newPipe(&object); err != nil {
+			log.Println("Error creating dead letter pipe: ", err)
+			return
+		}
+		d.date = date
+		streamer := getStreamer(object)
+		d.streamers = append(d.streamers, streamer)
+		go d.stream(d.dataPipe, streamer)
+	}
+
+	if _, err = d.dataPipe.Write(line); err != nil {
+		log.Println("Error when writing dead letter: ", err)
+	}
+}
+
+// stream streams the pipe to the backend, a pipe whose stream fails is closed and replaced by the next rejection
+func (d *deadLetters) stream(dataPipe pipe.GzipWriter, streamer storage.MessageStreamer) {
+	err := streamer.Stream(dataPipe)
+	if err == nil {
+		return
+	}
+	log.Println("Error when streaming dead letters", err)
+	pipe.CloseWithError(dataPipe, err)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.dataPipe == dataPipe {
+		d.dataPipe = nil
+	}
+}
+
+func (d *deadLetters) Close() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.dataPipe != nil {
+		d.dataPipe.Close()
+		d.dataPipe = nil
+	}
+	for _, stream := range d.streamers {
+		stream.Wait()
+	}
+	d.streamers = nil
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fasthttp-server/mocks"
+	"fasthttp-server/pipe"
+	"fasthttp-server/storage"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+func Test_newDeadLetters(t *testing.T) {
+	if got := newDeadLetters(&pipeFactory{}); got.template != defaultDeadLetterTemplate {
+		t.Errorf("wanted %v but got %v", defaultDeadLetterTemplate, got.template)
+	}
+
+	fatal := false
+	logFatalf = func(format string, args ...interface{}) {
+		fatal = true
+	}
+	os.Setenv(deadLetterTemplate, "bad/{template")
+	defer func() {
+		logFatalf = log.Fatalf
+		os.Unsetenv(deadLetterTemplate)
+	}()
+
+	newDeadLetters(&pipeFactory{})
+	if !fatal {
+		t.Error("expected fatal for an invalid template")
+	}
+}
+
+func Test_deadLetters_reject(t *testing.T) {
+	day := time.Date(2026, 10, 18, 23, 59, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		payload  []byte
+		received []time.Time
+		want     []string
+		streams  int
+	}{
+		{"writes a record with the rejection reason", []byte("{"), []time.Time{day},
+			[]string{`{"reason":"bad","received_at":"2026-10-18T23:59:00Z","remote_addr":"1.2.3.4:5","payload":"{"}`}, 1},
+		{"encodes invalid UTF-8 payloads as base64", []byte{0xff, 0xfe}, []time.Time{day},
+			[]string{`{"reason":"bad","received_at":"2026-10-18T23:59:00Z","remote_addr":"1.2.3.4:5","payload_base64":"//4="}`}, 1},
+		{"starts a new object every day", []byte("x"), []time.Time{day, day.Add(time.Minute)},
+			[]string{
+				`{"reason":"bad","received_at":"2026-10-18T23:59:00Z","remote_addr":"1.2.3.4:5","payload":"x"}`,
+				`{"reason":"bad","received_at":"2026-10-19T00:00:00Z","remote_addr":"1.2.3.4:5","payload":"x"}`,
+			}, 2},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			mockPipe := mocks.NewMockGzipWriter(mockCtrl)
+			mockStreamer := mocks.NewMockMessageStreamer(mockCtrl)
+
+			var written []string
+			mockPipe.EXPECT().Write(gomock.Any()).Times(len(test.want)).DoAndReturn(func(p []byte) (int, error) {
+				written = append(written, string(p))
+				return len(p), nil
+			})
+			mockPipe.EXPECT().Close().Times(test.streams)
+			var streaming sync.WaitGroup
+			streaming.Add(test.streams)
+			mockStreamer.EXPECT().Stream(gomock.Any()).Times(test.streams).Do(func(io.Reader) {
+				streaming.Done()
+			})
+			mockStreamer.EXPECT().Wait().Times(test.streams)
+
+			var objects []storage.Object
+			pipeNew = func() pipe.GzipWriter {
+				return mockPipe
+			}
+			s3New = func(o storage.Object, _, _ int) storage.MessageStreamer {
+				objects = append(objects, o)
+				return mockStreamer
+			}
+			defer func() {
+				s3New = storage.NewS3Streamer
+				pipeNew = pipe.NewGzipWriter
+			}()
+
+			d := newDeadLetters(&pipeFactory{})
+			for _, received := range test.received {
+				d.reject(test.payload, "bad", "1.2.3.4:5", received)
+			}
+			d.Close()
+			streaming.Wait()
+
+			for i, want := range test.want {
+				if written[i] != want {
+					t.Errorf("wanted %v but got %v", want, written[i])
+				}
+			}
+			for _, o := range objects {
+				if o.Partition != deadLetterPartition || o.Template != defaultDeadLetterTemplate {
+					t.Errorf("unexpected dead letter object %v", o)
+				}
+			}
+
+			mockCtrl.Finish()
+		})
+	}
+}
+
+// capturedDeadLetters returns dead letters which record the reasons of the rejections instead of streaming them
+func capturedDeadLetters(t *testing.T) (*deadLetters, func() []string) {
+	mockCtrl := gomock.NewController(t)
+	t.Cleanup(mockCtrl.Finish)
+	mockPipe := mocks.NewMockGzipWriter(mockCtrl)
+	mockStreamer := mocks.NewMockMessageStreamer(mockCtrl)
+	var mutex sync.Mutex
+	var reasons []string
+	mockPipe.EXPECT().Write(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+		var record rejection
+		if err := json.Unmarshal(p, &record); err != nil {
+			t.Error(err)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		reasons = append(reasons, record.Reason)
+		return len(p), nil
+	}).AnyTimes()
+	mockStreamer.EXPECT().Stream(gomock.Any()).AnyTimes()
+	pipeNew = func() pipe.GzipWriter {
+		return mockPipe
+	}
+	s3New = func(storage.Object, int, int) storage.MessageStreamer {
+		return mockStreamer
+	}
+	t.Cleanup(func() {
+		s3New = storage.NewS3Streamer
+		pipeNew = pipe.NewGzipWriter
+	})
+
+	return newDeadLetters(&pipeFactory{}), func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), reasons...)
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	maxDecompressedSize        = "MAX_DECOMPRESSED_SIZE"
+	defaultMaxDecompressedSize = 10 * 1024 * 1024
+
+	ndjsonContentType = "application/x-ndjson"
+
+	// zstdMaxWindowSize is the largest window a zstd body may use, the size decoders are required to support
+	zstdMaxWindowSize = 8 * 1024 * 1024
+)
+
+var errTooLarge = errors.New("decompressed body is too large")
+
+// decodeError is returned by decode with the status the request should be responded to with
+type decodeError struct {
+	status int
+	err    error
+}
+
+func (e *decodeError) Error() string {
+	return e.err.Error()
+}
+
+// decoder decompresses request bodies, a body is read up to maxSize bytes so a small body cannot expand to fill
+// the memory of the server
+type decoder struct {
+	maxSize int
+}
+
+func newDecoder() *decoder {
+	d := &decoder{maxSize: defaultMaxDecompressedSize}
+	if size := os.Getenv(maxDecompressedSize); size != "" {
+		var err error
+		if d.maxSize, err = strconv.Atoi(size); err != nil || d.maxSize <= 0 {
+			logFatalf("%s must be a positive number of bytes", maxDecompressedSize)
+		}
+	}
+	return d
+}
+
+// decode returns the body of the request decoded with its Content-Encoding, encodings can be combined e.g.
+// `gzip, zstd` and are decoded in reverse order
+func (d *decoder) decode(request *fasthttp.Request) ([]byte, error) {
+	encoding := strings.TrimSpace(string(request.Header.Peek(fasthttp.HeaderContentEncoding)))
+	if encoding == "" || strings.EqualFold(encoding, "identity") {
+		return request.Body(), nil
+	}
+
+	body := request.Body()
+	encodings := strings.Split(encoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		decoded, err := d.decodeWith(strings.ToLower(strings.TrimSpace(encodings[i])), body)
+		if e, ok := err.(*decodeError); ok {
+			return nil, e
+		}
+		if err == errTooLarge {
+			return nil, &decodeError{fasthttp.StatusRequestEntityTooLarge, err}
+		}
+		if err != nil {
+			return nil, &decodeError{fasthttp.StatusBadRequest, err}
+		}
+		body = decoded
+	}
+	return body, nil
+}
+
+func (d *decoder) decodeWith(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %s", err)
+		}
+		defer reader.Close()
+		return d.readAll(reader)
+	case "deflate":
+		// deflate is zlib wrapped, some clients send raw deflate streams instead
+		reader, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader = flate.NewReader(bytes.NewReader(body))
+		}
+		defer reader.Close()
+		return d.readAll(reader)
+	case "zstd":
+		reader, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true), zstd.WithDecoderMaxMemory(zstdMaxWindowSize))
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd body: %s", err)
+		}
+		defer reader.Close()
+		return d.readAll(reader)
+	}
+	return nil, &decodeError{fasthttp.StatusUnsupportedMediaType, fmt.Errorf("unsupported Content-Encoding %s", encoding)}
+}
+
+// readAll reads one byte past the limit to tell a body of exactly maxSize bytes from one which is too large
+func (d *decoder) readAll(reader io.Reader) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(reader, int64(d.maxSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid body: %s", err)
+	}
+	if len(body) > d.maxSize {
+		return nil, errTooLarge
+	}
+	return body, nil
+}
+
+// isNDJSON returns true for requests with a batch of newline delimited messages
+func isNDJSON(request *fasthttp.Request) bool {
+	contentType := string(request.Header.ContentType())
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.EqualFold(strings.TrimSpace(contentType), ndjsonContentType)
+}
+
+// splitLines returns the non blank lines of a batch
+func splitLines(body []byte) [][]byte {
+	var lines [][]byte
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
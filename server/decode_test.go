@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fasthttp-server/mocks"
+	"fasthttp-server/pipe"
+	"fasthttp-server/storage"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/klauspost/compress/zstd"
+	"github.com/valyala/fasthttp"
+)
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	switch encoding {
+	case "gzip":
+		writer = gzip.NewWriter(&buf)
+	case "deflate":
+		writer = zlib.NewWriter(&buf)
+	case "raw deflate":
+		writer, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "zstd":
+		var err error
+		if writer, err = zstd.NewWriter(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Write(data)
+	writer.Close()
+	return buf.Bytes()
+}
+
+func Test_newDecoder(t *testing.T) {
+	tests := []struct {
+		name            string
+		maxSize         string
+		want            int
+		shouldCallFatal bool
+	}{
+		{"default", "", defaultMaxDecompressedSize, false},
+		{"max size", "1024", 1024, false},
+		{"should call fatal for invalid sizes", "-1", -1, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv(maxDecompressedSize, test.maxSize)
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				os.Unsetenv(maxDecompressedSize)
+			}()
+
+			if got := newDecoder(); got.maxSize != test.want {
+				t.Errorf("maxSize = %d, want %d", got.maxSize, test.want)
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+func Test_decoder_decode(t *testing.T) {
+	message := []byte(`{"client_id":1,"text":"hello"}`)
+	large := []byte(`{"text":"` + strings.Repeat("a", 100) + `"}`)
+	tests := []struct {
+		name       string
+		encoding   string
+		body       []byte
+		want       []byte
+		wantStatus int
+	}{
+		{"uncompressed", "", message, message, 0},
+		{"identity", "identity", message, message, 0},
+		{"gzip", "gzip", compress(t, "gzip", message), message, 0},
+		{"x-gzip", "x-gzip", compress(t, "gzip", message), message, 0},
+		{"deflate", "deflate", compress(t, "deflate", message), message, 0},
+		{"raw deflate", "deflate", compress(t, "raw deflate", message), message, 0},
+		{"zstd", "zstd", compress(t, "zstd", message), message, 0},
+		{"case insensitive", "GZIP", compress(t, "gzip", message), message, 0},
+		{"encodings are decoded in reverse order", "gzip, zstd", compress(t, "zstd", compress(t, "gzip", message)), message, 0},
+		{"bodies larger than the limit", "gzip", compress(t, "gzip", large), nil, fasthttp.StatusRequestEntityTooLarge},
+		{"zstd bodies larger than the limit", "zstd", compress(t, "zstd", large), nil, fasthttp.StatusRequestEntityTooLarge},
+		{"invalid bodies", "gzip", message, nil, fasthttp.StatusBadRequest},
+		{"truncated bodies", "gzip", compress(t, "gzip", message)[:20], nil, fasthttp.StatusBadRequest},
+		{"unsupported encodings", "br", message, nil, fasthttp.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			d := &decoder{maxSize: 64}
+			var request fasthttp.Request
+			request.Header.Set(fasthttp.HeaderContentEncoding, test.encoding)
+			request.SetBody(test.body)
+
+			got, err := d.decode(&request)
+			if test.wantStatus == 0 && (err != nil || !bytes.Equal(got, test.want)) {
+				t.Errorf("decode() = %s, %v, want %s", got, err, test.want)
+			}
+			if test.wantStatus != 0 {
+				if e, ok := err.(*decodeError); !ok || e.status != test.wantStatus {
+					t.Errorf("decode() error = %v, want status %d", err, test.wantStatus)
+				}
+			}
+		})
+	}
+}
+
+func Test_isNDJSON(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/x-ndjson", true},
+		{"Application/X-NDJSON; charset=utf-8", true},
+		{"application/json", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.contentType, func(t *testing.T) {
+			var request fasthttp.Request
+			request.Header.SetContentType(test.contentType)
+			if got := isNDJSON(&request); got != test.want {
+				t.Errorf("isNDJSON() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func Test_server_requestHandler_compressedBatch(t *testing.T) {
+	var message Request
+	parseErr := json.Unmarshal([]byte("{"), &message)
+	badRequest, _ := json.Marshal(struct {
+		Errors []string `json:"errors"`
+	}{[]string{"line 1: " + parseErr.Error(), "line 2: (root): text is required"}})
+	tests := []struct {
+		name         string
+		body         string
+		writeErr     error
+		wantStatus   int
+		wantBody     string
+		wantMessages []string
+	}{
+		{"ingests every line", "{\"client_id\":1}\n\n{\"client_id\":2}\r\n", nil, fasthttp.StatusOK, "",
+			[]string{`{"client_id":1}`, `{"client_id":2}`}},
+		{"responds with the errors of each line", "{\"client_id\":7}\n{\"client_id\":42}\n{\"client_id\":3}", nil,
+			fasthttp.StatusUnprocessableEntity, `{"errors":["line 2: (root): text is required"]}`,
+			[]string{`{"client_id":7}`, `{"client_id":3}`}},
+		{"responds with bad request if a line is not JSON", "{\n{\"client_id\":42}\n{\"client_id\":3}", nil,
+			fasthttp.StatusBadRequest, string(badRequest),
+			[]string{`{"client_id":3}`}},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeSchemas(t, map[string]string{"42.json": testSchema})
+			os.Setenv(schemaDir, dir)
+			mockCtrl := gomock.NewController(t)
+			mockPipe := mocks.NewMockGzipWriter(mockCtrl)
+			mockStreamer := mocks.NewMockMessageStreamer(mockCtrl)
+			var written []string
+			mockPipe.EXPECT().Write(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+				written = append(written, string(p))
+				return len(p), test.writeErr
+			}).AnyTimes()
+			mockStreamer.EXPECT().Stream(gomock.Any()).AnyTimes()
+			pipeNew = func() pipe.GzipWriter {
+				return mockPipe
+			}
+			s3New = func(storage.Object, int, int) storage.MessageStreamer {
+				return mockStreamer
+			}
+			defer func() {
+				s3New = storage.NewS3Streamer
+				pipeNew = pipe.NewGzipWriter
+				os.Unsetenv(schemaDir)
+				os.RemoveAll(dir)
+			}()
+
+			s := &server{
+				dataPipes:   map[string]pipe.GzipWriter{},
+				streamers:   map[string]storage.MessageStreamer{},
+				router:      newRouter(),
+				pipes:       &pipeFactory{},
+				validator:   newValidator(),
+				redactor:    newRedactor(),
+				enricher:    newEnricher(),
+				deadLetters: newDeadLetters(&pipeFactory{}),
+				decoder:     newDecoder(),
+			}
+			var ctx fasthttp.RequestCtx
+			ctx.Request.Header.SetMethod("POST")
+			ctx.Request.Header.SetContentType(ndjsonContentType)
+			ctx.Request.Header.Set(fasthttp.HeaderContentEncoding, "gzip")
+			ctx.Request.SetBody(compress(t, "gzip", []byte(test.body)))
+			s.requestHandler(&ctx)
+
+			if ctx.Response.StatusCode() != test.wantStatus || string(ctx.Response.Body()) != test.wantBody {
+				t.Errorf("response %d %s, want %d %s", ctx.Response.StatusCode(), ctx.Response.Body(), test.wantStatus, test.wantBody)
+			}
+			var messages []string
+			for _, w := range written {
+				if !strings.Contains(w, "reason") {
+					messages = append(messages, w)
+				}
+			}
+			if !reflect.DeepEqual(messages, test.wantMessages) {
+				t.Errorf("wrote %q, want %q", messages, test.wantMessages)
+			}
+			mockCtrl.Finish()
+		})
+	}
+}
+
+func Test_server_requestHandler_invalidEncoding(t *testing.T) {
+	deadLetters, rejected := capturedDeadLetters(t)
+	s := &server{decoder: &decoder{maxSize: 8}, redactor: newRedactor(), deadLetters: deadLetters}
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.Set(fasthttp.HeaderContentEncoding, "gzip")
+	ctx.Request.SetBody(compress(t, "gzip", []byte(`{"client_id":1,"text":"hello"}`)))
+	s.requestHandler(&ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusRequestEntityTooLarge {
+		t.Errorf("unexpected status code: %d. Expecting %d", ctx.Response.StatusCode(), fasthttp.StatusRequestEntityTooLarge)
+	}
+	if got := rejected(); len(got) != 1 || got[0] != errTooLarge.Error() {
+		t.Errorf("dead letters %q, want %q", got, errTooLarge.Error())
+	}
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"fasthttp-server/pipe"
+	"os"
+)
+
+const encryptionKeyFile = "ENCRYPTION_KEY_FILE"
+
+var encryptedPipeNew = pipe.NewEncryptedGzipWriter
+
+// newKeyWrapper returns the KeyWrapper of the master key in ENCRYPTION_KEY_FILE, or nil if encryption is disabled
+func newKeyWrapper() pipe.KeyWrapper {
+	path := os.Getenv(encryptionKeyFile)
+	if path == "" {
+		return nil
+	}
+	k, err := pipe.NewLocalKeyWrapper(path)
+	if err != nil {
+		logFatalf("Cannot load %s: %s", encryptionKeyFile, err)
+		return nil
+	}
+	return k
+}
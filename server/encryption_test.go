@@ -0,0 +1,51 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func Test_newKeyWrapper(t *testing.T) {
+	file, err := ioutil.TempFile("", "master.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(bytes.Repeat([]byte{1}, 32))
+	file.Close()
+	defer os.Remove(file.Name())
+
+	tests := []struct {
+		name            string
+		path            string
+		wantWrapper     bool
+		shouldCallFatal bool
+	}{
+		{"disabled by default", "", false, false},
+		{"loads the keyfile", file.Name(), true, false},
+		{"should call fatal for a missing keyfile", "/does/not/exist", false, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv(encryptionKeyFile, test.path)
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				os.Unsetenv(encryptionKeyFile)
+			}()
+
+			if got := newKeyWrapper(); (got != nil) != test.wantWrapper {
+				t.Errorf("newKeyWrapper() = %v, want a wrapper %v", got, test.wantWrapper)
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
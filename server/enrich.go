@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fasthttp-server/storage"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	enrichFields    = "ENRICH_FIELDS"
+	enrichMode      = "ENRICH_MODE"
+	requestIDHeader = "X-Request-Id"
+
+	envelopeMode         = "envelope"
+	envelopeMessageField = "message"
+
+	fieldReceivedAt = "received_at"
+	fieldRemoteIP   = "remote_ip"
+	fieldUserAgent  = "user_agent"
+	fieldRequestID  = "request_id"
+	fieldInstance   = "instance"
+	fieldSequence   = "sequence"
+)
+
+var randRead = rand.Read
+
+// origin describes when and from where a message was received
+type origin struct {
+	received   time.Time
+	remoteAddr string
+	remoteIP   string
+	userAgent  string
+	requestID  string
+	// idempotencyKey is sent by clients which retry requests, messages with the same key are stored once
+	idempotencyKey string
+	// sequence is the number of the message among the messages of its client, it is assigned by enricher.write
+	sequence uint64
+}
+
+func newOrigin(ctx *fasthttp.RequestCtx) origin {
+	o := origin{
+		received:       ctx.Time(),
+		remoteAddr:     ctx.RemoteAddr().String(),
+		remoteIP:       ctx.RemoteIP().String(),
+		userAgent:      string(ctx.UserAgent()),
+		requestID:      string(ctx.Request.Header.Peek(requestIDHeader)),
+		idempotencyKey: string(ctx.Request.Header.Peek(idempotencyKeyHeader)),
+	}
+	if o.requestID == "" {
+		o.requestID = newRequestID()
+	}
+	ctx.Response.Header.Set(requestIDHeader, o.requestID)
+	return o
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := randRead(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id)
+}
+
+// enricher adds the fields listed in ENRICH_FIELDS to each message, either by injecting them into
+// the message object or, if ENRICH_MODE is envelope, by wrapping the message in an envelope
+type enricher struct {
+	fields    []string
+	envelope  bool
+	instance  string
+	mutex     sync.Mutex
+	sequences map[string]*sequence
+}
+
+// sequence numbers the messages of a client, its mutex is held while a message is numbered and written
+type sequence struct {
+	mutex sync.Mutex
+	last  uint64
+}
+
+func newEnricher() *enricher {
+	e := &enricher{
+		envelope:  os.Getenv(enrichMode) == envelopeMode,
+		sequences: map[string]*sequence{},
+	}
+	for _, field := range strings.Split(os.Getenv(enrichFields), ",") {
+		switch field = strings.TrimSpace(field); field {
+		case "":
+		case fieldReceivedAt, fieldRemoteIP, fieldUserAgent, fieldRequestID, fieldInstance, fieldSequence:
+			e.fields = append(e.fields, field)
+		default:
+			logFatalf("Unknown field %q in %s", field, enrichFields)
+		}
+	}
+	e.instance = storage.KeyTemplate("{instance}").Execute(storage.Object{})
+	return e
+}
+
+// enrich returns the message with the configured fields added, messages must be JSON objects
+func (e *enricher) enrich(message []byte, clientID string, o origin) []byte {
+	if len(e.fields) == 0 {
+		return message
+	}
+
+	fields := make([]byte, 0, 128)
+	for i, field := range e.fields {
+		if i > 0 {
+			fields = append(fields, ',')
+		}
+		fields = append(fields, '"')
+		fields = append(fields, field...)
+		fields = append(fields, '"', ':')
+		fields = append(fields, e.value(field, clientID, o)...)
+	}
+
+	if e.envelope {
+		enriched := make([]byte, 0, len(fields)+len(message)+16)
+		enriched = append(enriched, '{')
+		enriched = append(enriched, fields...)
+		enriched = append(enriched, `,"`+envelopeMessageField+`":`...)
+		enriched = append(enriched, bytes.TrimSpace(message)...)
+		return append(enriched, '}')
+	}
+
+	message = bytes.TrimSpace(message)
+	end := bytes.LastIndexByte(message, '}')
+	if len(message) == 0 || message[0] != '{' || end < 0 {
+		return message
+	}
+	enriched := make([]byte, 0, len(fields)+len(message)+1)
+	enriched = append(enriched, message[:end]...)
+	if len(bytes.TrimSpace(message[1:end])) > 0 {
+		enriched = append(enriched, ',')
+	}
+	enriched = append(enriched, fields...)
+	return append(enriched, '}')
+}
+
+func (e *enricher) value(field, clientID string, o origin) []byte {
+	var value string
+	switch field {
+	case fieldReceivedAt:
+		value = o.received.UTC().Format(time.RFC3339Nano)
+	case fieldRemoteIP:
+		value = o.remoteIP
+	case fieldUserAgent:
+		value = o.userAgent
+	case fieldRequestID:
+		value = o.requestID
+	case fieldInstance:
+		value = e.instance
+	case fieldSequence:
+		return strconv.AppendUint(nil, o.sequence, 10)
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return []byte(`""`)
+	}
+	return encoded
+}
+
+// write writes the enriched message. If messages are numbered the number is assigned and the message written while
+// the sequence of the client is locked, so the messages of a client are stored in the order of their numbers and a
+// message which cannot be written does not use up a number
+func (e *enricher) write(w io.Writer, message []byte, clientID string, o origin) error {
+	if !e.numbered() {
+		_, err := w.Write(e.enrich(message, clientID, o))
+		return err
+	}
+
+	seq := e.sequence(clientID)
+	seq.mutex.Lock()
+	defer seq.mutex.Unlock()
+	o.sequence = seq.last + 1
+	if _, err := w.Write(e.enrich(message, clientID, o)); err != nil {
+		return err
+	}
+	seq.last++
+	return nil
+}
+
+// numbered returns true if the sequence field is added to messages
+func (e *enricher) numbered() bool {
+	for _, field := range e.fields {
+		if field == fieldSequence {
+			return true
+		}
+	}
+	return false
+}
+
+// sequence returns the sequence of the client, numbers start at 1
+func (e *enricher) sequence(clientID string) *sequence {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	seq, ok := e.sequences[clientID]
+	if !ok {
+		seq = &sequence{}
+		e.sequences[clientID] = seq
+	}
+	return seq
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func Test_newEnricher(t *testing.T) {
+	tests := []struct {
+		name            string
+		fields          string
+		mode            string
+		wantFields      []string
+		wantEnvelope    bool
+		shouldCallFatal bool
+	}{
+		{"disabled by default", "", "", nil, false, false},
+		{"fields and envelope", "received_at, sequence", "envelope", []string{"received_at", "sequence"}, true, false},
+		{"should call fatal for unknown fields", "received_at,nope", "", []string{"received_at"}, false, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv(enrichFields, test.fields)
+			os.Setenv(enrichMode, test.mode)
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				os.Unsetenv(enrichFields)
+				os.Unsetenv(enrichMode)
+			}()
+
+			e := newEnricher()
+			if !reflect.DeepEqual(e.fields, test.wantFields) || e.envelope != test.wantEnvelope {
+				t.Errorf("newEnricher() = %v %v, want %v %v", e.fields, e.envelope, test.wantFields, test.wantEnvelope)
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+func Test_enricher_enrich(t *testing.T) {
+	o := origin{
+		received:  time.Date(2026, 10, 18, 12, 0, 0, 5, time.UTC),
+		remoteIP:  "10.0.0.1",
+		userAgent: `agent "1"`,
+		requestID: "abc",
+		sequence:  1,
+	}
+	all := []string{fieldReceivedAt, fieldRemoteIP, fieldUserAgent, fieldRequestID, fieldInstance, fieldSequence}
+	tests := []struct {
+		name     string
+		fields   []string
+		envelope bool
+		message  string
+		want     string
+	}{
+		{"no fields", nil, false, `{"a":1}`, `{"a":1}`},
+		{"injects all fields", all, false, `{"a":1}`,
+			`{"a":1,"received_at":"2026-10-18T12:00:00.000000005Z","remote_ip":"10.0.0.1","user_agent":"agent \"1\"",` +
+				`"request_id":"abc","instance":"host","sequence":1}`},
+		{"injects into an empty object", []string{fieldRequestID}, false, ` { } `, `{ "request_id":"abc"}`},
+		{"wraps the message in an envelope", []string{fieldRemoteIP, fieldRequestID}, true, `{"a":1}`,
+			`{"remote_ip":"10.0.0.1","request_id":"abc","message":{"a":1}}`},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			e := &enricher{fields: test.fields, envelope: test.envelope, instance: "host", sequences: map[string]*sequence{}}
+			if got := string(e.enrich([]byte(test.message), "42", o)); got != test.want {
+				t.Errorf("enrich() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func Test_enricher_sequence(t *testing.T) {
+	e := &enricher{fields: []string{fieldSequence}, sequences: map[string]*sequence{}}
+	for i, clientID := range []string{"a", "a", "b", "a"} {
+		want := []string{`{"sequence":1}`, `{"sequence":2}`, `{"sequence":1}`, `{"sequence":3}`}[i]
+		var buf bytes.Buffer
+		if err := e.write(&buf, []byte(`{}`), clientID, origin{}); err != nil || buf.String() != want {
+			t.Errorf("write() = %v, %v, want %v", buf.String(), err, want)
+		}
+	}
+
+	// a message which cannot be written does not use up a number
+	if err := e.write(failingWriter{}, []byte(`{}`), "a", origin{}); err == nil {
+		t.Error("expected the error of the writer")
+	}
+	var buf bytes.Buffer
+	if err := e.write(&buf, []byte(`{}`), "a", origin{}); err != nil || buf.String() != `{"sequence":4}` {
+		t.Errorf("write() = %v, %v, want %v", buf.String(), err, `{"sequence":4}`)
+	}
+}
+
+func Test_enricher_sequenceOrder(t *testing.T) {
+	e := &enricher{fields: []string{fieldSequence}, sequences: map[string]*sequence{}}
+	w := &orderedWriter{}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := e.write(w, []byte(`{}`), "a", origin{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, message := range w.messages {
+		if want := fmt.Sprintf(`{"sequence":%d}`, i+1); message != want {
+			t.Fatalf("message %d = %v, want %v", i, message, want)
+		}
+	}
+}
+
+// orderedWriter records the messages in the order they are written
+type orderedWriter struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (w *orderedWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.messages = append(w.messages, string(p))
+	return len(p), nil
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("closed")
+}
+
+func Test_newOrigin(t *testing.T) {
+	tests := []struct {
+		name      string
+		requestID string
+		random    func([]byte) (int, error)
+		want      string
+	}{
+		{"uses the request id header", "from-client", nil, "from-client"},
+		{"generates a request id", "", func(b []byte) (int, error) {
+			for i := range b {
+				b[i] = 1
+			}
+			return len(b), nil
+		}, "01010101010101010101010101010101"},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			if test.random != nil {
+				randRead = test.random
+			}
+			defer func() {
+				randRead = rand.Read
+			}()
+
+			var ctx fasthttp.RequestCtx
+			ctx.Request.Header.Set(requestIDHeader, test.requestID)
+			ctx.Request.Header.SetUserAgent("agent")
+
+			o := newOrigin(&ctx)
+			if o.requestID != test.want || o.userAgent != "agent" {
+				t.Errorf("newOrigin() = %v, want request id %v", o, test.want)
+			}
+			if got := string(ctx.Response.Header.Peek(requestIDHeader)); got != test.want {
+				t.Errorf("response request id = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fasthttp-server/storage"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	storageLocal        = "local"
+	failoverStorageType = "FAILOVER_STORAGE_TYPE"
+	failoverSpoolDir    = "FAILOVER_SPOOL_DIR"
+	reuploadInterval    = "REUPLOAD_INTERVAL"
+)
+
+var (
+	failoverNew   = storage.NewFailoverStreamer
+	localNew      = storage.NewLocalStreamer
+	reuploadLocal = storage.ReuploadLocal
+)
+
+// getStreamer returns the streamer of the STORAGE_TYPE backends, diverting to the FAILOVER_STORAGE_TYPE backend
+// if they fail
+func getStreamer(object storage.Object) storage.MessageStreamer {
+	primary := primaryStreamer(object)
+	secondary := strings.TrimSpace(os.Getenv(failoverStorageType))
+	if secondary == "" {
+		return primary
+	}
+	name := os.Getenv(storageType)
+	if name == "" {
+		name = storageS3
+	}
+	return failoverNew(storage.Backend{Name: name, Streamer: primary},
+		storage.Backend{Name: secondary, Streamer: newBackend(secondary, object)}, os.Getenv(failoverSpoolDir), reportUpload)
+}
+
+// newReuploader returns a job uploading the objects diverted to local storage to the STORAGE_TYPE backends
+// every REUPLOAD_INTERVAL, or nil if it is not set
+func newReuploader() *job {
+	interval := os.Getenv(reuploadInterval)
+	if interval == "" {
+		return nil
+	}
+	if strings.TrimSpace(os.Getenv(failoverStorageType)) != storageLocal {
+		logFatalf("%s requires %s=%s", reuploadInterval, failoverStorageType, storageLocal)
+	}
+	every, err := time.ParseDuration(interval)
+	if err != nil || every <= 0 {
+		logFatalf("%s must be a positive duration e.g. 10m", reuploadInterval)
+	}
+	return newJob("upload of diverted objects", every, func() error {
+		return reuploadLocal(primaryStreamer)
+	})
+}
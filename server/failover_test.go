@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fasthttp-server/storage"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_getStreamer_failover(t *testing.T) {
+	tests := []struct {
+		name          string
+		storageType   string
+		failover      string
+		wantPrimary   string
+		wantSecondary string
+	}{
+		{"no failover", "azure", "", "", ""},
+		{"defaults to s3", "", "local", "s3", "local"},
+		{"failover", "azure", "local", "azure", "local"},
+		{"fan out with failover", "s3,azure", "local", "s3,azure", "local"},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv(storageType, test.storageType)
+			os.Setenv(failoverStorageType, test.failover)
+			os.Setenv(failoverSpoolDir, "spool")
+			var primary, secondary, spoolDir string
+			fanOutNew = func([]storage.Backend, int, time.Duration, storage.CommitPolicy, storage.UploadReporter) storage.MessageStreamer {
+				return nil
+			}
+			failoverNew = func(p, s storage.Backend, dir string, report storage.UploadReporter) storage.MessageStreamer {
+				primary, secondary, spoolDir = p.Name, s.Name, dir
+				return nil
+			}
+			localNew = func(storage.Object, int, int) storage.MessageStreamer {
+				return nil
+			}
+			s3New = localNew
+			azureNew = localNew
+			defer func() {
+				s3New = storage.NewS3Streamer
+				azureNew = storage.NewAzureStreamer
+				localNew = storage.NewLocalStreamer
+				fanOutNew = storage.NewFanOutStreamer
+				failoverNew = storage.NewFailoverStreamer
+				os.Unsetenv(storageType)
+				os.Unsetenv(failoverStorageType)
+				os.Unsetenv(failoverSpoolDir)
+			}()
+
+			getStreamer(storage.Object{})
+			if primary != test.wantPrimary || secondary != test.wantSecondary {
+				t.Errorf("failover from %q to %q, want %q to %q", primary, secondary, test.wantPrimary, test.wantSecondary)
+			}
+			if test.failover != "" && spoolDir != "spool" {
+				t.Errorf("spool directory = %q", spoolDir)
+			}
+		})
+	}
+}
+
+func Test_newReuploader(t *testing.T) {
+	tests := []struct {
+		name            string
+		interval        string
+		failover        string
+		wantNil         bool
+		wantInterval    time.Duration
+		shouldCallFatal bool
+	}{
+		{"disabled", "", "local", true, 0, false},
+		{"interval", "10m", "local", false, 10 * time.Minute, false},
+		{"should call fatal for invalid intervals", "often", "local", false, 0, true},
+		{"should call fatal unless failing over to local storage", "10m", "azure", false, 10 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv(reuploadInterval, test.interval)
+			os.Setenv(failoverStorageType, test.failover)
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				os.Unsetenv(reuploadInterval)
+				os.Unsetenv(failoverStorageType)
+			}()
+
+			var uploaded bool
+			reuploadLocal = func(func(storage.Object) storage.MessageStreamer) error {
+				uploaded = true
+				return nil
+			}
+			defer func() {
+				reuploadLocal = storage.ReuploadLocal
+			}()
+
+			got := newReuploader()
+			if (got == nil) != test.wantNil {
+				t.Fatalf("newReuploader() = %v, wantNil %v", got, test.wantNil)
+			}
+			if got == nil {
+				return
+			}
+			if got.interval != test.wantInterval {
+				t.Errorf("interval = %v, want %v", got.interval, test.wantInterval)
+			}
+			if got.run(); !uploaded {
+				t.Error("the job does not upload the diverted objects")
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fasthttp-server/ingest"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	grpcAddress        = "GRPC_ADDRESS"
+	grpcTLSCert        = "GRPC_TLS_CERT"
+	grpcTLSKey         = "GRPC_TLS_KEY"
+	grpcMaxMessageSize = "GRPC_MAX_MESSAGE_SIZE"
+
+	defaultGRPCMaxMessageSize = 4 * 1024 * 1024
+	grpcShutdownTimeout       = 10 * time.Second
+	grpcAcceptedTrailer       = "accepted"
+)
+
+// grpcListener serves the Ingester service, messages are ingested like the body of a request
+type grpcListener struct {
+	ingest.UnimplementedIngesterServer
+	listener net.Listener
+	server   *grpc.Server
+	ingest   func(body []byte, o origin) error
+}
+
+// newGRPCListener listens at GRPC_ADDRESS, with TLS if the certificate and key are set, it returns nil if the
+// address is not set
+func newGRPCListener(ingestMessage func(body []byte, o origin) error) *grpcListener {
+	address := os.Getenv(grpcAddress)
+	if address == "" {
+		return nil
+	}
+	maxSize := defaultGRPCMaxMessageSize
+	if size := os.Getenv(grpcMaxMessageSize); size != "" {
+		var err error
+		if maxSize, err = strconv.Atoi(size); err != nil || maxSize <= 0 {
+			logFatalf("%s must be a positive number of bytes", grpcMaxMessageSize)
+		}
+	}
+	options := []grpc.ServerOption{grpc.MaxRecvMsgSize(maxSize)}
+	cert, key := os.Getenv(grpcTLSCert), os.Getenv(grpcTLSKey)
+	if cert != "" || key != "" {
+		certificate, err := tlsLoadX509KeyPair(cert, key)
+		if err != nil {
+			logFatalf("Error loading %s and %s: %s", grpcTLSCert, grpcTLSKey, err)
+			return nil
+		}
+		options = append(options, grpc.Creds(credentials.NewServerTLSFromCert(&certificate)))
+	}
+
+	listener, err := netListen("tcp", address)
+	if err != nil {
+		logFatalf("Error creating grpc listener: %s", err)
+		return nil
+	}
+	g := &grpcListener{listener: listener, server: grpc.NewServer(options...), ingest: ingestMessage}
+	ingest.RegisterIngesterServer(g.server, g)
+	return g
+}
+
+func (g *grpcListener) start() {
+	fmt.Println("Starting grpc listener at address: ", g.listener.Addr())
+	go g.server.Serve(g.listener)
+}
+
+// Close waits for the running calls to finish, calls still running after the shutdown timeout are cancelled
+func (g *grpcListener) Close() {
+	stopped := make(chan struct{})
+	go func() {
+		g.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(grpcShutdownTimeout):
+		g.server.Stop()
+		<-stopped
+	}
+}
+
+// Ingest responds with InvalidArgument for invalid messages and Unavailable if the message should be sent again
+func (g *grpcListener) Ingest(ctx context.Context, request *ingest.IngestRequest) (*ingest.IngestResponse, error) {
+	o := grpcOrigin(ctx)
+	switch e := g.ingestRequest(request, o).(type) {
+	case nil:
+	case *validationError:
+		return nil, status.Error(codes.InvalidArgument, e.Error())
+	default:
+		return nil, status.Error(codes.Unavailable, e.Error())
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDHeader, o.requestID))
+	return &ingest.IngestResponse{RequestId: o.requestID}, nil
+}
+
+// IngestStream ingests the messages of the stream in order. Invalid messages are reported in the response, the
+// stream fails with Unavailable if a message cannot be stored and the number of messages received before it is
+// sent in the accepted trailer, so the client can resume from there. The idempotency key of the stream is
+// suffixed with the index of each message, like the line number of a batch
+func (g *grpcListener) IngestStream(stream ingest.Ingester_IngestStreamServer) error {
+	o := grpcOrigin(stream.Context())
+	streamKey := o.idempotencyKey
+	response := &ingest.IngestStreamResponse{}
+	for index := uint64(0); ; index++ {
+		request, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(response)
+		}
+		if err != nil {
+			return err
+		}
+
+		o.received, o.requestID = time.Now(), newRequestID()
+		if streamKey != "" {
+			o.idempotencyKey = fmt.Sprintf("%s/%d", streamKey, index)
+		}
+		switch e := g.ingestRequest(request, o).(type) {
+		case nil:
+			response.Accepted++
+		case *validationError:
+			response.Rejected = append(response.Rejected, &ingest.Rejection{Index: index, Errors: e.errors})
+		default:
+			stream.SetTrailer(metadata.Pairs(grpcAcceptedTrailer, strconv.FormatUint(index, 10)))
+			return status.Errorf(codes.Unavailable, "%s, %d messages were received", e, index)
+		}
+	}
+}
+
+// ingestRequest converts the payload to a JSON object and ingests it, the client id of the request is added to
+// payloads without one. Invalid payloads are returned as a validationError
+func (g *grpcListener) ingestRequest(request *ingest.IngestRequest, o origin) error {
+	var message []byte
+	switch payload := request.Payload.(type) {
+	case *ingest.IngestRequest_Json:
+		message = bytes.TrimSpace(payload.Json)
+	case *ingest.IngestRequest_Message:
+		message, _ = json.Marshal(payload.Message.AsMap())
+	default:
+		return &validationError{errors: []string{"payload is required"}}
+	}
+	if len(message) == 0 || message[0] != '{' || !json.Valid(message) {
+		return &validationError{errors: []string{"payload must be a JSON object"}}
+	}
+	var parsed Request
+	if err := json.Unmarshal(message, &parsed); err != nil {
+		return &validationError{errors: []string{err.Error()}}
+	}
+	switch string(parsed.ClientID) {
+	case request.ClientId:
+	case "":
+		message = withClientID(message, request.ClientId)
+	default:
+		if request.ClientId != "" {
+			return &validationError{errors: []string{"client_id does not match the payload"}}
+		}
+	}
+
+	switch e := g.ingest(message, o).(type) {
+	case nil, *validationError, *unavailableError:
+		return e
+	default:
+		return &unavailableError{e}
+	}
+}
+
+// grpcOrigin describes the peer of a call, the request id is taken from the x-request-id metadata if it is set
+func grpcOrigin(ctx context.Context) origin {
+	o := origin{received: time.Now()}
+	if p, ok := peer.FromContext(ctx); ok {
+		o.remoteAddr = p.Addr.String()
+		o.remoteIP, _, _ = net.SplitHostPort(o.remoteAddr)
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("user-agent"); len(values) > 0 {
+			o.userAgent = values[0]
+		}
+		if values := md.Get(requestIDHeader); len(values) > 0 {
+			o.requestID = values[0]
+		}
+		if values := md.Get(idempotencyKeyHeader); len(values) > 0 {
+			o.idempotencyKey = values[0]
+		}
+	}
+	if o.requestID == "" {
+		o.requestID = newRequestID()
+	}
+	return o
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fasthttp-server/ingest"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func Test_newGRPCListener(t *testing.T) {
+	tests := []struct {
+		name            string
+		env             map[string]string
+		wantNil         bool
+		shouldCallFatal bool
+	}{
+		{"disabled", map[string]string{}, true, false},
+		{"listens", map[string]string{grpcAddress: "127.0.0.1:0", grpcMaxMessageSize: "1024"}, false, false},
+		{"should call fatal for invalid message sizes", map[string]string{grpcAddress: "127.0.0.1:0", grpcMaxMessageSize: "big"},
+			false, true},
+		{"should call fatal for missing certificates", map[string]string{grpcAddress: "127.0.0.1:0", grpcTLSCert: "missing.pem",
+			grpcTLSKey: "missing.key"}, true, true},
+		{"should call fatal for invalid addresses", map[string]string{grpcAddress: "invalid"}, true, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				os.Setenv(name, value)
+			}
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				for name := range test.env {
+					os.Unsetenv(name)
+				}
+			}()
+
+			got := newGRPCListener(nil)
+			if (got == nil) != test.wantNil {
+				t.Fatalf("newGRPCListener() = %v, wantNil %v", got, test.wantNil)
+			}
+			if got != nil {
+				got.listener.Close()
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+// startGRPCListener starts a listener and returns a client connected to it
+func startGRPCListener(t *testing.T, env map[string]string, ingestMessage func(body []byte, o origin) error, creds credentials.TransportCredentials) (*grpcListener, ingest.IngesterClient) {
+	env[grpcAddress] = "127.0.0.1:0"
+	for name, value := range env {
+		os.Setenv(name, value)
+	}
+	defer func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	}()
+	g := newGRPCListener(ingestMessage)
+	g.start()
+	conn, err := grpc.Dial(g.listener.Addr().String(), grpc.WithTransportCredentials(creds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return g, ingest.NewIngesterClient(conn)
+}
+
+func Test_grpcListener_Ingest(t *testing.T) {
+	message, _ := structpb.NewStruct(map[string]interface{}{"text": "hi", "tags": []interface{}{"a"}})
+	tests := []struct {
+		name         string
+		request      *ingest.IngestRequest
+		err          error
+		wantCode     codes.Code
+		wantIngested []string
+	}{
+		{"json", &ingest.IngestRequest{Payload: &ingest.IngestRequest_Json{Json: []byte(` {"client_id":1} `)}},
+			nil, codes.OK, []string{`{"client_id":1}`}},
+		{"adds the client id", &ingest.IngestRequest{ClientId: "7", Payload: &ingest.IngestRequest_Json{Json: []byte(`{"text":"hi"}`)}},
+			nil, codes.OK, []string{`{"client_id":"7","text":"hi"}`}},
+		{"structured payloads", &ingest.IngestRequest{ClientId: "7", Payload: &ingest.IngestRequest_Message{Message: message}},
+			nil, codes.OK, []string{`{"client_id":"7","tags":["a"],"text":"hi"}`}},
+		{"rejects payloads of other clients", &ingest.IngestRequest{ClientId: "7", Payload: &ingest.IngestRequest_Json{Json: []byte(`{"client_id":8}`)}},
+			nil, codes.InvalidArgument, nil},
+		{"rejects payloads which are not objects", &ingest.IngestRequest{Payload: &ingest.IngestRequest_Json{Json: []byte(`[1]`)}},
+			nil, codes.InvalidArgument, nil},
+		{"rejects missing payloads", &ingest.IngestRequest{ClientId: "7"}, nil, codes.InvalidArgument, nil},
+		{"invalid messages", &ingest.IngestRequest{Payload: &ingest.IngestRequest_Json{Json: []byte(`{}`)}},
+			&validationError{errors: []string{"text is required"}}, codes.InvalidArgument, []string{`{}`}},
+		{"unavailable storage", &ingest.IngestRequest{Payload: &ingest.IngestRequest_Json{Json: []byte(`{}`)}},
+			&unavailableError{errors.New("full")}, codes.Unavailable, []string{`{}`}},
+		{"errors writing to the pipe", &ingest.IngestRequest{Payload: &ingest.IngestRequest_Json{Json: []byte(`{}`)}},
+			errors.New("closed pipe"), codes.Unavailable, []string{`{}`}},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			i := &ingested{err: test.err}
+			g, client := startGRPCListener(t, map[string]string{}, i.ingest, insecure.NewCredentials())
+			defer g.Close()
+
+			ctx := metadata.AppendToOutgoingContext(context.Background(), "x-request-id", "abc")
+			var header metadata.MD
+			response, err := client.Ingest(ctx, test.request, grpc.Header(&header))
+			if status.Code(err) != test.wantCode {
+				t.Errorf("Ingest() error = %v, want %v", err, test.wantCode)
+			}
+			if err == nil && (response.RequestId != "abc" || header.Get("x-request-id")[0] != "abc") {
+				t.Errorf("request id = %s, header %v", response.RequestId, header)
+			}
+			if !reflect.DeepEqual(i.get(), test.wantIngested) {
+				t.Errorf("ingested %v, want %v", i.get(), test.wantIngested)
+			}
+			if len(i.origins) > 0 && (i.origins[0].remoteIP != "127.0.0.1" || i.origins[0].requestID != "abc" || i.origins[0].userAgent == "") {
+				t.Errorf("origin = %+v", i.origins[0])
+			}
+		})
+	}
+}
+
+// failingIngest rejects messages without text and fails once the limit is reached
+type failingIngest struct {
+	ingested
+	limit int
+}
+
+func (f *failingIngest) ingest(body []byte, o origin) error {
+	f.ingested.ingest(body, o)
+	if len(f.get()) > f.limit {
+		return &unavailableError{errors.New("full")}
+	}
+	if string(body) == `{}` {
+		return &validationError{errors: []string{"text is required"}}
+	}
+	return nil
+}
+
+func Test_grpcListener_IngestStream(t *testing.T) {
+	tests := []struct {
+		name         string
+		limit        int
+		wantCode     codes.Code
+		wantResponse *ingest.IngestStreamResponse
+		wantAccepted string
+	}{
+		{"accepts and rejects messages", 10, codes.OK,
+			&ingest.IngestStreamResponse{Accepted: 2, Rejected: []*ingest.Rejection{{Index: 1, Errors: []string{"text is required"}}}}, ""},
+		{"fails when messages cannot be stored", 1, codes.Unavailable, nil, "1"},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			f := &failingIngest{limit: test.limit}
+			g, client := startGRPCListener(t, map[string]string{}, f.ingest, insecure.NewCredentials())
+			defer g.Close()
+
+			stream, err := client.IngestStream(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, message := range []string{`{"text":"a"}`, `{}`, `{"text":"b"}`} {
+				stream.Send(&ingest.IngestRequest{Payload: &ingest.IngestRequest_Json{Json: []byte(message)}})
+			}
+			response, err := stream.CloseAndRecv()
+			if status.Code(err) != test.wantCode {
+				t.Fatalf("IngestStream() error = %v, want %v", err, test.wantCode)
+			}
+			if test.wantResponse != nil && (response.Accepted != test.wantResponse.Accepted ||
+				len(response.Rejected) != 1 || response.Rejected[0].Index != 1 ||
+				!reflect.DeepEqual(response.Rejected[0].Errors, test.wantResponse.Rejected[0].Errors)) {
+				t.Errorf("response = %v, want %v", response, test.wantResponse)
+			}
+			if accepted := stream.Trailer().Get(grpcAcceptedTrailer); test.wantAccepted != "" && (len(accepted) != 1 || accepted[0] != test.wantAccepted) {
+				t.Errorf("accepted trailer = %v, want %s", accepted, test.wantAccepted)
+			}
+		})
+	}
+}
+
+func Test_grpcListener_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile)
+
+	creds, err := credentials.NewClientTLSFromFile(certFile, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &ingested{}
+	g, client := startGRPCListener(t, map[string]string{grpcTLSCert: certFile, grpcTLSKey: keyFile}, i.ingest, creds)
+	defer g.Close()
+	if _, err := client.Ingest(context.Background(), &ingest.IngestRequest{Payload: &ingest.IngestRequest_Json{Json: []byte(`{}`)}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(i.get()) != 1 {
+		t.Errorf("ingested %v", i.get())
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"container/list"
+	"errors"
+	"fasthttp-server/storage"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyWindow  = "IDEMPOTENCY_WINDOW"
+	idempotencyMaxKeys = "IDEMPOTENCY_MAX_KEYS"
+	messageIDField     = "MESSAGE_ID_FIELD"
+
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	defaultIdempotencyMaxKeys = 100000
+)
+
+// errInFlight is returned for a message sent again while the message with its key is still being written
+var errInFlight = errors.New("a message with the same idempotency key is being stored")
+
+// duplicates remembers the idempotency keys of the messages stored within the window, per client. The index is
+// bounded to maxKeys, the oldest keys are forgotten first so a duplicate of an old message may be stored again
+type duplicates struct {
+	window  time.Duration
+	maxKeys int
+	idField string
+	mutex   sync.Mutex
+	keys    map[string]*list.Element
+	order   *list.List
+}
+
+// idempotencyKey is reserved when its message is received, it is a duplicate once the message has been stored
+type idempotencyKey struct {
+	key      string
+	received time.Time
+	stored   bool
+}
+
+// newDuplicates returns nil unless IDEMPOTENCY_WINDOW is set, messages are then stored once per client and key
+func newDuplicates() *duplicates {
+	value := os.Getenv(idempotencyWindow)
+	if value == "" {
+		return nil
+	}
+	d := &duplicates{
+		maxKeys: defaultIdempotencyMaxKeys,
+		idField: os.Getenv(messageIDField),
+		keys:    map[string]*list.Element{},
+		order:   list.New(),
+	}
+	var err error
+	if d.window, err = time.ParseDuration(value); err != nil || d.window <= 0 {
+		logFatalf("%s must be a positive duration e.g. 10m", idempotencyWindow)
+	}
+	if maxKeys := os.Getenv(idempotencyMaxKeys); maxKeys != "" {
+		if d.maxKeys, err = strconv.Atoi(maxKeys); err != nil || d.maxKeys <= 0 {
+			logFatalf("%s must be a positive number of keys", idempotencyMaxKeys)
+		}
+	}
+	return d
+}
+
+// key returns the idempotency key of the request the message was sent with, or the value of the message id field,
+// prefixed by the client id. Messages without either have no key and are always stored
+func (d *duplicates) key(message []byte, clientID string, o origin) string {
+	if d == nil {
+		return ""
+	}
+	key := o.idempotencyKey
+	if key == "" && d.idField != "" {
+		key, _ = storage.MessageField(message, d.idField)
+	}
+	if key == "" {
+		return ""
+	}
+	return clientID + "\n" + key
+}
+
+// reserve returns false if the message of the key was stored within the window, and errInFlight if it is still being
+// written so the message is sent again rather than acknowledged before it is stored. Otherwise it remembers the key
+// until the window has passed or it is released, the message must then be stored or the key released
+func (d *duplicates) reserve(key string, now time.Time) (bool, error) {
+	if d == nil || key == "" {
+		return true, nil
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for front := d.order.Front(); front != nil && now.Sub(front.Value.(*idempotencyKey).received) >= d.window; front = d.order.Front() {
+		d.remove(front)
+	}
+	if element, exists := d.keys[key]; exists {
+		if !element.Value.(*idempotencyKey).stored {
+			return false, errInFlight
+		}
+		return false, nil
+	}
+	if d.order.Len() >= d.maxKeys {
+		d.remove(d.order.Front())
+	}
+	d.keys[key] = d.order.PushBack(&idempotencyKey{key: key, received: now})
+	return true, nil
+}
+
+// stored marks the key of a message which has been written, messages sent again with the key are duplicates
+func (d *duplicates) stored(key string) {
+	if d == nil || key == "" {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if element, exists := d.keys[key]; exists {
+		element.Value.(*idempotencyKey).stored = true
+	}
+}
+
+// release forgets a key reserved for a message which could not be stored, so the message can be sent again
+func (d *duplicates) release(key string) {
+	if d == nil || key == "" {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if element, exists := d.keys[key]; exists {
+		d.remove(element)
+	}
+}
+
+func (d *duplicates) remove(element *list.Element) {
+	d.order.Remove(element)
+	delete(d.keys, element.Value.(*idempotencyKey).key)
+}
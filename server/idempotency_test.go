@@ -0,0 +1,394 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fasthttp-server/ingest"
+	"fasthttp-server/mocks"
+	"fasthttp-server/pipe"
+	"fasthttp-server/storage"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/golang/mock/gomock"
+	"github.com/valyala/fasthttp"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+func Test_newDuplicates(t *testing.T) {
+	tests := []struct {
+		name            string
+		env             map[string]string
+		wantNil         bool
+		wantMaxKeys     int
+		shouldCallFatal bool
+	}{
+		{"disabled", map[string]string{}, true, 0, false},
+		{"default size", map[string]string{idempotencyWindow: "10m"}, false, defaultIdempotencyMaxKeys, false},
+		{"size", map[string]string{idempotencyWindow: "10m", idempotencyMaxKeys: "10"}, false, 10, false},
+		{"should call fatal for invalid windows", map[string]string{idempotencyWindow: "10"}, false, defaultIdempotencyMaxKeys, true},
+		{"should call fatal for invalid sizes", map[string]string{idempotencyWindow: "10m", idempotencyMaxKeys: "0"}, false, 0, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				os.Setenv(name, value)
+			}
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				for name := range test.env {
+					os.Unsetenv(name)
+				}
+			}()
+
+			got := newDuplicates()
+			if (got == nil) != test.wantNil {
+				t.Fatalf("newDuplicates() = %v, wantNil %v", got, test.wantNil)
+			}
+			if got != nil && got.maxKeys != test.wantMaxKeys {
+				t.Errorf("maxKeys = %d, want %d", got.maxKeys, test.wantMaxKeys)
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+func Test_duplicates_key(t *testing.T) {
+	message := []byte(`{"client_id":1,"meta":{"id":"m-1"}}`)
+	tests := []struct {
+		name       string
+		duplicates *duplicates
+		o          origin
+		want       string
+	}{
+		{"disabled", nil, origin{idempotencyKey: "k"}, ""},
+		{"idempotency key", &duplicates{idField: "meta.id"}, origin{idempotencyKey: "k"}, "1\nk"},
+		{"message id field", &duplicates{idField: "meta.id"}, origin{}, "1\nm-1"},
+		{"no key", &duplicates{}, origin{}, ""},
+		{"missing message id field", &duplicates{idField: "id"}, origin{}, ""},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.duplicates.key(message, "1", test.o); got != test.want {
+				t.Errorf("key() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func Test_duplicates_reserve(t *testing.T) {
+	now := time.Now()
+	d := &duplicates{window: time.Minute, maxKeys: 2, keys: map[string]*list.Element{}, order: list.New()}
+	steps := []struct {
+		key     string
+		now     time.Time
+		stored  bool
+		want    bool
+		wantErr error
+	}{
+		{"1\na", now, false, true, nil},
+		// the message of the key is still being written
+		{"1\na", now.Add(time.Second), true, false, errInFlight},
+		{"1\na", now.Add(time.Second), false, false, nil},
+		{"2\na", now.Add(time.Second), true, true, nil},
+		{"", now.Add(time.Second), false, true, nil},
+		{"", now.Add(time.Second), false, true, nil},
+		// the index is full so the oldest key is forgotten
+		{"1\nb", now.Add(2 * time.Second), true, true, nil},
+		{"1\na", now.Add(3 * time.Second), true, true, nil},
+		// keys are forgotten once the window has passed
+		{"1\nb", now.Add(time.Minute + 2*time.Second), true, true, nil},
+	}
+	for i, step := range steps {
+		if got, err := d.reserve(step.key, step.now); got != step.want || err != step.wantErr {
+			t.Errorf("step %d: reserve(%q) = %v, %v, want %v, %v", i, step.key, got, err, step.want, step.wantErr)
+		}
+		if step.stored {
+			d.stored(step.key)
+		}
+	}
+	if d.order.Len() != len(d.keys) || d.order.Len() > d.maxKeys {
+		t.Errorf("index has %d keys and %d entries", len(d.keys), d.order.Len())
+	}
+
+	d.release("1\nb")
+	if reserved, _ := d.reserve("1\nb", now.Add(time.Minute+3*time.Second)); !reserved {
+		t.Error("released keys should be reserved again")
+	}
+	var disabled *duplicates
+	first, _ := disabled.reserve("1\na", now)
+	second, _ := disabled.reserve("1\na", now)
+	if !first || !second {
+		t.Error("every message should be stored when disabled")
+	}
+	disabled.stored("1\na")
+	disabled.release("1\na")
+}
+
+func Test_server_requestHandler_duplicates(t *testing.T) {
+	tests := []struct {
+		name           string
+		contentType    string
+		requests       []string
+		keys           []string
+		writeErrs      []error
+		wantMessages   []string
+		wantDuplicates int64
+	}{
+		{"stores messages with the same key once", "", []string{`{"client_id":1,"text":"a"}`, `{"client_id":1,"text":"b"}`},
+			[]string{"k1", "k1"}, nil, []string{`{"client_id":1,"text":"a"}`}, 1},
+		{"stores messages of other clients", "", []string{`{"client_id":1}`, `{"client_id":2}`}, []string{"k1", "k1"}, nil,
+			[]string{`{"client_id":1}`, `{"client_id":2}`}, 0},
+		{"stores messages with the same id once", "", []string{`{"client_id":1,"id":"m1"}`, `{"client_id":1,"id":"m1"}`},
+			[]string{"", ""}, nil, []string{`{"client_id":1,"id":"m1"}`}, 1},
+		{"stores messages without keys", "", []string{`{"client_id":1}`, `{"client_id":1}`}, []string{"", ""}, nil,
+			[]string{`{"client_id":1}`, `{"client_id":1}`}, 0},
+		{"stores messages again which failed to be stored", "", []string{`{"client_id":1}`, `{"client_id":1}`},
+			[]string{"k1", "k1"}, []error{errors.New("closed pipe")}, []string{`{"client_id":1}`, `{"client_id":1}`}, 0},
+		{"stores the missing lines of batches", ndjsonContentType,
+			[]string{"{\"client_id\":1,\"text\":\"a\"}", "{\"client_id\":1,\"text\":\"a\"}\n{\"client_id\":1,\"text\":\"b\"}"},
+			[]string{"k1", "k1"}, nil, []string{`{"client_id":1,"text":"a"}`, `{"client_id":1,"text":"b"}`}, 1},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			mockPipe := mocks.NewMockGzipWriter(mockCtrl)
+			mockStreamer := mocks.NewMockMessageStreamer(mockCtrl)
+			var written []string
+			mockPipe.EXPECT().Write(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+				written = append(written, string(p))
+				if len(written) <= len(test.writeErrs) {
+					return 0, test.writeErrs[len(written)-1]
+				}
+				return len(p), nil
+			}).AnyTimes()
+			mockStreamer.EXPECT().Stream(gomock.Any()).AnyTimes()
+			pipeNew = func() pipe.GzipWriter {
+				return mockPipe
+			}
+			s3New = func(storage.Object, int, int) storage.MessageStreamer {
+				return mockStreamer
+			}
+			defer func() {
+				s3New = storage.NewS3Streamer
+				pipeNew = pipe.NewGzipWriter
+			}()
+
+			s := &server{
+				dataPipes:   map[string]pipe.GzipWriter{},
+				streamers:   map[string]storage.MessageStreamer{},
+				router:      newRouter(),
+				pipes:       &pipeFactory{},
+				validator:   newValidator(),
+				redactor:    newRedactor(),
+				enricher:    newEnricher(),
+				deadLetters: newDeadLetters(&pipeFactory{}),
+				decoder:     newDecoder(),
+				duplicates:  &duplicates{window: time.Minute, maxKeys: 10, idField: "id", keys: map[string]*list.Element{}, order: list.New()},
+			}
+			before := counter(metricDuplicates)
+			for i, body := range test.requests {
+				var ctx fasthttp.RequestCtx
+				ctx.Request.Header.SetMethod("POST")
+				ctx.Request.Header.SetContentType(test.contentType)
+				ctx.Request.Header.Set(idempotencyKeyHeader, test.keys[i])
+				ctx.Request.SetBodyString(body)
+				s.requestHandler(&ctx)
+				// messages which failed to be stored are responded to with 503 to be sent again
+				wantStatus := fasthttp.StatusOK
+				if i < len(test.writeErrs) {
+					wantStatus = fasthttp.StatusServiceUnavailable
+				}
+				if ctx.Response.StatusCode() != wantStatus {
+					t.Errorf("request %d: unexpected status code: %d. Expecting %d", i, ctx.Response.StatusCode(), wantStatus)
+				}
+			}
+
+			if !reflect.DeepEqual(written, test.wantMessages) {
+				t.Errorf("wrote %q, want %q", written, test.wantMessages)
+			}
+			if counter(metricDuplicates) != before+test.wantDuplicates {
+				t.Errorf("%s = %d, want %d", metricDuplicates, counter(metricDuplicates), before+test.wantDuplicates)
+			}
+		})
+	}
+}
+
+func Test_server_write_inFlight(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockPipe := mocks.NewMockGzipWriter(mockCtrl)
+	mockStreamer := mocks.NewMockMessageStreamer(mockCtrl)
+	writing, fail := make(chan struct{}), make(chan error)
+	// the first write blocks until it fails, the next writes succeed
+	gomock.InOrder(
+		mockPipe.EXPECT().Write(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+			close(writing)
+			return 0, <-fail
+		}),
+		mockPipe.EXPECT().Write(gomock.Any()).Return(1, nil),
+	)
+	mockStreamer.EXPECT().Stream(gomock.Any()).AnyTimes()
+	pipeNew = func() pipe.GzipWriter {
+		return mockPipe
+	}
+	s3New = func(storage.Object, int, int) storage.MessageStreamer {
+		return mockStreamer
+	}
+	defer func() {
+		s3New = storage.NewS3Streamer
+		pipeNew = pipe.NewGzipWriter
+	}()
+	s := &server{
+		dataPipes:   map[string]pipe.GzipWriter{},
+		streamers:   map[string]storage.MessageStreamer{},
+		router:      newRouter(),
+		pipes:       &pipeFactory{},
+		validator:   newValidator(),
+		redactor:    newRedactor(),
+		enricher:    newEnricher(),
+		deadLetters: newDeadLetters(&pipeFactory{}),
+		duplicates:  &duplicates{window: time.Minute, maxKeys: 10, keys: map[string]*list.Element{}, order: list.New()},
+	}
+	body := []byte(`{"client_id":1}`)
+	o := origin{received: time.Now(), idempotencyKey: "k1"}
+
+	first := make(chan error)
+	go func() {
+		_, err := s.write(body, o)
+		first <- err
+	}()
+	<-writing
+	// a retry sent while the first message is written is not acknowledged as a duplicate
+	if _, err := s.write(body, o); err == nil || !strings.Contains(err.Error(), errInFlight.Error()) {
+		t.Errorf("write() of a message in flight = %v, want %v", err, errInFlight)
+	}
+	fail <- errors.New("closed pipe")
+	if err := <-first; err == nil {
+		t.Fatal("expected the first write to fail")
+	}
+
+	// the message is stored by the next retry, and only then are retries duplicates
+	if stored, err := s.write(body, o); err != nil || stored.dataPipe == nil {
+		t.Errorf("write() after the failure = %v, %v", stored, err)
+	}
+	if stored, err := s.write(body, o); err != nil || stored.dataPipe != nil {
+		t.Errorf("write() of a stored message = %v, %v, want a duplicate", stored, err)
+	}
+}
+
+// keyedServer returns a server storing messages once per idempotency key, the messages written are recorded
+func keyedServer(t *testing.T) (*server, func() []string) {
+	mockCtrl := gomock.NewController(t)
+	t.Cleanup(mockCtrl.Finish)
+	mockPipe := mocks.NewMockGzipWriter(mockCtrl)
+	mockStreamer := mocks.NewMockMessageStreamer(mockCtrl)
+	var mutex sync.Mutex
+	var written []string
+	mockPipe.EXPECT().Write(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		written = append(written, string(p))
+		return len(p), nil
+	}).AnyTimes()
+	mockStreamer.EXPECT().Stream(gomock.Any()).AnyTimes()
+	pipeNew = func() pipe.GzipWriter {
+		return mockPipe
+	}
+	s3New = func(storage.Object, int, int) storage.MessageStreamer {
+		return mockStreamer
+	}
+	t.Cleanup(func() {
+		s3New = storage.NewS3Streamer
+		pipeNew = pipe.NewGzipWriter
+	})
+
+	s := &server{
+		dataPipes:   map[string]pipe.GzipWriter{},
+		streamers:   map[string]storage.MessageStreamer{},
+		router:      newRouter(),
+		pipes:       &pipeFactory{},
+		validator:   newValidator(),
+		redactor:    newRedactor(),
+		enricher:    newEnricher(),
+		deadLetters: newDeadLetters(&pipeFactory{}),
+		duplicates:  &duplicates{window: time.Minute, maxKeys: 10, idField: "id", keys: map[string]*list.Element{}, order: list.New()},
+	}
+	return s, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), written...)
+	}
+}
+
+func Test_grpcListener_IngestStream_idempotencyKey(t *testing.T) {
+	s, written := keyedServer(t)
+	g, client := startGRPCListener(t, map[string]string{}, s.ingest, insecure.NewCredentials())
+	defer g.Close()
+
+	// the stream is sent twice with the same key, every message is stored once
+	for i := 0; i < 2; i++ {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "idempotency-key", "k1")
+		stream, err := client.IngestStream(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, message := range []string{`{"client_id":1,"text":"a"}`, `{"client_id":1,"text":"b"}`} {
+			stream.Send(&ingest.IngestRequest{Payload: &ingest.IngestRequest_Json{Json: []byte(message)}})
+		}
+		if response, err := stream.CloseAndRecv(); err != nil || response.Accepted != 2 {
+			t.Fatalf("IngestStream() = %v, %v", response, err)
+		}
+	}
+	if want := []string{`{"client_id":1,"text":"a"}`, `{"client_id":1,"text":"b"}`}; !reflect.DeepEqual(written(), want) {
+		t.Errorf("wrote %q, want %q", written(), want)
+	}
+}
+
+func Test_websocketHandler_idempotencyKey(t *testing.T) {
+	s, written := keyedServer(t)
+	w, ln := startWebSocketHandler(&ingested{})
+	w.ingest = s.ingest
+	defer ln.Close()
+	headers := upgradeHeaders("secret")
+	headers[idempotencyKeyHeader] = "k1"
+
+	// the second connection sends the first frame again
+	for _, frames := range [][]string{
+		{`{"seq":1,"message":{"text":"a"}}`, `{"seq":2,"message":{"text":"b"}}`},
+		{`{"seq":2,"message":{"text":"b"}}`, `{"seq":3,"message":{"text":"c"}}`},
+	} {
+		conn, reader, _ := dialWebSocket(t, ln, defaultWebSocketPath, headers)
+		for _, frame := range frames {
+			writeClientFrame(conn, true, websocket.TextMessage, frame)
+			if _, payload := readServerFrame(t, reader); !strings.Contains(payload, `"status":"ok"`) {
+				t.Errorf("received %s for %s", payload, frame)
+			}
+		}
+		conn.Close()
+	}
+	w.Close()
+
+	want := []string{`{"client_id":"1","text":"a"}`, `{"client_id":"1","text":"b"}`, `{"client_id":"1","text":"c"}`}
+	if !reflect.DeepEqual(written(), want) {
+		t.Errorf("wrote %q, want %q", written(), want)
+	}
+}
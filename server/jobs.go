@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fasthttp-server/storage"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	abortUploadsAfter    = "AWS_ABORT_UPLOADS_AFTER_HOURS"
+	uploadCheckpointDir  = "AWS_UPLOAD_CHECKPOINT_DIR"
+	abortUploadsInterval = time.Hour
+)
+
+var abortStaleUploads = storage.AbortStaleUploads
+
+// job runs in the background every interval until it is closed
+type job struct {
+	name     string
+	interval time.Duration
+	run      func() error
+	done     chan struct{}
+	running  sync.WaitGroup
+}
+
+func newJob(name string, interval time.Duration, run func() error) *job {
+	return &job{name: name, interval: interval, run: run, done: make(chan struct{})}
+}
+
+// newJobs returns the background jobs which are configured
+func newJobs() []*job {
+	var jobs []*job
+	for _, j := range []*job{newReuploader(), newUploadCleaner()} {
+		if j != nil {
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs
+}
+
+func (j *job) start() {
+	fmt.Println("Running ", j.name, " every ", j.interval)
+	j.running.Add(1)
+	go func() {
+		defer j.running.Done()
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-j.done:
+				return
+			case <-ticker.C:
+				if err := j.run(); err != nil {
+					log.Println("Error when running", j.name, err)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops the job, waiting for a running job to end
+func (j *job) Close() {
+	close(j.done)
+	j.running.Wait()
+}
+
+// newUploadCleaner returns a job aborting the multipart uploads to S3 which are older than
+// AWS_ABORT_UPLOADS_AFTER_HOURS, or nil if it is not set. Only the uploads recorded in the checkpoints of
+// AWS_UPLOAD_CHECKPOINT_DIR which are not in flight are aborted
+func newUploadCleaner() *job {
+	after := os.Getenv(abortUploadsAfter)
+	if after == "" {
+		return nil
+	}
+	hours, err := strconv.Atoi(after)
+	if err != nil || hours <= 0 {
+		logFatalf("%s must be a positive number of hours", abortUploadsAfter)
+	}
+	usesS3 := os.Getenv(storageType) == ""
+	for _, name := range strings.Split(os.Getenv(storageType)+","+os.Getenv(failoverStorageType), ",") {
+		usesS3 = usesS3 || strings.TrimSpace(name) == storageS3
+	}
+	if !usesS3 {
+		logFatalf("%s requires an %s backend", abortUploadsAfter, storageS3)
+	}
+	if os.Getenv(uploadCheckpointDir) == "" {
+		logFatalf("%s requires %s as only the uploads with a checkpoint are aborted", abortUploadsAfter, uploadCheckpointDir)
+	}
+	maxAge := time.Duration(hours) * time.Hour
+	return newJob("abort stale uploads", abortUploadsInterval, func() error {
+		return abortStaleUploads(maxAge)
+	})
+}
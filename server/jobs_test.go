@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"fasthttp-server/storage"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_job(t *testing.T) {
+	runs := make(chan struct{}, 10)
+	j := newJob("test", 5*time.Millisecond, func() error {
+		runs <- struct{}{}
+		return errors.New("failed")
+	})
+	j.start()
+	<-runs
+	<-runs
+	j.Close()
+}
+
+func Test_newUploadCleaner(t *testing.T) {
+	tests := []struct {
+		name            string
+		after           string
+		storageType     string
+		failover        string
+		checkpoints     string
+		wantNil         bool
+		wantMaxAge      time.Duration
+		shouldCallFatal bool
+	}{
+		{"disabled", "", "", "", "", true, 0, false},
+		{"defaults to s3", "24", "", "", "checkpoints", false, 24 * time.Hour, false},
+		{"fan out to s3", "48", "azure,s3", "", "checkpoints", false, 48 * time.Hour, false},
+		{"failover to s3", "12", "azure", "s3", "checkpoints", false, 12 * time.Hour, false},
+		{"should call fatal for invalid hours", "1d", "", "", "checkpoints", false, 0, true},
+		{"should call fatal without an s3 backend", "24", "azure", "local", "checkpoints", false, 24 * time.Hour, true},
+		{"should call fatal without checkpoints", "24", "", "", "", false, 24 * time.Hour, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv(abortUploadsAfter, test.after)
+			os.Setenv(storageType, test.storageType)
+			os.Setenv(failoverStorageType, test.failover)
+			os.Setenv(uploadCheckpointDir, test.checkpoints)
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			var maxAge time.Duration
+			abortStaleUploads = func(age time.Duration) error {
+				maxAge = age
+				return nil
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				abortStaleUploads = storage.AbortStaleUploads
+				os.Unsetenv(abortUploadsAfter)
+				os.Unsetenv(storageType)
+				os.Unsetenv(failoverStorageType)
+				os.Unsetenv(uploadCheckpointDir)
+			}()
+
+			got := newUploadCleaner()
+			if (got == nil) != test.wantNil {
+				t.Fatalf("newUploadCleaner() = %v, wantNil %v", got, test.wantNil)
+			}
+			if got != nil {
+				got.run()
+				if got.interval != abortUploadsInterval || maxAge != test.wantMaxAge {
+					t.Errorf("aborts uploads older than %v every %v, want %v", maxAge, got.interval, test.wantMaxAge)
+				}
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
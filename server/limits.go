@@ -0,0 +1,158 @@
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	maxRequestBodySize = "MAX_REQUEST_BODY_SIZE"
+	maxMessageSize     = "MAX_MESSAGE_SIZE"
+	httpReadTimeout    = "HTTP_READ_TIMEOUT"
+	httpWriteTimeout   = "HTTP_WRITE_TIMEOUT"
+	maxConnsPerIP      = "MAX_CONNS_PER_IP"
+
+	defaultMaxMessageSize = 1024 * 1024
+
+	tooManyConnections = "HTTP/1.1 429 Too Many Requests\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"
+)
+
+// httpLimits are the sizes and timeouts of requests to the http server, timeouts are unlimited unless they are set
+type httpLimits struct {
+	maxRequestBodySize int
+	maxMessageSize     int
+	readTimeout        time.Duration
+	writeTimeout       time.Duration
+}
+
+func newHTTPLimits() httpLimits {
+	l := httpLimits{maxRequestBodySize: fasthttp.DefaultMaxRequestBodySize, maxMessageSize: defaultMaxMessageSize}
+	if size := os.Getenv(maxRequestBodySize); size != "" {
+		var err error
+		if l.maxRequestBodySize, err = strconv.Atoi(size); err != nil || l.maxRequestBodySize <= 0 {
+			logFatalf("%s must be a positive number of bytes", maxRequestBodySize)
+		}
+	}
+	if size := os.Getenv(maxMessageSize); size != "" {
+		var err error
+		if l.maxMessageSize, err = strconv.Atoi(size); err != nil || l.maxMessageSize <= 0 {
+			logFatalf("%s must be a positive number of bytes", maxMessageSize)
+		}
+	}
+	if timeout := os.Getenv(httpReadTimeout); timeout != "" {
+		var err error
+		if l.readTimeout, err = time.ParseDuration(timeout); err != nil || l.readTimeout <= 0 {
+			logFatalf("%s must be a positive duration e.g. 30s", httpReadTimeout)
+		}
+	}
+	if timeout := os.Getenv(httpWriteTimeout); timeout != "" {
+		var err error
+		if l.writeTimeout, err = time.ParseDuration(timeout); err != nil || l.writeTimeout <= 0 {
+			logFatalf("%s must be a positive duration e.g. 30s", httpWriteTimeout)
+		}
+	}
+	return l
+}
+
+// handleRequestError responds to requests which could not be read, counting the ones which are too large or
+// too slow. It responds like the default handler of fasthttp apart from 413 for bodies over the limit
+func handleRequestError(ctx *fasthttp.RequestCtx, err error) {
+	if _, ok := err.(*fasthttp.ErrSmallBuffer); ok {
+		ctx.Error("Too big request header", fasthttp.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+	if err == fasthttp.ErrBodyTooLarge {
+		metrics.Add(metricRequestTooLarge, 1)
+		ctx.Error("Request body is too large", fasthttp.StatusRequestEntityTooLarge)
+		return
+	}
+	// errors reading the headers are wrapped as text
+	if e, ok := err.(net.Error); (ok && e.Timeout()) || strings.Contains(err.Error(), "i/o timeout") {
+		metrics.Add(metricRequestTimeout, 1)
+		ctx.Error("Request timeout", fasthttp.StatusRequestTimeout)
+		return
+	}
+	ctx.Error("Error when parsing request", fasthttp.StatusBadRequest)
+}
+
+// connLimitListener responds to connections from addresses with maxConns open connections with 429 Too Many
+// Requests and closes them. The MaxConnsPerIP option of fasthttp does the same but does not report rejections
+type connLimitListener struct {
+	net.Listener
+	maxConns int
+	mutex    sync.Mutex
+	conns    map[string]int
+}
+
+// limitConnsPerIP returns the listener limited to MAX_CONNS_PER_IP connections per address, or the listener
+// itself if it is not set
+func limitConnsPerIP(l net.Listener) net.Listener {
+	value := os.Getenv(maxConnsPerIP)
+	if value == "" {
+		return l
+	}
+	maxConns, err := strconv.Atoi(value)
+	if err != nil || maxConns <= 0 {
+		logFatalf("%s must be a positive number of connections", maxConnsPerIP)
+		return l
+	}
+	return &connLimitListener{Listener: l, maxConns: maxConns, conns: map[string]int{}}
+}
+
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			ip = conn.RemoteAddr().String()
+		}
+		if l.acquire(ip) {
+			return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+		}
+		metrics.Add(metricConnsRejected, 1)
+		go func() {
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			conn.Write([]byte(tooManyConnections))
+			conn.Close()
+		}()
+	}
+}
+
+func (l *connLimitListener) acquire(ip string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.conns[ip] >= l.maxConns {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *connLimitListener) release(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// limitedConn releases its slot once when it is closed, fasthttp may close a connection more than once
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func Test_newHTTPLimits(t *testing.T) {
+	tests := []struct {
+		name            string
+		env             map[string]string
+		want            httpLimits
+		shouldCallFatal bool
+	}{
+		{"defaults", map[string]string{},
+			httpLimits{maxRequestBodySize: fasthttp.DefaultMaxRequestBodySize, maxMessageSize: defaultMaxMessageSize}, false},
+		{"limits", map[string]string{maxRequestBodySize: "2048", maxMessageSize: "1024", httpReadTimeout: "10s", httpWriteTimeout: "1m"},
+			httpLimits{maxRequestBodySize: 2048, maxMessageSize: 1024, readTimeout: 10 * time.Second, writeTimeout: time.Minute}, false},
+		{"should call fatal for invalid body sizes", map[string]string{maxRequestBodySize: "0"},
+			httpLimits{maxMessageSize: defaultMaxMessageSize}, true},
+		{"should call fatal for invalid message sizes", map[string]string{maxMessageSize: "big"},
+			httpLimits{maxRequestBodySize: fasthttp.DefaultMaxRequestBodySize}, true},
+		{"should call fatal for invalid timeouts", map[string]string{httpReadTimeout: "10"},
+			httpLimits{maxRequestBodySize: fasthttp.DefaultMaxRequestBodySize, maxMessageSize: defaultMaxMessageSize}, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				os.Setenv(name, value)
+			}
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				for name := range test.env {
+					os.Unsetenv(name)
+				}
+			}()
+
+			if got := newHTTPLimits(); got != test.want {
+				t.Errorf("newHTTPLimits() = %+v, want %+v", got, test.want)
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func Test_handleRequestError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantMetric string
+	}{
+		{"bodies over the limit", fasthttp.ErrBodyTooLarge, fasthttp.StatusRequestEntityTooLarge, metricRequestTooLarge},
+		{"read timeouts", timeoutError{}, fasthttp.StatusRequestTimeout, metricRequestTimeout},
+		{"read timeouts of the headers", fmt.Errorf("error when reading request headers: %s", timeoutError{}),
+			fasthttp.StatusRequestTimeout, metricRequestTimeout},
+		{"invalid requests", errors.New("cannot find http request method"), fasthttp.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			before := counter(test.wantMetric)
+			var ctx fasthttp.RequestCtx
+			handleRequestError(&ctx, test.err)
+			if ctx.Response.StatusCode() != test.wantStatus {
+				t.Errorf("unexpected status code: %d. Expecting %d", ctx.Response.StatusCode(), test.wantStatus)
+			}
+			if test.wantMetric != "" && counter(test.wantMetric) != before+1 {
+				t.Errorf("%s = %d, want %d", test.wantMetric, counter(test.wantMetric), before+1)
+			}
+		})
+	}
+}
+
+func Test_limitConnsPerIP(t *testing.T) {
+	tests := []struct {
+		name            string
+		maxConns        string
+		wantLimited     bool
+		shouldCallFatal bool
+	}{
+		{"unlimited", "", false, false},
+		{"limited", "2", true, false},
+		{"should call fatal for invalid limits", "-1", false, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv(maxConnsPerIP, test.maxConns)
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				os.Unsetenv(maxConnsPerIP)
+			}()
+
+			ln := fasthttputil.NewInmemoryListener()
+			defer ln.Close()
+			_, limited := limitConnsPerIP(ln).(*connLimitListener)
+			if limited != test.wantLimited {
+				t.Errorf("limited = %v, want %v", limited, test.wantLimited)
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+func Test_connLimitListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(maxConnsPerIP, "1")
+	limited := limitConnsPerIP(ln)
+	os.Unsetenv(maxConnsPerIP)
+	defer limited.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := limited.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	before := counter(metricConnsRejected)
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	conn := <-accepted
+
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	var resp fasthttp.Response
+	if err := resp.Read(bufio.NewReader(second)); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != fasthttp.StatusTooManyRequests {
+		t.Errorf("unexpected status code: %d. Expecting %d", resp.StatusCode(), fasthttp.StatusTooManyRequests)
+	}
+	if counter(metricConnsRejected) != before+1 {
+		t.Errorf("%s = %d, want %d", metricConnsRejected, counter(metricConnsRejected), before+1)
+	}
+
+	// closing a connection more than once releases its slot once
+	conn.Close()
+	conn.Close()
+	third, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not accepted once a slot was released")
+	}
+}
+
+func Test_server_requestHandler_tooLarge(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantBody    string
+		wantRejects []string
+	}{
+		{"messages", "application/json", `{"client_id":1,"text":"hello"}`, "message is larger than 16 bytes",
+			[]string{"message is larger than 16 bytes"}},
+		{"lines of a batch", ndjsonContentType, "{\"client_id\":1}\n{\"client_id\":1,\"text\":\"hello\"}",
+			"line 2 is larger than 16 bytes", []string{"line 2 is larger than 16 bytes"}},
+		{"every line over the size is a dead letter", ndjsonContentType,
+			"{\"client_id\":1,\"text\":\"hi\"}\n{\"client_id\":1}\n{\"client_id\":1,\"text\":\"hello\"}",
+			"line 1 is larger than 16 bytes", []string{"line 1 is larger than 16 bytes", "line 3 is larger than 16 bytes"}},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			before := counter(metricMessageTooLarge)
+			deadLetters, rejected := capturedDeadLetters(t)
+			s := &server{decoder: newDecoder(), maxMessageSize: 16, redactor: newRedactor(), deadLetters: deadLetters}
+			var ctx fasthttp.RequestCtx
+			ctx.Request.Header.SetMethod("POST")
+			ctx.Request.Header.SetContentType(test.contentType)
+			ctx.Request.SetBodyString(test.body)
+			s.requestHandler(&ctx)
+
+			if ctx.Response.StatusCode() != fasthttp.StatusRequestEntityTooLarge || string(ctx.Response.Body()) != test.wantBody {
+				t.Errorf("response %d %s, want %d %s", ctx.Response.StatusCode(), ctx.Response.Body(),
+					fasthttp.StatusRequestEntityTooLarge, test.wantBody)
+			}
+			want := before + int64(len(test.wantRejects))
+			if counter(metricMessageTooLarge) != want {
+				t.Errorf("%s = %d, want %d", metricMessageTooLarge, counter(metricMessageTooLarge), want)
+			}
+			if got := rejected(); !reflect.DeepEqual(got, test.wantRejects) {
+				t.Errorf("dead letters %q, want %q", got, test.wantRejects)
+			}
+		})
+	}
+}
+
+func Test_server_Start_bodyTooLarge(t *testing.T) {
+	ln := fasthttputil.NewInmemoryListener()
+	s := &server{listener: ln, decoder: newDecoder(), httpServer: fasthttp.Server{MaxRequestBodySize: 8}}
+	serverCh := make(chan struct{})
+	go func() {
+		s.Start()
+		close(serverCh)
+	}()
+
+	before := counter(metricRequestTooLarge)
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"client_id":1}`
+	if _, err = c.Write([]byte(fmt.Sprintf("POST / HTTP/1.1\r\nContent-Length: %d\r\n\r\n%s", len(body), body))); err != nil {
+		t.Fatal(err)
+	}
+	var resp fasthttp.Response
+	if err := resp.Read(bufio.NewReader(c)); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != fasthttp.StatusRequestEntityTooLarge {
+		t.Errorf("unexpected status code: %d. Expecting %d", resp.StatusCode(), fasthttp.StatusRequestEntityTooLarge)
+	}
+	if counter(metricRequestTooLarge) != before+1 {
+		t.Errorf("%s = %d, want %d", metricRequestTooLarge, counter(metricRequestTooLarge), before+1)
+	}
+	c.Close()
+	ln.Close()
+	<-serverCh
+}
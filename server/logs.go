@@ -0,0 +1,302 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"fasthttp-server/pipe"
+	"fasthttp-server/storage"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	readAPITokens = "READ_API_TOKENS"
+
+	logsPathPrefix = "/v1/clients/"
+	logsPathSuffix = "/logs"
+	logsDateLayout = "2006-01-02"
+	maxLogsDays    = 31
+)
+
+var (
+	s3StoreNew    = storage.NewS3Store
+	azureStoreNew = storage.NewAzureStore
+	localStoreNew = storage.NewLocalStore
+)
+
+// logsHandler streams the stored messages of a client back as NDJSON at /v1/clients/{id}/logs, so support teams
+// holding a READ_API_TOKENS token can read them without access to the storage backend
+type logsHandler struct {
+	tokens     []string
+	store      storage.ObjectStore
+	keyWrapper pipe.KeyWrapper
+	router     *router
+	// envelope is true if messages are stored in an envelope, see ENRICH_MODE
+	envelope bool
+}
+
+// logsQuery selects the messages of the days from and to, matching every filter, up to limit messages
+type logsQuery struct {
+	from, to time.Time
+	filters  []logsFilter
+	limit    int
+}
+
+// logsFilter matches messages with the value at a dot separated path
+type logsFilter struct {
+	path, value string
+}
+
+// newLogsHandler returns nil if READ_API_TOKENS is not set. Messages are read from the first STORAGE_TYPE backend
+func newLogsHandler(keyWrapper pipe.KeyWrapper, r *router) *logsHandler {
+	tokens := os.Getenv(readAPITokens)
+	if tokens == "" {
+		return nil
+	}
+	l := &logsHandler{keyWrapper: keyWrapper, router: r, envelope: os.Getenv(enrichMode) == envelopeMode}
+	for _, token := range strings.Split(tokens, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			l.tokens = append(l.tokens, token)
+		}
+	}
+	if l.store = newObjectStore(); l.store == nil {
+		logFatalf("%s requires %s to be %s, %s or %s", readAPITokens, storageType, storageS3, storageAzure, storageLocal)
+	}
+	return l
+}
+
+// newObjectStore returns the store of the first STORAGE_TYPE backend, or nil if its objects cannot be listed
+func newObjectStore() storage.ObjectStore {
+	switch backend := strings.TrimSpace(strings.Split(os.Getenv(storageType), ",")[0]); backend {
+	case "", storageS3:
+		return s3StoreNew()
+	case storageAzure:
+		return azureStoreNew()
+	case storageLocal:
+		return localStoreNew()
+	}
+	return nil
+}
+
+// serve streams the messages of the client in the path, it returns false for other requests
+func (l *logsHandler) serve(ctx *fasthttp.RequestCtx) bool {
+	path := string(ctx.Path())
+	if l == nil || !strings.HasPrefix(path, logsPathPrefix) || !strings.HasSuffix(path, logsPathSuffix) ||
+		len(path) <= len(logsPathPrefix)+len(logsPathSuffix) {
+		return false
+	}
+	clientID := path[len(logsPathPrefix) : len(path)-len(logsPathSuffix)]
+	if strings.Contains(clientID, "/") {
+		return false
+	}
+	if !ctx.IsGet() {
+		ctx.Error("expected a GET request", fasthttp.StatusMethodNotAllowed)
+		return true
+	}
+	if !l.authenticate(ctx) {
+		ctx.Error("invalid token", fasthttp.StatusUnauthorized)
+		return true
+	}
+	query, err := newLogsQuery(ctx.QueryArgs())
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return true
+	}
+	objects, err := l.list(clientID, query)
+	if err != nil {
+		log.Println("Error when listing objects of client", clientID, err)
+		ctx.Error("cannot list objects: "+err.Error(), fasthttp.StatusBadGateway)
+		return true
+	}
+
+	ctx.SetContentType(ndjsonContentType)
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		l.stream(w, clientID, objects, query)
+	})
+	return true
+}
+
+func (l *logsHandler) authenticate(ctx *fasthttp.RequestCtx) bool {
+	auth := string(ctx.Request.Header.Peek("Authorization"))
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	found := false
+	for _, t := range l.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+// newLogsQuery parses the from and to dates, which default to today, the filters and the limit of a request
+func newLogsQuery(args *fasthttp.Args) (logsQuery, error) {
+	today := time.Now().Format(logsDateLayout)
+	var q logsQuery
+	var err error
+	from, to := string(args.Peek("from")), string(args.Peek("to"))
+	if to == "" {
+		to = today
+	}
+	if from == "" {
+		from = to
+	}
+	if q.from, err = time.ParseInLocation(logsDateLayout, from, time.Local); err != nil {
+		return q, fmt.Errorf("from must be a date e.g. %s", today)
+	}
+	if q.to, err = time.ParseInLocation(logsDateLayout, to, time.Local); err != nil {
+		return q, fmt.Errorf("to must be a date e.g. %s", today)
+	}
+	if q.to.Before(q.from) || q.to.After(q.from.AddDate(0, 0, maxLogsDays-1)) {
+		return q, fmt.Errorf("to must be within %d days after from", maxLogsDays)
+	}
+	if limit := string(args.Peek("limit")); limit != "" {
+		if q.limit, err = strconv.Atoi(limit); err != nil || q.limit <= 0 {
+			return q, fmt.Errorf("limit must be a positive number of messages")
+		}
+	}
+	for _, filter := range args.PeekMulti("filter") {
+		parts := strings.SplitN(string(filter), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return q, fmt.Errorf("filter must be a path and a value e.g. meta.type=chat")
+		}
+		q.filters = append(q.filters, logsFilter{path: parts[0], value: parts[1]})
+	}
+	return q, nil
+}
+
+// list returns the objects of the client stored on the days of the query, by day and then by last modification.
+// Objects last modified before the first day cannot hold its messages and are skipped
+func (l *logsHandler) list(clientID string, q logsQuery) ([]storage.StoredObject, error) {
+	var objects []storage.StoredObject
+	listed := map[string]bool{}
+	for day := q.from; !day.After(q.to); day = day.AddDate(0, 0, 1) {
+		dayObjects, err := l.store.List(storage.Object{ClientID: clientID, Partition: l.router.partition(clientID), Created: day})
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(dayObjects, func(i, j int) bool {
+			return dayObjects[i].Modified.Before(dayObjects[j].Modified)
+		})
+		for _, object := range dayObjects {
+			id := object.Container + "/" + object.Key
+			if listed[id] || (!object.Modified.IsZero() && object.Modified.Before(q.from)) {
+				continue
+			}
+			listed[id] = true
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
+
+// stream writes the messages of the client in the objects which match the query, objects which cannot be read are
+// skipped. Objects may be shared with other clients if messages are routed by another field
+func (l *logsHandler) stream(w *bufio.Writer, clientID string, objects []storage.StoredObject, q logsQuery) {
+	clientIDPath := defaultRouteBy
+	if l.envelope {
+		clientIDPath = envelopeMessageField + "." + defaultRouteBy
+	}
+	written := 0
+	for _, object := range objects {
+		// objects of other clients sharing the prefix are skipped before they are read if they were listed with metadata
+		if id := storage.ClientIDOf(object.Metadata); id != "" && id != clientID {
+			continue
+		}
+		err := l.read(object, clientID, func(line []byte) bool {
+			if !q.matches(line, clientID, clientIDPath) {
+				return true
+			}
+			if _, err := w.Write(append(line, '\n')); err != nil {
+				return false
+			}
+			written++
+			return q.limit == 0 || written < q.limit
+		})
+		if err != nil {
+			log.Println("Error when reading", object.Key, err)
+		}
+		if q.limit > 0 && written >= q.limit {
+			return
+		}
+		if err = w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// read passes every line of the object of the client to fn, decrypting and decompressing it, until fn returns false
+func (l *logsHandler) read(object storage.StoredObject, clientID string, fn func(line []byte) bool) error {
+	content, metadata, err := l.store.Open(object)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	if id := storage.ClientIDOf(metadata); id != "" && id != clientID {
+		return nil
+	}
+
+	var reader io.Reader = content
+	if wrappedKey := metadata[pipe.MetadataKey]; wrappedKey != "" {
+		if l.keyWrapper == nil {
+			return fmt.Errorf("the object is encrypted but %s is not set", encryptionKeyFile)
+		}
+		if reader, err = pipe.NewDecryptReader(reader, l.keyWrapper, wrappedKey); err != nil {
+			return err
+		}
+	}
+	// backends may have decompressed the object already as it is stored with the gzip content encoding
+	buffered := bufio.NewReader(reader)
+	if magic, _ := buffered.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		if reader, err = gzip.NewReader(buffered); err != nil {
+			return err
+		}
+		buffered = bufio.NewReader(reader)
+	}
+
+	for {
+		line, err := buffered.ReadBytes('\n')
+		if line = bytes.TrimRight(line, "\r\n"); len(line) > 0 && !fn(line) {
+			return nil
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// matches returns true for messages of the client, its id is at clientIDPath, received on the days of the query with
+// every value of the filters. Only messages enriched with received_at can be filtered by day, other messages match if
+// their object was created on one of the days
+func (q logsQuery) matches(line []byte, clientID, clientIDPath string) bool {
+	if id, _ := storage.MessageField(line, clientIDPath); id != clientID {
+		return false
+	}
+	if value, ok := storage.MessageField(line, fieldReceivedAt); ok {
+		received, err := time.Parse(time.RFC3339Nano, value)
+		if err == nil && (received.Before(q.from) || !received.Before(q.to.AddDate(0, 0, 1))) {
+			return false
+		}
+	}
+	for _, filter := range q.filters {
+		if value, _ := storage.MessageField(line, filter.path); value != filter.value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fasthttp-server/pipe"
+	"fasthttp-server/storage"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// fakeStore lists the objects of each day and opens their contents
+type fakeStore struct {
+	objects  map[string][]storage.StoredObject
+	contents map[string][]byte
+	metadata map[string]map[string]string
+	listErr  error
+	listed   []storage.Object
+}
+
+func (f *fakeStore) List(object storage.Object) ([]storage.StoredObject, error) {
+	f.listed = append(f.listed, object)
+	return f.objects[object.Created.Format(logsDateLayout)], f.listErr
+}
+
+func (f *fakeStore) Open(object storage.StoredObject) (io.ReadCloser, map[string]string, error) {
+	content, ok := f.contents[object.Key]
+	if !ok {
+		return nil, nil, errors.New("not found")
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), f.metadata[object.Key], nil
+}
+
+// streamed returns the content a backend would store for the messages, each message is a gzip member
+func streamed(t *testing.T, w pipe.GzipWriter, messages ...string) []byte {
+	read := make(chan []byte)
+	go func() {
+		content, _ := ioutil.ReadAll(w)
+		read <- content
+	}()
+	for _, message := range messages {
+		w.Write([]byte(message))
+		if err := w.(interface{ Flush() error }).Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	return <-read
+}
+
+func Test_newLogsHandler(t *testing.T) {
+	tests := []struct {
+		name            string
+		env             map[string]string
+		wantStore       string
+		shouldCallFatal bool
+	}{
+		{"disabled", map[string]string{}, "", false},
+		{"s3 by default", map[string]string{readAPITokens: "t1, t2"}, storageS3, false},
+		{"first backend", map[string]string{readAPITokens: "t1", storageType: "azure,s3"}, storageAzure, false},
+		{"local", map[string]string{readAPITokens: "t1", storageType: "local"}, storageLocal, false},
+		{"should call fatal for backends which cannot be read", map[string]string{readAPITokens: "t1", storageType: "kafka"}, "", true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				os.Setenv(name, value)
+			}
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			stores := map[storage.ObjectStore]string{}
+			newStore := func(name string) func() storage.ObjectStore {
+				return func() storage.ObjectStore {
+					store := &fakeStore{}
+					stores[store] = name
+					return store
+				}
+			}
+			s3StoreNew, azureStoreNew, localStoreNew = newStore(storageS3), newStore(storageAzure), newStore(storageLocal)
+			defer func() {
+				logFatalf = log.Fatalf
+				s3StoreNew, azureStoreNew, localStoreNew = storage.NewS3Store, storage.NewAzureStore, storage.NewLocalStore
+				for name := range test.env {
+					os.Unsetenv(name)
+				}
+			}()
+
+			got := newLogsHandler(nil, newRouter())
+			if (got == nil) != (len(test.env) == 0) {
+				t.Fatalf("newLogsHandler() = %v", got)
+			}
+			if got != nil && stores[got.store] != test.wantStore {
+				t.Errorf("store = %q, want %q", stores[got.store], test.wantStore)
+			}
+			if got != nil && !test.shouldCallFatal && !reflect.DeepEqual(got.tokens, []string{"t1", "t2"}[:len(got.tokens)]) {
+				t.Errorf("tokens = %q", got.tokens)
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+func Test_newLogsQuery(t *testing.T) {
+	day := func(date string) time.Time {
+		d, _ := time.ParseInLocation(logsDateLayout, date, time.Local)
+		return d
+	}
+	today := day(time.Now().Format(logsDateLayout))
+	tests := []struct {
+		name    string
+		query   string
+		want    logsQuery
+		wantErr bool
+	}{
+		{"today", "", logsQuery{from: today, to: today}, false},
+		{"day", "to=2026-10-18", logsQuery{from: day("2026-10-18"), to: day("2026-10-18")}, false},
+		{"range, filters and limit", "from=2026-10-01&to=2026-10-31&filter=meta.type%3Dchat&filter=text%3D&limit=10",
+			logsQuery{from: day("2026-10-01"), to: day("2026-10-31"), limit: 10,
+				filters: []logsFilter{{"meta.type", "chat"}, {"text", ""}}}, false},
+		{"invalid dates", "from=18-10-2026", logsQuery{}, true},
+		{"ranges ending before they start", "from=2026-10-18&to=2026-10-17", logsQuery{}, true},
+		{"ranges over the maximum", "from=2026-10-01&to=2026-11-01", logsQuery{}, true},
+		{"invalid limits", "limit=0", logsQuery{}, true},
+		{"invalid filters", "filter=meta.type", logsQuery{}, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			var args fasthttp.Args
+			args.Parse(test.query)
+			got, err := newLogsQuery(&args)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("newLogsQuery() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("newLogsQuery() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func Test_logsHandler_serve(t *testing.T) {
+	file, err := ioutil.TempFile("", "master.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(bytes.Repeat([]byte{1}, 32))
+	file.Close()
+	defer os.Remove(file.Name())
+	keyWrapper, err := pipe.NewLocalKeyWrapper(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, encryptedMetadata, err := pipe.NewEncryptedGzipWriter(keyWrapper)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modified := time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local)
+	store := &fakeStore{
+		objects: map[string][]storage.StoredObject{
+			"2026-10-17": {{Key: "old", Modified: modified.AddDate(0, 0, -2)}},
+			"2026-10-18": {
+				{Key: "later", Modified: modified.Add(time.Hour)},
+				{Key: "first", Modified: modified},
+				{Key: "other", Metadata: map[string]string{storage.MetadataClientID: "43"}},
+			},
+			"2026-10-19": {{Key: "encrypted", Modified: modified.AddDate(0, 0, 1)}, {Key: "missing"}},
+		},
+		contents: map[string][]byte{
+			"old": streamed(t, pipe.NewGzipWriter(), `{"client_id":42,"text":"old"}`),
+			"first": streamed(t, pipe.NewGzipWriter(), `{"client_id":42,"text":"a","meta":{"type":"chat"}}`,
+				`{"client_id":43,"text":"routed"}`, `{"client_id":42,"text":"b"}`),
+			"later":     []byte("{\"client_id\":\"42\",\"text\":\"c\"}\r\n\n"),
+			"other":     streamed(t, pipe.NewGzipWriter(), `{"client_id":42,"text":"other"}`),
+			"encrypted": streamed(t, encrypted, `{"client_id":42,"text":"d"}`),
+		},
+		metadata: map[string]map[string]string{"encrypted": encryptedMetadata},
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		listErr    error
+		keyWrapper pipe.KeyWrapper
+		wantServed bool
+		wantStatus int
+		wantBody   string
+	}{
+		{"other paths", "GET", "/v1/clients/42", "t1", nil, keyWrapper, false, fasthttp.StatusOK, ""},
+		{"nested paths", "GET", "/v1/clients/42/x/logs", "t1", nil, keyWrapper, false, fasthttp.StatusOK, ""},
+		{"other methods", "POST", "/v1/clients/42/logs", "t1", nil, keyWrapper, true, fasthttp.StatusMethodNotAllowed, ""},
+		{"invalid tokens", "GET", "/v1/clients/42/logs", "t3", nil, keyWrapper, true, fasthttp.StatusUnauthorized, ""},
+		{"invalid queries", "GET", "/v1/clients/42/logs?limit=-1", "t1", nil, keyWrapper, true, fasthttp.StatusBadRequest, ""},
+		{"list errors", "GET", "/v1/clients/42/logs?from=2026-10-18&to=2026-10-18", "t1", errors.New("denied"), keyWrapper, true,
+			fasthttp.StatusBadGateway, ""},
+		{"messages of the client", "GET", "/v1/clients/42/logs?from=2026-10-18&to=2026-10-19", "t2", nil, keyWrapper, true,
+			fasthttp.StatusOK, "{\"client_id\":42,\"text\":\"a\",\"meta\":{\"type\":\"chat\"}}\n{\"client_id\":42,\"text\":\"b\"}\n" +
+				"{\"client_id\":\"42\",\"text\":\"c\"}\n{\"client_id\":42,\"text\":\"d\"}\n"},
+		{"skips objects which cannot be decrypted", "GET", "/v1/clients/42/logs?from=2026-10-19&to=2026-10-19", "t1", nil, nil, true,
+			fasthttp.StatusOK, ""},
+		{"filters", "GET", "/v1/clients/42/logs?from=2026-10-18&to=2026-10-18&filter=meta.type%3Dchat", "t1", nil, keyWrapper, true,
+			fasthttp.StatusOK, "{\"client_id\":42,\"text\":\"a\",\"meta\":{\"type\":\"chat\"}}\n"},
+		{"limit", "GET", "/v1/clients/42/logs?from=2026-10-18&to=2026-10-19&limit=2", "t1", nil, keyWrapper, true,
+			fasthttp.StatusOK, "{\"client_id\":42,\"text\":\"a\",\"meta\":{\"type\":\"chat\"}}\n{\"client_id\":42,\"text\":\"b\"}\n"},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			store.listErr = test.listErr
+			l := &logsHandler{tokens: []string{"t1", "t2"}, store: store, keyWrapper: test.keyWrapper, router: newRouter()}
+			var ctx fasthttp.RequestCtx
+			ctx.Request.Header.SetMethod(test.method)
+			ctx.Request.SetRequestURI(test.path)
+			ctx.Request.Header.Set("Authorization", "Bearer "+test.token)
+
+			if served := l.serve(&ctx); served != test.wantServed {
+				t.Fatalf("serve() = %v, want %v", served, test.wantServed)
+			}
+			if ctx.Response.StatusCode() != test.wantStatus {
+				t.Errorf("unexpected status code: %d. Expecting %d", ctx.Response.StatusCode(), test.wantStatus)
+			}
+			if test.wantStatus == fasthttp.StatusOK && string(ctx.Response.Body()) != test.wantBody {
+				t.Errorf("body = %q, want %q", ctx.Response.Body(), test.wantBody)
+			}
+		})
+	}
+
+	store.listed = nil
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/v1/clients/42/logs?from=2026-10-18&to=2026-10-18")
+	ctx.Request.Header.Set("Authorization", "Bearer t1")
+	(&logsHandler{tokens: []string{"t1"}, store: store, router: &router{paths: []string{"tenant"}}}).serve(&ctx)
+	if len(store.listed) != 1 || store.listed[0].ClientID != "42" || store.listed[0].Partition != "" {
+		t.Errorf("listed %+v, want the objects of client 42 in any partition", store.listed)
+	}
+}
+
+func Test_logsHandler_serve_envelope(t *testing.T) {
+	day := time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local)
+	received := func(at time.Time) string {
+		return at.UTC().Format(time.RFC3339Nano)
+	}
+	store := &fakeStore{
+		objects: map[string][]storage.StoredObject{"2026-10-18": {{Key: "envelopes"}}},
+		contents: map[string][]byte{"envelopes": streamed(t, pipe.NewGzipWriter(),
+			`{"received_at":"`+received(day.Add(-time.Minute))+`","message":{"client_id":42,"text":"day before"}}`,
+			`{"received_at":"`+received(day.Add(time.Hour))+`","message":{"client_id":42,"text":"a"}}`,
+			`{"received_at":"`+received(day.Add(2*time.Hour))+`","message":{"client_id":43,"text":"routed"}}`,
+			`{"received_at":"`+received(day.Add(3*time.Hour))+`","client_id":42,"message":{"text":"envelope field"}}`,
+			`{"message":{"client_id":42,"text":"not enriched"}}`,
+			`{"received_at":"`+received(day.AddDate(0, 0, 1))+`","message":{"client_id":42,"text":"day after"}}`)},
+	}
+	l := &logsHandler{tokens: []string{"t1"}, store: store, router: newRouter(), envelope: true}
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/v1/clients/42/logs?from=2026-10-18&to=2026-10-18&filter=message.text%3Da")
+	ctx.Request.Header.Set("Authorization", "Bearer t1")
+	l.serve(&ctx)
+	want := `{"received_at":"` + received(day.Add(time.Hour)) + `","message":{"client_id":42,"text":"a"}}` + "\n"
+	if string(ctx.Response.Body()) != want {
+		t.Errorf("body = %q, want %q", ctx.Response.Body(), want)
+	}
+
+	ctx.Request.SetRequestURI("/v1/clients/42/logs?from=2026-10-18&to=2026-10-18")
+	l.serve(&ctx)
+	if got := bytes.Count(ctx.Response.Body(), []byte("\n")); got != 2 {
+		t.Errorf("body = %q, want the messages of the day and the message without received_at", ctx.Response.Body())
+	}
+}
+
+func Test_logsHandler_serve_disabled(t *testing.T) {
+	var l *logsHandler
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/v1/clients/42/logs")
+	if l.serve(&ctx) {
+		t.Error("requests should not be served when the read API is disabled")
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"expvar"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/expvarhandler"
+)
+
+const (
+	metricsPath = "/debug/vars"
+
+	metricInvalidJSON     = "messages_invalid_json"
+	metricInvalidSchema   = "messages_invalid_schema"
+	metricMessageTooLarge = "messages_too_large"
+	metricDuplicates      = "messages_duplicate"
+	metricRequestTooLarge = "requests_too_large"
+	metricRequestTimeout  = "requests_timed_out"
+	metricConnsRejected   = "connections_rejected"
+	metricAckTimeout      = "acks_timed_out"
+	metricUploadsOK       = "uploads_succeeded_"
+	metricUploadsFailed   = "uploads_failed_"
+)
+
+// metrics are counters published with expvar and served as JSON at /debug/vars
+var metrics = expvar.NewMap("fasthttp_server")
+
+func serveMetrics(ctx *fasthttp.RequestCtx) bool {
+	if !ctx.IsGet() || string(ctx.Path()) != metricsPath {
+		return false
+	}
+	expvarhandler.ExpvarHandler(ctx)
+	return true
+}
+
+// reportUpload counts the uploads to a backend by their result
+func reportUpload(backend string, err error) {
+	if err != nil {
+		metrics.Add(metricUploadsFailed+backend, 1)
+		return
+	}
+	metrics.Add(metricUploadsOK+backend, 1)
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"errors"
+	"expvar"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func counter(name string) int64 {
+	if v, ok := metrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func Test_serveMetrics(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   bool
+	}{
+		{"serves metrics", "GET", metricsPath, true},
+		{"ignores posts", "POST", metricsPath, false},
+		{"ignores other paths", "GET", "/", false},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			metrics.Add(metricInvalidJSON, 0)
+
+			var ctx fasthttp.RequestCtx
+			ctx.Request.Header.SetMethod(test.method)
+			ctx.Request.SetRequestURI(test.path)
+
+			if got := serveMetrics(&ctx); got != test.want {
+				t.Errorf("serveMetrics() = %v, want %v", got, test.want)
+			}
+			if test.want && !strings.Contains(string(ctx.Response.Body()), metricInvalidJSON) {
+				t.Errorf("metrics do not contain %s: %s", metricInvalidJSON, ctx.Response.Body())
+			}
+		})
+	}
+}
+
+func Test_reportUpload(t *testing.T) {
+	ok, failed := counter(metricUploadsOK+"s3"), counter(metricUploadsFailed+"s3")
+	reportUpload("s3", nil)
+	reportUpload("s3", errors.New("denied"))
+	reportUpload("s3", nil)
+	if got := counter(metricUploadsOK+"s3") - ok; got != 2 {
+		t.Errorf("succeeded uploads = %d, want 2", got)
+	}
+	if got := counter(metricUploadsFailed+"s3") - failed; got != 1 {
+		t.Errorf("failed uploads = %d, want 1", got)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fasthttp-server/pipe"
+	"fasthttp-server/storage"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	gzipFlushInterval = "GZIP_FLUSH_INTERVAL"
+	gzipFlushSize     = "GZIP_FLUSH_SIZE"
+)
+
+var pipeAutoFlush = pipe.AutoFlush
+
+// pipeFactory creates the pipes objects are streamed from, encrypting them and ending their gzip members as configured
+type pipeFactory struct {
+	keyWrapper    pipe.KeyWrapper
+	flushInterval time.Duration
+	flushSize     int
+}
+
+func newPipeFactory() *pipeFactory {
+	f := &pipeFactory{keyWrapper: newKeyWrapper()}
+	if interval := os.Getenv(gzipFlushInterval); interval != "" {
+		var err error
+		if f.flushInterval, err = time.ParseDuration(interval); err != nil || f.flushInterval <= 0 {
+			logFatalf("%s must be a positive duration e.g. 30s", gzipFlushInterval)
+		}
+	}
+	if size := os.Getenv(gzipFlushSize); size != "" {
+		var err error
+		if f.flushSize, err = strconv.Atoi(size); err != nil || f.flushSize <= 0 {
+			logFatalf("%s must be a positive number of bytes", gzipFlushSize)
+		}
+	}
+	return f
+}
+
+// newPipe returns a new pipe for the object, if a KeyWrapper is set the pipe is encrypted and the
+// wrapped data key is added to the object's metadata
+func (f *pipeFactory) newPipe(object *storage.Object) (pipe.GzipWriter, error) {
+	dataPipe := pipeNew()
+	if f.keyWrapper != nil {
+		var metadata map[string]string
+		var err error
+		if dataPipe, metadata, err = encryptedPipeNew(f.keyWrapper); err != nil {
+			return nil, err
+		}
+		object.Extension = pipe.EncryptedExtension
+		if object.Metadata == nil {
+			object.Metadata = map[string]string{}
+		}
+		for key, value := range metadata {
+			object.Metadata[key] = value
+		}
+	}
+
+	if f.flushInterval > 0 || f.flushSize > 0 {
+		pipeAutoFlush(dataPipe, f.flushInterval, f.flushSize)
+	}
+	return dataPipe, nil
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"fasthttp-server/pipe"
+	"fasthttp-server/storage"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_newPipeFactory(t *testing.T) {
+	tests := []struct {
+		name            string
+		interval        string
+		size            string
+		wantInterval    time.Duration
+		wantSize        int
+		shouldCallFatal bool
+	}{
+		{"disabled by default", "", "", 0, 0, false},
+		{"interval and size", "30s", "1048576", 30 * time.Second, 1048576, false},
+		{"should call fatal for invalid intervals", "often", "", 0, 0, true},
+		{"should call fatal for invalid sizes", "", "-1", 0, -1, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv(gzipFlushInterval, test.interval)
+			os.Setenv(gzipFlushSize, test.size)
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				os.Unsetenv(gzipFlushInterval)
+				os.Unsetenv(gzipFlushSize)
+			}()
+
+			f := newPipeFactory()
+			if f.flushInterval != test.wantInterval || f.flushSize != test.wantSize {
+				t.Errorf("newPipeFactory() = %v %v, want %v %v", f.flushInterval, f.flushSize, test.wantInterval, test.wantSize)
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+func Test_pipeFactory_newPipe(t *testing.T) {
+	file, err := ioutil.TempFile("", "master.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(bytes.Repeat([]byte{1}, 32))
+	file.Close()
+	defer os.Remove(file.Name())
+	k, err := pipe.NewLocalKeyWrapper(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	object := storage.Object{Metadata: map[string]string{"client": "42"}}
+	if _, err := (&pipeFactory{}).newPipe(&object); err != nil || object.Extension != "" || len(object.Metadata) != 1 {
+		t.Errorf("newPipe() without a key changed the object %v, %v", object, err)
+	}
+
+	if _, err = (&pipeFactory{keyWrapper: k}).newPipe(&object); err != nil {
+		t.Fatal(err)
+	}
+	if object.Extension != pipe.EncryptedExtension {
+		t.Errorf("Extension = %v, want %v", object.Extension, pipe.EncryptedExtension)
+	}
+	if object.Metadata["client"] != "42" || object.Metadata[pipe.MetadataKeyID] != k.KeyID() || object.Metadata[pipe.MetadataKey] == "" {
+		t.Errorf("unexpected metadata %v", object.Metadata)
+	}
+}
+
+func Test_pipeFactory_autoFlush(t *testing.T) {
+	var interval time.Duration
+	var size int
+	pipeAutoFlush = func(w pipe.GzipWriter, i time.Duration, s int) {
+		interval, size = i, s
+	}
+	defer func() {
+		pipeAutoFlush = pipe.AutoFlush
+	}()
+
+	object := storage.Object{}
+	if _, err := (&pipeFactory{flushInterval: time.Second, flushSize: 10}).newPipe(&object); err != nil {
+		t.Fatal(err)
+	}
+	if interval != time.Second || size != 10 {
+		t.Errorf("AutoFlush() called with %v %v", interval, size)
+	}
+}
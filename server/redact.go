@@ -0,0 +1,273 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	// the redactor works on generic maps which the pinned json-iterator cannot iterate reliably
+	stdjson "encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	redactionConfig  = "REDACTION_CONFIG"
+	redactionHMACKey = "REDACTION_HMAC_KEY"
+
+	actionDrop = "drop"
+	actionHash = "hash"
+	actionMask = "mask"
+
+	maskCharacter = "*"
+	pathWildcard  = "*"
+)
+
+// detectors are the built in patterns which can be detected in free text fields
+var detectors = map[string]*regexp.Regexp{
+	"email": regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	"ipv4":  regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`),
+	"ipv6":  regexp.MustCompile(`\b(?:[0-9A-Fa-f]{1,4}:){7}[0-9A-Fa-f]{1,4}\b`),
+	"phone": regexp.MustCompile(`\+?\d[\d ().-]{6,}\d`),
+}
+
+// redactionRule drops, hashes or masks the field at Path, a * in the path matches every element of an
+// array or object. If Detect or Pattern are set only the matches within the field's text are redacted
+type redactionRule struct {
+	Path    string   `json:"path"`
+	Action  string   `json:"action"`
+	Keep    int      `json:"keep"`
+	Detect  []string `json:"detect"`
+	Pattern string   `json:"pattern"`
+
+	keys     []string
+	patterns []*regexp.Regexp
+}
+
+// redactor applies the default rules and the rules of the client, loaded from the REDACTION_CONFIG file e.g.
+//
+//	{"default": [{"path": "user.email", "action": "hash"}], "clients": {"42": [{"path": "text", "action": "mask", "detect": ["phone"]}]}}
+type redactor struct {
+	Default []*redactionRule            `json:"default"`
+	Clients map[string][]*redactionRule `json:"clients"`
+
+	key []byte
+}
+
+func newRedactor() *redactor {
+	r := &redactor{}
+	path := os.Getenv(redactionConfig)
+	if path == "" {
+		return r
+	}
+
+	config, err := ioutil.ReadFile(path)
+	if err != nil {
+		logFatalf("Cannot read %s: %s", redactionConfig, err)
+		return r
+	}
+	if err = stdjson.Unmarshal(config, r); err != nil {
+		logFatalf("Invalid %s: %s", redactionConfig, err)
+		return r
+	}
+
+	r.key = []byte(os.Getenv(redactionHMACKey))
+	rules := r.Default
+	for _, clientRules := range r.Clients {
+		rules = append(rules, clientRules...)
+	}
+	for _, rule := range rules {
+		if err = rule.compile(); err != nil {
+			logFatalf("Invalid %s rule for %q: %s", redactionConfig, rule.Path, err)
+		}
+		if rule.Action == actionHash && len(r.key) == 0 {
+			logFatalf("%s must be set to hash fields", redactionHMACKey)
+		}
+	}
+	return r
+}
+
+func (rule *redactionRule) compile() error {
+	switch rule.Action {
+	case actionDrop, actionHash, actionMask:
+	default:
+		return fmt.Errorf("unknown action %q", rule.Action)
+	}
+	if rule.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	rule.keys = strings.Split(rule.Path, ".")
+
+	for _, name := range rule.Detect {
+		detector, ok := detectors[name]
+		if !ok {
+			return fmt.Errorf("unknown detector %q", name)
+		}
+		rule.patterns = append(rule.patterns, detector)
+	}
+	if rule.Pattern != "" {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return err
+		}
+		rule.patterns = append(rule.patterns, pattern)
+	}
+	return nil
+}
+
+func (r *redactor) rules(clientID string) []*redactionRule {
+	if clientRules, ok := r.Clients[clientID]; ok {
+		return append(r.Default[:len(r.Default):len(r.Default)], clientRules...)
+	}
+	return r.Default
+}
+
+// redact returns the message with the rules of the client applied, messages without matching fields are
+// returned unchanged
+func (r *redactor) redact(message []byte, clientID string) ([]byte, error) {
+	rules := r.rules(clientID)
+	if len(rules) == 0 {
+		return message, nil
+	}
+
+	decoder := stdjson.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	changed := false
+	for _, rule := range rules {
+		var ok bool
+		if document, ok = r.apply(rule, document, rule.keys); ok {
+			changed = true
+		}
+	}
+	if !changed {
+		return message, nil
+	}
+
+	var buf bytes.Buffer
+	encoder := stdjson.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(document); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// redactText applies the pattern rules of the client to raw text, it is used for messages which are not valid JSON
+func (r *redactor) redactText(text []byte, clientID string) []byte {
+	for _, rule := range r.rules(clientID) {
+		if len(rule.patterns) > 0 {
+			text = []byte(r.replace(rule, string(text)))
+		}
+	}
+	return text
+}
+
+// apply redacts the value at the remaining keys of the path, returning the new value and whether it changed
+func (r *redactor) apply(rule *redactionRule, value interface{}, keys []string) (interface{}, bool) {
+	if len(keys) == 0 {
+		return r.redactValue(rule, value)
+	}
+
+	key, rest := keys[0], keys[1:]
+	changed := false
+	switch node := value.(type) {
+	case map[string]interface{}:
+		for k, child := range node {
+			if key != pathWildcard && key != k {
+				continue
+			}
+			redacted, ok := r.apply(rule, child, rest)
+			if !ok {
+				continue
+			}
+			changed = true
+			if redacted == nil && len(rest) == 0 && rule.Action == actionDrop && len(rule.patterns) == 0 {
+				delete(node, k)
+				continue
+			}
+			node[k] = redacted
+		}
+	case []interface{}:
+		for i, child := range node {
+			if key != pathWildcard && key != fmt.Sprint(i) {
+				continue
+			}
+			if redacted, ok := r.apply(rule, child, rest); ok {
+				node[i] = redacted
+				changed = true
+			}
+		}
+	}
+	return value, changed
+}
+
+func (r *redactor) redactValue(rule *redactionRule, value interface{}) (interface{}, bool) {
+	if len(rule.patterns) > 0 {
+		text, ok := value.(string)
+		if !ok {
+			return value, false
+		}
+		redacted := r.replace(rule, text)
+		return redacted, redacted != text
+	}
+
+	switch rule.Action {
+	case actionDrop:
+		return nil, true
+	case actionHash:
+		return r.hash(fieldText(value)), true
+	default:
+		return mask(fieldText(value), rule.Keep), true
+	}
+}
+
+func (r *redactor) replace(rule *redactionRule, text string) string {
+	for _, pattern := range rule.patterns {
+		text = pattern.ReplaceAllStringFunc(text, func(match string) string {
+			switch rule.Action {
+			case actionDrop:
+				return ""
+			case actionHash:
+				return r.hash(match)
+			default:
+				return mask(match, rule.Keep)
+			}
+		})
+	}
+	return text
+}
+
+// hash returns the hex encoded HMAC-SHA256 of the value
+func (r *redactor) hash(value string) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// mask replaces every character but the last keep characters with *
+func mask(value string, keep int) string {
+	characters := []rune(value)
+	if keep < 0 || keep >= len(characters) {
+		keep = 0
+	}
+	return strings.Repeat(maskCharacter, len(characters)-keep) + string(characters[len(characters)-keep:])
+}
+
+func fieldText(value interface{}) string {
+	if text, ok := value.(string); ok {
+		return text
+	}
+	encoded, err := stdjson.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func Test_newRedactor(t *testing.T) {
+	tests := []struct {
+		name            string
+		config          string
+		key             string
+		shouldCallFatal bool
+	}{
+		{"loads rules", `{"default":[{"path":"email","action":"hash"}],"clients":{"42":[{"path":"text","action":"mask","detect":["phone"]}]}}`,
+			"secret", false},
+		{"should call fatal for invalid json", `{`, "", true},
+		{"should call fatal for unknown actions", `{"default":[{"path":"email","action":"encrypt"}]}`, "", true},
+		{"should call fatal for unknown detectors", `{"default":[{"path":"text","action":"mask","detect":["ssn"]}]}`, "", true},
+		{"should call fatal for invalid patterns", `{"default":[{"path":"text","action":"mask","pattern":"("}]}`, "", true},
+		{"should call fatal if hashing without a key", `{"default":[{"path":"email","action":"hash"}]}`, "", true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			file, err := ioutil.TempFile("", "redaction")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = file.WriteString(test.config); err != nil {
+				t.Fatal(err)
+			}
+			file.Close()
+
+			os.Setenv(redactionConfig, file.Name())
+			os.Setenv(redactionHMACKey, test.key)
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				os.Unsetenv(redactionConfig)
+				os.Unsetenv(redactionHMACKey)
+				os.Remove(file.Name())
+			}()
+
+			newRedactor()
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+func Test_redactor_redact(t *testing.T) {
+	r := &redactor{
+		Default: []*redactionRule{
+			{Path: "user.email", Action: actionHash},
+			{Path: "password", Action: actionDrop},
+			{Path: "ip", Action: actionMask},
+			{Path: "card", Action: actionMask, Keep: 4},
+			{Path: "participants.*.phone", Action: actionDrop},
+			{Path: "text", Action: actionMask, Detect: []string{"email", "phone"}},
+		},
+		Clients: map[string][]*redactionRule{
+			"42": {{Path: "notes", Action: actionDrop, Pattern: `secret-\d+`}},
+		},
+		key: []byte("key"),
+	}
+	for _, rules := range append([][]*redactionRule{r.Default}, r.Clients["42"]) {
+		for _, rule := range rules {
+			if err := rule.compile(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name     string
+		clientID string
+		message  string
+		want     string
+	}{
+		{"unchanged without matching fields", "1", `{"a": 1}`, `{"a": 1}`},
+		{"hashes nested fields", "1", `{"user":{"email":"a@b.com","name":"x"}}`,
+			`{"user":{"email":"8373b0b94ff14438725f7639ce539e8fd5a447fc6a9e5c66aa6a1e4a5ac5c9db","name":"x"}}`},
+		{"drops fields", "1", `{"password":"hunter2","a":1}`, `{"a":1}`},
+		{"masks fields", "1", `{"ip":"10.0.0.1","card":"4111111111111111"}`, `{"card":"************1111","ip":"********"}`},
+		{"wildcards match array elements", "1", `{"participants":[{"phone":"1","id":1},{"id":2}]}`,
+			`{"participants":[{"id":1},{"id":2}]}`},
+		{"masks detected patterns in free text", "1", `{"text":"mail me at a@b.com or +1 555 123 4567 <3"}`,
+			`{"text":"mail me at ******* or *************** <3"}`},
+		{"applies client rules", "42", `{"notes":"the code is secret-123"}`, `{"notes":"the code is "}`},
+		{"does not apply other client rules", "1", `{"notes":"the code is secret-123"}`, `{"notes":"the code is secret-123"}`},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			got, err := r.redact([]byte(test.message), test.clientID)
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if string(got) != test.want {
+				t.Errorf("redact() = %s, want %s", got, test.want)
+			}
+		})
+	}
+
+	if got := string(r.redactText([]byte(`{"text":"a@b.com`), "1")); got != `{"text":"*******` {
+		t.Errorf("redactText() = %s", got)
+	}
+}
+
+func Test_mask(t *testing.T) {
+	tests := []struct {
+		value string
+		keep  int
+		want  string
+	}{
+		{"secret", 0, "******"},
+		{"secret", 2, "****et"},
+		{"abc", 3, "***"},
+		{"héllo", 1, "****o"},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.value, func(t *testing.T) {
+			if got := mask(test.value, test.keep); got != test.want {
+				t.Errorf("mask() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
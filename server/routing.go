@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fasthttp-server/storage"
+	"os"
+	"strings"
+)
+
+const (
+	routeBy        = "ROUTE_BY"
+	routeFallback  = "ROUTE_FALLBACK"
+	defaultRouteBy = "client_id"
+	defaultRoute   = "unknown"
+	routeSeparator = "_"
+)
+
+// router picks the partition key of a message from one or more JSON paths,
+// each partition is streamed to its own object or blob
+type router struct {
+	paths    []string
+	fallback string
+}
+
+func newRouter() *router {
+	r := &router{
+		paths:    []string{defaultRouteBy},
+		fallback: defaultRoute,
+	}
+	if paths := os.Getenv(routeBy); paths != "" {
+		r.paths = r.paths[:0]
+		for _, path := range strings.Split(paths, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				r.paths = append(r.paths, path)
+			}
+		}
+	}
+	if fallback := os.Getenv(routeFallback); fallback != "" {
+		r.fallback = fallback
+	}
+	return r
+}
+
+// route returns the values of the configured paths joined by an underscore,
+// or the fallback if the message is missing any of them
+func (r *router) route(message []byte) string {
+	values := make([]string, 0, len(r.paths))
+	for _, path := range r.paths {
+		value, ok := storage.MessageField(message, path)
+		if !ok {
+			return r.fallback
+		}
+		values = append(values, value)
+	}
+	if len(values) == 0 {
+		return r.fallback
+	}
+	return strings.Join(values, routeSeparator)
+}
+
+// partition returns the partition of the messages of a client, or an empty string if they are not routed by client id
+func (r *router) partition(clientID string) string {
+	if len(r.paths) == 1 && r.paths[0] == defaultRouteBy {
+		return clientID
+	}
+	return ""
+}
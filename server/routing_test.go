@@ -0,0 +1,81 @@
+package server
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func Test_newRouter(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func()
+		want  *router
+	}{
+		{"defaults to client_id", func() {}, &router{paths: []string{"client_id"}, fallback: "unknown"}},
+		{"multiple paths and fallback", func() {
+			os.Setenv(routeBy, "tenant.id, event_type,")
+			os.Setenv(routeFallback, "unrouted")
+		}, &router{paths: []string{"tenant.id", "event_type"}, fallback: "unrouted"}},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			test.setup()
+			defer func() {
+				os.Unsetenv(routeBy)
+				os.Unsetenv(routeFallback)
+			}()
+
+			if got := newRouter(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("newRouter() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func Test_router_route(t *testing.T) {
+	tests := []struct {
+		name    string
+		paths   []string
+		message string
+		want    string
+	}{
+		{"client id", []string{"client_id"}, `{"client_id":42}`, "42"},
+		{"nested path", []string{"tenant.id"}, `{"tenant":{"id":"acme"}}`, "acme"},
+		{"combination of paths", []string{"tenant.id", "event_type"}, `{"tenant":{"id":"acme"},"event_type":"login"}`, "acme_login"},
+		{"missing field", []string{"tenant.id", "event_type"}, `{"tenant":{"id":"acme"}}`, "fallback"},
+		{"object field", []string{"tenant"}, `{"tenant":{"id":"acme"}}`, "fallback"},
+		{"no paths", []string{}, `{"client_id":42}`, "fallback"},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			r := &router{paths: test.paths, fallback: "fallback"}
+			if got := r.route([]byte(test.message)); got != test.want {
+				t.Errorf("route() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func Test_router_partition(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []string
+		want  string
+	}{
+		{"client id", []string{"client_id"}, "42"},
+		{"other paths", []string{"tenant.id"}, ""},
+		{"client id and other paths", []string{"client_id", "event_type"}, ""},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			r := &router{paths: test.paths, fallback: "fallback"}
+			if got := r.partition("42"); got != test.want {
+				t.Errorf("partition() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
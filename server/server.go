@@ -1,13 +1,17 @@
 package server
 
 import (
+	"errors"
 	"fasthttp-server/pipe"
 	"fasthttp-server/storage"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	jsoniter "github.com/json-iterator/go"
 	"github.com/valyala/fasthttp"
@@ -16,14 +20,28 @@ import (
 const (
 	partSize    = 5 * 1024 * 1024 // minimum allowed for s3 storage
 	concurrency = 10
+
+	storageType      = "STORAGE_TYPE"
+	storageS3        = "s3"
+	storageAzure     = "azure"
+	storageKafka     = "kafka"
+	fanOutBufferSize = "FANOUT_BUFFER_SIZE"
+	fanOutStall      = "FANOUT_STALL_TIMEOUT"
+	fanOutCommit     = "FANOUT_COMMIT_POLICY"
+
+	defaultFanOutBufferSize = 64 * 1024 * 1024
+	defaultFanOutStall      = 30 * time.Second
 )
 
 var (
 	// A high-performance 100% compatible drop-in replacement of "encoding/json"
-	json     = jsoniter.ConfigCompatibleWithStandardLibrary
-	pipeNew  = pipe.NewGzipWriter
-	s3New    = storage.NewS3Streamer
-	azureNew = storage.NewAzureStreamer
+	json      = jsoniter.ConfigCompatibleWithStandardLibrary
+	logFatalf = log.Fatalf
+	pipeNew   = pipe.NewGzipWriter
+	s3New     = storage.NewS3Streamer
+	azureNew  = storage.NewAzureStreamer
+	kafkaNew  = storage.NewKafkaStreamer
+	fanOutNew = storage.NewFanOutStreamer
 )
 
 type Server interface {
@@ -33,54 +51,383 @@ type Server interface {
 }
 
 type server struct {
-	httpServer fasthttp.Server
-	listener   net.Listener
-	dataPipes  map[int]pipe.GzipWriter
-	streamers  map[int]storage.MessageStreamer
-	waitGroup  sync.WaitGroup
+	httpServer     fasthttp.Server
+	listener       net.Listener
+	router         *router
+	pipes          *pipeFactory
+	validator      *validator
+	redactor       *redactor
+	enricher       *enricher
+	deadLetters    *deadLetters
+	decoder        *decoder
+	duplicates     *duplicates
+	maxMessageSize int
+	ackTimeout     time.Duration
+	syncInterval   time.Duration
+	jobs           []*job
+	listeners      []listener
+	websockets     *websocketHandler
+	logs           *logsHandler
+	mutex          sync.Mutex
+	dataPipes      map[string]pipe.GzipWriter
+	streamers      map[string]storage.MessageStreamer
+	waitGroup      sync.WaitGroup
 }
 
 type Request struct {
-	ClientID int `json:"client_id"`
+	ClientID ClientID `json:"client_id"`
+}
+
+// ClientID identifies a client, it accepts both JSON strings e.g. UUIDs and numbers
+type ClientID string
+
+func (c *ClientID) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*c = ""
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var id string
+		if err := json.Unmarshal(data, &id); err != nil {
+			return err
+		}
+		*c = ClientID(id)
+		return nil
+	}
+	var id jsoniter.Number
+	if err := json.Unmarshal(data, &id); err != nil {
+		return fmt.Errorf("client_id must be a string or a number: %s", err)
+	}
+	*c = ClientID(id)
+	return nil
 }
 
 func New(l net.Listener) Server {
-	return &server{
-		dataPipes:  map[int]pipe.GzipWriter{},
-		streamers:  map[int]storage.MessageStreamer{},
-		listener:   l,
-		httpServer: fasthttp.Server{},
-		waitGroup:  sync.WaitGroup{},
+	pipes := newPipeFactory()
+	limits := newHTTPLimits()
+	router := newRouter()
+	storage.SeedSequences(newObjectStore())
+	s := &server{
+		dataPipes:      map[string]pipe.GzipWriter{},
+		streamers:      map[string]storage.MessageStreamer{},
+		listener:       limitConnsPerIP(l),
+		router:         router,
+		pipes:          pipes,
+		validator:      newValidator(),
+		redactor:       newRedactor(),
+		enricher:       newEnricher(),
+		deadLetters:    newDeadLetters(pipes),
+		decoder:        newDecoder(),
+		duplicates:     newDuplicates(),
+		maxMessageSize: limits.maxMessageSize,
+		ackTimeout:     newAckTimeout(),
+		syncInterval:   newSyncInterval(),
+		jobs:           newJobs(),
+		httpServer: fasthttp.Server{
+			MaxRequestBodySize: limits.maxRequestBodySize,
+			ReadTimeout:        limits.readTimeout,
+			WriteTimeout:       limits.writeTimeout,
+		},
+		waitGroup: sync.WaitGroup{},
 	}
+	s.listeners = newListeners(s.ingest)
+	s.websockets = newWebSocketHandler(s.ingest)
+	s.logs = newLogsHandler(pipes.keyWrapper, router)
+	return s
 }
 
 func (s *server) Start() error {
 	s.waitGroup.Add(1)
 	fmt.Println("Starting http server at address: ", s.listener.Addr())
 	s.httpServer.Handler = s.requestHandler
+	s.httpServer.ErrorHandler = handleRequestError
+	for _, j := range s.jobs {
+		j.start()
+	}
+	for _, l := range s.listeners {
+		l.start()
+	}
 	return s.httpServer.Serve(s.listener)
 }
 
 func (s *server) requestHandler(ctx *fasthttp.RequestCtx) {
-	var message Request
-	err := json.Unmarshal(ctx.PostBody(), &message)
+	if serveMetrics(ctx) || s.websockets.serve(ctx) || s.logs.serve(ctx) {
+		return
+	}
+
+	o := newOrigin(ctx)
+	body, err := s.decoder.decode(&ctx.Request)
 	if err != nil {
-		fmt.Println("Error parsing request", err)
+		var e *decodeError
+		if !errors.As(err, &e) {
+			e = &decodeError{fasthttp.StatusBadRequest, err}
+		}
+		if e.status == fasthttp.StatusRequestEntityTooLarge {
+			metrics.Add(metricRequestTooLarge, 1)
+		}
+		s.reject(ctx.Request.Body(), e, o)
+		ctx.Error(e.Error(), e.status)
+		return
+	}
+	if isNDJSON(&ctx.Request) {
+		s.ingestBatch(ctx, body, o)
+		return
+	}
+	if s.tooLarge(body) {
+		err = fmt.Errorf("message is larger than %d bytes", s.maxMessageSize)
+		s.reject(body, err, o)
+		ctx.Error(err.Error(), fasthttp.StatusRequestEntityTooLarge)
+		return
+	}
+
+	stored, err := s.write(body, o)
+	switch e := err.(type) {
+	case *validationError:
+		respondRejected(ctx, fasthttp.StatusUnprocessableEntity, e.errors)
+	case *unavailableError:
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+	case nil:
+		if s.ackTimeout > 0 {
+			s.respondCommitted(ctx, []written{stored})
+		}
+	default:
+		respondRejected(ctx, fasthttp.StatusBadRequest, []string{e.Error()})
+	}
+}
+
+// ingestBatch ingests every line of a newline delimited batch in order. The errors of the lines which are not
+// valid JSON or fail validation are responded to together, prefixed by the line number. If a line cannot be stored the lines after it are not
+// ingested and the batch should be sent again. Batches with a line over the message size are not ingested at all,
+// the lines over the size are written to the dead letters. The idempotency key of a batch is suffixed with the line
+// number, so a batch sent again stores the missing lines. In sync ack mode the response waits until the stored lines
+// are committed
+func (s *server) ingestBatch(ctx *fasthttp.RequestCtx, body []byte, o origin) {
+	lines := splitLines(body)
+	var tooLarge error
+	for i, line := range lines {
+		if s.tooLarge(line) {
+			err := fmt.Errorf("line %d is larger than %d bytes", i+1, s.maxMessageSize)
+			s.reject(line, err, o)
+			if tooLarge == nil {
+				tooLarge = err
+			}
+		}
+	}
+	if tooLarge != nil {
+		ctx.Error(tooLarge.Error(), fasthttp.StatusRequestEntityTooLarge)
 		return
 	}
 
-	_, exists := s.dataPipes[message.ClientID]
-	if !exists {
-		s.dataPipes[message.ClientID] = pipeNew()
-		go func() {
-			s.streamers[message.ClientID] = getStreamer(message.ClientID)
-			s.streamers[message.ClientID].Stream(s.dataPipes[message.ClientID])
-		}()
+	var rejections []string
+	var writes []written
+	status := fasthttp.StatusUnprocessableEntity
+	synced := map[pipe.GzipWriter]bool{}
+	for i, line := range lines {
+		lineOrigin := o
+		if o.idempotencyKey != "" {
+			lineOrigin.idempotencyKey = fmt.Sprintf("%s/%d", o.idempotencyKey, i+1)
+		}
+		stored, err := s.write(line, lineOrigin)
+		switch e := err.(type) {
+		case *validationError:
+			for _, message := range e.errors {
+				rejections = append(rejections, fmt.Sprintf("line %d: %s", i+1, message))
+			}
+		case *unavailableError:
+			ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+			return
+		case nil:
+			if stored.dataPipe != nil && !synced[stored.dataPipe] {
+				synced[stored.dataPipe] = true
+				writes = append(writes, stored)
+			}
+		default:
+			status = fasthttp.StatusBadRequest
+			rejections = append(rejections, fmt.Sprintf("line %d: %s", i+1, e))
+		}
+	}
+	if len(rejections) > 0 {
+		if s.ackTimeout > 0 {
+			s.commit(writes)
+		}
+		respondRejected(ctx, status, rejections)
+		return
+	}
+	if s.ackTimeout > 0 {
+		s.respondCommitted(ctx, writes)
+	}
+}
+
+// tooLarge returns true and counts messages over the message size, servers without a size accept any message
+func (s *server) tooLarge(message []byte) bool {
+	if s.maxMessageSize <= 0 || len(message) <= s.maxMessageSize {
+		return false
+	}
+	metrics.Add(metricMessageTooLarge, 1)
+	return true
+}
+
+// reject writes a message which is not ingested to the dead letters with the reason it was rejected
+func (s *server) reject(payload []byte, err error, o origin) {
+	s.deadLetters.reject(s.redactor.redactText(payload, ""), err.Error(), o.remoteAddr, o.received)
+}
+
+// unavailableError is returned by ingest if a message cannot be stored and should be retried
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return "storage unavailable: " + e.err.Error()
+}
+
+// validationError is returned by ingest for messages which do not match their schema
+type validationError struct {
+	errors []string
+}
+
+func (e *validationError) Error() string {
+	return "schema validation failed: " + strings.Join(e.errors, "; ")
+}
+
+// ingest writes a message to the pipe of its partition, messages are acknowledged once they are written
+func (s *server) ingest(body []byte, o origin) error {
+	_, err := s.write(body, o)
+	return err
+}
+
+// written is the pipe a message was written to and the partition of the pipe, the pipe is nil for duplicates of
+// stored messages as they are not written again
+type written struct {
+	partition string
+	dataPipe  pipe.GzipWriter
+}
+
+// write parses, routes, validates, redacts and enriches a message before writing it to the pipe of its partition,
+// which is returned. Rejected messages are written to the dead letters and duplicates of stored messages are
+// acknowledged without being written again
+func (s *server) write(body []byte, o origin) (written, error) {
+	var message Request
+	err := json.Unmarshal(body, &message)
+	if err != nil {
+		metrics.Add(metricInvalidJSON, 1)
+		s.reject(body, err, o)
+		return written{}, err
+	}
+
+	clientID := string(message.ClientID)
+	partition := s.router.route(body)
+	validationErrors, err := s.validator.validate(body, clientID, partition)
+	if err != nil {
+		validationErrors = []string{err.Error()}
+	}
+
+	redacted, err := s.redactor.redact(body, clientID)
+	if err != nil {
+		redacted = s.redactor.redactText(body, clientID)
+	}
+
+	if len(validationErrors) > 0 {
+		metrics.Add(metricInvalidSchema, 1)
+		err = &validationError{errors: validationErrors}
+		s.deadLetters.reject(redacted, err.Error(), o.remoteAddr, o.received)
+		return written{}, err
+	}
+
+	key := s.duplicates.key(body, clientID, o)
+	reserved, err := s.duplicates.reserve(key, o.received)
+	if err != nil {
+		return written{}, &unavailableError{err}
+	}
+	if !reserved {
+		metrics.Add(metricDuplicates, 1)
+		return written{partition: partition}, nil
 	}
 
-	_, err = s.dataPipes[message.ClientID].Write(ctx.PostBody())
+	dataPipe, err := s.dataPipe(storage.Object{
+		ClientID:  clientID,
+		Partition: partition,
+		Created:   time.Now(),
+		Message:   redacted,
+	})
+	if err != nil {
+		log.Println("Error creating data pipe: ", err)
+		s.duplicates.release(key)
+		return written{}, &unavailableError{err}
+	}
+
+	err = s.enricher.write(dataPipe, redacted, clientID, o)
 	if err != nil {
 		log.Println("Error when reading request: ", err)
+		s.duplicates.release(key)
+		return written{}, &unavailableError{err}
+	}
+	s.duplicates.stored(key)
+	return written{partition: partition, dataPipe: dataPipe}, nil
+}
+
+// respondRejected responds with the status and the errors of the rejected messages, 400 Bad Request for messages
+// which are not valid JSON and 422 Unprocessable Entity for messages which fail validation
+func respondRejected(ctx *fasthttp.RequestCtx, status int, rejections []string) {
+	body, err := json.Marshal(struct {
+		Errors []string `json:"errors"`
+	}{rejections})
+	if err != nil {
+		log.Println("Error encoding rejections: ", err)
+	}
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
+
+// dataPipe returns the pipe of the object's partition, creating it and starting to stream it if it does not exist
+func (s *server) dataPipe(object storage.Object) (pipe.GzipWriter, error) {
+	s.mutex.Lock()
+	dataPipe, exists := s.dataPipes[object.Partition]
+	s.mutex.Unlock()
+	if exists {
+		return dataPipe, nil
+	}
+
+	// the sequence number may be seeded from the stored objects, so it is taken before the pipes are locked
+	object.Message = append([]byte(nil), object.Message...)
+	object.Sequence = storage.NextSequence(object)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if dataPipe, exists := s.dataPipes[object.Partition]; exists {
+		return dataPipe, nil
+	}
+	dataPipe, err := s.pipes.newPipe(&object)
+	if err != nil {
+		return nil, err
+	}
+	if s.ackTimeout > 0 {
+		pipe.RequireDurable(dataPipe)
+		pipe.GroupSyncs(dataPipe, s.syncInterval)
+	}
+	streamer := getStreamer(object)
+	s.dataPipes[object.Partition] = dataPipe
+	s.streamers[object.Partition] = streamer
+	go s.stream(object.Partition, dataPipe, streamer)
+	return dataPipe, nil
+}
+
+// stream streams the pipe to the backend. If the stream fails the pipe is closed, so its writes fail rather than
+// block, and removed, so the next message of the partition creates a new pipe
+func (s *server) stream(partition string, dataPipe pipe.GzipWriter, streamer storage.MessageStreamer) {
+	err := streamer.Stream(dataPipe)
+	if err == nil {
+		return
+	}
+	log.Println("Error when streaming partition", partition, err)
+	pipe.CloseWithError(dataPipe, err)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.dataPipes[partition] == dataPipe {
+		delete(s.dataPipes, partition)
+		delete(s.streamers, partition)
 	}
 }
 
@@ -90,17 +437,33 @@ func (s *server) Close() {
 	if err != nil {
 		log.Println("Error when shutting down the server: ", err)
 	}
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	if s.websockets != nil {
+		s.websockets.Close()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
 	fmt.Println("Closing data pipes")
 	for _, dp := range s.dataPipes {
 		dp.Close()
 	}
 
+	for _, j := range s.jobs {
+		j.Close()
+	}
+
 	fmt.Println("Closing streamers")
 	for _, stream := range s.streamers {
 		stream.Wait()
 	}
 
+	fmt.Println("Closing dead letters")
+	s.deadLetters.Close()
+
 	fmt.Println("Closed all streamers")
 	s.waitGroup.Done()
 }
@@ -109,9 +472,52 @@ func (s *server) Wait() {
 	s.waitGroup.Wait()
 }
 
-func getStreamer(clientID int) storage.MessageStreamer {
-	if os.Getenv("STORAGE_TYPE") == "azure" {
-		return azureNew(clientID, partSize, concurrency)
+// primaryStreamer returns the streamer of the STORAGE_TYPE backend, or a streamer writing to all of the backends
+// if a comma separated list is set e.g. s3,azure
+func primaryStreamer(object storage.Object) storage.MessageStreamer {
+	types := strings.Split(os.Getenv(storageType), ",")
+	if len(types) == 1 {
+		return newBackend(strings.TrimSpace(types[0]), object)
+	}
+
+	backends := make([]storage.Backend, 0, len(types))
+	for _, name := range types {
+		name = strings.TrimSpace(name)
+		backends = append(backends, storage.Backend{Name: name, Streamer: newBackend(name, object)})
+	}
+	bufferSize := defaultFanOutBufferSize
+	if size := os.Getenv(fanOutBufferSize); size != "" {
+		var err error
+		if bufferSize, err = strconv.Atoi(size); err != nil || bufferSize <= 0 {
+			logFatalf("%s must be a positive number of bytes", fanOutBufferSize)
+		}
+	}
+	stall := defaultFanOutStall
+	if timeout := os.Getenv(fanOutStall); timeout != "" {
+		var err error
+		if stall, err = time.ParseDuration(timeout); err != nil || stall <= 0 {
+			logFatalf("%s must be a positive duration e.g. 30s", fanOutStall)
+		}
+	}
+	policy := storage.CommitPolicy(os.Getenv(fanOutCommit))
+	switch policy {
+	case "":
+		policy = storage.CommitAll
+	case storage.CommitAll, storage.CommitAny:
+	default:
+		logFatalf("%s must be %s or %s", fanOutCommit, storage.CommitAll, storage.CommitAny)
+	}
+	return fanOutNew(backends, bufferSize, stall, policy, reportUpload)
+}
+
+func newBackend(name string, object storage.Object) storage.MessageStreamer {
+	switch name {
+	case storageAzure:
+		return azureNew(object, partSize, concurrency)
+	case storageLocal:
+		return localNew(object, partSize, concurrency)
+	case storageKafka:
+		return kafkaNew(object, partSize, concurrency)
 	}
-	return s3New(clientID, partSize, concurrency)
+	return s3New(object, partSize, concurrency)
 }
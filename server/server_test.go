@@ -2,9 +2,13 @@ package server
 
 import (
 	"bufio"
+	"errors"
 	"fasthttp-server/pipe"
 	"fasthttp-server/storage"
 	"fmt"
+	"io"
+	"log"
+	"os"
 	"reflect"
 	"testing"
 	"time"
@@ -31,11 +35,23 @@ func TestNew(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 			mockCtrl := gomock.NewController(t)
 			mockListener := mocks.NewMockListener(mockCtrl)
+			s3StoreNew = func() storage.ObjectStore { return nil }
+			defer func() { s3StoreNew = storage.NewS3Store }()
 
 			want := &server{
-				dataPipes: map[int]pipe.GzipWriter{},
-				streamers: map[int]storage.MessageStreamer{},
-				listener:  mockListener,
+				dataPipes:      map[string]pipe.GzipWriter{},
+				streamers:      map[string]storage.MessageStreamer{},
+				listener:       mockListener,
+				router:         newRouter(),
+				pipes:          &pipeFactory{},
+				validator:      newValidator(),
+				redactor:       newRedactor(),
+				enricher:       newEnricher(),
+				deadLetters:    newDeadLetters(&pipeFactory{}),
+				decoder:        newDecoder(),
+				maxMessageSize: defaultMaxMessageSize,
+				syncInterval:   defaultSyncInterval,
+				httpServer:     fasthttp.Server{MaxRequestBodySize: fasthttp.DefaultMaxRequestBodySize},
 			}
 
 			if got := New(mockListener); !reflect.DeepEqual(got, want) {
@@ -49,25 +65,31 @@ func TestNew(t *testing.T) {
 
 func Test_server_Start(t *testing.T) {
 	tests := []struct {
-		name    string
-		request string
-		setup   func(mockPipe *mocks.MockGzipWriter, MockS3 *mocks.MockMessageStreamer)
+		name       string
+		request    string
+		setup      func(mockPipe *mocks.MockGzipWriter, MockS3 *mocks.MockMessageStreamer)
+		wantStatus int
 	}{
-		{"error parsing request", fmt.Sprintf("POST / HTTP/1.1\r\nContent-Length: %d\r\n\r\n%s", 1, "{"),
+		{"error parsing request is dead lettered", fmt.Sprintf("POST / HTTP/1.1\r\nContent-Length: %d\r\n\r\n%s", 1, "{"),
 			func(mockPipe *mocks.MockGzipWriter, MockS3 *mocks.MockMessageStreamer) {
-				mockPipe.EXPECT().Write(gomock.Any()).Times(0)
-				MockS3.EXPECT().Stream(gomock.Any()).Times(0)
-			}},
+				mockPipe.EXPECT().Write(gomock.Any()).Times(1)
+				MockS3.EXPECT().Stream(gomock.Any()).Times(1)
+			}, fasthttp.StatusBadRequest},
 		{"error writing to pipe", fmt.Sprintf("POST / HTTP/1.1\r\nContent-Length: %d\r\n\r\n%s", 2, "{}"),
 			func(mockPipe *mocks.MockGzipWriter, MockS3 *mocks.MockMessageStreamer) {
 				mockPipe.EXPECT().Write(gomock.Any()).Times(1).Return(0, fmt.Errorf("error"))
 				MockS3.EXPECT().Stream(gomock.Any()).Times(1)
-			}},
+			}, fasthttp.StatusServiceUnavailable},
 		{"success", fmt.Sprintf("POST / HTTP/1.1\r\nContent-Length: %d\r\n\r\n%s", 2, "{}"),
 			func(mockPipe *mocks.MockGzipWriter, MockS3 *mocks.MockMessageStreamer) {
 				mockPipe.EXPECT().Write(gomock.Any()).Times(1)
 				MockS3.EXPECT().Stream(gomock.Any()).Times(1)
-			}},
+			}, fasthttp.StatusOK},
+		{"success with string client id", fmt.Sprintf("POST / HTTP/1.1\r\nContent-Length: %d\r\n\r\n%s", 19, `{"client_id":"a-b"}`),
+			func(mockPipe *mocks.MockGzipWriter, MockS3 *mocks.MockMessageStreamer) {
+				mockPipe.EXPECT().Write(gomock.Any()).Times(1)
+				MockS3.EXPECT().Stream(gomock.Any()).Times(1)
+			}, fasthttp.StatusOK},
 	}
 	for _, tt := range tests {
 		test := tt
@@ -81,7 +103,7 @@ func Test_server_Start(t *testing.T) {
 			pipeNew = func() pipe.GzipWriter {
 				return mockPipe
 			}
-			s3New = func(int, int, int) storage.MessageStreamer {
+			s3New = func(storage.Object, int, int) storage.MessageStreamer {
 				return MockS3
 			}
 
@@ -91,9 +113,16 @@ func Test_server_Start(t *testing.T) {
 			}()
 
 			s := &server{
-				dataPipes: map[int]pipe.GzipWriter{},
-				streamers: map[int]storage.MessageStreamer{},
-				listener:  ln,
+				dataPipes:   map[string]pipe.GzipWriter{},
+				streamers:   map[string]storage.MessageStreamer{},
+				listener:    ln,
+				router:      newRouter(),
+				pipes:       &pipeFactory{},
+				validator:   newValidator(),
+				redactor:    newRedactor(),
+				enricher:    newEnricher(),
+				deadLetters: newDeadLetters(&pipeFactory{}),
+				decoder:     newDecoder(),
 			}
 
 			// Start the server with an in memory listener
@@ -105,7 +134,7 @@ func Test_server_Start(t *testing.T) {
 				close(serverCh)
 			}()
 
-			// Send the server a request and expect a response with status OK code
+			// Send the server a request and expect a response with the status code of the test
 			clientCh := make(chan struct{})
 			go func() {
 				c, err := ln.Dial()
@@ -120,8 +149,8 @@ func Test_server_Start(t *testing.T) {
 				if err := resp.Read(br); err != nil {
 					t.Errorf("unexpected error: %s", err)
 				}
-				if resp.StatusCode() != 200 {
-					t.Errorf("unexpected status code: %d. Expecting %d", resp.StatusCode(), 200)
+				if resp.StatusCode() != test.wantStatus {
+					t.Errorf("unexpected status code: %d. Expecting %d", resp.StatusCode(), test.wantStatus)
 				}
 				if err := c.Close(); err != nil {
 					t.Errorf("unexpected error: %s", err)
@@ -154,17 +183,18 @@ func Test_server_Close(t *testing.T) {
 			mockPipe := mocks.NewMockGzipWriter(mockCtrl)
 			MockS3 := mocks.NewMockMessageStreamer(mockCtrl)
 
-			dataPipes := map[int]pipe.GzipWriter{}
-			dataPipes[0] = mockPipe
+			dataPipes := map[string]pipe.GzipWriter{}
+			dataPipes["0"] = mockPipe
 			mockPipe.EXPECT().Close().Times(1)
 
-			streamers := map[int]storage.MessageStreamer{}
-			streamers[0] = MockS3
+			streamers := map[string]storage.MessageStreamer{}
+			streamers["0"] = MockS3
 			MockS3.EXPECT().Wait().Times(1)
 
 			s := &server{
-				dataPipes: dataPipes,
-				streamers: streamers,
+				dataPipes:   dataPipes,
+				streamers:   streamers,
+				deadLetters: newDeadLetters(&pipeFactory{}),
 			}
 
 			s.waitGroup.Add(1)
@@ -175,6 +205,50 @@ func Test_server_Close(t *testing.T) {
 	}
 }
 
+// failingStreamer fails without reading the stream, like an upload which is aborted
+type failingStreamer struct{}
+
+func (failingStreamer) Stream(io.Reader) error {
+	return errors.New("aborted")
+}
+
+func (failingStreamer) Wait() {}
+
+func Test_server_dataPipe_streamErrors(t *testing.T) {
+	s3New = func(storage.Object, int, int) storage.MessageStreamer {
+		return failingStreamer{}
+	}
+	defer func() {
+		s3New = storage.NewS3Streamer
+	}()
+	s := &server{dataPipes: map[string]pipe.GzipWriter{}, streamers: map[string]storage.MessageStreamer{}, pipes: &pipeFactory{}}
+
+	failed, err := s.dataPipe(storage.Object{Partition: "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		s.mutex.Lock()
+		removed := len(s.dataPipes) == 0 && len(s.streamers) == 0
+		s.mutex.Unlock()
+		if removed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the pipe of the failed stream is not removed")
+		}
+	}
+
+	// writes to the failed pipe return the error rather than blocking
+	failed.Write([]byte(`{"client_id":42}`))
+	if err := failed.(interface{ Flush() error }).Flush(); err == nil {
+		t.Error("expected writes to the failed pipe to fail")
+	}
+	if dataPipe, err := s.dataPipe(storage.Object{Partition: "42"}); err != nil || dataPipe == failed {
+		t.Errorf("dataPipe() = %v, %v, want a new pipe", dataPipe, err)
+	}
+}
+
 func Test_server_Wait(t *testing.T) {
 	s := &server{}
 	s.waitGroup.Add(1)
@@ -182,3 +256,124 @@ func Test_server_Wait(t *testing.T) {
 	s.Wait()
 	fmt.Println("Does not deadlock, that's good!")
 }
+
+func TestClientID_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    ClientID
+		wantErr bool
+	}{
+		{"number", `{"client_id":42}`, "42", false},
+		{"string", `{"client_id":"42"}`, "42", false},
+		{"uuid", `{"client_id":"550e8400-e29b-41d4-a716-446655440000"}`, "550e8400-e29b-41d4-a716-446655440000", false},
+		{"null", `{"client_id":null}`, "", false},
+		{"missing", `{}`, "", false},
+		{"object", `{"client_id":{}}`, "", true},
+		{"boolean", `{"client_id":true}`, "", true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			var message Request
+			err := json.Unmarshal([]byte(test.body), &message)
+			if (err != nil) != test.wantErr {
+				t.Errorf("Unmarshal() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && message.ClientID != test.want {
+				t.Errorf("Unmarshal() = %v, want %v", message.ClientID, test.want)
+			}
+		})
+	}
+}
+
+func Test_getStreamer(t *testing.T) {
+	tests := []struct {
+		name            string
+		storageType     string
+		bufferSize      string
+		commitPolicy    string
+		wantBackends    []string
+		wantBufferSize  int
+		wantPolicy      storage.CommitPolicy
+		shouldCallFatal bool
+	}{
+		{"defaults to s3", "", "", "", []string{"s3"}, 0, "", false},
+		{"azure", "azure", "", "", []string{"azure"}, 0, "", false},
+		{"kafka", "kafka", "", "", []string{"kafka"}, 0, "", false},
+		{"fans out to object storage and kafka", "s3,kafka", "", "", []string{"s3", "kafka"}, defaultFanOutBufferSize,
+			storage.CommitAll, false},
+		{"fans out to a list of backends", "s3, azure", "", "", []string{"s3", "azure"}, defaultFanOutBufferSize,
+			storage.CommitAll, false},
+		{"buffer size", "s3,azure", "1024", "", []string{"s3", "azure"}, 1024, storage.CommitAll, false},
+		{"commit policy", "s3,azure", "", "any", []string{"s3", "azure"}, defaultFanOutBufferSize, storage.CommitAny, false},
+		{"should call fatal for invalid buffer sizes", "s3,azure", "big", "", []string{"s3", "azure"}, 0,
+			storage.CommitAll, true},
+		{"should call fatal for unknown commit policies", "s3,azure", "", "most", []string{"s3", "azure"},
+			defaultFanOutBufferSize, "most", true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv(storageType, test.storageType)
+			os.Setenv(fanOutBufferSize, test.bufferSize)
+			os.Setenv(fanOutCommit, test.commitPolicy)
+			var created []string
+			s3New = func(storage.Object, int, int) storage.MessageStreamer {
+				created = append(created, storageS3)
+				return nil
+			}
+			azureNew = func(storage.Object, int, int) storage.MessageStreamer {
+				created = append(created, storageAzure)
+				return nil
+			}
+			kafkaNew = func(storage.Object, int, int) storage.MessageStreamer {
+				created = append(created, storageKafka)
+				return nil
+			}
+			var fannedOut []string
+			var bufferSize int
+			var policy storage.CommitPolicy
+			fanOutNew = func(backends []storage.Backend, size int, stall time.Duration, commitPolicy storage.CommitPolicy,
+				report storage.UploadReporter) storage.MessageStreamer {
+				for _, backend := range backends {
+					fannedOut = append(fannedOut, backend.Name)
+				}
+				bufferSize = size
+				policy = commitPolicy
+				return nil
+			}
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				s3New = storage.NewS3Streamer
+				azureNew = storage.NewAzureStreamer
+				kafkaNew = storage.NewKafkaStreamer
+				fanOutNew = storage.NewFanOutStreamer
+				logFatalf = log.Fatalf
+				os.Unsetenv(storageType)
+				os.Unsetenv(fanOutBufferSize)
+				os.Unsetenv(fanOutCommit)
+			}()
+
+			getStreamer(storage.Object{})
+			if !reflect.DeepEqual(created, test.wantBackends) {
+				t.Errorf("created backends %v, want %v", created, test.wantBackends)
+			}
+			if len(test.wantBackends) > 1 && !reflect.DeepEqual(fannedOut, test.wantBackends) {
+				t.Errorf("fanned out to %v, want %v", fannedOut, test.wantBackends)
+			}
+			if bufferSize != test.wantBufferSize && !test.shouldCallFatal {
+				t.Errorf("buffer size = %d, want %d", bufferSize, test.wantBufferSize)
+			}
+			if policy != test.wantPolicy {
+				t.Errorf("commit policy = %v, want %v", policy, test.wantPolicy)
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
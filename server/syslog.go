@@ -0,0 +1,355 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	stdjson "encoding/json"
+	"fasthttp-server/storage"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	syslogUDPAddress       = "SYSLOG_UDP_ADDRESS"
+	syslogTCPAddress       = "SYSLOG_TCP_ADDRESS"
+	syslogTCPTLSCert       = "SYSLOG_TCP_TLS_CERT"
+	syslogTCPTLSKey        = "SYSLOG_TCP_TLS_KEY"
+	syslogTCPIdleTimeout   = "SYSLOG_TCP_IDLE_TIMEOUT"
+	syslogTCPMaxSize       = "SYSLOG_TCP_MAX_MESSAGE_SIZE"
+	syslogClientIDField    = "SYSLOG_CLIENT_ID_FIELD"
+	defaultSyslogClientID  = "hostname"
+	syslogMaxDatagramSize  = 64 * 1024
+	syslogMaxOctetCountLen = 10
+)
+
+var (
+	netListenPacket = net.ListenPacket
+
+	syslogTCPEnv = tcpSettings{syslogTCPAddress, syslogTCPTLSCert, syslogTCPTLSKey, syslogTCPIdleTimeout, syslogTCPMaxSize}
+
+	syslogFacilities = []string{"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron",
+		"authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7"}
+	syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+	utf8BOM = []byte("\xEF\xBB\xBF")
+)
+
+// syslogMessage is the JSON object a syslog message is converted to
+type syslogMessage struct {
+	ClientID       string                       `json:"client_id,omitempty"`
+	Facility       string                       `json:"facility"`
+	Severity       string                       `json:"severity"`
+	Timestamp      string                       `json:"timestamp,omitempty"`
+	Hostname       string                       `json:"hostname,omitempty"`
+	App            string                       `json:"app,omitempty"`
+	ProcID         string                       `json:"procid,omitempty"`
+	MsgID          string                       `json:"msgid,omitempty"`
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+	Msg            string                       `json:"msg"`
+}
+
+// syslogConverter converts syslog messages to JSON before they are ingested, the client id is taken from a
+// field of the converted message e.g. hostname or structured_data.origin.tenant
+type syslogConverter struct {
+	clientIDField string
+	ingest        func(body []byte, o origin) error
+}
+
+// newSyslogListeners returns the syslog listeners which are configured
+func newSyslogListeners(ingest func(body []byte, o origin) error) []listener {
+	c := &syslogConverter{clientIDField: defaultSyslogClientID, ingest: ingest}
+	if field := os.Getenv(syslogClientIDField); field != "" {
+		c.clientIDField = field
+	}
+
+	var listeners []listener
+	if u := newUDPListener(os.Getenv(syslogUDPAddress), c.ingestMessage); u != nil {
+		listeners = append(listeners, u)
+	}
+	if t := newTCPListener(syslogTCPEnv, splitSyslog, c.ingestMessage); t != nil {
+		listeners = append(listeners, t)
+	}
+	return listeners
+}
+
+func (c *syslogConverter) ingestMessage(data []byte, o origin) error {
+	return c.ingest(c.convert(data, o), o)
+}
+
+// convert parses the message and encodes it as JSON, messages which cannot be parsed are kept as the msg field
+func (c *syslogConverter) convert(data []byte, o origin) []byte {
+	m := parseSyslog(data, o.received)
+	if m.Hostname == "" {
+		m.Hostname = o.remoteIP
+	}
+	body, err := stdjson.Marshal(m)
+	if err != nil {
+		log.Println("Error encoding syslog message: ", err)
+		return data
+	}
+	if clientID, ok := storage.MessageField(body, c.clientIDField); ok {
+		m.ClientID = clientID
+		body, _ = stdjson.Marshal(m)
+	}
+	return body
+}
+
+// parseSyslog parses RFC 5424 and RFC 3164 messages, a message without a valid priority is kept as a
+// user.notice message as RFC 3164 recommends
+func parseSyslog(data []byte, received time.Time) syslogMessage {
+	data = bytes.TrimRight(data, "\r\n\x00")
+	m := syslogMessage{Facility: syslogFacilities[1], Severity: syslogSeverities[5]}
+	priority, rest, ok := parsePriority(data)
+	if !ok {
+		m.Msg = string(data)
+		return m
+	}
+	m.Facility, m.Severity = syslogFacilities[priority/8], syslogSeverities[priority%8]
+
+	if bytes.HasPrefix(rest, []byte("1 ")) {
+		parsed := m
+		if parseRFC5424(&parsed, rest[2:]) {
+			return parsed
+		}
+	}
+	parseRFC3164(&m, rest, received)
+	return m
+}
+
+// parsePriority parses the <PRI> prefix of a message
+func parsePriority(data []byte) (int, []byte, bool) {
+	end := bytes.IndexByte(data, '>')
+	if len(data) < 3 || data[0] != '<' || end < 2 || end > 4 {
+		return 0, nil, false
+	}
+	priority, err := strconv.Atoi(string(data[1:end]))
+	if err != nil || priority < 0 || priority >= len(syslogFacilities)*8 {
+		return 0, nil, false
+	}
+	return priority, data[end+1:], true
+}
+
+// parseRFC5424 parses the header, structured data and message following the version
+func parseRFC5424(m *syslogMessage, data []byte) bool {
+	var header [5]string
+	for i := range header {
+		space := bytes.IndexByte(data, ' ')
+		if space <= 0 {
+			return false
+		}
+		if value := string(data[:space]); value != "-" {
+			header[i] = value
+		}
+		data = data[space+1:]
+	}
+	m.Timestamp, m.Hostname, m.App, m.ProcID, m.MsgID = header[0], header[1], header[2], header[3], header[4]
+	if timestamp, err := time.Parse(time.RFC3339Nano, m.Timestamp); err == nil {
+		m.Timestamp = timestamp.UTC().Format(time.RFC3339Nano)
+	}
+
+	structuredData, rest, ok := parseStructuredData(data)
+	if !ok {
+		return false
+	}
+	m.StructuredData = structuredData
+	if len(rest) > 0 {
+		if rest[0] != ' ' {
+			return false
+		}
+		m.Msg = string(bytes.TrimPrefix(rest[1:], utf8BOM))
+	}
+	return true
+}
+
+// parseStructuredData parses the [id name="value" ...] elements of a message, or the - nil value
+func parseStructuredData(data []byte) (map[string]map[string]string, []byte, bool) {
+	if len(data) > 0 && data[0] == '-' {
+		return nil, data[1:], true
+	}
+	elements := map[string]map[string]string{}
+	for len(data) > 0 && data[0] == '[' {
+		data = data[1:]
+		end := bytes.IndexAny(data, " ]")
+		if end <= 0 {
+			return nil, nil, false
+		}
+		id := string(data[:end])
+		data = data[end:]
+		params := map[string]string{}
+		for len(data) > 0 && data[0] == ' ' {
+			equals := bytes.IndexByte(data, '=')
+			if equals <= 1 || len(data) < equals+2 || data[equals+1] != '"' {
+				return nil, nil, false
+			}
+			name := string(data[1:equals])
+			value, rest, ok := parseParamValue(data[equals+2:])
+			if !ok {
+				return nil, nil, false
+			}
+			params[name] = value
+			data = rest
+		}
+		if len(data) == 0 || data[0] != ']' {
+			return nil, nil, false
+		}
+		data = data[1:]
+		elements[id] = params
+	}
+	if len(elements) == 0 {
+		return nil, nil, false
+	}
+	return elements, data, true
+}
+
+// parseParamValue parses a parameter value up to its closing quote, unescaping \", \\ and \]
+func parseParamValue(data []byte) (string, []byte, bool) {
+	value := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		switch {
+		case data[i] == '\\' && i+1 < len(data) && bytes.IndexByte([]byte(`"\]`), data[i+1]) >= 0:
+			i++
+			value = append(value, data[i])
+		case data[i] == '"':
+			return string(value), data[i+1:], true
+		default:
+			value = append(value, data[i])
+		}
+	}
+	return "", nil, false
+}
+
+// parseRFC3164 parses the timestamp, hostname and tag of a BSD syslog message, parts which are missing are left
+// empty and the rest of the message is kept as msg
+func parseRFC3164(m *syslogMessage, data []byte, received time.Time) {
+	if len(data) > len(time.Stamp) && data[len(time.Stamp)] == ' ' {
+		if timestamp, err := time.Parse(time.Stamp, string(data[:len(time.Stamp)])); err == nil {
+			// the year is not sent, a timestamp in the future is from the previous year
+			t := time.Date(received.Year(), timestamp.Month(), timestamp.Day(), timestamp.Hour(), timestamp.Minute(),
+				timestamp.Second(), 0, received.Location())
+			if t.After(received.AddDate(0, 0, 1)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+			m.Timestamp = t.UTC().Format(time.RFC3339Nano)
+			data = data[len(time.Stamp)+1:]
+
+			// devices which omit the hostname send the tag right after the timestamp
+			if space := bytes.IndexByte(data, ' '); space > 0 && !bytes.ContainsAny(data[:space], ":[") {
+				m.Hostname = string(data[:space])
+				data = data[space+1:]
+			}
+		}
+	}
+
+	tag := 0
+	for tag < len(data) && tag < 48 && isTagChar(data[tag]) {
+		tag++
+	}
+	if tag > 0 && tag < len(data) && (data[tag] == '[' || data[tag] == ':') {
+		m.App = string(data[:tag])
+		data = data[tag:]
+		if data[0] == '[' {
+			if end := bytes.IndexByte(data, ']'); end > 0 {
+				m.ProcID = string(data[1:end])
+				data = data[end+1:]
+			}
+		}
+		data = bytes.TrimPrefix(data, []byte(":"))
+		data = bytes.TrimPrefix(data, []byte(" "))
+	}
+	m.Msg = string(data)
+}
+
+func isTagChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '/'
+}
+
+// splitSyslog splits a TCP stream into syslog messages framed by octet counting e.g. "42 <34>1 ...", or
+// separated by newlines (RFC 6587)
+func splitSyslog(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) > 0 && data[0] >= '1' && data[0] <= '9' {
+		space := bytes.IndexByte(data, ' ')
+		if space < 0 && len(data) <= syslogMaxOctetCountLen && !atEOF {
+			return 0, nil, nil
+		}
+		if space > 0 && space <= syslogMaxOctetCountLen {
+			if length, err := strconv.Atoi(string(data[:space])); err == nil {
+				end := space + 1 + length
+				if len(data) >= end {
+					return end, data[space+1 : end], nil
+				}
+				if atEOF {
+					return 0, nil, io.ErrUnexpectedEOF
+				}
+				return 0, nil, nil
+			}
+		}
+	}
+	return bufio.ScanLines(data, atEOF)
+}
+
+// udpListener ingests every datagram received at an address
+type udpListener struct {
+	conn    net.PacketConn
+	ingest  func(body []byte, o origin) error
+	closed  int32
+	running sync.WaitGroup
+}
+
+// newUDPListener listens at the address, it returns nil if the address is not set
+func newUDPListener(address string, ingest func(body []byte, o origin) error) *udpListener {
+	if address == "" {
+		return nil
+	}
+	conn, err := netListenPacket("udp", address)
+	if err != nil {
+		logFatalf("Error creating udp listener: %s", err)
+		return nil
+	}
+	return &udpListener{conn: conn, ingest: ingest}
+}
+
+func (u *udpListener) start() {
+	fmt.Println("Starting udp listener at address: ", u.conn.LocalAddr())
+	u.running.Add(1)
+	go u.serve()
+}
+
+func (u *udpListener) serve() {
+	defer u.running.Done()
+	buf := make([]byte, syslogMaxDatagramSize)
+	for {
+		n, addr, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			if atomic.LoadInt32(&u.closed) == 1 {
+				return
+			}
+			log.Println("Error reading udp datagram: ", err)
+			continue
+		}
+		if n == 0 {
+			continue
+		}
+		remoteAddr := addr.String()
+		remoteIP, _, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			remoteIP = remoteAddr
+		}
+		o := origin{received: time.Now(), remoteAddr: remoteAddr, remoteIP: remoteIP, requestID: newRequestID()}
+		u.ingest(append([]byte(nil), buf[:n]...), o)
+	}
+}
+
+// Close stops reading datagrams and waits for the last one to be ingested
+func (u *udpListener) Close() {
+	atomic.StoreInt32(&u.closed, 1)
+	u.conn.Close()
+	u.running.Wait()
+}
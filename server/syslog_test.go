@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseSyslog(t *testing.T) {
+	received := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		message string
+		want    syslogMessage
+	}{
+		{"rfc 5424", `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application"] An application event`,
+			syslogMessage{Facility: "local4", Severity: "notice", Timestamp: "2003-10-11T22:14:15.003Z", Hostname: "mymachine.example.com",
+				App: "evntslog", MsgID: "ID47", StructuredData: map[string]map[string]string{"exampleSDID@32473": {"iut": "3", "eventSource": "Application"}},
+				Msg: "An application event"}},
+		{"rfc 5424 with nil values", "<34>1 2003-10-11T22:14:15-07:00 - su 77 - - \xEF\xBB\xBF'su root' failed\n",
+			syslogMessage{Facility: "auth", Severity: "crit", Timestamp: "2003-10-12T05:14:15Z", App: "su", ProcID: "77", Msg: "'su root' failed"}},
+		{"rfc 5424 without a message", `<14>1 - host app - - [a@1][b@1 x="\"quoted\" \] \\"]`,
+			syslogMessage{Facility: "user", Severity: "info", Hostname: "host", App: "app",
+				StructuredData: map[string]map[string]string{"a@1": {}, "b@1": {"x": `"quoted" ] \`}}}},
+		{"rfc 3164", "<13>Jan  2 07:32:18 10.0.0.99 sshd[42]: Accepted publickey",
+			syslogMessage{Facility: "user", Severity: "notice", Timestamp: "2020-01-02T07:32:18Z", Hostname: "10.0.0.99", App: "sshd",
+				ProcID: "42", Msg: "Accepted publickey"}},
+		{"rfc 3164 from the previous year", "<0>Dec 31 23:59:59 host kernel: panic",
+			syslogMessage{Facility: "kern", Severity: "emerg", Timestamp: "2019-12-31T23:59:59Z", Hostname: "host", App: "kernel", Msg: "panic"}},
+		{"rfc 3164 without a hostname", "<30>Jan  2 09:00:00 cron: job done",
+			syslogMessage{Facility: "daemon", Severity: "info", Timestamp: "2020-01-02T09:00:00Z", App: "cron", Msg: "job done"}},
+		{"rfc 3164 without a timestamp", "<30>just a message",
+			syslogMessage{Facility: "daemon", Severity: "info", Msg: "just a message"}},
+		{"malformed rfc 5424 is parsed as rfc 3164", "<30>1 broken",
+			syslogMessage{Facility: "daemon", Severity: "info", Msg: "1 broken"}},
+		{"invalid priority", "<999>hello", syslogMessage{Facility: "user", Severity: "notice", Msg: "<999>hello"}},
+		{"missing priority", "hello", syslogMessage{Facility: "user", Severity: "notice", Msg: "hello"}},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseSyslog([]byte(test.message), received); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseSyslog() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func Test_splitSyslog(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []string
+	}{
+		{"newlines", "<13>a\n<13>b\n", []string{"<13>a", "<13>b"}},
+		{"octet counting", "5 <13>a9 <13>b\nc d\n", []string{"<13>a", "<13>b\nc d", ""}},
+		{"mixed", "<13>a\n5 <13>b<13>c", []string{"<13>a", "<13>b", "<13>c"}},
+		{"numbers which are not lengths", "42\n", []string{"42"}},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			scanner := bufio.NewScanner(strings.NewReader(test.stream))
+			scanner.Split(splitSyslog)
+			var got []string
+			for scanner.Scan() {
+				got = append(got, scanner.Text())
+			}
+			if scanner.Err() != nil || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("split %q, %v, want %q", got, scanner.Err(), test.want)
+			}
+		})
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader("10 <13>a"))
+	scanner.Split(splitSyslog)
+	if scanner.Scan() || scanner.Err() == nil {
+		t.Error("a truncated frame should be an error")
+	}
+}
+
+func Test_syslogConverter_convert(t *testing.T) {
+	tests := []struct {
+		name    string
+		field   string
+		message string
+		want    string
+	}{
+		{"routes by hostname", "hostname", "<13>1 - web-1 app - - - hello",
+			`{"client_id":"web-1","facility":"user","severity":"notice","hostname":"web-1","app":"app","msg":"hello"}`},
+		{"defaults the hostname to the sender", "hostname", "hello",
+			`{"client_id":"10.0.0.1","facility":"user","severity":"notice","hostname":"10.0.0.1","msg":"hello"}`},
+		{"routes by structured data", "structured_data.origin.tenant", `<13>1 - h - - - [origin tenant="7"]`,
+			`{"client_id":"7","facility":"user","severity":"notice","hostname":"h","structured_data":{"origin":{"tenant":"7"}},"msg":""}`},
+		{"missing fields are not routed", "app", "<13>1 - h - - - - hi",
+			`{"facility":"user","severity":"notice","hostname":"h","msg":"hi"}`},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			c := &syslogConverter{clientIDField: test.field}
+			if got := string(c.convert([]byte(test.message), origin{remoteIP: "10.0.0.1"})); got != test.want {
+				t.Errorf("convert() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func Test_newSyslogListeners(t *testing.T) {
+	tests := []struct {
+		name            string
+		env             map[string]string
+		wantListeners   int
+		shouldCallFatal bool
+	}{
+		{"disabled", map[string]string{}, 0, false},
+		{"udp and tcp", map[string]string{syslogUDPAddress: "127.0.0.1:0", syslogTCPAddress: "127.0.0.1:0"}, 2, false},
+		{"client id field", map[string]string{syslogUDPAddress: "127.0.0.1:0", syslogClientIDField: "app"}, 1, false},
+		{"should call fatal for invalid addresses", map[string]string{syslogUDPAddress: "invalid"}, 0, true},
+		{"should call fatal for invalid message sizes", map[string]string{syslogTCPAddress: "127.0.0.1:0", syslogTCPMaxSize: "big"},
+			1, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				os.Setenv(name, value)
+			}
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				for name := range test.env {
+					os.Unsetenv(name)
+				}
+			}()
+
+			got := newSyslogListeners(nil)
+			if len(got) != test.wantListeners {
+				t.Errorf("newSyslogListeners() = %v, want %d listeners", got, test.wantListeners)
+			}
+			for _, l := range got {
+				switch l := l.(type) {
+				case *udpListener:
+					l.conn.Close()
+				case *tcpListener:
+					l.listener.Close()
+				}
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+func Test_syslogListeners(t *testing.T) {
+	os.Setenv(syslogUDPAddress, "127.0.0.1:0")
+	os.Setenv(syslogTCPAddress, "127.0.0.1:0")
+	defer os.Unsetenv(syslogUDPAddress)
+	defer os.Unsetenv(syslogTCPAddress)
+
+	i := &ingested{}
+	listeners := newSyslogListeners(i.ingest)
+	for _, l := range listeners {
+		l.start()
+	}
+	u, tcp := listeners[0].(*udpListener), listeners[1].(*tcpListener)
+
+	udpConn, err := net.Dial("udp", u.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	fmt.Fprint(udpConn, "<13>1 - udp-host app - - - over udp")
+	for len(i.get()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	tcpConn, err := net.Dial("tcp", tcp.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	framed := "<13>1 - tcp-host app - - - a\nb"
+	fmt.Fprintf(tcpConn, "%d %s<13>Jan  2 09:00:00 tcp-host app: c\n", len(framed), framed)
+	tcpConn.(*net.TCPConn).CloseWrite()
+	waitClosed(t, tcpConn)
+
+	for _, l := range listeners {
+		l.Close()
+	}
+	want := []string{
+		`{"client_id":"udp-host","facility":"user","severity":"notice","hostname":"udp-host","app":"app","msg":"over udp"}`,
+		`{"client_id":"tcp-host","facility":"user","severity":"notice","hostname":"tcp-host","app":"app","msg":"a\nb"}`,
+	}
+	got := i.get()
+	if len(got) != 3 || !reflect.DeepEqual(got[:2], want) || !strings.Contains(got[2], `"msg":"c"`) {
+		t.Errorf("ingested %v, want %v", got, want)
+	}
+	if o := i.origins[0]; o.remoteIP != "127.0.0.1" || o.requestID == "" {
+		t.Errorf("origin = %+v", o)
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	tcpAddress     = "TCP_ADDRESS"
+	tcpTLSCert     = "TCP_TLS_CERT"
+	tcpTLSKey      = "TCP_TLS_KEY"
+	tcpIdleTimeout = "TCP_IDLE_TIMEOUT"
+	tcpMaxLineSize = "TCP_MAX_LINE_SIZE"
+
+	defaultTCPIdleTimeout = 5 * time.Minute
+	defaultTCPMaxLineSize = 1024 * 1024
+)
+
+var (
+	netListen          = net.Listen
+	tlsLoadX509KeyPair = tls.LoadX509KeyPair
+)
+
+// listener is an input which runs alongside the http server
+type listener interface {
+	start()
+	Close()
+}
+
+// newListeners returns the inputs which are configured, messages they receive are passed to ingest
+func newListeners(ingest func(body []byte, o origin) error) []listener {
+	var listeners []listener
+	if t := newTCPListener(tcpEnv, bufio.ScanLines, ingest); t != nil {
+		listeners = append(listeners, t)
+	}
+	if g := newGRPCListener(ingest); g != nil {
+		listeners = append(listeners, g)
+	}
+	return append(listeners, newSyslogListeners(ingest)...)
+}
+
+// tcpSettings are the names of the environment variables configuring a tcp listener
+type tcpSettings struct {
+	address     string
+	tlsCert     string
+	tlsKey      string
+	idleTimeout string
+	maxLineSize string
+}
+
+var tcpEnv = tcpSettings{tcpAddress, tcpTLSCert, tcpTLSKey, tcpIdleTimeout, tcpMaxLineSize}
+
+// tcpListener accepts newline delimited JSON over TCP, each line is ingested like the body of a request. A line
+// is ingested before the next one is read, so a client writing faster than its stream is uploaded is slowed down
+// by TCP flow control
+type tcpListener struct {
+	listener    net.Listener
+	split       bufio.SplitFunc
+	ingest      func(body []byte, o origin) error
+	idleTimeout time.Duration
+	maxLineSize int
+
+	mutex   sync.Mutex
+	conns   map[net.Conn]struct{}
+	closed  bool
+	running sync.WaitGroup
+}
+
+// newTCPListener listens at the address, with TLS if the certificate and key are set, it returns nil if the
+// address is not set. The messages of a connection are separated by split
+func newTCPListener(env tcpSettings, split bufio.SplitFunc, ingest func(body []byte, o origin) error) *tcpListener {
+	address := os.Getenv(env.address)
+	if address == "" {
+		return nil
+	}
+	t := &tcpListener{
+		split:       split,
+		ingest:      ingest,
+		idleTimeout: defaultTCPIdleTimeout,
+		maxLineSize: defaultTCPMaxLineSize,
+		conns:       map[net.Conn]struct{}{},
+	}
+	if timeout := os.Getenv(env.idleTimeout); timeout != "" {
+		var err error
+		if t.idleTimeout, err = time.ParseDuration(timeout); err != nil || t.idleTimeout <= 0 {
+			logFatalf("%s must be a positive duration e.g. 5m", env.idleTimeout)
+		}
+	}
+	if size := os.Getenv(env.maxLineSize); size != "" {
+		var err error
+		if t.maxLineSize, err = strconv.Atoi(size); err != nil || t.maxLineSize <= 0 {
+			logFatalf("%s must be a positive number of bytes", env.maxLineSize)
+		}
+	}
+
+	listener, err := netListen("tcp", address)
+	if err != nil {
+		logFatalf("Error creating tcp listener: %s", err)
+		return nil
+	}
+	cert, key := os.Getenv(env.tlsCert), os.Getenv(env.tlsKey)
+	if cert != "" || key != "" {
+		certificate, err := tlsLoadX509KeyPair(cert, key)
+		if err != nil {
+			listener.Close()
+			logFatalf("Error loading %s and %s: %s", env.tlsCert, env.tlsKey, err)
+			return nil
+		}
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12})
+	}
+	t.listener = listener
+	return t
+}
+
+func (t *tcpListener) start() {
+	go t.serve()
+}
+
+// serve accepts connections until the listener is closed
+func (t *tcpListener) serve() {
+	fmt.Println("Starting tcp listener at address: ", t.listener.Addr())
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			t.mutex.Lock()
+			closed := t.closed
+			t.mutex.Unlock()
+			if closed {
+				return
+			}
+			log.Println("Error accepting tcp connection: ", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		t.mutex.Lock()
+		if t.closed {
+			t.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		t.conns[conn] = struct{}{}
+		t.running.Add(1)
+		t.mutex.Unlock()
+		go t.handle(conn)
+	}
+}
+
+// handle ingests the lines of a connection, the connection is closed when it is idle for the idle timeout, a
+// line is too long or a message cannot be stored so the client can retry it
+func (t *tcpListener) handle(conn net.Conn) {
+	defer t.running.Done()
+	defer func() {
+		t.mutex.Lock()
+		delete(t.conns, conn)
+		t.mutex.Unlock()
+		conn.Close()
+	}()
+
+	remoteAddr := conn.RemoteAddr().String()
+	remoteIP, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		remoteIP = remoteAddr
+	}
+	bufferSize := 64 * 1024
+	if bufferSize > t.maxLineSize {
+		bufferSize = t.maxLineSize
+	}
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(t.split)
+	scanner.Buffer(make([]byte, 0, bufferSize), t.maxLineSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(t.idleTimeout))
+		if !scanner.Scan() {
+			break
+		}
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte("\r"))
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		o := origin{received: time.Now(), remoteAddr: remoteAddr, remoteIP: remoteIP, requestID: newRequestID()}
+		if _, ok := t.ingest(line, o).(*unavailableError); ok {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println("Closing tcp connection from", remoteAddr, err)
+	}
+}
+
+// Close stops accepting connections, closes the open connections and waits for their lines to be ingested
+func (t *tcpListener) Close() {
+	t.mutex.Lock()
+	t.closed = true
+	t.listener.Close()
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mutex.Unlock()
+	t.running.Wait()
+}
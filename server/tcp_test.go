@@ -0,0 +1,261 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_newTCPListener(t *testing.T) {
+	tests := []struct {
+		name            string
+		env             map[string]string
+		wantNil         bool
+		wantIdleTimeout time.Duration
+		wantMaxLineSize int
+		shouldCallFatal bool
+	}{
+		{"disabled", map[string]string{}, true, 0, 0, false},
+		{"defaults", map[string]string{tcpAddress: "127.0.0.1:0"}, false, defaultTCPIdleTimeout, defaultTCPMaxLineSize, false},
+		{"options", map[string]string{tcpAddress: "127.0.0.1:0", tcpIdleTimeout: "30s", tcpMaxLineSize: "4096"},
+			false, 30 * time.Second, 4096, false},
+		{"should call fatal for invalid idle timeouts", map[string]string{tcpAddress: "127.0.0.1:0", tcpIdleTimeout: "never"},
+			false, 0, defaultTCPMaxLineSize, true},
+		{"should call fatal for invalid line sizes", map[string]string{tcpAddress: "127.0.0.1:0", tcpMaxLineSize: "-1"},
+			false, defaultTCPIdleTimeout, -1, true},
+		{"should call fatal for missing certificates", map[string]string{tcpAddress: "127.0.0.1:0", tcpTLSCert: "missing.pem",
+			tcpTLSKey: "missing.key"}, true, 0, 0, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				os.Setenv(name, value)
+			}
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				for name := range test.env {
+					os.Unsetenv(name)
+				}
+			}()
+
+			got := newTCPListener(tcpEnv, bufio.ScanLines, nil)
+			if (got == nil) != test.wantNil {
+				t.Fatalf("newTCPListener() = %v, wantNil %v", got, test.wantNil)
+			}
+			if got != nil {
+				defer got.listener.Close()
+				if got.idleTimeout != test.wantIdleTimeout || got.maxLineSize != test.wantMaxLineSize {
+					t.Errorf("idle timeout = %v, max line size = %d", got.idleTimeout, got.maxLineSize)
+				}
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+// ingested records the lines ingested by a tcp listener
+type ingested struct {
+	mutex   sync.Mutex
+	lines   []string
+	origins []origin
+	err     error
+}
+
+func (i *ingested) ingest(body []byte, o origin) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.lines = append(i.lines, string(body))
+	i.origins = append(i.origins, o)
+	return i.err
+}
+
+func (i *ingested) get() []string {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return append([]string(nil), i.lines...)
+}
+
+func startTCPListener(t *testing.T, env map[string]string, i *ingested) *tcpListener {
+	env[tcpAddress] = "127.0.0.1:0"
+	for name, value := range env {
+		os.Setenv(name, value)
+	}
+	defer func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	}()
+	l := newTCPListener(tcpEnv, bufio.ScanLines, i.ingest)
+	l.start()
+	return l
+}
+
+// waitClosed waits for the server to close the connection
+func waitClosed(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// the connection is reset if the server closed it before reading everything
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Errorf("the connection was not closed: %v", err)
+		}
+	}
+}
+
+func Test_tcpListener(t *testing.T) {
+	i := &ingested{}
+	l := startTCPListener(t, map[string]string{}, i)
+
+	conn, err := net.Dial("tcp", l.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "{\"client_id\":1}\r\n\n  \n{\"client_id\":2}\n{\"client_id\":3}")
+	conn.(*net.TCPConn).CloseWrite()
+	waitClosed(t, conn)
+
+	want := []string{`{"client_id":1}`, `{"client_id":2}`, `{"client_id":3}`}
+	if fmt.Sprint(i.get()) != fmt.Sprint(want) {
+		t.Errorf("ingested %v, want %v", i.get(), want)
+	}
+	if o := i.origins[0]; o.remoteAddr != conn.LocalAddr().String() || o.remoteIP != "127.0.0.1" || o.requestID == "" {
+		t.Errorf("origin = %+v", o)
+	}
+	l.Close()
+}
+
+func Test_tcpListener_closesConnections(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		err   error
+		write string
+	}{
+		{"idle connections", map[string]string{tcpIdleTimeout: "50ms"}, nil, "{}\n"},
+		{"lines which are too long", map[string]string{tcpMaxLineSize: "8"}, nil, "{\"client_id\":1}\n"},
+		{"when messages cannot be stored", map[string]string{}, &unavailableError{errors.New("full")}, "{}\n{}\n"},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			i := &ingested{err: test.err}
+			l := startTCPListener(t, test.env, i)
+			defer l.Close()
+
+			conn, err := net.Dial("tcp", l.listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			fmt.Fprint(conn, test.write)
+			waitClosed(t, conn)
+			if len(i.get()) > 1 {
+				t.Errorf("ingested %v after the connection should have been closed", i.get())
+			}
+		})
+	}
+}
+
+func Test_tcpListener_Close(t *testing.T) {
+	i := &ingested{}
+	l := startTCPListener(t, map[string]string{}, i)
+	conn, err := net.Dial("tcp", l.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "{}\n")
+	for len(i.get()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	l.Close()
+	waitClosed(t, conn)
+	if _, err := net.Dial("tcp", l.listener.Addr().String()); err == nil {
+		t.Error("the listener still accepts connections")
+	}
+}
+
+func Test_tcpListener_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	writeCertificate(t, certFile, keyFile)
+
+	i := &ingested{}
+	l := startTCPListener(t, map[string]string{tcpTLSCert: certFile, tcpTLSKey: keyFile}, i)
+	defer l.Close()
+
+	conn, err := tls.Dial("tcp", l.listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "{\"client_id\":1}\n")
+	conn.CloseWrite()
+	waitClosed(t, conn)
+	if fmt.Sprint(i.get()) != `[{"client_id":1}]` {
+		t.Errorf("ingested %v", i.get())
+	}
+}
+
+// writeCertificate writes a self-signed certificate for localhost
+func writeCertificate(t *testing.T, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, certFile, "CERTIFICATE", cert)
+	writePEM(t, keyFile, "EC PRIVATE KEY", der)
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	defer w.Flush()
+	if err := pem.Encode(w, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		t.Fatal(err)
+	}
+}
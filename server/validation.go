@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fasthttp-server/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+const (
+	schemaDir       = "SCHEMA_DIR"
+	schemaExtension = ".json"
+)
+
+// validator validates messages against the JSON Schema documents in SCHEMA_DIR, a schema named
+// after the routing key of a message e.g. login.json takes precedence over one named after its
+// client id e.g. 42.json. Messages without a matching schema are not validated
+type validator struct {
+	schemas map[string]*gojsonschema.Schema
+}
+
+func newValidator() *validator {
+	v := &validator{schemas: map[string]*gojsonschema.Schema{}}
+	dir := os.Getenv(schemaDir)
+	if dir == "" {
+		return v
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logFatalf("Cannot read %s: %s", schemaDir, err)
+		return v
+	}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != schemaExtension {
+			continue
+		}
+		path, err := filepath.Abs(filepath.Join(dir, file.Name()))
+		if err != nil {
+			logFatalf("Cannot load schema %s: %s", file.Name(), err)
+			continue
+		}
+		schema, err := gojsonschema.NewSchema(gojsonschema.NewReferenceLoader("file://" + filepath.ToSlash(path)))
+		if err != nil {
+			logFatalf("Invalid schema %s: %s", file.Name(), err)
+			continue
+		}
+		v.schemas[strings.TrimSuffix(file.Name(), schemaExtension)] = schema
+	}
+	return v
+}
+
+// validate returns the validation errors of the message, or nil if it is valid
+func (v *validator) validate(message []byte, clientID, partition string) ([]string, error) {
+	schema, ok := v.schemas[storage.SanitizeKey(partition)]
+	if !ok {
+		schema, ok = v.schemas[storage.SanitizeKey(clientID)]
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(message))
+	if err != nil {
+		return nil, err
+	}
+	if result.Valid() {
+		return nil, nil
+	}
+
+	errors := make([]string, 0, len(result.Errors()))
+	for _, e := range result.Errors() {
+		errors = append(errors, e.String())
+	}
+	return errors, nil
+}
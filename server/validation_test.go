@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fasthttp-server/mocks"
+	"fasthttp-server/pipe"
+	"fasthttp-server/storage"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/valyala/fasthttp"
+)
+
+const testSchema = `{
+	"type": "object",
+	"required": ["client_id", "text"],
+	"properties": {"text": {"type": "string"}}
+}`
+
+func writeSchemas(t *testing.T, schemas map[string]string) string {
+	dir, err := ioutil.TempDir("", "schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, schema := range schemas {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(schema), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func Test_newValidator(t *testing.T) {
+	tests := []struct {
+		name            string
+		schemas         map[string]string
+		want            []string
+		shouldCallFatal bool
+	}{
+		{"loads json files", map[string]string{"42.json": testSchema, "login.json": testSchema, "notes.txt": "x"},
+			[]string{"42", "login"}, false},
+		{"should call fatal for invalid schemas", map[string]string{"42.json": `{"type": 1}`}, nil, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeSchemas(t, test.schemas)
+			os.Setenv(schemaDir, dir)
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				os.Unsetenv(schemaDir)
+				os.RemoveAll(dir)
+			}()
+
+			v := newValidator()
+			if len(v.schemas) != len(test.want) {
+				t.Errorf("wanted %d schemas but got %d", len(test.want), len(v.schemas))
+			}
+			for _, name := range test.want {
+				if _, ok := v.schemas[name]; !ok {
+					t.Errorf("schema %s was not loaded", name)
+				}
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+func Test_validator_validate(t *testing.T) {
+	dir := writeSchemas(t, map[string]string{"42.json": testSchema, "login.json": `{"required": ["user"]}`})
+	os.Setenv(schemaDir, dir)
+	defer func() {
+		os.Unsetenv(schemaDir)
+		os.RemoveAll(dir)
+	}()
+	v := newValidator()
+
+	tests := []struct {
+		name      string
+		message   string
+		clientID  string
+		partition string
+		wantErrs  int
+	}{
+		{"valid for client schema", `{"client_id":42,"text":"hi"}`, "42", "42", 0},
+		{"invalid for client schema", `{"client_id":42,"text":1}`, "42", "42", 1},
+		{"routing key schema takes precedence", `{"client_id":42,"user":"a"}`, "42", "login", 0},
+		{"invalid for routing key schema", `{"client_id":42}`, "42", "login", 1},
+		{"no schema", `{"client_id":7}`, "7", "7", 0},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			got, err := v.validate([]byte(test.message), test.clientID, test.partition)
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if len(got) != test.wantErrs {
+				t.Errorf("wanted %d errors but got %v", test.wantErrs, got)
+			}
+		})
+	}
+}
+
+func Test_server_requestHandler_invalidSchema(t *testing.T) {
+	dir := writeSchemas(t, map[string]string{"42.json": testSchema})
+	os.Setenv(schemaDir, dir)
+	defer func() {
+		os.Unsetenv(schemaDir)
+		os.RemoveAll(dir)
+	}()
+
+	mockCtrl := gomock.NewController(t)
+	mockPipe := mocks.NewMockGzipWriter(mockCtrl)
+	mockStreamer := mocks.NewMockMessageStreamer(mockCtrl)
+	// only the dead letter is written
+	mockPipe.EXPECT().Write(gomock.Any()).Times(1)
+	mockStreamer.EXPECT().Stream(gomock.Any()).AnyTimes()
+	pipeNew = func() pipe.GzipWriter {
+		return mockPipe
+	}
+	s3New = func(storage.Object, int, int) storage.MessageStreamer {
+		return mockStreamer
+	}
+	defer func() {
+		s3New = storage.NewS3Streamer
+		pipeNew = pipe.NewGzipWriter
+	}()
+
+	s := &server{
+		dataPipes:   map[string]pipe.GzipWriter{},
+		streamers:   map[string]storage.MessageStreamer{},
+		router:      newRouter(),
+		pipes:       &pipeFactory{},
+		validator:   newValidator(),
+		redactor:    newRedactor(),
+		enricher:    newEnricher(),
+		deadLetters: newDeadLetters(&pipeFactory{}),
+		decoder:     newDecoder(),
+	}
+	before := counter(metricInvalidSchema)
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetBodyString(`{"client_id":42}`)
+	s.requestHandler(&ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusUnprocessableEntity {
+		t.Errorf("unexpected status code: %d. Expecting %d", ctx.Response.StatusCode(), fasthttp.StatusUnprocessableEntity)
+	}
+	want := `{"errors":["(root): text is required"]}`
+	if string(ctx.Response.Body()) != want {
+		t.Errorf("wanted %s but got %s", want, ctx.Response.Body())
+	}
+	if after := counter(metricInvalidSchema); after != before+1 {
+		t.Errorf("wanted counter %d but got %d", before+1, after)
+	}
+
+	mockCtrl.Finish()
+}
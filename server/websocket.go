@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	websocketPath           = "WEBSOCKET_PATH"
+	websocketTokens         = "WEBSOCKET_TOKENS"
+	websocketIdleTimeout    = "WEBSOCKET_IDLE_TIMEOUT"
+	websocketMaxMessageSize = "WEBSOCKET_MAX_MESSAGE_SIZE"
+
+	defaultWebSocketPath        = "/v1/stream"
+	defaultWebSocketIdleTimeout = 5 * time.Minute
+	defaultWebSocketMaxSize     = 1024 * 1024
+
+	websocketTokenParam   = "access_token"
+	websocketWriteTimeout = 10 * time.Second
+
+	ackOK          = "ok"
+	ackInvalid     = "invalid"
+	ackUnavailable = "unavailable"
+)
+
+// websocketHandler streams messages of authenticated clients over WebSocket connections. Every message is
+// acknowledged with its sequence number once it is written to its pipe, so a client can resend the messages which
+// were not acknowledged after reconnecting
+type websocketHandler struct {
+	path        string
+	tokens      map[string]string
+	idleTimeout time.Duration
+	maxSize     int
+	ingest      func(body []byte, o origin) error
+	upgrader    websocket.FastHTTPUpgrader
+
+	mutex   sync.Mutex
+	conns   map[*websocket.Conn]struct{}
+	closed  bool
+	running sync.WaitGroup
+}
+
+// streamFrame is a message sent by a client, seq is chosen by the client and echoed in the ack
+type streamFrame struct {
+	Seq     uint64              `json:"seq"`
+	Message jsoniter.RawMessage `json:"message"`
+}
+
+// streamAck acknowledges a message, messages with the status unavailable should be sent again
+type streamAck struct {
+	Seq    uint64   `json:"seq"`
+	Status string   `json:"status"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// newWebSocketHandler returns nil if WEBSOCKET_TOKENS is not set. Tokens are a comma separated list of
+// client_id:token pairs, the client id of a token is stored with every message sent with it
+func newWebSocketHandler(ingest func(body []byte, o origin) error) *websocketHandler {
+	tokens := os.Getenv(websocketTokens)
+	if tokens == "" {
+		return nil
+	}
+	w := &websocketHandler{
+		path:        defaultWebSocketPath,
+		tokens:      map[string]string{},
+		idleTimeout: defaultWebSocketIdleTimeout,
+		maxSize:     defaultWebSocketMaxSize,
+		ingest:      ingest,
+		upgrader:    newWebSocketUpgrader(),
+		conns:       map[*websocket.Conn]struct{}{},
+	}
+	if path := os.Getenv(websocketPath); path != "" {
+		w.path = path
+	}
+	for _, pair := range strings.Split(tokens, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			logFatalf("%s must be a comma separated list of client_id:token pairs", websocketTokens)
+			continue
+		}
+		w.tokens[parts[1]] = parts[0]
+	}
+	if timeout := os.Getenv(websocketIdleTimeout); timeout != "" {
+		var err error
+		if w.idleTimeout, err = time.ParseDuration(timeout); err != nil || w.idleTimeout <= 0 {
+			logFatalf("%s must be a positive duration e.g. 5m", websocketIdleTimeout)
+		}
+	}
+	if size := os.Getenv(websocketMaxMessageSize); size != "" {
+		var err error
+		if w.maxSize, err = strconv.Atoi(size); err != nil || w.maxSize <= 0 {
+			logFatalf("%s must be a positive number of bytes", websocketMaxMessageSize)
+		}
+	}
+	return w
+}
+
+// newWebSocketUpgrader accepts connections from any origin, clients are authenticated by their token and not by
+// cookies a page of another origin could send
+func newWebSocketUpgrader() websocket.FastHTTPUpgrader {
+	return websocket.FastHTTPUpgrader{
+		CheckOrigin: func(ctx *fasthttp.RequestCtx) bool { return true },
+	}
+}
+
+// serve upgrades requests to the WebSocket path, it returns false for other requests
+func (w *websocketHandler) serve(ctx *fasthttp.RequestCtx) bool {
+	if w == nil || string(ctx.Path()) != w.path {
+		return false
+	}
+	if !websocket.FastHTTPIsWebSocketUpgrade(ctx) {
+		ctx.Error("expected a websocket upgrade request", fasthttp.StatusBadRequest)
+		return true
+	}
+	clientID, ok := w.authenticate(ctx)
+	if !ok {
+		ctx.Error("invalid token", fasthttp.StatusUnauthorized)
+		return true
+	}
+
+	o := newOrigin(ctx)
+	w.upgrader.Upgrade(ctx, func(conn *websocket.Conn) {
+		w.handle(conn, clientID, o)
+	})
+	return true
+}
+
+// authenticate returns the client id of the bearer token, browsers which cannot set headers send the token as
+// the access_token query parameter
+func (w *websocketHandler) authenticate(ctx *fasthttp.RequestCtx) (string, bool) {
+	token := string(ctx.QueryArgs().Peek(websocketTokenParam))
+	if auth := string(ctx.Request.Header.Peek("Authorization")); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	clientID, found := "", false
+	for t, id := range w.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			clientID, found = id, true
+		}
+	}
+	return clientID, found
+}
+
+// closeConn sends a close frame with the code to the client, it is safe to call while the connection is read
+func closeConn(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(websocketWriteTimeout))
+}
+
+// handle reads the messages of a connection until the client closes it, it is idle for the idle timeout or it
+// breaks the protocol. Pings extend the idle timeout, messages larger than the max message size close the
+// connection
+func (w *websocketHandler) handle(conn *websocket.Conn, clientID string, o origin) {
+	w.mutex.Lock()
+	if w.closed {
+		w.mutex.Unlock()
+		closeConn(conn, websocket.CloseGoingAway, "shutting down")
+		return
+	}
+	w.conns[conn] = struct{}{}
+	w.running.Add(1)
+	w.mutex.Unlock()
+	defer func() {
+		w.mutex.Lock()
+		delete(w.conns, conn)
+		w.mutex.Unlock()
+		w.running.Done()
+	}()
+
+	conn.SetReadLimit(int64(w.maxSize))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(w.idleTimeout))
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(websocketWriteTimeout))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+	for {
+		conn.SetReadDeadline(time.Now().Add(w.idleTimeout))
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway,
+				websocket.CloseNoStatusReceived) {
+				log.Println("Closing websocket connection from", o.remoteAddr, err)
+			}
+			return
+		}
+
+		o.received, o.requestID = time.Now(), newRequestID()
+		ack, err := json.Marshal(w.ingestFrame(message, clientID, o))
+		if err != nil {
+			log.Println("Error encoding websocket ack: ", err)
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+		if err := conn.WriteMessage(websocket.TextMessage, ack); err != nil {
+			log.Println("Closing websocket connection from", o.remoteAddr, err)
+			return
+		}
+	}
+}
+
+// ingestFrame ingests the message of a frame as the authenticated client, the client id is added to messages
+// without one and messages of other clients are rejected. The idempotency key of the connection is suffixed with
+// the sequence number of the frame, so a frame sent again on a new connection with the same key is stored once
+func (w *websocketHandler) ingestFrame(data []byte, clientID string, o origin) streamAck {
+	var frame streamFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return streamAck{Status: ackInvalid, Errors: []string{err.Error()}}
+	}
+	ack := streamAck{Seq: frame.Seq, Status: ackOK}
+	if o.idempotencyKey != "" {
+		o.idempotencyKey = fmt.Sprintf("%s/%d", o.idempotencyKey, frame.Seq)
+	}
+	message := bytes.TrimSpace(frame.Message)
+	if len(message) == 0 || message[0] != '{' {
+		ack.Status, ack.Errors = ackInvalid, []string{"message must be a JSON object"}
+		return ack
+	}
+	var request Request
+	if err := json.Unmarshal(message, &request); err != nil {
+		ack.Status, ack.Errors = ackInvalid, []string{err.Error()}
+		return ack
+	}
+	switch string(request.ClientID) {
+	case clientID:
+	case "":
+		message = withClientID(message, clientID)
+	default:
+		ack.Status, ack.Errors = ackInvalid, []string{"client_id does not match the token"}
+		return ack
+	}
+
+	switch e := w.ingest(message, o).(type) {
+	case nil:
+	case *validationError:
+		ack.Status, ack.Errors = ackInvalid, e.errors
+	default:
+		ack.Status, ack.Errors = ackUnavailable, []string{e.Error()}
+	}
+	return ack
+}
+
+// withClientID adds the client id as the first field of a JSON object
+func withClientID(message []byte, clientID string) []byte {
+	id, _ := json.Marshal(clientID)
+	rest := bytes.TrimSpace(message[1:])
+	result := append([]byte(`{"client_id":`), id...)
+	if len(rest) > 0 && rest[0] != '}' {
+		result = append(result, ',')
+	}
+	return append(result, rest...)
+}
+
+// Close sends a going away frame to the open connections and waits for their messages to be ingested
+func (w *websocketHandler) Close() {
+	w.mutex.Lock()
+	w.closed = true
+	for conn := range w.conns {
+		closeConn(conn, websocket.CloseGoingAway, "shutting down")
+		conn.Close()
+	}
+	w.mutex.Unlock()
+	w.running.Wait()
+}
@@ -0,0 +1,354 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// continuationFrame is the opcode of the frames which continue a fragmented message
+const continuationFrame = 0
+
+func Test_newWebSocketHandler(t *testing.T) {
+	tests := []struct {
+		name            string
+		env             map[string]string
+		wantNil         bool
+		wantPath        string
+		wantTokens      map[string]string
+		shouldCallFatal bool
+	}{
+		{"disabled", map[string]string{}, true, "", nil, false},
+		{"tokens", map[string]string{websocketTokens: "1:secret, 2:other:token"}, false, defaultWebSocketPath,
+			map[string]string{"secret": "1", "other:token": "2"}, false},
+		{"path", map[string]string{websocketTokens: "1:secret", websocketPath: "/ws"}, false, "/ws",
+			map[string]string{"secret": "1"}, false},
+		{"should call fatal for tokens without a client id", map[string]string{websocketTokens: "secret"}, false,
+			defaultWebSocketPath, map[string]string{}, true},
+		{"should call fatal for invalid idle timeouts", map[string]string{websocketTokens: "1:secret", websocketIdleTimeout: "1"},
+			false, defaultWebSocketPath, map[string]string{"secret": "1"}, true},
+		{"should call fatal for invalid message sizes", map[string]string{websocketTokens: "1:secret", websocketMaxMessageSize: "0"},
+			false, defaultWebSocketPath, map[string]string{"secret": "1"}, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				os.Setenv(name, value)
+			}
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				for name := range test.env {
+					os.Unsetenv(name)
+				}
+			}()
+
+			got := newWebSocketHandler(nil)
+			if (got == nil) != test.wantNil {
+				t.Fatalf("newWebSocketHandler() = %v, wantNil %v", got, test.wantNil)
+			}
+			if got != nil && (got.path != test.wantPath || !reflect.DeepEqual(got.tokens, test.wantTokens)) {
+				t.Errorf("path = %s, tokens = %v", got.path, got.tokens)
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+// startWebSocketHandler serves the handler from an in memory listener
+func startWebSocketHandler(i *ingested) (*websocketHandler, *fasthttputil.InmemoryListener) {
+	w := &websocketHandler{
+		path:        defaultWebSocketPath,
+		tokens:      map[string]string{"secret": "1"},
+		idleTimeout: time.Second,
+		maxSize:     64,
+		ingest:      i.ingest,
+		upgrader:    newWebSocketUpgrader(),
+		conns:       map[*websocket.Conn]struct{}{},
+	}
+	ln := fasthttputil.NewInmemoryListener()
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) {
+		if !w.serve(ctx) {
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+		}
+	})
+	return w, ln
+}
+
+// dialWebSocket sends the upgrade request and returns the status of the response
+func dialWebSocket(t *testing.T, ln *fasthttputil.InmemoryListener, uri string, headers map[string]string) (net.Conn, *bufio.Reader, *fasthttp.Response) {
+	conn, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := "GET " + uri + " HTTP/1.1\r\nHost: localhost\r\n"
+	for name, value := range headers {
+		request += name + ": " + value + "\r\n"
+	}
+	fmt.Fprint(conn, request+"\r\n")
+
+	reader := bufio.NewReader(conn)
+	response := &fasthttp.Response{}
+	response.SkipBody = true
+	if err := response.Read(reader); err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, response
+}
+
+func upgradeHeaders(token string) map[string]string {
+	headers := map[string]string{
+		"Connection":            "keep-alive, Upgrade",
+		"Upgrade":               "websocket",
+		"Sec-WebSocket-Version": "13",
+		"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+	}
+	if token != "" {
+		headers["Authorization"] = "Bearer " + token
+	}
+	return headers
+}
+
+// writeClientFrame writes a masked frame as browsers do
+func writeClientFrame(conn net.Conn, fin bool, opcode int, payload string) {
+	header := []byte{byte(opcode), 0x80}
+	if fin {
+		header[0] |= 0x80
+	}
+	if len(payload) > 125 {
+		header[1] |= 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	} else {
+		header[1] |= byte(len(payload))
+	}
+	mask := []byte{1, 2, 3, 4}
+	masked := []byte(payload)
+	for i := range masked {
+		masked[i] ^= mask[i%4]
+	}
+	conn.Write(append(append(header, mask...), masked...))
+}
+
+func readServerFrame(t *testing.T, reader *bufio.Reader) (int, string) {
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	length := int(header[1] & 0x7F)
+	if length == 126 {
+		var extended [2]byte
+		if _, err := io.ReadFull(reader, extended[:]); err != nil {
+			t.Fatal(err)
+		}
+		length = int(binary.BigEndian.Uint16(extended[:]))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	return int(header[0] & 0x0F), string(payload)
+}
+
+func Test_websocketHandler_handshake(t *testing.T) {
+	tests := []struct {
+		name       string
+		uri        string
+		headers    map[string]string
+		wantStatus int
+	}{
+		{"upgrades with a bearer token", defaultWebSocketPath, upgradeHeaders("secret"), fasthttp.StatusSwitchingProtocols},
+		{"upgrades with a token parameter", defaultWebSocketPath + "?access_token=secret", upgradeHeaders(""), fasthttp.StatusSwitchingProtocols},
+		{"rejects invalid tokens", defaultWebSocketPath, upgradeHeaders("wrong"), fasthttp.StatusUnauthorized},
+		{"rejects missing tokens", defaultWebSocketPath, upgradeHeaders(""), fasthttp.StatusUnauthorized},
+		{"rejects requests which are not upgrades", defaultWebSocketPath, map[string]string{}, fasthttp.StatusBadRequest},
+		{"rejects other versions", defaultWebSocketPath, map[string]string{"Connection": "Upgrade", "Upgrade": "websocket",
+			"Sec-WebSocket-Version": "8", "Authorization": "Bearer secret"}, fasthttp.StatusBadRequest},
+		{"ignores other paths", "/", upgradeHeaders("secret"), fasthttp.StatusNotFound},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			_, ln := startWebSocketHandler(&ingested{})
+			defer ln.Close()
+			conn, _, response := dialWebSocket(t, ln, test.uri, test.headers)
+			defer conn.Close()
+			if response.StatusCode() != test.wantStatus {
+				t.Errorf("status = %d, want %d", response.StatusCode(), test.wantStatus)
+			}
+			if test.wantStatus == fasthttp.StatusSwitchingProtocols {
+				if accept := string(response.Header.Peek("Sec-WebSocket-Accept")); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+					t.Errorf("Sec-WebSocket-Accept = %s", accept)
+				}
+			}
+		})
+	}
+}
+
+func Test_websocketHandler_acks(t *testing.T) {
+	i := &ingested{}
+	w, ln := startWebSocketHandler(i)
+	defer ln.Close()
+	conn, reader, _ := dialWebSocket(t, ln, defaultWebSocketPath, upgradeHeaders("secret"))
+	defer conn.Close()
+
+	writeClientFrame(conn, true, websocket.TextMessage, `{"seq":1,"message":{"text":"hi"}}`)
+	writeClientFrame(conn, true, websocket.PingMessage, "ping")
+	writeClientFrame(conn, false, websocket.TextMessage, `{"seq":2,"message":`)
+	writeClientFrame(conn, true, continuationFrame, `{"client_id":"1"}}`)
+	writeClientFrame(conn, true, websocket.TextMessage, `{"seq":3,"message":{"client_id":2}}`)
+	writeClientFrame(conn, true, websocket.TextMessage, `{"seq":4,"message":[]}`)
+	writeClientFrame(conn, true, websocket.TextMessage, `not json`)
+
+	want := []string{
+		`{"seq":1,"status":"ok"}`,
+		"pong: ping",
+		`{"seq":2,"status":"ok"}`,
+		`{"seq":3,"status":"invalid","errors":["client_id does not match the token"]}`,
+		`{"seq":4,"status":"invalid","errors":["message must be a JSON object"]}`,
+	}
+	for _, frame := range want {
+		opcode, payload := readServerFrame(t, reader)
+		if opcode == websocket.PongMessage {
+			payload = "pong: " + payload
+		}
+		if payload != frame {
+			t.Errorf("received %s, want %s", payload, frame)
+		}
+	}
+	if opcode, payload := readServerFrame(t, reader); opcode != websocket.TextMessage || payload[:len(`{"seq":0,"status":"invalid"`)] != `{"seq":0,"status":"invalid"` {
+		t.Errorf("received %s for a frame which is not JSON", payload)
+	}
+
+	writeClientFrame(conn, true, websocket.CloseMessage, "")
+	if opcode, _ := readServerFrame(t, reader); opcode != websocket.CloseMessage {
+		t.Errorf("received opcode %d, want a close frame", opcode)
+	}
+	w.Close()
+
+	wantIngested := []string{`{"client_id":"1","text":"hi"}`, `{"client_id":"1"}`}
+	if !reflect.DeepEqual(i.get(), wantIngested) {
+		t.Errorf("ingested %v, want %v", i.get(), wantIngested)
+	}
+	if o := i.origins[0]; o.requestID == "" || o.requestID == i.origins[1].requestID {
+		t.Errorf("origins = %+v", i.origins)
+	}
+}
+
+func Test_websocketHandler_ingestErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"validation errors", &validationError{errors: []string{"text is required"}}, `{"seq":7,"status":"invalid","errors":["text is required"]}`},
+		{"unavailable storage", &unavailableError{errors.New("full")}, `{"seq":7,"status":"unavailable","errors":["storage unavailable: full"]}`},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			w := &websocketHandler{ingest: (&ingested{err: test.err}).ingest}
+			got, _ := json.Marshal(w.ingestFrame([]byte(`{"seq":7,"message":{}}`), "1", origin{}))
+			if string(got) != test.want {
+				t.Errorf("ack = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func Test_websocketHandler_closesConnections(t *testing.T) {
+	tests := []struct {
+		name      string
+		write     func(conn net.Conn)
+		wantClose int
+	}{
+		{"messages which are too big", func(conn net.Conn) {
+			writeClientFrame(conn, true, websocket.TextMessage, fmt.Sprintf(`{"seq":1,"message":{"text":"%0100d"}}`, 0))
+		}, websocket.CloseMessageTooBig},
+		{"fragments which are too big", func(conn net.Conn) {
+			writeClientFrame(conn, false, websocket.TextMessage, fmt.Sprintf(`{"seq":1,"message":{"text":"%040d`, 0))
+			writeClientFrame(conn, true, continuationFrame, fmt.Sprintf(`%040d"}}`, 0))
+		}, websocket.CloseMessageTooBig},
+		{"unmasked frames", func(conn net.Conn) {
+			conn.Write([]byte{0x81, 2, '{', '}'})
+		}, websocket.CloseProtocolError},
+		{"unexpected continuation frames", func(conn net.Conn) {
+			writeClientFrame(conn, true, continuationFrame, "{}")
+		}, websocket.CloseProtocolError},
+		{"idle connections", func(conn net.Conn) {}, 0},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			w, ln := startWebSocketHandler(&ingested{})
+			defer ln.Close()
+			w.idleTimeout = 50 * time.Millisecond
+			conn, reader, _ := dialWebSocket(t, ln, defaultWebSocketPath, upgradeHeaders("secret"))
+			defer conn.Close()
+
+			test.write(conn)
+			if test.wantClose != 0 {
+				opcode, payload := readServerFrame(t, reader)
+				if opcode != websocket.CloseMessage || int(binary.BigEndian.Uint16([]byte(payload))) != test.wantClose {
+					t.Errorf("received opcode %d %q, want close %d", opcode, payload, test.wantClose)
+				}
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := reader.ReadByte(); err != io.EOF {
+				t.Errorf("the connection was not closed: %v", err)
+			}
+		})
+	}
+}
+
+func Test_websocketHandler_Close(t *testing.T) {
+	i := &ingested{}
+	w, ln := startWebSocketHandler(i)
+	defer ln.Close()
+	conn, reader, _ := dialWebSocket(t, ln, defaultWebSocketPath, upgradeHeaders("secret"))
+	defer conn.Close()
+	writeClientFrame(conn, true, websocket.TextMessage, `{"seq":1,"message":{}}`)
+	readServerFrame(t, reader)
+
+	w.Close()
+	if opcode, payload := readServerFrame(t, reader); opcode != websocket.CloseMessage || int(binary.BigEndian.Uint16([]byte(payload))) != websocket.CloseGoingAway {
+		t.Errorf("received opcode %d %q, want going away", opcode, payload)
+	}
+}
+
+func Test_withClientID(t *testing.T) {
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{`{}`, `{"client_id":"a\"b"}`},
+		{`{ }`, `{"client_id":"a\"b"}`},
+		{`{"text":"hi"}`, `{"client_id":"a\"b","text":"hi"}`},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.message, func(t *testing.T) {
+			if got := string(withClientID([]byte(test.message), `a"b`)); got != test.want {
+				t.Errorf("withClientID() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -2,11 +2,16 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
+	"regexp"
+	"strconv"
 	"sync"
 	"time"
 
@@ -18,47 +23,126 @@ import (
 const (
 	azureAccount   = "AZURE_STORAGE_ACCOUNT"
 	azureAccessKey = "AZURE_STORAGE_ACCESS_KEY"
+	azureTemplate  = "AZURE_BLOB_TEMPLATE"
+	azureBlobType  = "AZURE_BLOB_TYPE"
+	blobTypeBlock  = "block"
+	blobTypeAppend = "append"
+	// AZURE_METADATA_CONFIG is a JSON file of the default and per client blob metadata, values may use the
+	// key template placeholders e.g. {"default": {"team": "chat"}, "clients": {"42": {"tenant": "{field:tenant}"}}}
+	azureMetadataConfig     = "AZURE_METADATA_CONFIG"
+	azureAccessTier         = "AZURE_ACCESS_TIER"
+	azureLegalHold          = "AZURE_LEGAL_HOLD"
+	azureImmutabilityDays   = "AZURE_IMMUTABILITY_DAYS"
+	azureImmutabilityMode   = "AZURE_IMMUTABILITY_MODE"
+	defaultImmutabilityMode = "Unlocked"
+
+	defaultAzureBlobTemplate KeyTemplate = "content-logs-{date}-{partition}-{seq}"
+
+	metadataMessageCount = "message_count"
+	// immutabilityVersion is the first service version supporting blob legal holds and immutability policies,
+	// it is newer than the version of the SDK so these requests are built by hand
+	immutabilityVersion = "2020-10-02"
 )
 
 var (
 	azblobUploadStreamToBlockBlob = azblob.UploadStreamToBlockBlob
 	azblobNewSharedKeyCredential  = azblob.NewSharedKeyCredential
 	azblobNewContainerURL         = NewContainerURL
+	azblobSetMetadata             = azblob.BlockBlobURL.SetMetadata
+	azblobSetTier                 = azblob.BlockBlobURL.SetTier
+
+	// metadataName matches valid Azure metadata names, which must be C# identifiers
+	metadataName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
 )
 
 type azure struct {
 	blob, account, accessKey string
 	bufferSize, maxBuffers   int
+	metadata                 map[string]string
+	encoding                 string
+	tier                     azblob.AccessTierType
+	legalHold                bool
+	immutabilityDays         int
+	immutabilityMode         string
 	running                  sync.WaitGroup
 }
 
+// immutabilityRequest sets the comp operation of a blob with the given headers
+type immutabilityRequest struct {
+	comp    string
+	headers map[string]string
+}
+
+// blobMetadata is the content of the AZURE_METADATA_CONFIG file
+type blobMetadata struct {
+	Default map[string]string            `json:"default"`
+	Clients map[string]map[string]string `json:"clients"`
+}
+
 type ContainerURL interface {
 	Create(ctx context.Context, metadata azblob.Metadata, publicAccessType azblob.PublicAccessType) (*azblob.ContainerCreateResponse, error)
 	NewBlockBlobURL(blobName string) azblob.BlockBlobURL
+	NewAppendBlobURL(blobName string) azblob.AppendBlobURL
 }
 
 func NewContainerURL(u *url.URL, p pipeline.Pipeline) ContainerURL {
 	return azblob.NewContainerURL(*u, p)
 }
 
-func NewAzureStreamer(clientID, bufferSize, maxBuffers int) MessageStreamer {
-	fmt.Println("Creating new Azure streamer for client ", clientID)
+func NewAzureStreamer(object Object, bufferSize, maxBuffers int) MessageStreamer {
+	fmt.Println("Creating new Azure streamer for client ", object.ClientID)
 	s := &azure{}
-	s.blob = getBlobName(clientID)
+	s.blob = object.key(azureTemplate, defaultAzureBlobTemplate)
+	s.metadata = object.metadata()
+	s.encoding = object.contentEncoding()
 	s.account = os.Getenv(azureAccount)
 	s.accessKey = os.Getenv(azureAccessKey)
 	s.bufferSize = bufferSize
 	s.maxBuffers = maxBuffers
 
+	if err := configuredMetadata(os.Getenv(azureMetadataConfig), object, s.metadata); err != nil {
+		logFatalf("Invalid %s: %s", azureMetadataConfig, err)
+	}
+
+	switch tier := azblob.AccessTierType(os.Getenv(azureAccessTier)); tier {
+	case azblob.AccessTierNone, azblob.AccessTierHot, azblob.AccessTierCool, azblob.AccessTierArchive:
+		s.tier = tier
+	default:
+		logFatalf("%s must be %s, %s or %s", azureAccessTier, azblob.AccessTierHot, azblob.AccessTierCool, azblob.AccessTierArchive)
+	}
+
+	s.legalHold = os.Getenv(azureLegalHold) == "true"
+	if days := os.Getenv(azureImmutabilityDays); days != "" {
+		var err error
+		if s.immutabilityDays, err = strconv.Atoi(days); err != nil || s.immutabilityDays < 1 {
+			logFatalf("%s must be a positive number of days", azureImmutabilityDays)
+		}
+		s.immutabilityMode = os.Getenv(azureImmutabilityMode)
+		if s.immutabilityMode == "" {
+			s.immutabilityMode = defaultImmutabilityMode
+		}
+		if s.immutabilityMode != "Unlocked" && s.immutabilityMode != "Locked" {
+			logFatalf("%s must be Unlocked or Locked", azureImmutabilityMode)
+		}
+	}
+
 	if s.account == "" || s.accessKey == "" {
 		message := "Cannot create Azure streamer, ensure the following environment variables are set:"
 		logFatalf("%s\n%s\n%s\n", message, azureAccount, azureAccessKey)
 	}
 
+	switch blobType := os.Getenv(azureBlobType); blobType {
+	case "", blobTypeBlock:
+	case blobTypeAppend:
+		return newAzureAppend(s, object)
+	default:
+		logFatalf("%s must be %s or %s", azureBlobType, blobTypeBlock, blobTypeAppend)
+	}
 	return s
 }
 
-func (a *azure) Stream(reader io.Reader) {
+// container returns the container of the day and its pipeline, creating the container if it does not exist
+func (a *azure) container(ctx context.Context) (ContainerURL, pipeline.Pipeline) {
 	credential, err := azblobNewSharedKeyCredential(a.account, a.accessKey)
 	if err != nil {
 		logFatalf("Invalid credentials with error: ", err)
@@ -66,34 +150,131 @@ func (a *azure) Stream(reader io.Reader) {
 
 	URL, _ := url.Parse(
 		fmt.Sprintf("https://%s.blob.core.windows.net/%s", a.account, getContainerName()))
-	containerURL := azblobNewContainerURL(URL, azblob.NewPipeline(credential, azblob.PipelineOptions{}))
+	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+	containerURL := azblobNewContainerURL(URL, p)
 
-	ctx := context.Background()
 	_, err = containerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessNone)
 	if err != nil {
 		if serr, ok := err.(azblob.StorageError); ok && serr.ServiceCode() != azblob.ServiceCodeContainerAlreadyExists {
 			logFatalf("Error when creating container: ", err)
 		}
 	}
+	return containerURL, p
+}
+
+func (a *azure) Stream(reader io.Reader) error {
+	ctx := context.Background()
+	containerURL, p := a.container(ctx)
 
 	a.running.Add(1)
+	defer a.running.Done()
 	blobURL := containerURL.NewBlockBlobURL(a.blob)
-	_, err = azblobUploadStreamToBlockBlob(ctx, reader, blobURL, azblob.UploadStreamToBlockBlobOptions{
+	_, err := azblobUploadStreamToBlockBlob(ctx, reader, blobURL, azblob.UploadStreamToBlockBlobOptions{
 		BufferSize: a.bufferSize,
-		MaxBuffers: a.maxBuffers})
-	a.running.Done()
+		MaxBuffers: a.maxBuffers,
+		BlobHTTPHeaders: azblob.BlobHTTPHeaders{
+			ContentType:     contentType,
+			ContentEncoding: a.encoding,
+		},
+		Metadata: a.metadata})
 	if err != nil {
 		log.Println("Error when uploading", err)
+		return err
+	}
+
+	// the message count is only known once the stream has ended, and the blob cannot be changed once it is immutable
+	if counter, ok := reader.(messageCounter); ok {
+		metadata := azblob.Metadata{metadataMessageCount: strconv.FormatInt(counter.Messages(), 10)}
+		for name, value := range a.metadata {
+			metadata[name] = value
+		}
+		if _, err = azblobSetMetadata(blobURL, ctx, metadata, azblob.BlobAccessConditions{}); err != nil {
+			log.Println("Error when setting metadata of", a.blob, err)
+		}
 	}
+	if a.tier != azblob.AccessTierNone {
+		if _, err = azblobSetTier(blobURL, ctx, a.tier, azblob.LeaseAccessConditions{}); err != nil {
+			log.Println("Error when setting access tier of", a.blob, err)
+		}
+	}
+	if err = a.setImmutability(ctx, p, blobURL.URL()); err != nil {
+		log.Println("Error when setting immutability of", a.blob, err)
+	}
+	return nil
 }
 
-func getContainerName() string {
-	return time.Now().Format("2006-01-02")
+// setImmutability places a legal hold and a time based retention policy on the blob if they are configured,
+// the container must have version level immutability enabled
+func (a *azure) setImmutability(ctx context.Context, p pipeline.Pipeline, blob url.URL) error {
+	var requests []immutabilityRequest
+	if a.legalHold {
+		requests = append(requests, immutabilityRequest{"legalhold", map[string]string{"x-ms-legal-hold": "true"}})
+	}
+	if a.immutabilityDays > 0 {
+		until := time.Now().UTC().AddDate(0, 0, a.immutabilityDays)
+		requests = append(requests, immutabilityRequest{"immutabilityPolicies", map[string]string{
+			"x-ms-immutability-policy-until-date": until.Format(http.TimeFormat),
+			"x-ms-immutability-policy-mode":       a.immutabilityMode,
+		}})
+	}
+
+	for _, r := range requests {
+		u := blob
+		query := u.Query()
+		query.Set("comp", r.comp)
+		u.RawQuery = query.Encode()
+
+		request, err := pipeline.NewRequest(http.MethodPut, u, nil)
+		if err != nil {
+			return err
+		}
+		request.Header.Set("x-ms-version", immutabilityVersion)
+		for name, value := range r.headers {
+			request.Header.Set(name, value)
+		}
+
+		response, err := p.Do(ctx, nil, request)
+		if err != nil {
+			return err
+		}
+		if status := response.Response().StatusCode; status != http.StatusOK {
+			return fmt.Errorf("setting %s returned status %d", r.comp, status)
+		}
+	}
+	return nil
+}
+
+// configuredMetadata adds the default and client metadata of the config file to the metadata
+func configuredMetadata(path string, object Object, metadata map[string]string) error {
+	if path == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config blobMetadata
+	if err = json.Unmarshal(content, &config); err != nil {
+		return err
+	}
+
+	for _, values := range []map[string]string{config.Default, config.Clients[object.ClientID]} {
+		for name, value := range values {
+			if !metadataName.MatchString(name) {
+				return fmt.Errorf("invalid metadata name %q", name)
+			}
+			template := KeyTemplate(value)
+			if err = template.Validate(); err != nil {
+				return err
+			}
+			metadata[name] = template.Execute(object)
+		}
+	}
+	return nil
 }
 
-func getBlobName(clientID int) string {
-	date := time.Now().Format("2006-01-02")
-	return fmt.Sprintf("content-logs-%s-%d", date, clientID)
+func getContainerName() string {
+	return time.Now().Format("2006-01-02")
 }
 
 func (a *azure) Wait() {
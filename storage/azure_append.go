@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+const (
+	azureAppendInterval   = "AZURE_APPEND_INTERVAL"
+	defaultAppendInterval = 10 * time.Second
+	readBufferSize        = 64 * 1024
+	// maxBlobNames bounds the search for a blob name which is not taken yet
+	maxBlobNames = 1000
+)
+
+var (
+	azblobCreateAppendBlob = azblob.AppendBlobURL.Create
+	azblobAppendBlock      = azblob.AppendBlobURL.AppendBlock
+
+	// appendBlobMaxBlocks is the number of blocks after which a new blob is started
+	appendBlobMaxBlocks = azblob.AppendBlobMaxBlocks - 100
+	appendBlockSize     = azblob.AppendBlobMaxAppendBlockBytes
+	// maxPendingAppend is the size of the stream read but not appended yet at which the stream fails, so a blob
+	// which cannot be appended to does not hold the stream in memory
+	maxPendingAppend = 16 * azblob.AppendBlobMaxAppendBlockBytes
+)
+
+// memberFlusher is implemented by pipes which can end the current gzip member, Boundary is the offset in the
+// stream at which the last complete member ends
+type memberFlusher interface {
+	Flush() error
+	Boundary() int64
+}
+
+// azureAppend streams to append blobs, complete gzip members are appended every interval so data is durable
+// and readable within seconds. A new blob is started when the block limit of the blob approaches
+type azureAppend struct {
+	*azure
+	object   Object
+	base     string
+	suffix   int
+	interval time.Duration
+
+	containerURL ContainerURL
+	pipeline     pipeline.Pipeline
+	backoff      backoff
+	// appending serializes appendTo, the blob, its blocks and its size are only changed while it is held
+	appending sync.Mutex
+	blobURL   azblob.AppendBlobURL
+	blocks    int
+	size      int64
+	// partial is true if an append failed part way, the stream does not end on a member boundary then
+	partial bool
+
+	mutex sync.Mutex
+	read  *sync.Cond
+	// pending holds the stream from the appended offset on, from its index start
+	pending  []byte
+	start    int
+	received int64
+	appended int64
+	eof      bool
+}
+
+func newAzureAppend(a *azure, object Object) *azureAppend {
+	s := &azureAppend{azure: a, object: object, base: a.blob, interval: defaultAppendInterval, backoff: newBackoff()}
+	s.read = sync.NewCond(&s.mutex)
+	if interval := os.Getenv(azureAppendInterval); interval != "" {
+		var err error
+		if s.interval, err = time.ParseDuration(interval); err != nil || s.interval <= 0 {
+			logFatalf("%s must be a positive duration e.g. 10s", azureAppendInterval)
+		}
+	}
+	if a.tier != azblob.AccessTierNone {
+		logFatalf("%s is only supported for block blobs", azureAccessTier)
+	}
+	return s
+}
+
+func (a *azureAppend) Stream(reader io.Reader) error {
+	ctx := context.Background()
+	a.containerURL, a.pipeline = a.container(ctx)
+
+	a.running.Add(1)
+	defer a.running.Done()
+	if err := a.createBlob(ctx); err != nil {
+		log.Println("Error when creating append blob", err)
+		return err
+	}
+
+	// a failed append is retried by the next one from the appended offset, so the stream only fails if the append
+	// at its end fails
+	done := make(chan struct{})
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		flusher, ok := reader.(memberFlusher)
+		if !ok {
+			return
+		}
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := flusher.Flush(); err != nil {
+					log.Println("Error when flushing", a.blob, err)
+					continue
+				}
+				if err := a.appendTo(ctx, flusher.Boundary()); err != nil {
+					log.Println("Error when appending to", a.blob, err)
+					continue
+				}
+				commit(reader, a.appendedOffset())
+			}
+		}
+	}()
+
+	var readErr error
+	buf := make([]byte, readBufferSize)
+	for {
+		n, err := reader.Read(buf)
+		a.mutex.Lock()
+		// the appended part is dropped once it is at least half of the buffer, so it is moved rarely
+		if a.start > 0 && a.start >= len(a.pending)/2 {
+			a.pending = a.pending[:copy(a.pending, a.pending[a.start:])]
+			a.start = 0
+		}
+		a.pending = append(a.pending, buf[:n]...)
+		a.received += int64(n)
+		if err == nil && len(a.pending)-a.start > maxPendingAppend {
+			err = fmt.Errorf("%d bytes of the stream are waiting to be appended", len(a.pending)-a.start)
+		}
+		a.eof = err != nil
+		a.read.Broadcast()
+		a.mutex.Unlock()
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Error when reading stream for", a.blob, err)
+				readErr = err
+			}
+			break
+		}
+	}
+	close(done)
+	<-flushed
+	streamErr := readErr
+
+	a.mutex.Lock()
+	end := a.received
+	a.mutex.Unlock()
+	if err := a.appendTo(ctx, end); err != nil {
+		log.Println("Error when appending to", a.blob, err)
+		streamErr = err
+	} else {
+		commit(reader, end)
+	}
+	a.finishBlob(ctx)
+	return streamErr
+}
+
+// appendTo appends the stream up to the offset, waiting until it has been read. The appended offset only moves
+// once a block has been appended, so a failed append is retried from there by the next call
+func (a *azureAppend) appendTo(ctx context.Context, offset int64) error {
+	a.appending.Lock()
+	defer a.appending.Unlock()
+	a.mutex.Lock()
+	for a.received < offset && !a.eof {
+		a.read.Wait()
+	}
+	if offset > a.received {
+		offset = a.received
+	}
+	size := int(offset - a.appended)
+	if size <= 0 {
+		a.mutex.Unlock()
+		return nil
+	}
+	data := append([]byte(nil), a.pending[a.start:a.start+size]...)
+	a.mutex.Unlock()
+
+	// data starts and ends on a member boundary unless an append failed part way, so it can be moved to a new
+	// blob as a whole. The margin of appendBlobMaxBlocks leaves room to finish the member otherwise
+	blocks := (len(data) + appendBlockSize - 1) / appendBlockSize
+	if a.blocks > 0 && a.blocks+blocks > appendBlobMaxBlocks && !a.partial {
+		a.finishBlob(ctx)
+		if err := a.createBlob(ctx); err != nil {
+			return err
+		}
+	}
+
+	a.partial = true
+	for len(data) > 0 {
+		block := data
+		if len(block) > appendBlockSize {
+			block = block[:appendBlockSize]
+		}
+		if err := a.appendBlock(ctx, block); err != nil {
+			return err
+		}
+		a.mutex.Lock()
+		a.start += len(block)
+		a.appended += int64(len(block))
+		a.mutex.Unlock()
+		data = data[len(block):]
+	}
+	a.partial = false
+	return nil
+}
+
+// appendBlock appends a block at the end of the blob with the same backoff as S3 requests. The block must be
+// appended at the current size of the blob, so a block whose attempt failed but was stored is not stored twice
+func (a *azureAppend) appendBlock(ctx context.Context, block []byte) error {
+	// -1 is a position of 0, as 0 leaves the position unchecked
+	position := a.size
+	if position == 0 {
+		position = -1
+	}
+	conditions := azblob.AppendBlobAccessConditions{
+		AppendPositionAccessConditions: azblob.AppendPositionAccessConditions{IfAppendPositionEqual: position},
+	}
+	attempted := false
+	err := a.backoff.retry("AppendBlock", func() error {
+		_, err := azblobAppendBlock(a.blobURL, ctx, bytes.NewReader(block), conditions, nil)
+		if serr, ok := err.(azblob.StorageError); ok && attempted &&
+			serr.ServiceCode() == azblob.ServiceCodeAppendPositionConditionNotMet {
+			// the blob has moved past the position, so a previous attempt did append the block
+			return nil
+		}
+		attempted = true
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	a.blocks++
+	a.size += int64(len(block))
+	return nil
+}
+
+func (a *azureAppend) appendedOffset() int64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.appended
+}
+
+// createBlob creates the next append blob, blobs which already exist are skipped so they are never overwritten
+func (a *azureAppend) createBlob(ctx context.Context) error {
+	headers := azblob.BlobHTTPHeaders{ContentType: contentType, ContentEncoding: a.encoding}
+	conditions := azblob.BlobAccessConditions{
+		ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny},
+	}
+
+	for i := 0; i < maxBlobNames; i++ {
+		if a.blocks > 0 || i > 0 {
+			a.nextBlobName()
+		}
+		a.blobURL = a.containerURL.NewAppendBlobURL(a.blob)
+		_, err := azblobCreateAppendBlob(a.blobURL, ctx, headers, a.metadata, conditions)
+		if serr, ok := err.(azblob.StorageError); ok && serr.ServiceCode() == azblob.ServiceCodeBlobAlreadyExists {
+			continue
+		}
+		if err == nil {
+			fmt.Println("Appending to blob ", a.blob)
+			a.blocks, a.size = 0, 0
+		}
+		return err
+	}
+	return fmt.Errorf("no free blob name after %s", a.blob)
+}
+
+// nextBlobName moves to the blob of the next sequence number of the partition, if the template has no {seq}
+// placeholder a counter of the blobs of this stream is appended to the name instead
+func (a *azureAppend) nextBlobName() {
+	a.object.Sequence = NextSequence(a.object)
+	a.blob = a.object.key(azureTemplate, defaultAzureBlobTemplate)
+	if a.blob == a.base {
+		a.suffix++
+		a.blob = fmt.Sprintf("%s.%d", a.base, a.suffix)
+	}
+}
+
+// finishBlob applies the immutability options to a blob which will not be appended to anymore
+func (a *azureAppend) finishBlob(ctx context.Context) {
+	if err := a.setImmutability(ctx, a.pipeline, a.blobURL.URL()); err != nil {
+		log.Println("Error when setting immutability of", a.blob, err)
+	}
+}
@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fasthttp-server/mocks"
+	"fasthttp-server/pipe"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/golang/mock/gomock"
+)
+
+func TestNewAzureStreamer_append(t *testing.T) {
+	tests := []struct {
+		name            string
+		interval        string
+		tier            string
+		wantInterval    time.Duration
+		shouldCallFatal bool
+	}{
+		{"default interval", "", "", defaultAppendInterval, false},
+		{"interval", "2s", "", 2 * time.Second, false},
+		{"should call fatal for invalid intervals", "soon", "", 0, true},
+		{"should call fatal for access tiers", "", "Cool", defaultAppendInterval, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv(azureAccount, "azureAccount")
+			os.Setenv(azureAccessKey, "azureAccessKey")
+			os.Setenv(azureBlobType, blobTypeAppend)
+			os.Setenv(azureAppendInterval, test.interval)
+			os.Setenv(azureAccessTier, test.tier)
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				os.Unsetenv(azureAccount)
+				os.Unsetenv(azureAccessKey)
+				os.Unsetenv(azureBlobType)
+				os.Unsetenv(azureAppendInterval)
+				os.Unsetenv(azureAccessTier)
+			}()
+
+			got, ok := NewAzureStreamer(Object{}, 0, 0).(*azureAppend)
+			if !ok {
+				t.Fatal("NewAzureStreamer() did not return an append streamer")
+			}
+			if got.interval != test.wantInterval {
+				t.Errorf("interval = %v, want %v", got.interval, test.wantInterval)
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+// appendedBlobs records the blobs created and the data appended to them
+type appendedBlobs struct {
+	mutex   sync.Mutex
+	names   []string
+	appends [][]byte
+	blobs   map[string][]byte
+	exists  map[string]bool
+}
+
+func mockAppendBlobs(t *testing.T, mockCtrl *gomock.Controller, mURL *mocks.MockContainerURL) *appendedBlobs {
+	var calledUpload bool
+	mockFunctions(&calledUpload, mURL)
+	mURL.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any()).Times(1)
+
+	blobs := &appendedBlobs{blobs: map[string][]byte{}, exists: map[string]bool{}}
+	var current string
+	mURL.EXPECT().NewAppendBlobURL(gomock.Any()).AnyTimes().DoAndReturn(func(name string) azblob.AppendBlobURL {
+		current = name
+		return azblob.AppendBlobURL{}
+	})
+	azblobCreateAppendBlob = func(b azblob.AppendBlobURL, ctx context.Context, h azblob.BlobHTTPHeaders, m azblob.Metadata,
+		ac azblob.BlobAccessConditions) (*azblob.AppendBlobCreateResponse, error) {
+		if ac.ModifiedAccessConditions.IfNoneMatch != azblob.ETagAny {
+			t.Error("append blobs must not be overwritten")
+		}
+		if blobs.exists[current] {
+			mError := mocks.NewMockStorageError(mockCtrl)
+			mError.EXPECT().ServiceCode().Return(azblob.ServiceCodeBlobAlreadyExists)
+			return nil, mError
+		}
+		blobs.names = append(blobs.names, current)
+		return nil, nil
+	}
+	azblobAppendBlock = func(b azblob.AppendBlobURL, ctx context.Context, body io.ReadSeeker, ac azblob.AppendBlobAccessConditions,
+		md5 []byte) (*azblob.AppendBlobAppendBlockResponse, error) {
+		data, _ := ioutil.ReadAll(body)
+		blobs.mutex.Lock()
+		blobs.appends = append(blobs.appends, data)
+		blobs.blobs[current] = append(blobs.blobs[current], data...)
+		blobs.mutex.Unlock()
+		return nil, nil
+	}
+	return blobs
+}
+
+func resetAppendBlobs() {
+	azblobNewSharedKeyCredential = azblob.NewSharedKeyCredential
+	azblobNewContainerURL = NewContainerURL
+	azblobCreateAppendBlob = azblob.AppendBlobURL.Create
+	azblobAppendBlock = azblob.AppendBlobURL.AppendBlock
+	appendBlobMaxBlocks = azblob.AppendBlobMaxBlocks - 100
+}
+
+func gunzip(t *testing.T, data []byte) string {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func Test_azureAppend_Stream(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mURL := mocks.NewMockContainerURL(mockCtrl)
+	blobs := mockAppendBlobs(t, mockCtrl, mURL)
+	defer resetAppendBlobs()
+
+	a := newAzureAppend(&azure{blob: "blob"}, Object{Template: "blob"})
+	a.interval = 5 * time.Millisecond
+	dataPipe := pipe.NewGzipWriter()
+	go func() {
+		for i := 0; i < 5; i++ {
+			dataPipe.Write([]byte(fmt.Sprintf(`{"n":%d}`, i)))
+			time.Sleep(20 * time.Millisecond)
+		}
+		dataPipe.Close()
+	}()
+	a.Stream(dataPipe)
+
+	if len(blobs.appends) < 2 {
+		t.Fatalf("expected periodic appends but got %d", len(blobs.appends))
+	}
+	for _, data := range blobs.appends {
+		gunzip(t, data)
+	}
+	want := "{\"n\":0}\n{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n{\"n\":4}\n"
+	if got := gunzip(t, blobs.blobs["blob"]); got != want {
+		t.Errorf("blob = %q, want %q", got, want)
+	}
+}
+
+func Test_azureAppend_rollover(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mURL := mocks.NewMockContainerURL(mockCtrl)
+	blobs := mockAppendBlobs(t, mockCtrl, mURL)
+	blobs.exists["blob.2"] = true
+	defer resetAppendBlobs()
+	appendBlobMaxBlocks = 1
+
+	a := newAzureAppend(&azure{blob: "blob"}, Object{Template: "blob"})
+	a.interval = time.Hour
+	dataPipe := pipe.NewGzipWriter()
+	go func() {
+		for i := 0; i < 3; i++ {
+			dataPipe.Write([]byte(fmt.Sprintf(`{"n":%d}`, i)))
+			dataPipe.(memberFlusher).Flush()
+			a.appendTo(context.Background(), dataPipe.(memberFlusher).Boundary())
+		}
+		dataPipe.Close()
+	}()
+	a.Stream(dataPipe)
+
+	wantNames := []string{"blob", "blob.1", "blob.3"}
+	if fmt.Sprint(blobs.names) != fmt.Sprint(wantNames) {
+		t.Errorf("blobs = %v, want %v", blobs.names, wantNames)
+	}
+	for i, name := range wantNames {
+		if got, want := gunzip(t, blobs.blobs[name]), fmt.Sprintf("{\"n\":%d}\n", i); got != want {
+			t.Errorf("blob %s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func Test_azureAppend_appendFailures(t *testing.T) {
+	var appended []byte
+	var positions []int64
+	// the calls which fail, each append has two attempts
+	failing, calls := map[int]bool{1: true, 2: true, 4: true, 5: true}, 0
+	azblobAppendBlock = func(b azblob.AppendBlobURL, ctx context.Context, body io.ReadSeeker, ac azblob.AppendBlobAccessConditions,
+		md5 []byte) (*azblob.AppendBlobAppendBlockResponse, error) {
+		if calls++; failing[calls] {
+			return nil, errors.New("timeout")
+		}
+		data, _ := ioutil.ReadAll(body)
+		appended = append(appended, data...)
+		positions = append(positions, ac.IfAppendPositionEqual)
+		return nil, nil
+	}
+	defer resetAppendBlobs()
+	appendBlockSize = 4
+	defer func() {
+		appendBlockSize = azblob.AppendBlobMaxAppendBlockBytes
+	}()
+
+	a := newAzureAppend(&azure{blob: "blob"}, Object{})
+	a.backoff = backoff{attempts: 2, base: time.Millisecond, max: time.Millisecond}
+	a.pending, a.received, a.eof = []byte("0123456789"), 10, true
+
+	// the attempts of the first block are used up, nothing is appended
+	if err := a.appendTo(context.Background(), 10); err == nil {
+		t.Fatal("expected the append to fail")
+	}
+	if a.appendedOffset() != 0 || len(a.pending[a.start:]) != 10 {
+		t.Errorf("appended %d with %d bytes pending after a failed append", a.appendedOffset(), len(a.pending[a.start:]))
+	}
+	// the first block is retried and appended, the second fails
+	if err := a.appendTo(context.Background(), 10); err == nil {
+		t.Fatal("expected the append to fail")
+	}
+	if a.appendedOffset() != 4 || string(a.pending[a.start:]) != "456789" {
+		t.Errorf("appended %d with %q pending, want 4", a.appendedOffset(), a.pending[a.start:])
+	}
+	if err := a.appendTo(context.Background(), 10); err != nil {
+		t.Fatal(err)
+	}
+	if a.appendedOffset() != 10 || string(appended) != "0123456789" || fmt.Sprint(positions) != "[-1 4 8]" {
+		t.Errorf("appended %q at %v, offset %d", appended, positions, a.appendedOffset())
+	}
+}
+
+func Test_azureAppend_Stream_failedAppends(t *testing.T) {
+	tests := []struct {
+		name     string
+		failing  int
+		wantErr  bool
+		wantBlob string
+	}{
+		{"succeed once an append succeeds", 1, false, "{\"n\":0}\n{\"n\":1}\n{\"n\":2}\n"},
+		{"fail once the pending stream is over the limit", 100, true, ""},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			mURL := mocks.NewMockContainerURL(mockCtrl)
+			blobs := mockAppendBlobs(t, mockCtrl, mURL)
+			defer resetAppendBlobs()
+			appendBlock, calls := azblobAppendBlock, 0
+			azblobAppendBlock = func(b azblob.AppendBlobURL, ctx context.Context, body io.ReadSeeker,
+				ac azblob.AppendBlobAccessConditions, md5 []byte) (*azblob.AppendBlobAppendBlockResponse, error) {
+				if calls++; calls <= test.failing {
+					return nil, errors.New("timeout")
+				}
+				return appendBlock(b, ctx, body, ac, md5)
+			}
+			maxPendingAppend = 64
+			defer func() {
+				maxPendingAppend = 16 * azblob.AppendBlobMaxAppendBlockBytes
+			}()
+
+			a := newAzureAppend(&azure{blob: "blob"}, Object{Template: "blob"})
+			a.interval = 5 * time.Millisecond
+			a.backoff = backoff{attempts: 1}
+			dataPipe := pipe.NewGzipWriter()
+			go func() {
+				for i := 0; i < 3; i++ {
+					if _, err := dataPipe.Write([]byte(fmt.Sprintf(`{"n":%d}`, i))); err != nil {
+						return
+					}
+					time.Sleep(20 * time.Millisecond)
+				}
+				dataPipe.Close()
+			}()
+			err := a.Stream(dataPipe)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Stream() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && gunzip(t, blobs.blobs["blob"]) != test.wantBlob {
+				t.Errorf("blob = %q, want %q", gunzip(t, blobs.blobs["blob"]), test.wantBlob)
+			}
+		})
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"fasthttp-server/mocks"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"reflect"
@@ -32,13 +34,59 @@ func TestNewAzureStreamer(t *testing.T) {
 			os.Setenv(azureAccount, "azureAccount")
 			os.Setenv(azureAccessKey, "azureAccessKey")
 		}, &azure{
-			blob:      getBlobName(0),
+			blob:      defaultAzureBlobTemplate.Execute(Object{}),
+			metadata:  Object{}.metadata(),
+			encoding:  gzipContentEncoding,
 			account:   "azureAccount",
 			accessKey: "azureAccessKey",
 		}, false},
+		{"upload options", func() {
+			os.Setenv(azureAccount, "azureAccount")
+			os.Setenv(azureAccessKey, "azureAccessKey")
+			os.Setenv(azureAccessTier, "Cool")
+			os.Setenv(azureLegalHold, "true")
+			os.Setenv(azureImmutabilityDays, "30")
+		}, &azure{
+			blob:             defaultAzureBlobTemplate.Execute(Object{}),
+			metadata:         Object{}.metadata(),
+			encoding:         gzipContentEncoding,
+			tier:             azblob.AccessTierCool,
+			legalHold:        true,
+			immutabilityDays: 30,
+			immutabilityMode: "Unlocked",
+			account:          "azureAccount",
+			accessKey:        "azureAccessKey",
+		}, false},
 		{"should call error", func() {
 		}, &azure{
-			blob: getBlobName(0),
+			blob:     defaultAzureBlobTemplate.Execute(Object{}),
+			metadata: Object{}.metadata(),
+			encoding: gzipContentEncoding,
+		}, true},
+		{"should call error for unknown access tiers", func() {
+			os.Setenv(azureAccount, "azureAccount")
+			os.Setenv(azureAccessKey, "azureAccessKey")
+			os.Setenv(azureAccessTier, "Frozen")
+		}, &azure{
+			blob:      defaultAzureBlobTemplate.Execute(Object{}),
+			metadata:  Object{}.metadata(),
+			encoding:  gzipContentEncoding,
+			account:   "azureAccount",
+			accessKey: "azureAccessKey",
+		}, true},
+		{"should call error for invalid immutability", func() {
+			os.Setenv(azureAccount, "azureAccount")
+			os.Setenv(azureAccessKey, "azureAccessKey")
+			os.Setenv(azureImmutabilityDays, "30")
+			os.Setenv(azureImmutabilityMode, "Forever")
+		}, &azure{
+			blob:             defaultAzureBlobTemplate.Execute(Object{}),
+			metadata:         Object{}.metadata(),
+			encoding:         gzipContentEncoding,
+			immutabilityDays: 30,
+			immutabilityMode: "Forever",
+			account:          "azureAccount",
+			accessKey:        "azureAccessKey",
 		}, true},
 	}
 	for _, tt := range tests {
@@ -54,9 +102,13 @@ func TestNewAzureStreamer(t *testing.T) {
 				logFatalf = log.Fatalf
 				os.Unsetenv(azureAccount)
 				os.Unsetenv(azureAccessKey)
+				os.Unsetenv(azureAccessTier)
+				os.Unsetenv(azureLegalHold)
+				os.Unsetenv(azureImmutabilityDays)
+				os.Unsetenv(azureImmutabilityMode)
 			}()
 
-			if got := NewAzureStreamer(0, 0, 0); !reflect.DeepEqual(got, test.want) {
+			if got := NewAzureStreamer(Object{}, 0, 0); !reflect.DeepEqual(got, test.want) {
 				t.Errorf("NewAzureStreamer() = %v, want %v", got, test.want)
 			}
 
@@ -75,10 +127,10 @@ func Test_azure_Wait(t *testing.T) {
 	fmt.Println("Does not deadlock, that's good!")
 }
 
-func Test_getBlobName(t *testing.T) {
+func Test_defaultAzureBlobTemplate(t *testing.T) {
 	date := time.Now().Format("2006-01-02")
-	wanted := fmt.Sprintf("content-logs-%s-%d", date, 1)
-	got := getBlobName(1)
+	wanted := fmt.Sprintf("content-logs-%s-%d-%d", date, 1, 7)
+	got := defaultAzureBlobTemplate.Execute(Object{ClientID: "1", Partition: "1", Sequence: 7})
 
 	if got != wanted {
 		t.Errorf("wanted %v but got %v", wanted, got)
@@ -133,7 +185,7 @@ func Test_azure_Stream(t *testing.T) {
 			var calledUpload bool
 
 			s := &azure{
-				blob:      getBlobName(0),
+				blob:      defaultAzureBlobTemplate.Execute(Object{}),
 				account:   "azureAccount",
 				accessKey: "azureAccessKey",
 			}
@@ -189,3 +241,148 @@ func TestNewContainerURL(t *testing.T) {
 		t.Errorf("NewContainerURL() = %v, want %v", got, want)
 	}
 }
+
+type countingBuffer struct {
+	bytes.Buffer
+}
+
+func (c *countingBuffer) Messages() int64 {
+	return 3
+}
+
+func Test_azure_Stream_options(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mURL := mocks.NewMockContainerURL(mockCtrl)
+	mURL.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any()).Times(1)
+	mURL.EXPECT().NewBlockBlobURL(gomock.Any()).Times(1)
+
+	var calledUpload bool
+	var options azblob.UploadStreamToBlockBlobOptions
+	var metadata azblob.Metadata
+	var tier azblob.AccessTierType
+	mockFunctions(&calledUpload, mURL)
+	azblobUploadStreamToBlockBlob =
+		func(c context.Context, r io.Reader, b azblob.BlockBlobURL, o azblob.UploadStreamToBlockBlobOptions) (azblob.CommonResponse, error) {
+			options = o
+			return nil, nil
+		}
+	azblobSetMetadata = func(b azblob.BlockBlobURL, c context.Context, m azblob.Metadata, ac azblob.BlobAccessConditions) (*azblob.BlobSetMetadataResponse, error) {
+		metadata = m
+		return nil, nil
+	}
+	azblobSetTier = func(b azblob.BlockBlobURL, c context.Context, t azblob.AccessTierType, lac azblob.LeaseAccessConditions) (*azblob.BlobSetTierResponse, error) {
+		tier = t
+		return nil, nil
+	}
+	defer func() {
+		azblobNewSharedKeyCredential = azblob.NewSharedKeyCredential
+		azblobUploadStreamToBlockBlob = azblob.UploadStreamToBlockBlob
+		azblobNewContainerURL = NewContainerURL
+		azblobSetMetadata = azblob.BlockBlobURL.SetMetadata
+		azblobSetTier = azblob.BlockBlobURL.SetTier
+	}()
+
+	a := &azure{blob: "blob", metadata: map[string]string{"client_id": "42"}, encoding: gzipContentEncoding, tier: azblob.AccessTierArchive}
+	a.Stream(&countingBuffer{})
+
+	wantHeaders := azblob.BlobHTTPHeaders{ContentType: contentType, ContentEncoding: gzipContentEncoding}
+	if !reflect.DeepEqual(options.BlobHTTPHeaders, wantHeaders) || !reflect.DeepEqual(options.Metadata, azblob.Metadata{"client_id": "42"}) {
+		t.Errorf("unexpected upload options %v", options)
+	}
+	if want := (azblob.Metadata{"client_id": "42", metadataMessageCount: "3"}); !reflect.DeepEqual(metadata, want) {
+		t.Errorf("SetMetadata() = %v, want %v", metadata, want)
+	}
+	if tier != azblob.AccessTierArchive {
+		t.Errorf("SetTier() = %v, want %v", tier, azblob.AccessTierArchive)
+	}
+}
+
+type fakePipeline struct {
+	requests []pipeline.Request
+	status   int
+}
+
+func (f *fakePipeline) Do(ctx context.Context, methodFactory pipeline.Factory, request pipeline.Request) (pipeline.Response, error) {
+	f.requests = append(f.requests, request)
+	return pipeline.NewHTTPResponse(&http.Response{StatusCode: f.status}), nil
+}
+
+func Test_azure_setImmutability(t *testing.T) {
+	blob, _ := url.Parse("https://account.blob.core.windows.net/container/blob")
+	tests := []struct {
+		name      string
+		a         *azure
+		status    int
+		wantComps []string
+		wantErr   bool
+	}{
+		{"nothing configured", &azure{}, http.StatusOK, nil, false},
+		{"legal hold and policy", &azure{legalHold: true, immutabilityDays: 7, immutabilityMode: "Locked"}, http.StatusOK,
+			[]string{"legalhold", "immutabilityPolicies"}, false},
+		{"fails on errors", &azure{legalHold: true}, http.StatusConflict, []string{"legalhold"}, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			p := &fakePipeline{status: test.status}
+			err := test.a.setImmutability(context.Background(), p, *blob)
+			if (err != nil) != test.wantErr {
+				t.Errorf("setImmutability() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			var comps []string
+			for _, request := range p.requests {
+				comps = append(comps, request.URL.Query().Get("comp"))
+				if request.Method != http.MethodPut || request.Header.Get("x-ms-version") != immutabilityVersion {
+					t.Errorf("unexpected request %v", request)
+				}
+				if request.URL.Query().Get("comp") == "immutabilityPolicies" &&
+					(request.Header.Get("x-ms-immutability-policy-mode") != "Locked" ||
+						request.Header.Get("x-ms-immutability-policy-until-date") == "") {
+					t.Errorf("unexpected policy headers %v", request.Header)
+				}
+			}
+			if !reflect.DeepEqual(comps, test.wantComps) {
+				t.Errorf("requests = %v, want %v", comps, test.wantComps)
+			}
+		})
+	}
+}
+
+func Test_configuredMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"default and client metadata", `{"default":{"team":"chat","tier":"free"},"clients":{"42":{"tier":"gold","tenant":"{field:tenant}"}}}`,
+			map[string]string{"team": "chat", "tier": "gold", "tenant": "acme"}, false},
+		{"other clients", `{"clients":{"7":{"tier":"gold"}}}`, map[string]string{}, false},
+		{"invalid json", `{`, nil, true},
+		{"invalid names", `{"default":{"my-team":"chat"}}`, nil, true},
+		{"invalid templates", `{"default":{"team":"{nope}"}}`, nil, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			file, err := ioutil.TempFile("", "metadata")
+			if err != nil {
+				t.Fatal(err)
+			}
+			file.WriteString(test.config)
+			file.Close()
+			defer os.Remove(file.Name())
+
+			got := map[string]string{}
+			err = configuredMetadata(file.Name(), Object{ClientID: "42", Message: []byte(`{"tenant":"acme"}`)}, got)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("configuredMetadata() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("configuredMetadata() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+// failover streams to the primary backend and diverts the stream to the secondary backend if the primary fails.
+// The stream is spooled to a temporary file until the primary has succeeded, so the data the primary already
+// read is not lost
+type failover struct {
+	primary   Backend
+	secondary Backend
+	spoolDir  string
+	report    UploadReporter
+	running   sync.WaitGroup
+}
+
+// NewFailoverStreamer returns a MessageStreamer writing to the primary backend, or to the secondary backend once
+// the primary failed. The stream is spooled under spoolDir, the default directory for temporary files if empty
+func NewFailoverStreamer(primary, secondary Backend, spoolDir string, report UploadReporter) MessageStreamer {
+	return &failover{primary: primary, secondary: secondary, spoolDir: spoolDir, report: report}
+}
+
+func (f *failover) Stream(reader io.Reader) error {
+	f.running.Add(1)
+	defer f.running.Done()
+
+	spool, err := ioutil.TempFile(f.spoolDir, "spool-")
+	if err != nil {
+		log.Println("Error when creating spool file, streaming without failover", err)
+		err = f.primary.Streamer.Stream(reader)
+		f.reportUpload(f.primary.Name, err)
+		return err
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+
+	r, w := io.Pipe()
+	primaryErr := make(chan error, 1)
+	go func() {
+		err := f.primary.Streamer.Stream(&branchReader{Reader: r, source: reader})
+		// unblock the writer if the primary returned without reading the whole stream
+		r.CloseWithError(errBackendClosed)
+		primaryErr <- err
+	}()
+
+	var (
+		spooled      int64
+		spoolErr     error
+		secondary    *io.PipeWriter
+		secondaryErr chan error
+		readErr      error
+	)
+	buf := make([]byte, fanOutChunkSize)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			chunk := buf[:n]
+			if secondary != nil {
+				// errors are returned by the secondary's Stream
+				secondary.Write(chunk)
+			} else {
+				if spoolErr == nil {
+					if _, spoolErr = spool.Write(chunk); spoolErr != nil {
+						log.Println("Error when spooling, the stream can no longer fail over", spoolErr)
+					}
+					spooled += int64(n)
+				}
+				if _, err := w.Write(chunk); err != nil && spoolErr == nil {
+					secondary, secondaryErr = f.divert(spool, spooled, reader)
+				}
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+	}
+	w.CloseWithError(readErr)
+
+	err = <-primaryErr
+	if err == nil && secondary != nil {
+		err = errBackendClosed
+	}
+	f.reportUpload(f.primary.Name, err)
+	if err == nil {
+		fmt.Println("Finished streaming to ", f.primary.Name)
+		return nil
+	}
+	log.Println("Error when streaming to", f.primary.Name, err)
+	if spoolErr != nil {
+		return err
+	}
+
+	if secondary == nil {
+		secondary, secondaryErr = f.divert(spool, spooled, reader)
+	}
+	secondary.CloseWithError(readErr)
+	err = <-secondaryErr
+	f.reportUpload(f.secondary.Name, err)
+	if err != nil {
+		log.Println("Error when streaming to", f.secondary.Name, err)
+		return err
+	}
+	fmt.Println("Finished streaming to ", f.secondary.Name)
+	return nil
+}
+
+// divert starts streaming to the secondary backend, it reads the spooled part of the stream and then the rest of
+// the stream as it is written to the returned pipe
+func (f *failover) divert(spool *os.File, spooled int64, source io.Reader) (*io.PipeWriter, chan error) {
+	log.Println("Diverting stream from", f.primary.Name, "to", f.secondary.Name)
+	r, w := io.Pipe()
+	result := make(chan error, 1)
+	go func() {
+		reader := io.MultiReader(io.NewSectionReader(spool, 0, spooled), r)
+		err := f.secondary.Streamer.Stream(&branchReader{Reader: reader, source: source})
+		r.CloseWithError(errBackendClosed)
+		result <- err
+	}()
+	return w, result
+}
+
+func (f *failover) reportUpload(backend string, err error) {
+	if f.report != nil {
+		f.report(backend, err)
+	}
+}
+
+func (f *failover) Wait() {
+	f.running.Wait()
+	f.primary.Streamer.Wait()
+	f.secondary.Streamer.Wait()
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFailover_Stream(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	tests := []struct {
+		name          string
+		primary       *fakeStreamer
+		secondary     *fakeStreamer
+		wantErr       bool
+		wantSecondary bool
+		wantReports   []string
+	}{
+		{"primary succeeds", &fakeStreamer{}, &fakeStreamer{}, false, false, []string{"s3 ok"}},
+		{"diverts if the primary fails at the end", &fakeStreamer{err: errors.New("denied")}, &fakeStreamer{},
+			false, true, []string{"s3 failed", "local ok"}},
+		{"diverts the spooled and remaining data if the primary fails while streaming",
+			&fakeStreamer{stopAt: 1, err: errors.New("broken")}, &fakeStreamer{}, false, true, []string{"s3 failed", "local ok"}},
+		{"diverts if the primary stops reading", &fakeStreamer{stopAt: 1}, &fakeStreamer{},
+			false, true, []string{"s3 failed", "local ok"}},
+		{"both fail", &fakeStreamer{err: errors.New("denied")}, &fakeStreamer{err: errors.New("disk full")},
+			true, true, []string{"s3 failed", "local failed"}},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			spoolDir, err := ioutil.TempDir("", "spool")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var reports []string
+			f := NewFailoverStreamer(Backend{"s3", test.primary}, Backend{"local", test.secondary}, spoolDir,
+				func(backend string, err error) {
+					result := " ok"
+					if err != nil {
+						result = " failed"
+					}
+					reports = append(reports, backend+result)
+				})
+
+			if err := f.Stream(bytes.NewReader(data)); (err != nil) != test.wantErr {
+				t.Errorf("Stream() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if test.wantSecondary && !bytes.Equal(test.secondary.received, data) {
+				t.Errorf("secondary received %d bytes, want %d", len(test.secondary.received), len(data))
+			}
+			if !test.wantSecondary && len(test.secondary.received) > 0 {
+				t.Errorf("secondary received %d bytes, want none", len(test.secondary.received))
+			}
+			if fmt.Sprint(reports) != fmt.Sprint(test.wantReports) {
+				t.Errorf("reports = %v, want %v", reports, test.wantReports)
+			}
+			if files, _ := ioutil.ReadDir(spoolDir); len(files) > 0 {
+				t.Errorf("spool files were not removed: %v", files)
+			}
+
+			f.Wait()
+			if !test.primary.waited || !test.secondary.waited {
+				t.Error("did not wait for the backends")
+			}
+		})
+	}
+}
+
+func TestFailover_StreamCommits(t *testing.T) {
+	spoolDir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spoolDir)
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	tests := []struct {
+		name    string
+		primary MessageStreamer
+		want    int64
+	}{
+		{"not by the spool", &fakeStreamer{}, 0},
+		{"by the primary", &storingStreamer{}, int64(len(data))},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			reader := &committingReader{Reader: bytes.NewReader(data), durable: true}
+			f := NewFailoverStreamer(Backend{"s3", test.primary}, Backend{"local", &fakeStreamer{}}, spoolDir, nil)
+			if err := f.Stream(reader); err != nil {
+				t.Fatal(err)
+			}
+			if reader.committed() != test.want {
+				t.Errorf("committed %d, want %d", reader.committed(), test.want)
+			}
+		})
+	}
+}
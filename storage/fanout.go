@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const fanOutChunkSize = 64 * 1024
+
+var (
+	errFellBehind    = errors.New("backend fell behind, its buffer stayed full")
+	errBackendClosed = errors.New("backend stopped reading")
+)
+
+// Backend is a named MessageStreamer
+type Backend struct {
+	Name     string
+	Streamer MessageStreamer
+}
+
+// UploadReporter is called with the result of the upload to each backend
+type UploadReporter func(backend string, err error)
+
+// CommitPolicy tells a fan out streamer which backends must have stored a message before it is committed
+type CommitPolicy string
+
+const (
+	// CommitAll commits what every backend has stored, backends which failed are left out so they do not hold
+	// back the commits of the others
+	CommitAll CommitPolicy = "all"
+	// CommitAny commits what any backend has stored
+	CommitAny CommitPolicy = "any"
+)
+
+// fanOut streams to every backend at once, each backend reads from its own buffer so a slow or failed backend
+// does not block the others. A backend whose buffer stays full for the stall timeout is failed
+type fanOut struct {
+	backends []Backend
+	buffers  int
+	stall    time.Duration
+	policy   CommitPolicy
+	report   UploadReporter
+	running  sync.WaitGroup
+}
+
+// NewFanOutStreamer returns a MessageStreamer writing the stream to all backends, bufferSize bytes are buffered
+// for each backend and the stream is committed as the policy says. Stream returns an error if any of the backends
+// failed
+func NewFanOutStreamer(backends []Backend, bufferSize int, stallTimeout time.Duration, policy CommitPolicy,
+	report UploadReporter) MessageStreamer {
+	buffers := bufferSize / fanOutChunkSize
+	if buffers < 1 {
+		buffers = 1
+	}
+	return &fanOut{backends: backends, buffers: buffers, stall: stallTimeout, policy: policy, report: report}
+}
+
+// branch is the buffer and pipe of a backend
+type branch struct {
+	Backend
+	chunks  chan []byte
+	r       *io.PipeReader
+	w       *io.PipeWriter
+	stopped int32
+	// streamErr is set by the backend, closeErr and closed by the goroutine reading the source
+	streamErr error
+	closeErr  error
+	closed    bool
+}
+
+func (f *fanOut) Stream(reader io.Reader) error {
+	f.running.Add(1)
+	defer f.running.Done()
+
+	var wg sync.WaitGroup
+	branches := make([]*branch, len(f.backends))
+	commits := newFanOutCommits(reader, len(f.backends), f.policy)
+	for i, backend := range f.backends {
+		b := &branch{Backend: backend, chunks: make(chan []byte, f.buffers)}
+		b.r, b.w = io.Pipe()
+		branches[i] = b
+
+		wg.Add(2)
+		index := i
+		go func() {
+			defer wg.Done()
+			b.streamErr = b.Streamer.Stream(&branchReader{Reader: b.r, source: reader, commit: func(offset int64) {
+				commits.commit(index, offset)
+			}})
+			if b.streamErr != nil {
+				commits.fail(index)
+			}
+			// unblock the writer if the backend returned without reading the whole stream
+			b.r.CloseWithError(errBackendClosed)
+		}()
+		go func() {
+			defer wg.Done()
+			for chunk := range b.chunks {
+				if _, err := b.w.Write(chunk); err != nil {
+					atomic.StoreInt32(&b.stopped, 1)
+					break
+				}
+			}
+			// ends the stream unless it was already closed with an error
+			b.w.Close()
+		}()
+	}
+
+	var readErr error
+	buf := make([]byte, fanOutChunkSize)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			chunk := append([]byte(nil), buf[:n]...)
+			for i, b := range branches {
+				if b.send(chunk, f.stall) != nil {
+					commits.fail(i)
+				}
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+	}
+	for _, b := range branches {
+		b.close(readErr)
+	}
+	wg.Wait()
+
+	var failed []string
+	for _, b := range branches {
+		err := b.streamErr
+		if err == nil {
+			err = b.closeErr
+		}
+		if err == nil && atomic.LoadInt32(&b.stopped) == 1 {
+			err = errBackendClosed
+		}
+		if err != nil {
+			log.Println("Error when streaming to", b.Name, err)
+			failed = append(failed, fmt.Sprintf("%s: %s", b.Name, err))
+		} else {
+			fmt.Println("Finished streaming to ", b.Name)
+		}
+		if f.report != nil {
+			f.report(b.Name, err)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// send buffers the chunk for the backend, failing the backend if its buffer stays full for the stall timeout.
+// It returns the error the backend was failed with
+func (b *branch) send(chunk []byte, stall time.Duration) error {
+	if b.closed {
+		return b.closeErr
+	}
+	if atomic.LoadInt32(&b.stopped) == 1 {
+		b.close(errBackendClosed)
+		return b.closeErr
+	}
+	select {
+	case b.chunks <- chunk:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(stall)
+	defer timer.Stop()
+	select {
+	case b.chunks <- chunk:
+	case <-timer.C:
+		b.close(errFellBehind)
+	}
+	return b.closeErr
+}
+
+// close ends the stream of the backend once its buffer has been written, or at once with the error if set
+// as the backend must not complete a partial upload
+func (b *branch) close(err error) {
+	if b.closed {
+		return
+	}
+	b.closed = true
+	if err != nil {
+		b.closeErr = err
+		b.w.CloseWithError(err)
+	}
+	close(b.chunks)
+}
+
+func (f *fanOut) Wait() {
+	f.running.Wait()
+	for _, b := range f.backends {
+		b.Streamer.Wait()
+	}
+}
+
+// fanOutCommits commits the offset up to which the backends have stored the stream, either every backend which
+// has not failed or any backend
+type fanOutCommits struct {
+	source  io.Reader
+	policy  CommitPolicy
+	mutex   sync.Mutex
+	offsets []int64
+	failed  []bool
+}
+
+func newFanOutCommits(source io.Reader, backends int, policy CommitPolicy) *fanOutCommits {
+	return &fanOutCommits{source: source, policy: policy, offsets: make([]int64, backends), failed: make([]bool, backends)}
+}
+
+func (c *fanOutCommits) commit(backend int, offset int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if offset > c.offsets[backend] {
+		c.offsets[backend] = offset
+	}
+	c.commitStored()
+}
+
+// fail leaves the backend out of the commits, what it stored before it failed may be incomplete
+func (c *fanOutCommits) fail(backend int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.failed[backend] {
+		return
+	}
+	c.failed[backend] = true
+	c.commitStored()
+}
+
+func (c *fanOutCommits) commitStored() {
+	stored := int64(-1)
+	for i, o := range c.offsets {
+		if c.failed[i] {
+			continue
+		}
+		if stored < 0 || (c.policy == CommitAny && o > stored) || (c.policy != CommitAny && o < stored) {
+			stored = o
+		}
+	}
+	if stored > 0 {
+		commit(c.source, stored)
+	}
+}
+
+// branchReader passes the message count, gzip member boundaries and commits of the source pipe on to the
+// backends, commits are passed to the commit function instead if it is set
+type branchReader struct {
+	io.Reader
+	source io.Reader
+	commit func(offset int64)
+}
+
+func (r *branchReader) Messages() int64 {
+	if counter, ok := r.source.(messageCounter); ok {
+		return counter.Messages()
+	}
+	return 0
+}
+
+func (r *branchReader) Flush() error {
+	if flusher, ok := r.source.(memberFlusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func (r *branchReader) Boundary() int64 {
+	if flusher, ok := r.source.(memberFlusher); ok {
+		return flusher.Boundary()
+	}
+	return 0
+}
+
+func (r *branchReader) Commit(offset int64) {
+	if r.commit != nil {
+		r.commit(offset)
+		return
+	}
+	commit(r.source, offset)
+}
+
+func (r *branchReader) Durable() bool {
+	return durable(r.source)
+}
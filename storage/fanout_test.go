@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fasthttp-server/pipe"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStreamer records what it reads, it can fail, stop reading early or read slowly
+type fakeStreamer struct {
+	mutex    sync.Mutex
+	received []byte
+	messages int64
+	err      error
+	stopAt   int
+	delay    time.Duration
+	waited   bool
+}
+
+func (f *fakeStreamer) Stream(reader io.Reader) error {
+	if f.delay > 0 {
+		time.Sleep(f.delay)
+	}
+	buf := make([]byte, 1024)
+	for {
+		n, err := reader.Read(buf)
+		f.mutex.Lock()
+		f.received = append(f.received, buf[:n]...)
+		stop := f.stopAt > 0 && len(f.received) >= f.stopAt
+		f.mutex.Unlock()
+		if stop {
+			return f.err
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if counter, ok := reader.(messageCounter); ok {
+		f.messages = counter.Messages()
+	}
+	return f.err
+}
+
+func (f *fakeStreamer) Wait() {
+	f.waited = true
+}
+
+func TestFanOut_Stream(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	tests := []struct {
+		name        string
+		backends    map[string]*fakeStreamer
+		bufferSize  int
+		wantFailed  []string
+		wantCorrect []string
+	}{
+		{"all succeed", map[string]*fakeStreamer{"s3": {}, "azure": {}}, 1 << 20, nil, []string{"azure", "s3"}},
+		{"a failed backend does not affect the others", map[string]*fakeStreamer{"s3": {err: errors.New("denied")}, "azure": {}},
+			1 << 20, []string{"s3"}, []string{"azure", "s3"}},
+		{"a backend which stops reading does not block the others",
+			map[string]*fakeStreamer{"s3": {stopAt: 1, err: errors.New("broken")}, "azure": {}}, 1 << 20, []string{"s3"}, []string{"azure"}},
+		{"a slow backend is failed once its buffer is full",
+			map[string]*fakeStreamer{"s3": {delay: 300 * time.Millisecond}, "azure": {}}, 1, []string{"s3"}, []string{"azure"}},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			var backends []Backend
+			for name, streamer := range test.backends {
+				backends = append(backends, Backend{Name: name, Streamer: streamer})
+			}
+			var mutex sync.Mutex
+			var failed []string
+			f := NewFanOutStreamer(backends, test.bufferSize, 50*time.Millisecond, CommitAll, func(backend string, err error) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				if err != nil {
+					failed = append(failed, backend)
+				}
+			})
+
+			err := f.Stream(bytes.NewReader(data))
+			if (err != nil) != (len(test.wantFailed) > 0) {
+				t.Errorf("Stream() error = %v, want failures %v", err, test.wantFailed)
+			}
+			sort.Strings(failed)
+			if len(failed) != len(test.wantFailed) || (len(failed) > 0 && failed[0] != test.wantFailed[0]) {
+				t.Errorf("failed backends = %v, want %v", failed, test.wantFailed)
+			}
+			for _, name := range test.wantCorrect {
+				if !bytes.Equal(test.backends[name].received, data) {
+					t.Errorf("%s received %d bytes, want %d", name, len(test.backends[name].received), len(data))
+				}
+			}
+
+			f.Wait()
+			for name, streamer := range test.backends {
+				if !streamer.waited {
+					t.Errorf("did not wait for %s", name)
+				}
+			}
+		})
+	}
+}
+
+func TestFanOut_passesMessageCount(t *testing.T) {
+	s3, azure := &fakeStreamer{}, &fakeStreamer{}
+	f := NewFanOutStreamer([]Backend{{"s3", s3}, {"azure", azure}}, 1<<20, time.Second, CommitAll, nil)
+
+	dataPipe := pipe.NewGzipWriter()
+	go func() {
+		dataPipe.Write([]byte("a"))
+		dataPipe.Write([]byte("b"))
+		dataPipe.Close()
+	}()
+	if err := f.Stream(dataPipe); err != nil {
+		t.Fatal(err)
+	}
+	if s3.messages != 2 || azure.messages != 2 {
+		t.Errorf("messages = %d %d, want 2", s3.messages, azure.messages)
+	}
+	if len(s3.received) == 0 || !bytes.Equal(s3.received, azure.received) {
+		t.Errorf("backends received %d and %d bytes", len(s3.received), len(azure.received))
+	}
+}
+
+func TestFanOut_commitsWhatEveryBackendStored(t *testing.T) {
+	source := &committingReader{}
+	commits := newFanOutCommits(source, 3, CommitAll)
+	for _, step := range []struct {
+		backend int
+		offset  int64
+		fail    bool
+		want    int64
+	}{
+		{0, 10, false, 0},
+		{1, 5, false, 0},
+		{2, 8, false, 5},
+		{1, 20, false, 8},
+		{2, 0, true, 10},
+		{0, 30, false, 20},
+		// a failed backend does not hold back the others
+		{1, 0, true, 30},
+	} {
+		if step.fail {
+			commits.fail(step.backend)
+		} else {
+			commits.commit(step.backend, step.offset)
+		}
+		if source.committed() != step.want {
+			t.Errorf("committed %d after backend %d stored %d, want %d", source.committed(), step.backend, step.offset, step.want)
+		}
+	}
+
+	// nothing more is committed once every backend failed
+	commits.fail(0)
+	commits.commit(0, 50)
+	if source.committed() != 30 {
+		t.Errorf("committed %d, want 30", source.committed())
+	}
+}
+
+func TestFanOut_commitsWhatAnyBackendStored(t *testing.T) {
+	source := &committingReader{}
+	commits := newFanOutCommits(source, 2, CommitAny)
+	commits.commit(0, 10)
+	if source.committed() != 10 {
+		t.Errorf("committed %d, want 10", source.committed())
+	}
+	commits.commit(1, 5)
+	if source.committed() != 10 {
+		t.Errorf("committed %d, want 10", source.committed())
+	}
+
+	reader := &branchReader{source: source, commit: func(offset int64) { commits.commit(1, offset) }}
+	reader.Commit(40)
+	if source.committed() != 40 {
+		t.Errorf("committed %d, want 40", source.committed())
+	}
+}
+
+func TestFanOut_commitsPastFailedBackends(t *testing.T) {
+	source := &committingReader{}
+	stored := &storingStreamer{}
+	f := NewFanOutStreamer([]Backend{{"s3", stored}, {"azure", &fakeStreamer{err: errors.New("unavailable"), stopAt: 1}}},
+		1<<20, time.Second, CommitAll, nil)
+
+	source.Reader = strings.NewReader("abc")
+	if err := f.Stream(source); err == nil {
+		t.Error("expected the error of the failed backend")
+	}
+	if source.committed() != 3 {
+		t.Errorf("committed %d, want 3", source.committed())
+	}
+}
+
+// storingStreamer reads the whole stream and commits it
+type storingStreamer struct{}
+
+func (s *storingStreamer) Stream(reader io.Reader) error {
+	n, err := io.Copy(ioutil.Discard, reader)
+	if err != nil {
+		return err
+	}
+	commit(reader, n)
+	return nil
+}
+
+func (s *storingStreamer) Wait() {}
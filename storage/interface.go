@@ -4,7 +4,33 @@ import (
 	"io"
 )
 
+// Version of the server stored in the metadata of objects, it is set at build time with
+// -ldflags "-X fasthttp-server/storage.Version=..."
+var Version = "dev"
+
+// committer is implemented by pipes which acknowledge messages once they are stored, Commit is called with the
+// offset up to which the stream is stored. Backends which can store the stream at any offset e.g. files only sync
+// it as it is read if Durable is true, as writers wait for it to be committed then
+type committer interface {
+	Commit(offset int64)
+	Durable() bool
+}
+
+// commit reports the offset up to which the stream of the reader is stored
+func commit(reader io.Reader, offset int64) {
+	if c, ok := reader.(committer); ok {
+		c.Commit(offset)
+	}
+}
+
+// durable returns true if the stream of the reader should be stored as it is read
+func durable(reader io.Reader) bool {
+	c, ok := reader.(committer)
+	return ok && c.Durable()
+}
+
+// MessageStreamer uploads the stream of a reader to a storage backend, Stream returns once the upload has ended
 type MessageStreamer interface {
-	Stream(reader io.Reader)
+	Stream(reader io.Reader) error
 	Wait()
 }
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"io"
+	"sync"
+)
+
+// committingReader records the offsets committed by a backend
+type committingReader struct {
+	io.Reader
+	durable bool
+	mutex   sync.Mutex
+	commits []int64
+}
+
+func (c *committingReader) Commit(offset int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.commits = append(c.commits, offset)
+}
+
+func (c *committingReader) Durable() bool {
+	return c.durable
+}
+
+// committed returns the last committed offset
+func (c *committingReader) committed() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.commits) == 0 {
+		return 0
+	}
+	return c.commits[len(c.commits)-1]
+}
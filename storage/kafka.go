@@ -0,0 +1,310 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	kafkagzip "github.com/segmentio/kafka-go/gzip"
+	"github.com/segmentio/kafka-go/snappy"
+)
+
+const (
+	kafkaBrokers      = "KAFKA_BROKERS"
+	kafkaTopic        = "KAFKA_TOPIC"
+	kafkaKeyTemplate  = "KAFKA_KEY_TEMPLATE"
+	kafkaBatchSize    = "KAFKA_BATCH_SIZE"
+	kafkaBatchBytes   = "KAFKA_BATCH_BYTES"
+	kafkaBatchTimeout = "KAFKA_BATCH_TIMEOUT"
+	kafkaCompression  = "KAFKA_COMPRESSION"
+	kafkaAcks         = "KAFKA_ACKS"
+
+	defaultKafkaKeyTemplate  KeyTemplate = "{client_id}"
+	defaultKafkaBatchSize                = 100
+	defaultKafkaBatchBytes               = 1024 * 1024
+	defaultKafkaBatchTimeout             = time.Second
+
+	kafkaAcksAll = "all"
+	kafkaAcksOne = "one"
+
+	// maxMessageSize bounds the length of a line read from the stream
+	maxMessageSize = 16 * 1024 * 1024
+)
+
+// kafkaCodecs are the compression codecs messages can be published with
+var kafkaCodecs = map[string]func() kafka.CompressionCodec{
+	"none":   func() kafka.CompressionCodec { return nil },
+	"gzip":   func() kafka.CompressionCodec { return kafkagzip.NewCompressionCodec() },
+	"snappy": func() kafka.CompressionCodec { return snappy.NewCompressionCodec() },
+}
+
+// messageWriter publishes messages, it is implemented by kafka.Writer
+type messageWriter interface {
+	WriteMessages(ctx context.Context, messages ...kafka.Message) error
+	Close() error
+}
+
+var kafkaNewWriter = func(config kafka.WriterConfig) messageWriter {
+	return kafka.NewWriter(config)
+}
+
+type kafkaStreamer struct {
+	config  kafka.WriterConfig
+	key     []byte
+	backoff backoff
+	running sync.WaitGroup
+}
+
+// NewKafkaStreamer returns a MessageStreamer publishing every message of the stream to KAFKA_TOPIC, messages are
+// keyed by the client id so the messages of a client stay in order on one partition
+func NewKafkaStreamer(object Object, _, _ int) MessageStreamer {
+	fmt.Println("Creating new Kafka streamer for client ", object.ClientID)
+	k := &kafkaStreamer{key: []byte(object.key(kafkaKeyTemplate, defaultKafkaKeyTemplate)), backoff: newBackoff()}
+	k.config = kafka.WriterConfig{
+		Topic:        os.Getenv(kafkaTopic),
+		Balancer:     &kafka.Hash{},
+		BatchSize:    defaultKafkaBatchSize,
+		BatchBytes:   defaultKafkaBatchBytes,
+		BatchTimeout: defaultKafkaBatchTimeout,
+		RequiredAcks: -1,
+	}
+	for _, broker := range strings.Split(os.Getenv(kafkaBrokers), ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			k.config.Brokers = append(k.config.Brokers, broker)
+		}
+	}
+	if len(k.config.Brokers) == 0 || k.config.Topic == "" {
+		message := "Cannot create kafka streamer, ensure the following environment variables are set:"
+		logFatalf("%s\n%s\n%s\n", message, kafkaBrokers, kafkaTopic)
+	}
+	if object.contentEncoding() != gzipContentEncoding {
+		logFatalf("Cannot publish %s streams to kafka, encryption must be disabled", object.Extension)
+	}
+
+	for env, value := range map[string]*int{kafkaBatchSize: &k.config.BatchSize, kafkaBatchBytes: &k.config.BatchBytes} {
+		if setting := os.Getenv(env); setting != "" {
+			var err error
+			if *value, err = strconv.Atoi(setting); err != nil || *value <= 0 {
+				logFatalf("%s must be a positive number", env)
+			}
+		}
+	}
+	if timeout := os.Getenv(kafkaBatchTimeout); timeout != "" {
+		var err error
+		if k.config.BatchTimeout, err = time.ParseDuration(timeout); err != nil || k.config.BatchTimeout <= 0 {
+			logFatalf("%s must be a positive duration e.g. 1s", kafkaBatchTimeout)
+		}
+	}
+	if compression := os.Getenv(kafkaCompression); compression != "" {
+		codec, ok := kafkaCodecs[compression]
+		if !ok {
+			logFatalf("%s must be none, gzip or snappy", kafkaCompression)
+		} else {
+			k.config.CompressionCodec = codec()
+		}
+	}
+	switch os.Getenv(kafkaAcks) {
+	case "", kafkaAcksAll:
+	case kafkaAcksOne:
+		k.config.RequiredAcks = 1
+	default:
+		logFatalf("%s must be %s or %s", kafkaAcks, kafkaAcksAll, kafkaAcksOne)
+	}
+	return k
+}
+
+// Stream decompresses the stream and publishes its lines in batches of KAFKA_BATCH_SIZE, a smaller batch is
+// published once KAFKA_BATCH_TIMEOUT has passed since its first message. The stream is committed up to the end
+// of a gzip member once every line of the member has been published. Failed batches are retried with the
+// AWS_RETRY_* backoff, the stream ends with the error once a batch cannot be published
+func (k *kafkaStreamer) Stream(reader io.Reader) error {
+	k.running.Add(1)
+	defer k.running.Done()
+
+	writer := kafkaNewWriter(k.config)
+	defer writer.Close()
+
+	lines := make(chan streamLine, k.config.BatchSize)
+	done := make(chan struct{})
+	defer close(done)
+	var readErr error
+	go func() {
+		defer close(lines)
+		readErr = readLines(reader, lines, done)
+	}()
+
+	ctx := context.Background()
+	batch := make([]kafka.Message, 0, k.config.BatchSize)
+	// boundary is the end of the last member read, it is committed once the batch holding its lines is published
+	var boundary, committed int64
+	timer := time.NewTimer(k.config.BatchTimeout)
+	defer timer.Stop()
+	publish := func() error {
+		if len(batch) > 0 {
+			err := k.backoff.retry("WriteMessages", func() error {
+				return writer.WriteMessages(ctx, batch...)
+			})
+			if err != nil {
+				log.Println("Error when publishing to", k.config.Topic, err)
+				return err
+			}
+		}
+		if boundary > committed {
+			committed = boundary
+			commit(reader, committed)
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				if err := publish(); err != nil {
+					return err
+				}
+				if readErr != nil {
+					log.Println("Error when reading stream for", k.config.Topic, readErr)
+				}
+				return readErr
+			}
+			if line.value == nil {
+				boundary = line.boundary
+				if len(batch) == 0 {
+					if err := publish(); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if len(batch) == 0 {
+				timer.Reset(k.config.BatchTimeout)
+			}
+			batch = append(batch, kafka.Message{Key: k.key, Value: line.value})
+			if len(batch) >= k.config.BatchSize {
+				if err := publish(); err != nil {
+					return err
+				}
+			}
+		case <-timer.C:
+			if err := publish(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// streamLine is a line of the stream, or the end of a gzip member at the boundary offset if it has no value
+type streamLine struct {
+	value    []byte
+	boundary int64
+}
+
+// readLines decompresses the gzip stream and sends each line without its newline, followed by the offset in the
+// stream at which its member ends. It stops once done is closed
+func readLines(reader io.Reader, lines chan<- streamLine, done <-chan struct{}) error {
+	send := func(line streamLine) error {
+		select {
+		case lines <- line:
+			return nil
+		case <-done:
+			return errBackendClosed
+		}
+	}
+
+	// the gzip reader reads no further than the member it decompresses from a byte reader
+	counter := &countingReader{reader: reader}
+	buffered := bufio.NewReader(counter)
+	gz, err := gzip.NewReader(buffered)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	gz.Multistream(false)
+	lineReader := bufio.NewReaderSize(gz, 64*1024)
+	for {
+		line, skipped, err := readLine(lineReader)
+		if skipped {
+			log.Printf("Skipping a line of more than %d bytes", maxMessageSize)
+		} else if len(line) > 0 {
+			if err := send(streamLine{value: line}); err != nil {
+				return err
+			}
+		}
+		if err != io.EOF {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := send(streamLine{boundary: counter.n - int64(buffered.Buffered())}); err != nil {
+			return err
+		}
+		if err := gz.Reset(buffered); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		gz.Multistream(false)
+		lineReader.Reset(gz)
+	}
+}
+
+// readLine returns the next line without its line ending, a line of more than maxMessageSize bytes is read to
+// its end without being kept and skipped is returned instead, so one line cannot stop the stream
+func readLine(reader *bufio.Reader) (line []byte, skipped bool, err error) {
+	for {
+		var chunk []byte
+		chunk, err = reader.ReadSlice('\n')
+		if !skipped {
+			line = append(line, chunk...)
+			// the line ending is not part of the size
+			if len(line) > maxMessageSize+2 {
+				line, skipped = nil, true
+			}
+		}
+		if err != bufio.ErrBufferFull {
+			break
+		}
+	}
+	if skipped {
+		return nil, skipped, err
+	}
+	line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+	if len(line) > maxMessageSize {
+		return nil, true, err
+	}
+	return line, false, err
+}
+
+// countingReader counts the bytes read from the reader
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (k *kafkaStreamer) Wait() {
+	fmt.Println("Waiting for streaming to end for topic ", k.config.Topic)
+	k.running.Wait()
+	fmt.Println("Finished Streaming to topic ", k.config.Topic)
+}
@@ -0,0 +1,84 @@
+//go:build integration
+// +build integration
+
+package storage
+
+import (
+	"context"
+	"fasthttp-server/pipe"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// TestKafkaStreamer_integration publishes to the broker at KAFKA_BROKERS, localhost:9092 by default, run it with
+// go test -tags integration ./storage/...
+func TestKafkaStreamer_integration(t *testing.T) {
+	broker := os.Getenv(kafkaBrokers)
+	if broker == "" {
+		broker = "localhost:9092"
+	}
+	topic := fmt.Sprintf("fasthttp-server-test-%d", time.Now().UnixNano())
+	conn, err := kafka.Dial("tcp", broker)
+	if err != nil {
+		t.Fatalf("cannot connect to the broker at %s: %v", broker, err)
+	}
+	defer conn.Close()
+	if err := conn.CreateTopics(kafka.TopicConfig{Topic: topic, NumPartitions: 3, ReplicationFactor: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.DeleteTopics(topic)
+
+	os.Setenv(kafkaBrokers, broker)
+	os.Setenv(kafkaTopic, topic)
+	os.Setenv(kafkaCompression, "gzip")
+	os.Setenv(kafkaBatchTimeout, "10ms")
+	defer func() {
+		os.Unsetenv(kafkaBrokers)
+		os.Unsetenv(kafkaTopic)
+		os.Unsetenv(kafkaCompression)
+		os.Unsetenv(kafkaBatchTimeout)
+	}()
+
+	const messages = 250
+	for _, clientID := range []string{"1", "2"} {
+		streamer := NewKafkaStreamer(Object{ClientID: clientID, Partition: clientID}, 0, 0)
+		dataPipe := pipe.NewGzipWriter()
+		go func(clientID string) {
+			for i := 0; i < messages; i++ {
+				dataPipe.Write([]byte(fmt.Sprintf(`{"client_id":%s,"n":%d}`, clientID, i)))
+			}
+			dataPipe.Close()
+		}(clientID)
+		if err := streamer.Stream(dataPipe); err != nil {
+			t.Fatal(err)
+		}
+		streamer.Wait()
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{Brokers: []string{broker}, Topic: topic, GroupID: topic})
+	defer reader.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	next := map[string]int{}
+	partitions := map[string]int{}
+	for i := 0; i < 2*messages; i++ {
+		message, err := reader.ReadMessage(ctx)
+		if err != nil {
+			t.Fatalf("read %d messages: %v", i, err)
+		}
+		key := string(message.Key)
+		if want := fmt.Sprintf(`{"client_id":%s,"n":%d}`, key, next[key]); string(message.Value) != want {
+			t.Fatalf("message = %s, want %s", message.Value, want)
+		}
+		if partition, ok := partitions[key]; ok && partition != message.Partition {
+			t.Errorf("messages of client %s were published to partitions %d and %d", key, partition, message.Partition)
+		}
+		partitions[key] = message.Partition
+		next[key]++
+	}
+}
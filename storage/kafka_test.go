@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fasthttp-server/pipe"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/snappy"
+)
+
+func TestNewKafkaStreamer(t *testing.T) {
+	tests := []struct {
+		name            string
+		env             map[string]string
+		object          Object
+		want            kafka.WriterConfig
+		wantKey         string
+		shouldCallFatal bool
+	}{
+		{"defaults", map[string]string{kafkaBrokers: "localhost:9092", kafkaTopic: "logs"}, Object{ClientID: "42"},
+			kafka.WriterConfig{Brokers: []string{"localhost:9092"}, Topic: "logs", BatchSize: defaultKafkaBatchSize,
+				BatchBytes: defaultKafkaBatchBytes, BatchTimeout: defaultKafkaBatchTimeout, RequiredAcks: -1}, "42", false},
+		{"options", map[string]string{kafkaBrokers: "k1:9092, k2:9092", kafkaTopic: "logs", kafkaBatchSize: "500",
+			kafkaBatchBytes: "2048", kafkaBatchTimeout: "50ms", kafkaCompression: "snappy", kafkaAcks: "one",
+			kafkaKeyTemplate: "{client_id}-{partition}"}, Object{ClientID: "42", Partition: "eu"},
+			kafka.WriterConfig{Brokers: []string{"k1:9092", "k2:9092"}, Topic: "logs", BatchSize: 500, BatchBytes: 2048,
+				BatchTimeout: 50 * time.Millisecond, RequiredAcks: 1, CompressionCodec: snappy.NewCompressionCodec()}, "42-eu", false},
+		{"should call fatal without brokers", map[string]string{kafkaTopic: "logs"}, Object{ClientID: "42"},
+			kafka.WriterConfig{Topic: "logs", BatchSize: defaultKafkaBatchSize, BatchBytes: defaultKafkaBatchBytes,
+				BatchTimeout: defaultKafkaBatchTimeout, RequiredAcks: -1}, "42", true},
+		{"should call fatal for encrypted streams", map[string]string{kafkaBrokers: "localhost:9092", kafkaTopic: "logs"},
+			Object{ClientID: "42", Extension: "ndjson.gz.enc"},
+			kafka.WriterConfig{Brokers: []string{"localhost:9092"}, Topic: "logs", BatchSize: defaultKafkaBatchSize,
+				BatchBytes: defaultKafkaBatchBytes, BatchTimeout: defaultKafkaBatchTimeout, RequiredAcks: -1}, "42", true},
+		{"should call fatal for unknown codecs", map[string]string{kafkaBrokers: "localhost:9092", kafkaTopic: "logs",
+			kafkaCompression: "lz4"}, Object{ClientID: "42"},
+			kafka.WriterConfig{Brokers: []string{"localhost:9092"}, Topic: "logs", BatchSize: defaultKafkaBatchSize,
+				BatchBytes: defaultKafkaBatchBytes, BatchTimeout: defaultKafkaBatchTimeout, RequiredAcks: -1}, "42", true},
+		{"should call fatal for unknown acks", map[string]string{kafkaBrokers: "localhost:9092", kafkaTopic: "logs",
+			kafkaAcks: "none"}, Object{ClientID: "42"},
+			kafka.WriterConfig{Brokers: []string{"localhost:9092"}, Topic: "logs", BatchSize: defaultKafkaBatchSize,
+				BatchBytes: defaultKafkaBatchBytes, BatchTimeout: defaultKafkaBatchTimeout, RequiredAcks: -1}, "42", true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				os.Setenv(name, value)
+			}
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				for name := range test.env {
+					os.Unsetenv(name)
+				}
+			}()
+
+			got := NewKafkaStreamer(test.object, 0, 0).(*kafkaStreamer)
+			got.config.Balancer = nil
+			if !reflect.DeepEqual(got.config, test.want) {
+				t.Errorf("config = %+v, want %+v", got.config, test.want)
+			}
+			if string(got.key) != test.wantKey {
+				t.Errorf("key = %v, want %v", string(got.key), test.wantKey)
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+// fakeWriter records the batches written to it
+type fakeWriter struct {
+	mutex   sync.Mutex
+	batches [][]kafka.Message
+	err     error
+	// failures is the number of batches which fail with err, every batch fails if it is 0
+	failures int
+	closed   bool
+}
+
+func (f *fakeWriter) WriteMessages(ctx context.Context, messages ...kafka.Message) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.batches = append(f.batches, append([]kafka.Message(nil), messages...))
+	if f.failures > 0 && len(f.batches) > f.failures {
+		return nil
+	}
+	return f.err
+}
+
+func (f *fakeWriter) Close() error {
+	f.closed = true
+	return nil
+}
+
+func Test_kafkaStreamer_Stream(t *testing.T) {
+	tests := []struct {
+		name        string
+		messages    int
+		batchSize   int
+		delay       time.Duration
+		err         error
+		wantBatches []int
+		wantErr     bool
+	}{
+		{"batches messages", 5, 2, 0, nil, []int{2, 2, 1}, false},
+		{"publishes a partial batch after the timeout", 2, 10, 100 * time.Millisecond, nil, []int{1, 1}, false},
+		{"empty streams", 0, 10, 0, nil, nil, false},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			writer := &fakeWriter{err: test.err}
+			kafkaNewWriter = func(kafka.WriterConfig) messageWriter {
+				return writer
+			}
+			defer func() {
+				kafkaNewWriter = func(config kafka.WriterConfig) messageWriter { return kafka.NewWriter(config) }
+			}()
+
+			k := &kafkaStreamer{
+				config: kafka.WriterConfig{Topic: "logs", BatchSize: test.batchSize, BatchTimeout: 20 * time.Millisecond},
+				key:    []byte("42"),
+			}
+			dataPipe := pipe.NewGzipWriter()
+			go func() {
+				for i := 0; i < test.messages; i++ {
+					dataPipe.Write([]byte(fmt.Sprintf(`{"n":%d}`, i)))
+					if test.delay > 0 {
+						dataPipe.(memberFlusher).Flush()
+						time.Sleep(test.delay)
+					}
+				}
+				dataPipe.Close()
+			}()
+
+			if err := k.Stream(dataPipe); (err != nil) != test.wantErr {
+				t.Errorf("Stream() error = %v, wantErr %v", err, test.wantErr)
+			}
+			var sizes []int
+			n := 0
+			for _, batch := range writer.batches {
+				sizes = append(sizes, len(batch))
+				for _, message := range batch {
+					if want := fmt.Sprintf(`{"n":%d}`, n); string(message.Value) != want || string(message.Key) != "42" {
+						t.Errorf("message %d = %s: %s, want 42: %s", n, message.Key, message.Value, want)
+					}
+					n++
+				}
+			}
+			if fmt.Sprint(sizes) != fmt.Sprint(test.wantBatches) {
+				t.Errorf("batches = %v, want %v", sizes, test.wantBatches)
+			}
+			if !writer.closed {
+				t.Error("the writer was not closed")
+			}
+		})
+	}
+}
+
+func Test_kafkaStreamer_publishErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		failures    int
+		wantBatches int
+		wantErr     bool
+	}{
+		{"retries failed batches", 2, 3, false},
+		{"ends the stream once a batch cannot be published", 3, 3, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			writer := &fakeWriter{err: errors.New("not leader"), failures: test.failures}
+			kafkaNewWriter = func(kafka.WriterConfig) messageWriter {
+				return writer
+			}
+			timeSleep = func(time.Duration) {}
+			defer func() {
+				kafkaNewWriter = func(config kafka.WriterConfig) messageWriter { return kafka.NewWriter(config) }
+				timeSleep = time.Sleep
+			}()
+
+			k := &kafkaStreamer{
+				config:  kafka.WriterConfig{Topic: "logs", BatchSize: 2, BatchTimeout: time.Second},
+				backoff: backoff{attempts: 3, base: time.Millisecond, max: time.Millisecond},
+			}
+			dataPipe := pipe.NewGzipWriter()
+			go func() {
+				dataPipe.Write([]byte(`{"n":0}`))
+				dataPipe.Write([]byte(`{"n":1}`))
+				dataPipe.(memberFlusher).Flush()
+				if !test.wantErr {
+					dataPipe.Close()
+				}
+			}()
+
+			// the pipe is left open when publishing fails, so the stream must end without reaching its end
+			result := make(chan error, 1)
+			go func() {
+				result <- k.Stream(dataPipe)
+			}()
+			select {
+			case err := <-result:
+				if (err != nil) != test.wantErr {
+					t.Errorf("Stream() error = %v, wantErr %v", err, test.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Stream() did not end")
+			}
+			dataPipe.Close()
+			if len(writer.batches) != test.wantBatches {
+				t.Errorf("published %d batches, want %d", len(writer.batches), test.wantBatches)
+			}
+		})
+	}
+}
+
+func Test_kafkaStreamer_skipsLongLines(t *testing.T) {
+	writer := &fakeWriter{}
+	kafkaNewWriter = func(kafka.WriterConfig) messageWriter {
+		return writer
+	}
+	defer func() {
+		kafkaNewWriter = func(config kafka.WriterConfig) messageWriter { return kafka.NewWriter(config) }
+	}()
+
+	k := &kafkaStreamer{config: kafka.WriterConfig{Topic: "logs", BatchSize: 10, BatchTimeout: time.Second}}
+	dataPipe := pipe.NewGzipWriter()
+	go func() {
+		dataPipe.Write([]byte(`{"n":0}`))
+		dataPipe.Write(bytes.Repeat([]byte("a"), maxMessageSize+1))
+		dataPipe.Write(bytes.Repeat([]byte("b"), maxMessageSize))
+		dataPipe.Write([]byte(`{"n":1}`))
+		dataPipe.Close()
+	}()
+
+	if err := k.Stream(dataPipe); err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for _, batch := range writer.batches {
+		for _, message := range batch {
+			if len(message.Value) > 16 {
+				values = append(values, fmt.Sprintf("%d bytes", len(message.Value)))
+				continue
+			}
+			values = append(values, string(message.Value))
+		}
+	}
+	want := []string{`{"n":0}`, fmt.Sprintf("%d bytes", maxMessageSize), `{"n":1}`}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("published %v, want %v", values, want)
+	}
+}
+
+func Test_kafkaStreamer_commits(t *testing.T) {
+	writer := &fakeWriter{}
+	kafkaNewWriter = func(kafka.WriterConfig) messageWriter {
+		return writer
+	}
+	defer func() {
+		kafkaNewWriter = func(config kafka.WriterConfig) messageWriter { return kafka.NewWriter(config) }
+	}()
+
+	k := &kafkaStreamer{config: kafka.WriterConfig{Topic: "logs", BatchSize: 10, BatchTimeout: 10 * time.Millisecond}}
+	dataPipe := pipe.NewGzipWriter()
+	done := make(chan error)
+	go func() {
+		done <- k.Stream(dataPipe)
+	}()
+
+	// each synced member is committed once its messages are published
+	syncer := dataPipe.(interface {
+		Sync(timeout time.Duration) (int64, bool, error)
+	})
+	for i := 0; i < 2; i++ {
+		dataPipe.Write([]byte(fmt.Sprintf(`{"n":%d}`, i)))
+		if messages, committed, err := syncer.Sync(time.Second); err != nil || !committed || messages != int64(i+1) {
+			t.Fatalf("Sync() = %d, %v, %v after message %d", messages, committed, err, i)
+		}
+		writer.mutex.Lock()
+		published := len(writer.batches)
+		writer.mutex.Unlock()
+		if published != i+1 {
+			t.Errorf("committed before the message was published, %d batches", published)
+		}
+	}
+	dataPipe.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,382 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	instanceID       = "INSTANCE_ID"
+	defaultExtension = "ndjson.gz"
+	unknownValue     = "unknown"
+	maxValueLength   = 128
+	keyHashLength    = 16
+
+	contentType           = "application/x-ndjson"
+	gzipContentEncoding   = "gzip"
+	metadataServerVersion = "server_version"
+	metadataClientID      = "client_id"
+	metadataCodec         = "codec"
+)
+
+var (
+	osHostname = os.Hostname
+	timeNow    = time.Now
+
+	sequenceMutex sync.Mutex
+	// sequences holds the last sequence number of each partition numbered on sequenceDay
+	sequences   = map[string]int{}
+	sequenceDay string
+	// sequenceSeed returns the highest sequence number in the keys of the stored objects of the object's partition
+	sequenceSeed func(Object) (int, error)
+)
+
+// Object describes the object or blob a MessageStreamer writes to
+type Object struct {
+	ClientID string
+	// Partition is the routing key of the stream, it is the client id unless other routing rules are configured
+	Partition string
+	// Sequence is the number of the object in its partition, see NextSequence
+	Sequence  int
+	Created   time.Time
+	Extension string
+	// Template overrides the key template configured for the backend
+	Template KeyTemplate
+	// Metadata is stored with the object e.g. the wrapped data key of an encrypted object
+	Metadata map[string]string
+	// Message is the first message of the stream, it is used to resolve {field:...} placeholders
+	Message []byte
+}
+
+// metadata returns the metadata to store with the object, the server version, client id and codec
+// are added to the object's own metadata. The client id is query escaped as metadata only holds ASCII
+// header values, see ClientIDOf
+func (o Object) metadata() map[string]string {
+	metadata := map[string]string{metadataServerVersion: Version, metadataCodec: defaultExtension}
+	if o.ClientID != "" {
+		metadata[metadataClientID] = url.QueryEscape(o.ClientID)
+	}
+	if o.Extension != "" {
+		metadata[metadataCodec] = o.Extension
+	}
+	for name, value := range o.Metadata {
+		metadata[name] = value
+	}
+	return metadata
+}
+
+// contentEncoding returns gzip unless the object is encrypted, as clients must not decompress it transparently
+func (o Object) contentEncoding() string {
+	if o.Extension == "" || strings.HasSuffix(o.Extension, ".gz") {
+		return gzipContentEncoding
+	}
+	return ""
+}
+
+// KeyTemplate is an object key or blob name containing placeholders, e.g.
+// dt={date}/client={client_id}/part-{seq}.{ext}
+//
+// Supported placeholders are:
+//
+//	{date}         date formatted as 2006-01-02
+//	{yyyy} {mm} {dd} {hh}  date parts and hour
+//	{client_id}    the client id
+//	{partition}    the routing key of the stream
+//	{hostname}     hostname of the machine
+//	{instance}     INSTANCE_ID environment variable, defaults to the hostname
+//	{seq} {seq:N}  sequence number of the object, optionally zero padded to N digits, see NextSequence
+//	{ext}          codec extension e.g. ndjson.gz
+//	{field:path}   value of a field of the first message, e.g. {field:tenant.id}
+type KeyTemplate string
+
+// Validate checks that the template is well formed and only uses known placeholders
+func (t KeyTemplate) Validate() error {
+	_, err := t.expand(Object{})
+	return err
+}
+
+// Execute returns the key of the given object, it panics if the template is invalid as templates are validated
+// when they are configured
+func (t KeyTemplate) Execute(o Object) string {
+	key, err := t.expand(o)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func (t KeyTemplate) expand(o Object) (string, error) {
+	if o.Created.IsZero() {
+		o.Created = timeNow()
+	}
+	if o.Extension == "" {
+		o.Extension = defaultExtension
+	}
+
+	var b strings.Builder
+	rest := string(t)
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			b.WriteString(rest)
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unclosed placeholder in key template %q", t)
+		}
+		b.WriteString(rest[:start])
+		value, err := placeholder(rest[start+1:start+end], o)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+		rest = rest[start+end+1:]
+	}
+
+	return strings.TrimLeft(b.String(), "/"), nil
+}
+
+func placeholder(name string, o Object) (string, error) {
+	var arg string
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		name, arg = name[:i], name[i+1:]
+	}
+
+	switch name {
+	case "date":
+		return o.Created.Format("2006-01-02"), nil
+	case "yyyy":
+		return o.Created.Format("2006"), nil
+	case "mm":
+		return o.Created.Format("01"), nil
+	case "dd":
+		return o.Created.Format("02"), nil
+	case "hh":
+		return o.Created.Format("15"), nil
+	case "client_id":
+		return SanitizeKey(o.ClientID), nil
+	case "partition":
+		return SanitizeKey(o.Partition), nil
+	case "hostname":
+		return SanitizeKey(hostname()), nil
+	case "instance":
+		if id := os.Getenv(instanceID); id != "" {
+			return SanitizeKey(id), nil
+		}
+		return SanitizeKey(hostname()), nil
+	case "seq":
+		if arg == "" {
+			return strconv.Itoa(o.Sequence), nil
+		}
+		width, err := strconv.Atoi(arg)
+		if err != nil || width < 1 {
+			return "", fmt.Errorf("invalid sequence width %q", arg)
+		}
+		return fmt.Sprintf("%0*d", width, o.Sequence), nil
+	case "ext":
+		return o.Extension, nil
+	case "field":
+		if arg == "" {
+			return "", fmt.Errorf("field placeholder requires a path e.g. {field:tenant.id}")
+		}
+		value, _ := MessageField(o.Message, arg)
+		return SanitizeKey(value), nil
+	}
+	return "", fmt.Errorf("unknown placeholder {%s}", name)
+}
+
+func hostname() string {
+	name, err := osHostname()
+	if err != nil || name == "" {
+		return unknownValue
+	}
+	return name
+}
+
+// SanitizeKey makes a value safe to be used in an object key or blob name, any character other than
+// letters, digits, '-', '_', '.' and '=' is replaced by an underscore, as are dot only values such as ".."
+// and trailing dots. Values are limited to 128 characters and empty values become "unknown". Values which
+// are changed or truncated end with '~' and a hash of the original value, so different values such as "a/b"
+// and "a_b" never share a key
+func SanitizeKey(value string) string {
+	if value == "" {
+		return unknownValue
+	}
+
+	b := make([]byte, 0, len(value))
+	changed := false
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '=':
+			b = append(b, c)
+		default:
+			b = append(b, '_')
+			changed = true
+		}
+	}
+
+	for i := len(b) - 1; i >= 0 && b[i] == '.'; i-- {
+		b[i] = '_'
+		changed = true
+	}
+	if !changed && len(b) <= maxValueLength {
+		return string(b)
+	}
+
+	sum := sha256.Sum256([]byte(value))
+	suffix := "~" + hex.EncodeToString(sum[:keyHashLength/2])
+	if len(b) > maxValueLength-len(suffix) {
+		b = b[:maxValueLength-len(suffix)]
+	}
+	return string(b) + suffix
+}
+
+// MessageField returns the value at the dot separated path of a JSON message e.g. tenant.id,
+// ok is false if the path does not exist or does not hold a string, number or boolean
+func MessageField(message []byte, path string) (value string, ok bool) {
+	var keys []interface{}
+	for _, key := range strings.Split(path, ".") {
+		if i, err := strconv.Atoi(key); err == nil {
+			keys = append(keys, i)
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	field := jsoniter.Get(message, keys...)
+	switch field.ValueType() {
+	case jsoniter.InvalidValue, jsoniter.NilValue, jsoniter.ObjectValue, jsoniter.ArrayValue:
+		return "", false
+	}
+	value = field.ToString()
+	return value, value != ""
+}
+
+// SeedSequences seeds the sequence numbers of a partition from the keys of its objects in the store, nil stops
+// seeding. Stores which cannot tell the sequence numbers of their objects are ignored
+func SeedSequences(store ObjectStore) {
+	sequenceMutex.Lock()
+	defer sequenceMutex.Unlock()
+
+	sequenceSeed = nil
+	if seeder, ok := store.(interface{ lastSequence(Object) (int, error) }); ok {
+		sequenceSeed = seeder.lastSequence
+	}
+}
+
+// NextSequence returns the sequence number of the object in its partition. The numbers of a partition increase with
+// every object, starting each day after the highest number in the keys of the partition's objects in the store set
+// with SeedSequences. Without a store, or if its objects cannot be listed, numbers start at the current time in
+// milliseconds so the keys of objects stored before a restart are not reused. Only the numbers of the day are kept
+func NextSequence(object Object) int {
+	created := object.Created
+	if created.IsZero() {
+		created = timeNow()
+	}
+	day := created.Format("2006-01-02")
+
+	sequenceMutex.Lock()
+	_, numbered := sequences[object.Partition]
+	numbered = numbered && day <= sequenceDay
+	seed := sequenceSeed
+	sequenceMutex.Unlock()
+
+	// the objects are listed without holding the lock, so other partitions are numbered meanwhile
+	start := int(timeNow().UnixNano() / int64(time.Millisecond))
+	if !numbered && seed != nil {
+		last, err := seed(object)
+		if err == nil {
+			start = last + 1
+		} else {
+			log.Println("Error when listing the objects of partition", object.Partition, "numbering from the time", err)
+		}
+	}
+
+	sequenceMutex.Lock()
+	defer sequenceMutex.Unlock()
+	if day > sequenceDay {
+		sequences = map[string]int{}
+		sequenceDay = day
+	}
+	next, ok := sequences[object.Partition]
+	if ok {
+		next++
+	} else {
+		next = start
+	}
+	sequences[object.Partition] = next
+	return next
+}
+
+// sequenceOf returns the sequence number in a key of the template, ok is false unless the key is the one of the object
+// up to its sequence number
+func (t KeyTemplate) sequenceOf(key string, o Object) (sequence int, ok bool) {
+	start := strings.Index(string(t), "{seq}")
+	if width := strings.Index(string(t), "{seq:"); width >= 0 && (start < 0 || width < start) {
+		start = width
+	}
+	if start < 0 {
+		return 0, false
+	}
+	prefix, err := KeyTemplate(t[:start]).expand(o)
+	if err != nil || !strings.HasPrefix(key, prefix) {
+		return 0, false
+	}
+	digits := key[len(prefix):]
+	end := 0
+	for end < len(digits) && digits[end] >= '0' && digits[end] <= '9' {
+		end++
+	}
+	sequence, err = strconv.Atoi(digits[:end])
+	return sequence, err == nil
+}
+
+// lastSequence returns the highest sequence number in the keys of the objects of the store which were created with
+// the key template on the day of the object and share the key of the object up to its sequence number
+func lastSequence(store ObjectStore, template KeyTemplate, o Object) (int, error) {
+	template = templateOf(o, template)
+	objects, err := store.List(o)
+	if err != nil {
+		return 0, err
+	}
+	last := 0
+	for _, object := range objects {
+		if sequence, ok := template.sequenceOf(object.Key, o); ok && sequence > last {
+			last = sequence
+		}
+	}
+	return last, nil
+}
+
+// key returns the key of the object using its own template, or if not set, the one set in
+// the given environment variable or the fallback
+func (o Object) key(env string, fallback KeyTemplate) string {
+	if o.Template != "" {
+		return o.Template.Execute(o)
+	}
+	return keyTemplate(env, fallback).Execute(o)
+}
+
+// keyTemplate returns the template set in the given environment variable or the fallback
+func keyTemplate(env string, fallback KeyTemplate) KeyTemplate {
+	t := KeyTemplate(os.Getenv(env))
+	if t == "" {
+		return fallback
+	}
+	if err := t.Validate(); err != nil {
+		logFatalf("Invalid key template in %s: %s", env, err)
+	}
+	return t
+}
@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyTemplate_Execute(t *testing.T) {
+	created := time.Date(2026, 10, 18, 7, 30, 0, 0, time.UTC)
+	message := []byte(`{"client_id":42,"tenant":{"id":"acme"},"tags":["a","b"]}`)
+	tests := []struct {
+		name     string
+		template KeyTemplate
+		object   Object
+		want     string
+	}{
+		{"hive style layout", "dt={date}/client={client_id}/part-{seq:4}.{ext}",
+			Object{ClientID: "42", Sequence: 1, Created: created}, "dt=2026-10-18/client=42/part-0001.ndjson.gz"},
+		{"date parts and hour", "{yyyy}/{mm}/{dd}/{hh}/{seq}",
+			Object{Sequence: 12, Created: created}, "2026/10/18/07/12"},
+		{"leading slashes are removed", "/chat/{client_id}",
+			Object{ClientID: "1", Created: created}, "chat/1"},
+		{"message fields", "{field:tenant.id}/{field:tags.1}/{field:client_id}",
+			Object{Created: created, Message: message}, "acme/b/42"},
+		{"missing values", "{field:tenant.name}/{field:tenant}/{client_id}",
+			Object{Created: created, Message: message}, "unknown/unknown/unknown"},
+		{"custom extension", "log.{ext}",
+			Object{Created: created, Extension: "ndjson"}, "log.ndjson"},
+		{"partition", "{partition}/{client_id}",
+			Object{ClientID: "42", Partition: "acme", Created: created}, "acme/42"},
+		{"values are sanitized", "{client_id}/{partition}/{field:path}",
+			Object{ClientID: "../../etc", Partition: "a/b", Created: created, Message: []byte(`{"path":"x\\y?"}`)},
+			".._.._etc~74ccf3c5b4c19a81/a_b~c14cddc033f64b9d/x_y_~4ffeaeaf3c80dec7"},
+		{"uuid client id", "{client_id}",
+			Object{ClientID: "550e8400-e29b-41d4-a716-446655440000", Created: created}, "550e8400-e29b-41d4-a716-446655440000"},
+		{"hostname and instance", "{hostname}/{instance}",
+			Object{Created: created}, "host/host"},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			osHostname = func() (string, error) {
+				return "host", nil
+			}
+			defer func() {
+				osHostname = os.Hostname
+			}()
+
+			if got := test.template.Execute(test.object); got != test.want {
+				t.Errorf("Execute() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestKeyTemplate_Execute_invalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Execute() of an invalid template should panic")
+		}
+	}()
+	KeyTemplate("{date").Execute(Object{})
+}
+
+func TestKeyTemplate_Validate(t *testing.T) {
+	tests := []struct {
+		template KeyTemplate
+		wantErr  bool
+	}{
+		{"chat/{date}/{client_id}", false},
+		{"part-{seq:4}.{ext}", false},
+		{"{field:tenant.id}", false},
+		{"{unknown}", true},
+		{"{date", true},
+		{"{seq:x}", true},
+		{"{field}", true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(string(test.template), func(t *testing.T) {
+			if err := test.template.Validate(); (err != nil) != test.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func Test_keyTemplate(t *testing.T) {
+	fatal := false
+	logFatalf = func(format string, args ...interface{}) {
+		fatal = true
+	}
+	defer func() {
+		logFatalf = log.Fatalf
+		os.Unsetenv(awsKeyTemplate)
+	}()
+
+	if got := keyTemplate(awsKeyTemplate, defaultS3KeyTemplate); got != defaultS3KeyTemplate {
+		t.Errorf("wanted %v but got %v", defaultS3KeyTemplate, got)
+	}
+
+	os.Setenv(awsKeyTemplate, "{client_id}/{date}")
+	if got := keyTemplate(awsKeyTemplate, defaultS3KeyTemplate); got != "{client_id}/{date}" {
+		t.Errorf("wanted %v but got %v", "{client_id}/{date}", got)
+	}
+
+	os.Setenv(awsKeyTemplate, "{nope}")
+	keyTemplate(awsKeyTemplate, defaultS3KeyTemplate)
+	if !fatal {
+		t.Errorf("expected fatal for invalid template %s", os.Getenv(awsKeyTemplate))
+	}
+}
+
+func TestMessageField(t *testing.T) {
+	message := []byte(`{"id":7,"ok":true,"empty":"","tenant":{"id":"acme"},"tags":["a"],"none":null}`)
+	tests := []struct {
+		path   string
+		want   string
+		wantOk bool
+	}{
+		{"id", "7", true},
+		{"ok", "true", true},
+		{"tenant.id", "acme", true},
+		{"tags.0", "a", true},
+		{"empty", "", false},
+		{"tenant", "", false},
+		{"tags", "", false},
+		{"none", "", false},
+		{"missing.path", "", false},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.path, func(t *testing.T) {
+			got, ok := MessageField(message, test.path)
+			if got != test.want || ok != test.wantOk {
+				t.Errorf("MessageField() = %v, %v, want %v, %v", got, ok, test.want, test.wantOk)
+			}
+		})
+	}
+}
+
+func TestSanitizeKey(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"42", "42"},
+		{"tenant-a_b.c=d", "tenant-a_b.c=d"},
+		{"", "unknown"},
+		{"..", "__~5ec1f7e700f37c3d"},
+		{".", "_~cdb4ee2aea69cc6a"},
+		{"../secret", ".._secret~a6b096789d56f0b5"},
+		{"a/b\\c", "a_b_c~7e65aa1c27456dec"},
+		{"a_b_c", "a_b_c"},
+		{"name.", "name_~f8f47e4731f66a0a"},
+		{"héllo", "h__llo~3c48591d8d098a45"},
+		{strings.Repeat("a", 128), strings.Repeat("a", 128)},
+		{strings.Repeat("a", 200), strings.Repeat("a", 111) + "~c2a908d98f5df987"},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.value, func(t *testing.T) {
+			if got := SanitizeKey(test.value); got != test.want {
+				t.Errorf("SanitizeKey() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestObject_metadata(t *testing.T) {
+	tests := []struct {
+		clientID string
+		want     string
+	}{
+		{"42", "42"},
+		{"550e8400-e29b-41d4-a716-446655440000", "550e8400-e29b-41d4-a716-446655440000"},
+		{"héllo wörld/1", "h%C3%A9llo+w%C3%B6rld%2F1"},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.clientID, func(t *testing.T) {
+			metadata := Object{ClientID: test.clientID}.metadata()
+			if metadata[metadataClientID] != test.want {
+				t.Errorf("metadata() client id = %v, want %v", metadata[metadataClientID], test.want)
+			}
+			if got := ClientIDOf(metadata); got != test.clientID {
+				t.Errorf("ClientIDOf() = %v, want %v", got, test.clientID)
+			}
+		})
+	}
+}
+
+func TestObject_key(t *testing.T) {
+	created := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	o := Object{Partition: "42", Sequence: 7, Created: created}
+	if got := o.key(awsKeyTemplate, defaultS3KeyTemplate); got != "chat/2026-10-18/content_logs_2026-10-18_42_7" {
+		t.Errorf("key() = %v", got)
+	}
+
+	o.Template = "dead-letter/{date}/{partition}.{ext}"
+	if got := o.key(awsKeyTemplate, defaultS3KeyTemplate); got != "dead-letter/2026-10-18/42.ndjson.gz" {
+		t.Errorf("key() = %v", got)
+	}
+}
+
+// seedingStore fails to list the objects of a partition
+type seedingStore struct {
+	ObjectStore
+	err error
+}
+
+func (s *seedingStore) lastSequence(Object) (int, error) {
+	return 0, s.err
+}
+
+func TestNextSequence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	day := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	for _, sequence := range []int{3, 12} {
+		object := Object{Partition: "42", Sequence: sequence, Created: day}
+		path := filepath.Join(dir, filepath.FromSlash(object.key(localTemplate, defaultLocalKeyTemplate)))
+		os.MkdirAll(filepath.Dir(path), 0700)
+		ioutil.WriteFile(path, []byte("data"), 0600)
+	}
+	now := day.Add(time.Hour)
+	timeNow = func() time.Time { return now }
+	defer func() {
+		timeNow = time.Now
+		SeedSequences(nil)
+		sequences, sequenceDay = map[string]int{}, ""
+	}()
+
+	tests := []struct {
+		name      string
+		store     ObjectStore
+		partition string
+		created   time.Time
+		want      []int
+	}{
+		{"from the current time without a store", nil, "42", time.Time{}, []int{int(now.UnixNano() / 1e6), int(now.UnixNano()/1e6) + 1}},
+		{"after the stored objects", &localStore{dir: dir, template: defaultLocalKeyTemplate}, "42", day, []int{13, 14}},
+		{"from one for new partitions", &localStore{dir: dir, template: defaultLocalKeyTemplate}, "43", day, []int{1, 2}},
+		{"from the current time if objects cannot be listed", &seedingStore{err: errors.New("denied")}, "42", day,
+			[]int{int(now.UnixNano() / 1e6)}},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			SeedSequences(test.store)
+			sequences, sequenceDay = map[string]int{}, ""
+			for _, want := range test.want {
+				if got := NextSequence(Object{Partition: test.partition, Created: test.created}); got != want {
+					t.Errorf("NextSequence() = %v, want %v", got, want)
+				}
+			}
+		})
+	}
+
+	// the numbers of the previous day are dropped and numbering starts again from the objects of the day
+	SeedSequences(&localStore{dir: dir, template: defaultLocalKeyTemplate})
+	sequences, sequenceDay = map[string]int{}, ""
+	NextSequence(Object{Partition: "42", Created: day})
+	if got := NextSequence(Object{Partition: "42", Created: day.AddDate(0, 0, 1)}); got != 1 || len(sequences) != 1 {
+		t.Errorf("NextSequence() on the next day = %v with %d partitions, want 1 with 1", got, len(sequences))
+	}
+}
+
+func TestKeyTemplate_sequenceOf(t *testing.T) {
+	created := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		template KeyTemplate
+		key      string
+		want     int
+		wantOK   bool
+	}{
+		{"default template", defaultS3KeyTemplate, "chat/2026-10-18/content_logs_2026-10-18_42_17", 17, true},
+		{"padded", "{partition}/part-{seq:4}.{ext}", "42/part-0017.ndjson.gz", 17, true},
+		{"other partitions", defaultS3KeyTemplate, "chat/2026-10-18/content_logs_2026-10-18_420_17", 0, false},
+		{"no sequence", defaultS3KeyTemplate, "chat/2026-10-18/content_logs_2026-10-18_42_", 0, false},
+		{"templates without a sequence", "{partition}/{date}", "42/2026-10-18", 0, false},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := test.template.sequenceOf(test.key, Object{Partition: "42", Created: created})
+			if got != test.want || ok != test.wantOK {
+				t.Errorf("sequenceOf() = %v, %v, want %v, %v", got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
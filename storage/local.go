@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	localDir      = "LOCAL_STORAGE_DIR"
+	localTemplate = "LOCAL_KEY_TEMPLATE"
+
+	defaultLocalKeyTemplate KeyTemplate = "{date}/content_logs_{date}_{partition}_{seq}.{ext}"
+
+	// objectSuffix is the suffix of the file describing a complete local object
+	objectSuffix = ".object.json"
+)
+
+type local struct {
+	dir     string
+	path    string
+	object  Object
+	running sync.WaitGroup
+}
+
+// NewLocalStreamer returns a MessageStreamer writing to a file under LOCAL_STORAGE_DIR, once the stream has
+// ended the object is described in a .object.json file next to it so it can be uploaded again later
+func NewLocalStreamer(object Object, _, _ int) MessageStreamer {
+	fmt.Println("Creating new local streamer for client ", object.ClientID)
+	l := &local{object: object}
+	l.dir = os.Getenv(localDir)
+	if l.dir == "" {
+		logFatalf("Cannot create local streamer, ensure the following environment variables are set:\n%s\n", localDir)
+	}
+	l.path = filepath.Join(l.dir, filepath.FromSlash(object.key(localTemplate, defaultLocalKeyTemplate)))
+	return l
+}
+
+func (l *local) Stream(reader io.Reader) error {
+	l.running.Add(1)
+	defer l.running.Done()
+
+	file, err := l.create()
+	if err != nil {
+		log.Println("Error when creating", l.path, err)
+		return err
+	}
+	written, err := l.write(file, reader)
+	if err != nil {
+		file.Close()
+		log.Println("Error when writing", l.path, err)
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	commit(reader, written)
+
+	description, err := json.Marshal(l.object)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(l.path+objectSuffix, description, 0600)
+}
+
+// write copies the stream to the file, syncing and committing what has been written if the stream is durable
+func (l *local) write(file *os.File, reader io.Reader) (int64, error) {
+	var written int64
+	buf := make([]byte, readBufferSize)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			if _, err := file.Write(buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+			if durable(reader) {
+				if err := file.Sync(); err != nil {
+					return written, err
+				}
+				commit(reader, written)
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// create creates the file of the object, existing files are never overwritten so a sequence number is
+// appended to the name if the file exists
+func (l *local) create() (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return nil, err
+	}
+	base := l.path
+	for i := 1; ; i++ {
+		file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if !os.IsExist(err) {
+			return file, err
+		}
+		l.path = fmt.Sprintf("%s.%d", base, i)
+	}
+}
+
+func (l *local) Wait() {
+	fmt.Println("Waiting for streaming to end for ", l.path)
+	l.running.Wait()
+	fmt.Println("Finished Streaming to ", l.path)
+}
+
+// ReuploadLocal streams every complete object under LOCAL_STORAGE_DIR to the streamer returned for it,
+// removing the objects which were uploaded successfully
+func ReuploadLocal(newStreamer func(Object) MessageStreamer) error {
+	dir := os.Getenv(localDir)
+	if dir == "" {
+		return fmt.Errorf("%s is not set", localDir)
+	}
+
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, objectSuffix) {
+			return err
+		}
+		if err := reupload(strings.TrimSuffix(path, objectSuffix), newStreamer); err != nil {
+			log.Println("Error when uploading", path, err)
+		}
+		return nil
+	})
+}
+
+func reupload(path string, newStreamer func(Object) MessageStreamer) error {
+	description, err := ioutil.ReadFile(path + objectSuffix)
+	if err != nil {
+		return err
+	}
+	var object Object
+	if err = json.Unmarshal(description, &object); err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fmt.Println("Uploading local object ", path)
+	streamer := newStreamer(object)
+	if err = streamer.Stream(file); err != nil {
+		return err
+	}
+	streamer.Wait()
+
+	if err = os.Remove(path + objectSuffix); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
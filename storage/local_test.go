@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLocalStreamer(t *testing.T) {
+	tests := []struct {
+		name            string
+		dir             string
+		wantPath        string
+		shouldCallFatal bool
+	}{
+		{"path from the key template", "data", filepath.FromSlash("data/2026-10-18/content_logs_2026-10-18_42_7.ndjson.gz"), false},
+		{"should call fatal without a directory", "", filepath.FromSlash("2026-10-18/content_logs_2026-10-18_42_7.ndjson.gz"), true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv(localDir, test.dir)
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				os.Unsetenv(localDir)
+			}()
+
+			created := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+			got := NewLocalStreamer(Object{Partition: "42", Sequence: 7, Created: created}, 0, 0).(*local)
+			if got.path != test.wantPath {
+				t.Errorf("path = %v, want %v", got.path, test.wantPath)
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+func TestLocal_Stream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv(localDir, dir)
+	defer os.Unsetenv(localDir)
+
+	object := Object{ClientID: "42", Partition: "42", Template: "{partition}.{ext}"}
+	for i, data := range []string{"first", "second"} {
+		l := NewLocalStreamer(object, 0, 0)
+		if err := l.Stream(strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		l.Wait()
+
+		path := filepath.Join(dir, "42.ndjson.gz")
+		if i > 0 {
+			path += ".1"
+		}
+		if got, _ := ioutil.ReadFile(path); string(got) != data {
+			t.Errorf("%s = %q, want %q", path, got, data)
+		}
+		if _, err := os.Stat(path + objectSuffix); err != nil {
+			t.Errorf("object of %s was not described: %v", path, err)
+		}
+	}
+}
+
+func TestReuploadLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv(localDir, dir)
+	defer os.Unsetenv(localDir)
+
+	created := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	for _, partition := range []string{"1", "2"} {
+		l := NewLocalStreamer(Object{Partition: partition, Created: created, Metadata: map[string]string{"a": "b"}}, 0, 0)
+		if err := l.Stream(strings.NewReader("data " + partition)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an object which is still being written is not described yet
+	incomplete := filepath.Join(dir, "incomplete.ndjson.gz")
+	ioutil.WriteFile(incomplete, []byte("data"), 0600)
+
+	streamers := map[string]*fakeStreamer{"1": {}, "2": {err: errors.New("denied")}}
+	err = ReuploadLocal(func(object Object) MessageStreamer {
+		if !object.Created.Equal(created) || object.Metadata["a"] != "b" {
+			t.Errorf("object = %+v", object)
+		}
+		return streamers[object.Partition]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(streamers["1"].received, []byte("data 1")) || !streamers["1"].waited {
+		t.Errorf("received %q", streamers["1"].received)
+	}
+	var remaining []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if !info.IsDir() {
+			remaining = append(remaining, filepath.Base(path))
+		}
+		return nil
+	})
+	want := []string{"content_logs_2026-10-18_2_0.ndjson.gz", "content_logs_2026-10-18_2_0.ndjson.gz" + objectSuffix, "incomplete.ndjson.gz"}
+	if strings.Join(remaining, ",") != strings.Join(want, ",") {
+		t.Errorf("remaining files = %v, want %v", remaining, want)
+	}
+}
+
+func TestLocal_StreamCommits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv(localDir, dir)
+	defer os.Unsetenv(localDir)
+
+	tests := []struct {
+		name        string
+		durable     bool
+		wantCommits int
+	}{
+		{"commits what was written to durable streams", true, 3},
+		{"commits once the stream has ended", false, 1},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			data := bytes.Repeat([]byte("a"), 2*readBufferSize)
+			reader := &committingReader{Reader: bytes.NewReader(data), durable: test.durable}
+			if err := NewLocalStreamer(Object{Partition: "42"}, 0, 0).Stream(reader); err != nil {
+				t.Fatal(err)
+			}
+			if len(reader.commits) != test.wantCommits || reader.committed() != int64(len(data)) {
+				t.Errorf("commits = %v, want %d ending at %d", reader.commits, test.wantCommits, len(data))
+			}
+		})
+	}
+}
+
+func TestReuploadLocal_LiveStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv(localDir, dir)
+	defer os.Unsetenv(localDir)
+
+	created := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	diverted := Object{Partition: "42", Sequence: NextSequence(Object{Partition: "42", Created: created}), Created: created}
+	l := NewLocalStreamer(diverted, 0, 0)
+	if err := l.Stream(strings.NewReader("diverted")); err != nil {
+		t.Fatal(err)
+	}
+	// the stream started after the failure writes to the same partition while the diverted object is uploaded
+	live := Object{Partition: "42", Sequence: NextSequence(Object{Partition: "42", Created: created}), Created: created}.key(awsKeyTemplate, defaultS3KeyTemplate)
+
+	var keys []string
+	err = ReuploadLocal(func(object Object) MessageStreamer {
+		keys = append(keys, object.key(awsKeyTemplate, defaultS3KeyTemplate))
+		return &fakeStreamer{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] == live {
+		t.Errorf("uploaded %v, live stream writes %v", keys, live)
+	}
+}
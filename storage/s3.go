@@ -4,13 +4,17 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
-	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
@@ -19,34 +23,97 @@ const (
 	awsRegion       = "AWS_REGION"
 	awsAccessKey    = "AWS_ACCESS_KEY"
 	awsAccessSecret = "AWS_ACCESS_SECRET"
+	awsKeyTemplate  = "AWS_KEY_TEMPLATE"
+	awsSSE          = "AWS_SSE"
+	awsSSEKMSKeyID  = "AWS_SSE_KMS_KEY_ID"
+	awsStorageClass = "AWS_STORAGE_CLASS"
+	awsObjectTags   = "AWS_OBJECT_TAGS"
+	awsCheckpoints  = "AWS_UPLOAD_CHECKPOINT_DIR"
+
+	defaultS3KeyTemplate KeyTemplate = "chat/{date}/content_logs_{date}_{partition}_{seq}"
+
+	tagMessageCount       = "message_count"
+	storageClassGlacierIR = "GLACIER_IR"
 )
 
+// storageClasses are the storage classes objects can be uploaded with
+var storageClasses = map[string]bool{
+	awss3.StorageClassStandard:           true,
+	awss3.StorageClassReducedRedundancy:  true,
+	awss3.StorageClassStandardIa:         true,
+	awss3.StorageClassOnezoneIa:          true,
+	awss3.StorageClassIntelligentTiering: true,
+	awss3.StorageClassGlacier:            true,
+	awss3.StorageClassDeepArchive:        true,
+	storageClassGlacierIR:                true,
+}
+
+// messageCounter is implemented by pipes which count the messages written to them
+type messageCounter interface {
+	Messages() int64
+}
+
 var (
-	logFatalf            = log.Fatalf
-	s3managerNewUploader = s3manager.NewUploader
+	logFatalf = log.Fatalf
+	s3NewAPI  = func(sess *session.Session) s3iface.S3API { return awss3.New(sess) }
 )
 
 type s3 struct {
 	bucket       string
 	region       string
 	key          string
+	metadata     map[string]string
+	sse          string
+	kmsKeyID     string
+	storageClass string
+	tags         url.Values
+	encoding     string
 	accessKey    string
 	accessSecret string
 	partSize     int64
 	concurrency  int
+	checkpoints  string
+	backoff      backoff
 	running      sync.WaitGroup
 }
 
-func NewS3Streamer(clientID, partSize, concurrency int) MessageStreamer {
-	fmt.Println("Creating new S3 streamer for client ", clientID)
+func NewS3Streamer(object Object, partSize, concurrency int) MessageStreamer {
+	fmt.Println("Creating new S3 streamer for client ", object.ClientID)
 	s := &s3{}
-	s.key = getKey(clientID)
+	s.key = object.key(awsKeyTemplate, defaultS3KeyTemplate)
+	s.metadata = object.metadata()
+	s.encoding = object.contentEncoding()
 	s.bucket = os.Getenv(awsBucket)
 	s.region = os.Getenv(awsRegion)
 	s.accessKey = os.Getenv(awsAccessKey)
 	s.accessSecret = os.Getenv(awsAccessSecret)
 	s.partSize = int64(partSize)
 	s.concurrency = concurrency
+	s.checkpoints = os.Getenv(awsCheckpoints)
+	s.backoff = newBackoff()
+
+	s.sse = os.Getenv(awsSSE)
+	s.kmsKeyID = os.Getenv(awsSSEKMSKeyID)
+	if s.sse == "" && s.kmsKeyID != "" {
+		s.sse = awss3.ServerSideEncryptionAwsKms
+	}
+	if s.sse != "" && s.sse != awss3.ServerSideEncryptionAes256 && s.sse != awss3.ServerSideEncryptionAwsKms {
+		logFatalf("%s must be %s or %s", awsSSE, awss3.ServerSideEncryptionAes256, awss3.ServerSideEncryptionAwsKms)
+	}
+	if s.kmsKeyID != "" && s.sse != awss3.ServerSideEncryptionAwsKms {
+		logFatalf("%s requires %s to be %s", awsSSEKMSKeyID, awsSSE, awss3.ServerSideEncryptionAwsKms)
+	}
+
+	s.storageClass = os.Getenv(awsStorageClass)
+	if s.storageClass != "" && !storageClasses[s.storageClass] {
+		logFatalf("Unknown storage class in %s: %s", awsStorageClass, s.storageClass)
+	}
+
+	tags, err := objectTags(os.Getenv(awsObjectTags), object)
+	if err != nil {
+		logFatalf("Invalid %s: %s", awsObjectTags, err)
+	}
+	s.tags = tags
 
 	if s.bucket == "" || s.region == "" || s.accessKey == "" || s.accessSecret == "" {
 		message := "Cannot create s3 streamer, ensure the following environment variables are set:"
@@ -56,38 +123,112 @@ func NewS3Streamer(clientID, partSize, concurrency int) MessageStreamer {
 	return s
 }
 
-func (s *s3) Stream(reader io.Reader) {
+func (s *s3) Stream(reader io.Reader) error {
+	api := s3NewAPI(s.session())
+	upload := &multipartUpload{
+		api:         api,
+		input:       s.uploadInput(reader),
+		partSize:    s.partSize,
+		concurrency: s.concurrency,
+		checkpoints: s.checkpoints,
+		backoff:     s.backoff,
+	}
+
+	s.running.Add(1)
+	defer s.running.Done()
+	if err := upload.upload(reader); err != nil {
+		log.Println("Error when uploading", err)
+		return err
+	}
+	if counter, ok := reader.(messageCounter); ok {
+		s.tagMessageCount(api, counter.Messages())
+	}
+	return nil
+}
+
+// session returns the AWS session, requests are retried by backoff rather than by the SDK
+func (s *s3) session() *session.Session {
 	awsConfig := &aws.Config{
 		Region:      aws.String("eu-central-1"),
 		Credentials: credentials.NewStaticCredentials(s.accessKey, s.accessSecret, ""),
+		MaxRetries:  aws.Int(0),
 	}
+	return session.Must(session.NewSession(awsConfig))
+}
 
-	sess := session.Must(session.NewSession(awsConfig))
-	uploader := s3managerNewUploader(sess, func(u *s3manager.Uploader) {
-		u.PartSize = s.partSize
-		u.Concurrency = s.concurrency
-		u.LeavePartsOnError = true
-	})
+func (s *s3) uploadInput(reader io.Reader) *s3manager.UploadInput {
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.key),
+		Body:        reader,
+		ContentType: aws.String(contentType),
+		Metadata:    aws.StringMap(s.metadata),
+	}
+	if s.encoding != "" {
+		input.ContentEncoding = aws.String(s.encoding)
+	}
+	if s.sse != "" {
+		input.ServerSideEncryption = aws.String(s.sse)
+	}
+	if s.kmsKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s.kmsKeyID)
+	}
+	if s.storageClass != "" {
+		input.StorageClass = aws.String(s.storageClass)
+	}
+	if len(s.tags) > 0 {
+		input.Tagging = aws.String(s.tags.Encode())
+	}
+	return input
+}
 
-	s.running.Add(1)
-	_, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(s.key),
-		Body:   reader,
+// tagMessageCount adds the number of messages to the tags of an uploaded object, it is only known once the
+// stream has ended so it cannot be sent with the upload. Objects without configured tags are tagged with the
+// count alone
+func (s *s3) tagMessageCount(api s3iface.S3API, messages int64) {
+	tagSet := make([]*awss3.Tag, 0, len(s.tags)+1)
+	for name := range s.tags {
+		tagSet = append(tagSet, &awss3.Tag{Key: aws.String(name), Value: aws.String(s.tags.Get(name))})
+	}
+	tagSet = append(tagSet, &awss3.Tag{Key: aws.String(tagMessageCount), Value: aws.String(strconv.FormatInt(messages, 10))})
+
+	err := s.backoff.retry("PutObjectTagging", func() error {
+		_, err := api.PutObjectTagging(&awss3.PutObjectTaggingInput{
+			Bucket:  aws.String(s.bucket),
+			Key:     aws.String(s.key),
+			Tagging: &awss3.Tagging{TagSet: tagSet},
+		})
+		return err
 	})
-	s.running.Done()
 	if err != nil {
-		log.Println("Error when uploading", err)
+		log.Println("Error when tagging", s.key, err)
 	}
 }
 
+// objectTags returns the tags of the object from a comma separated list of name=template pairs,
+// e.g. client_id={client_id},date={date}
+func objectTags(tags string, object Object) (url.Values, error) {
+	values := url.Values{}
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("tag %q must be name=value", tag)
+		}
+		template := KeyTemplate(parts[1])
+		if err := template.Validate(); err != nil {
+			return nil, err
+		}
+		values.Set(parts[0], template.Execute(object))
+	}
+	return values, nil
+}
+
 func (s *s3) Wait() {
 	fmt.Println("Waiting for streaming to end for ", s.key)
 	s.running.Wait()
 	fmt.Println("Finished Streaming to ", s.key)
 }
-
-func getKey(clientID int) string {
-	date := time.Now().Format("2006-01-02")
-	return fmt.Sprintf("/chat/%s/content_logs_%s_%d", date, date, clientID)
-}
@@ -0,0 +1,533 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	awsRetryAttempts  = "AWS_RETRY_ATTEMPTS"
+	awsRetryBaseDelay = "AWS_RETRY_BASE_DELAY"
+	awsRetryMaxDelay  = "AWS_RETRY_MAX_DELAY"
+
+	defaultRetryAttempts  = 5
+	defaultRetryBaseDelay = 200 * time.Millisecond
+	defaultRetryMaxDelay  = 30 * time.Second
+)
+
+var (
+	timeSleep  = time.Sleep
+	randInt63n = rand.Int63n
+
+	// uploading are the ids of the uploads in flight in this process, they are not aborted by AbortStaleUploads
+	uploadingMutex sync.Mutex
+	uploading      = map[string]bool{}
+)
+
+// backoff retries requests with exponential backoff and full jitter
+type backoff struct {
+	attempts int
+	base     time.Duration
+	max      time.Duration
+}
+
+func newBackoff() backoff {
+	b := backoff{attempts: defaultRetryAttempts, base: defaultRetryBaseDelay, max: defaultRetryMaxDelay}
+	if attempts := os.Getenv(awsRetryAttempts); attempts != "" {
+		var err error
+		if b.attempts, err = strconv.Atoi(attempts); err != nil || b.attempts < 1 {
+			logFatalf("%s must be a positive number", awsRetryAttempts)
+		}
+	}
+	for env, delay := range map[string]*time.Duration{awsRetryBaseDelay: &b.base, awsRetryMaxDelay: &b.max} {
+		if value := os.Getenv(env); value != "" {
+			var err error
+			if *delay, err = time.ParseDuration(value); err != nil || *delay <= 0 {
+				logFatalf("%s must be a positive duration e.g. 200ms", env)
+			}
+		}
+	}
+	return b
+}
+
+// retry calls the request until it succeeds, fails with an error which is not retryable or runs out of attempts
+func (b backoff) retry(name string, request func() error) error {
+	var err error
+	for attempt := 0; attempt == 0 || attempt < b.attempts; attempt++ {
+		if attempt > 0 {
+			timeSleep(b.delay(attempt))
+		}
+		if err = request(); err == nil || !retryable(err) {
+			return err
+		}
+		log.Println("Error when calling", name, "attempt", attempt+1, "of", b.attempts, err)
+	}
+	return err
+}
+
+// delay returns a random delay up to base * 2^(attempt-1), capped at max
+func (b backoff) delay(attempt int) time.Duration {
+	ceiling := b.max
+	if shift := uint(attempt - 1); shift < 32 && b.base<<shift > 0 && b.base<<shift < b.max {
+		ceiling = b.base << shift
+	}
+	return time.Duration(randInt63n(int64(ceiling)) + 1)
+}
+
+// retryable returns false for client errors, which fail again when retried
+func retryable(err error) bool {
+	status := 0
+	if failure, ok := err.(awserr.RequestFailure); ok {
+		status = failure.StatusCode()
+	} else if serr, ok := err.(azblob.StorageError); ok && serr.Response() != nil {
+		status = serr.Response().StatusCode
+	} else {
+		return true
+	}
+	return status == 0 || status >= 500 || status == 408 || status == 429
+}
+
+// multipartUpload uploads a stream in parts. Uploads are recorded in a checkpoint file of the key in checkpoints,
+// so an interrupted upload is resumed when the same stream is uploaded again
+type multipartUpload struct {
+	api         s3iface.S3API
+	input       *s3manager.UploadInput
+	partSize    int64
+	concurrency int
+	backoff     backoff
+	// checkpoints is the directory of the checkpoints, uploads are not resumed if it is empty
+	checkpoints string
+
+	uploadID   string
+	checkpoint *uploadCheckpoint
+	// existing are the recorded parts of the resumed upload which S3 still stores, it is not modified once the parts
+	// are being uploaded
+	existing map[int64]checkpointPart
+	mutex    sync.Mutex
+	parts    []*awss3.CompletedPart
+	err      error
+	// uploaded is the size of the uploaded parts, the stream is only committed once the upload is completed
+	uploaded int64
+}
+
+func (u *multipartUpload) upload(reader io.Reader) error {
+	if u.partSize < s3manager.MinUploadPartSize {
+		u.partSize = s3manager.MinUploadPartSize
+	}
+	if u.concurrency < 1 {
+		u.concurrency = 1
+	}
+	data := make([]byte, u.partSize)
+	n, err := io.ReadFull(reader, data)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if err := u.putObject(data[:n]); err != nil {
+			return err
+		}
+		commit(reader, int64(n))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := u.resumeOrCreate(data); err != nil {
+		return err
+	}
+	uploadingMutex.Lock()
+	uploading[u.uploadID] = true
+	uploadingMutex.Unlock()
+	defer func() {
+		uploadingMutex.Lock()
+		delete(uploading, u.uploadID)
+		uploadingMutex.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, u.concurrency)
+	last := false
+	for number := int64(1); ; number++ {
+		if number > s3manager.MaxUploadParts {
+			u.fail(fmt.Errorf("the stream exceeds %d parts", s3manager.MaxUploadParts))
+			break
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(number int64, data []byte) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := u.uploadPart(number, data); err != nil {
+				u.fail(err)
+			}
+		}(number, data)
+		if last || u.failed() {
+			break
+		}
+
+		data = make([]byte, u.partSize)
+		n, err := io.ReadFull(reader, data)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			last = true
+		} else if err != nil {
+			u.fail(err)
+			break
+		}
+		data = data[:n]
+	}
+	wg.Wait()
+
+	// the parts are left for the upload to be resumed from its checkpoint, they are aborted by AbortStaleUploads otherwise
+	if u.err != nil {
+		return u.err
+	}
+	// parts are not visible until the upload is completed, so nothing is committed before
+	if err := u.complete(); err != nil {
+		return err
+	}
+	commit(reader, u.uploaded)
+	return nil
+}
+
+func (u *multipartUpload) putObject(data []byte) error {
+	return u.backoff.retry("PutObject", func() error {
+		params := &awss3.PutObjectInput{}
+		awsutil.Copy(params, u.input)
+		params.Body = bytes.NewReader(data)
+		_, err := u.api.PutObject(params)
+		return err
+	})
+}
+
+// resumeOrCreate resumes the upload recorded in the checkpoint of the key, or creates a new upload
+func (u *multipartUpload) resumeOrCreate(first []byte) error {
+	if u.checkpoints != "" {
+		if err := u.resume(first); err != nil {
+			log.Println("Error when resuming the upload of", aws.StringValue(u.input.Key), err)
+			u.uploadID, u.existing = "", nil
+		}
+	}
+	if u.uploadID != "" {
+		fmt.Println("Resuming upload of ", aws.StringValue(u.input.Key), " with ", len(u.existing), " parts")
+		return nil
+	}
+
+	params := &awss3.CreateMultipartUploadInput{}
+	awsutil.Copy(params, u.input)
+	err := u.backoff.retry("CreateMultipartUpload", func() error {
+		output, err := u.api.CreateMultipartUpload(params)
+		if err == nil {
+			u.uploadID = aws.StringValue(output.UploadId)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	u.checkpoint = &uploadCheckpoint{
+		Bucket:   aws.StringValue(u.input.Bucket),
+		Key:      aws.StringValue(u.input.Key),
+		UploadID: u.uploadID,
+		Metadata: aws.StringValueMap(u.input.Metadata),
+		Parts:    map[int64]checkpointPart{},
+	}
+	u.saveCheckpoint()
+	return nil
+}
+
+// resume resumes the upload of the checkpoint if it was started by this stream: it has the same metadata, which
+// holds the wrapped key of encrypted streams, and its first part holds the same data. Other uploads are aborted
+func (u *multipartUpload) resume(first []byte) error {
+	checkpoint, err := readCheckpoint(u.checkpointPath())
+	if err != nil || checkpoint == nil {
+		return err
+	}
+	u.removeCheckpoint()
+	part, ok := checkpoint.Parts[1]
+	if checkpoint.Bucket != aws.StringValue(u.input.Bucket) || checkpoint.Key != aws.StringValue(u.input.Key) ||
+		!reflect.DeepEqual(checkpoint.Metadata, aws.StringValueMap(u.input.Metadata)) ||
+		!ok || part.MD5 != partMD5(first) || part.Size != int64(len(first)) {
+		u.abort(checkpoint.UploadID)
+		return nil
+	}
+
+	existing := map[int64]checkpointPart{}
+	err = u.backoff.retry("ListParts", func() error {
+		input := &awss3.ListPartsInput{Bucket: u.input.Bucket, Key: u.input.Key, UploadId: aws.String(checkpoint.UploadID)}
+		return u.api.ListPartsPages(input, func(page *awss3.ListPartsOutput, _ bool) bool {
+			for _, part := range page.Parts {
+				number := aws.Int64Value(part.PartNumber)
+				if recorded, ok := checkpoint.Parts[number]; ok && recorded.ETag == aws.StringValue(part.ETag) &&
+					recorded.Size == aws.Int64Value(part.Size) {
+					existing[number] = recorded
+				}
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return err
+	}
+	u.uploadID = checkpoint.UploadID
+	u.existing = existing
+	checkpoint.Parts = map[int64]checkpointPart{}
+	u.checkpoint = checkpoint
+	u.saveCheckpoint()
+	return nil
+}
+
+// abort aborts an upload which is not resumed, uploads which cannot be aborted are left to AbortStaleUploads
+func (u *multipartUpload) abort(uploadID string) {
+	err := u.backoff.retry("AbortMultipartUpload", func() error {
+		_, err := u.api.AbortMultipartUpload(&awss3.AbortMultipartUploadInput{
+			Bucket:   u.input.Bucket,
+			Key:      u.input.Key,
+			UploadId: aws.String(uploadID),
+		})
+		return err
+	})
+	if err != nil {
+		log.Println("Error when aborting upload of", aws.StringValue(u.input.Key), err)
+	}
+}
+
+// partMD5 returns the hex encoded MD5 of the data of a part. It is recorded in the checkpoint as the ETag of a part is
+// not its MD5 with SSE-KMS
+func partMD5(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// uploadPart uploads a part unless the resumed upload already stores the same data
+func (u *multipartUpload) uploadPart(number int64, data []byte) error {
+	sum := md5.Sum(data)
+	digest := hex.EncodeToString(sum[:])
+	if part, ok := u.existing[number]; ok && part.Size == int64(len(data)) && part.MD5 == digest {
+		u.completed(number, part.ETag, digest, len(data))
+		return nil
+	}
+
+	return u.backoff.retry("UploadPart", func() error {
+		output, err := u.api.UploadPart(&awss3.UploadPartInput{
+			Bucket:     u.input.Bucket,
+			Key:        u.input.Key,
+			UploadId:   aws.String(u.uploadID),
+			PartNumber: aws.Int64(number),
+			Body:       bytes.NewReader(data),
+			ContentMD5: aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+		})
+		if err == nil {
+			u.completed(number, aws.StringValue(output.ETag), digest, len(data))
+		}
+		return err
+	})
+}
+
+// completed adds the part to the upload and its checkpoint
+func (u *multipartUpload) completed(number int64, etag, digest string, size int) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.parts = append(u.parts, &awss3.CompletedPart{PartNumber: aws.Int64(number), ETag: aws.String(etag)})
+	u.uploaded += int64(size)
+	if u.checkpoint != nil {
+		u.checkpoint.Parts[number] = checkpointPart{ETag: etag, MD5: digest, Size: int64(size)}
+		u.saveCheckpoint()
+	}
+}
+
+func (u *multipartUpload) fail(err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.err == nil {
+		u.err = err
+	}
+}
+
+func (u *multipartUpload) failed() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.err != nil
+}
+
+func (u *multipartUpload) complete() error {
+	sort.Slice(u.parts, func(i, j int) bool {
+		return aws.Int64Value(u.parts[i].PartNumber) < aws.Int64Value(u.parts[j].PartNumber)
+	})
+	err := u.backoff.retry("CompleteMultipartUpload", func() error {
+		_, err := u.api.CompleteMultipartUpload(&awss3.CompleteMultipartUploadInput{
+			Bucket:          u.input.Bucket,
+			Key:             u.input.Key,
+			UploadId:        aws.String(u.uploadID),
+			MultipartUpload: &awss3.CompletedMultipartUpload{Parts: u.parts},
+		})
+		return err
+	})
+	if err == nil {
+		u.removeCheckpoint()
+	}
+	return err
+}
+
+// uploadCheckpoint records an upload started by this server, only uploads with a checkpoint are resumed as the
+// unfinished uploads of a key may have been started by another writer or for another stream
+type uploadCheckpoint struct {
+	Bucket   string                   `json:"bucket"`
+	Key      string                   `json:"key"`
+	UploadID string                   `json:"upload_id"`
+	Metadata map[string]string        `json:"metadata"`
+	Parts    map[int64]checkpointPart `json:"parts"`
+}
+
+// checkpointPart is an uploaded part, the ETag S3 returned for it is only used to complete the upload and to find
+// the part when the upload is resumed, its data is compared by MD5
+type checkpointPart struct {
+	ETag string `json:"etag"`
+	MD5  string `json:"md5"`
+	Size int64  `json:"size"`
+}
+
+// checkpointPath returns the file of the checkpoint of the bucket and key
+func (u *multipartUpload) checkpointPath() string {
+	sum := sha256.Sum256([]byte(aws.StringValue(u.input.Bucket) + "/" + aws.StringValue(u.input.Key)))
+	return filepath.Join(u.checkpoints, hex.EncodeToString(sum[:])+".json")
+}
+
+// readCheckpoint returns nil if there is no checkpoint
+func readCheckpoint(path string) (*uploadCheckpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &uploadCheckpoint{}
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+// saveCheckpoint writes the checkpoint to a temporary file which is renamed, so it is never read partly written.
+// Uploads go on if it cannot be written, they are not resumed then
+func (u *multipartUpload) saveCheckpoint() {
+	if u.checkpoints == "" || u.checkpoint == nil {
+		return
+	}
+	data, err := json.Marshal(u.checkpoint)
+	if err == nil {
+		err = os.MkdirAll(u.checkpoints, 0700)
+	}
+	path := u.checkpointPath()
+	if err == nil {
+		err = ioutil.WriteFile(path+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		log.Println("Error when saving the checkpoint of", u.checkpoint.Key, err)
+	}
+}
+
+func (u *multipartUpload) removeCheckpoint() {
+	if u.checkpoints == "" {
+		return
+	}
+	if err := os.Remove(u.checkpointPath()); err != nil && !os.IsNotExist(err) {
+		log.Println("Error when removing the checkpoint of", aws.StringValue(u.input.Key), err)
+	}
+}
+
+// AbortStaleUploads aborts the multipart uploads recorded in the checkpoints of AWS_UPLOAD_CHECKPOINT_DIR which have
+// not been updated for maxAge, unless they are in flight. Only uploads of this server have a checkpoint, so the
+// uploads of other servers writing to the bucket are left alone
+func AbortStaleUploads(maxAge time.Duration) error {
+	s := &s3{
+		bucket:       os.Getenv(awsBucket),
+		accessKey:    os.Getenv(awsAccessKey),
+		accessSecret: os.Getenv(awsAccessSecret),
+		backoff:      newBackoff(),
+	}
+	if s.bucket == "" {
+		return fmt.Errorf("%s is not set", awsBucket)
+	}
+	checkpoints := os.Getenv(awsCheckpoints)
+	if checkpoints == "" {
+		return fmt.Errorf("%s is not set", awsCheckpoints)
+	}
+	return s.abortStaleUploads(s3NewAPI(s.session()), checkpoints, maxAge)
+}
+
+func (s *s3) abortStaleUploads(api s3iface.S3API, checkpoints string, maxAge time.Duration) error {
+	cutoff := timeNow().Add(-maxAge)
+	files, err := ioutil.ReadDir(checkpoints)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" || !file.ModTime().Before(cutoff) {
+			continue
+		}
+		s.abortStaleUpload(api, filepath.Join(checkpoints, file.Name()))
+	}
+	return nil
+}
+
+// abortStaleUpload aborts the upload of the checkpoint and removes it. The uploads in flight are locked meanwhile, so
+// an upload which is resumed from the checkpoint either finds it removed or fails to resume and creates a new upload
+func (s *s3) abortStaleUpload(api s3iface.S3API, path string) {
+	uploadingMutex.Lock()
+	defer uploadingMutex.Unlock()
+	checkpoint, err := readCheckpoint(path)
+	if err != nil || checkpoint == nil || checkpoint.Bucket != s.bucket || uploading[checkpoint.UploadID] {
+		return
+	}
+
+	fmt.Println("Aborting upload of ", checkpoint.Key)
+	err = s.backoff.retry("AbortMultipartUpload", func() error {
+		_, err := api.AbortMultipartUpload(&awss3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(checkpoint.Key),
+			UploadId: aws.String(checkpoint.UploadID),
+		})
+		return err
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == awss3.ErrCodeNoSuchUpload {
+		err = nil
+	}
+	if err != nil {
+		log.Println("Error when aborting upload of", checkpoint.Key, err)
+		return
+	}
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Println("Error when removing the checkpoint of", checkpoint.Key, err)
+	}
+}
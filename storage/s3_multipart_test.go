@@ -0,0 +1,468 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// fakeMultipartS3 stores objects and multipart uploads in memory, requests can be made to fail
+type fakeMultipartS3 struct {
+	s3iface.S3API
+	mutex    sync.Mutex
+	objects  map[string][]byte
+	uploads  map[string]*fakeUpload
+	uploaded []int64
+	aborted  []string
+	created  int
+	// failures is the number of times each request fails before it succeeds, failPart always fails
+	failures map[string]int
+	failPart int64
+	// kms returns ETags which are not the MD5 of the parts, as S3 does with SSE-KMS
+	kms bool
+}
+
+type fakeUpload struct {
+	key       string
+	initiated time.Time
+	parts     map[int64][]byte
+}
+
+func newFakeMultipartS3() *fakeMultipartS3 {
+	return &fakeMultipartS3{objects: map[string][]byte{}, uploads: map[string]*fakeUpload{}, failures: map[string]int{}}
+}
+
+var errInternal = awserr.NewRequestFailure(awserr.New("InternalError", "internal error", nil), 500, "")
+
+func (f *fakeMultipartS3) fail(request string) error {
+	if f.failures[request] > 0 {
+		f.failures[request]--
+		return errInternal
+	}
+	return nil
+}
+
+func (f *fakeMultipartS3) PutObject(input *awss3.PutObjectInput) (*awss3.PutObjectOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.fail("PutObject"); err != nil {
+		return nil, err
+	}
+	data, _ := ioutil.ReadAll(input.Body)
+	f.objects[*input.Key] = data
+	return &awss3.PutObjectOutput{}, nil
+}
+
+func (f *fakeMultipartS3) CreateMultipartUpload(input *awss3.CreateMultipartUploadInput) (*awss3.CreateMultipartUploadOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.created++
+	id := fmt.Sprintf("upload-%d", f.created)
+	f.uploads[id] = &fakeUpload{key: *input.Key, initiated: time.Now(), parts: map[int64][]byte{}}
+	return &awss3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (f *fakeMultipartS3) UploadPart(input *awss3.UploadPartInput) (*awss3.UploadPartOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if *input.PartNumber == f.failPart {
+		return nil, errInternal
+	}
+	if err := f.fail("UploadPart"); err != nil {
+		return nil, err
+	}
+	data, _ := ioutil.ReadAll(input.Body)
+	f.uploads[*input.UploadId].parts[*input.PartNumber] = data
+	f.uploaded = append(f.uploaded, *input.PartNumber)
+	return &awss3.UploadPartOutput{ETag: aws.String(f.etag(data))}, nil
+}
+
+func (f *fakeMultipartS3) CompleteMultipartUpload(input *awss3.CompleteMultipartUploadInput) (*awss3.CompleteMultipartUploadOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.fail("CompleteMultipartUpload"); err != nil {
+		return nil, err
+	}
+	upload := f.uploads[*input.UploadId]
+	var data []byte
+	for i, part := range input.MultipartUpload.Parts {
+		if *part.PartNumber != int64(i+1) || *part.ETag != f.etag(upload.parts[*part.PartNumber]) {
+			return nil, awserr.NewRequestFailure(awserr.New("InvalidPart", "invalid part", nil), 400, "")
+		}
+		data = append(data, upload.parts[*part.PartNumber]...)
+	}
+	f.objects[upload.key] = data
+	delete(f.uploads, *input.UploadId)
+	return &awss3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeMultipartS3) ListMultipartUploadsPages(input *awss3.ListMultipartUploadsInput,
+	fn func(*awss3.ListMultipartUploadsOutput, bool) bool) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	page := &awss3.ListMultipartUploadsOutput{}
+	for id, upload := range f.uploads {
+		if !strings.HasPrefix(upload.key, aws.StringValue(input.Prefix)) {
+			continue
+		}
+		page.Uploads = append(page.Uploads, &awss3.MultipartUpload{
+			Key: aws.String(upload.key), UploadId: aws.String(id), Initiated: aws.Time(upload.initiated),
+		})
+	}
+	fn(page, true)
+	return nil
+}
+
+func (f *fakeMultipartS3) ListPartsPages(input *awss3.ListPartsInput, fn func(*awss3.ListPartsOutput, bool) bool) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	page := &awss3.ListPartsOutput{}
+	for number, data := range f.uploads[*input.UploadId].parts {
+		page.Parts = append(page.Parts, &awss3.Part{
+			PartNumber: aws.Int64(number), ETag: aws.String(f.etag(data)), Size: aws.Int64(int64(len(data))),
+		})
+	}
+	fn(page, true)
+	return nil
+}
+
+func (f *fakeMultipartS3) AbortMultipartUpload(input *awss3.AbortMultipartUploadInput) (*awss3.AbortMultipartUploadOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.uploads[*input.UploadId]; !ok {
+		return nil, awserr.New(awss3.ErrCodeNoSuchUpload, "no such upload", nil)
+	}
+	delete(f.uploads, *input.UploadId)
+	f.aborted = append(f.aborted, *input.Key)
+	return &awss3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeMultipartS3) etag(data []byte) string {
+	sum := md5.Sum(data)
+	if f.kms {
+		sum = md5.Sum(append([]byte("kms"), data...))
+	}
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func Test_backoff_delay(t *testing.T) {
+	randInt63n = func(n int64) int64 {
+		return n - 1
+	}
+	defer func() {
+		randInt63n = rand.Int63n
+	}()
+
+	b := backoff{attempts: 10, base: 100 * time.Millisecond, max: time.Second}
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, delay := range want {
+		if got := b.delay(i + 1); got != delay {
+			t.Errorf("delay(%d) = %v, want %v", i+1, got, delay)
+		}
+	}
+	if got := b.delay(100); got != time.Second {
+		t.Errorf("delay(100) = %v, want %v", got, time.Second)
+	}
+}
+
+func Test_backoff_retry(t *testing.T) {
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{"succeeds", []error{nil}, 1, false},
+		{"retries server errors", []error{errInternal, errInternal, nil}, 3, false},
+		{"retries network errors", []error{errors.New("connection reset"), nil}, 2, false},
+		{"gives up after the attempts", []error{errInternal, errInternal, errInternal, errInternal}, 3, true},
+		{"does not retry client errors", []error{awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, ""), nil}, 1, true},
+		{"retries throttling", []error{awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), 429, ""), nil}, 2, false},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			var slept []time.Duration
+			timeSleep = func(d time.Duration) {
+				slept = append(slept, d)
+			}
+			defer func() {
+				timeSleep = time.Sleep
+			}()
+
+			calls := 0
+			err := backoff{attempts: 3, base: time.Millisecond, max: time.Second}.retry("request", func() error {
+				calls++
+				return test.errs[calls-1]
+			})
+			if (err != nil) != test.wantErr {
+				t.Errorf("retry() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if calls != test.wantCalls || len(slept) != calls-1 {
+				t.Errorf("called %d times and slept %d times, want %d calls", calls, len(slept), test.wantCalls)
+			}
+		})
+	}
+}
+
+func testUpload(api *fakeMultipartS3) *multipartUpload {
+	return &multipartUpload{
+		api:         api,
+		input:       &s3manager.UploadInput{Bucket: aws.String("b"), Key: aws.String("k")},
+		concurrency: 3,
+		backoff:     backoff{attempts: 2, base: time.Millisecond, max: time.Millisecond},
+	}
+}
+
+func testData(size int64, seed byte) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = seed + byte(i%251)
+	}
+	return data
+}
+
+func sortedParts(parts []int64) []int64 {
+	sort.Slice(parts, func(i, j int) bool { return parts[i] < parts[j] })
+	return parts
+}
+
+func Test_multipartUpload_upload(t *testing.T) {
+	data := testData(2*s3manager.MinUploadPartSize+1024, 0)
+	tests := []struct {
+		name     string
+		data     []byte
+		failures map[string]int
+		wantErr  bool
+	}{
+		{"small streams are put", []byte("data"), nil, false},
+		{"empty streams are put", []byte{}, nil, false},
+		{"large streams are uploaded in parts", data, nil, false},
+		{"retries failed parts", data, map[string]int{"UploadPart": 1, "CompleteMultipartUpload": 1}, false},
+		{"fails once the attempts are used", data, map[string]int{"CompleteMultipartUpload": 2}, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeMultipartS3()
+			for request, failures := range test.failures {
+				api.failures[request] = failures
+			}
+			err := testUpload(api).upload(bytes.NewReader(test.data))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("upload() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !bytes.Equal(api.objects["k"], test.data) {
+				t.Errorf("uploaded %d bytes, want %d", len(api.objects["k"]), len(test.data))
+			}
+		})
+	}
+}
+
+func checkpointDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "checkpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func Test_multipartUpload_resume(t *testing.T) {
+	tests := []struct {
+		name string
+		kms  bool
+	}{
+		{"ETags of the MD5 of the parts", false},
+		{"ETags of SSE-KMS", true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			dir := checkpointDir(t)
+			defer os.RemoveAll(dir)
+			data := testData(3*s3manager.MinUploadPartSize+1024, 0)
+			api := newFakeMultipartS3()
+			api.kms = test.kms
+			api.failPart = 2
+			upload := testUpload(api)
+			upload.checkpoints = dir
+			if err := upload.upload(bytes.NewReader(data)); err == nil {
+				t.Fatal("expected the upload to fail")
+			}
+			if len(api.uploads) != 1 {
+				t.Fatalf("the parts of the failed upload should be left, got %d uploads", len(api.uploads))
+			}
+
+			// the same data is streamed again, only the missing parts are uploaded
+			api.failPart = 0
+			api.uploaded = nil
+			left := len(api.uploads["upload-1"].parts)
+			upload = testUpload(api)
+			upload.checkpoints = dir
+			if err := upload.upload(bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(api.objects["k"], data) {
+				t.Errorf("uploaded %d bytes, want %d", len(api.objects["k"]), len(data))
+			}
+			if upload.uploadID != "upload-1" || len(api.uploaded) != 4-left || len(api.uploads) != 0 {
+				t.Errorf("uploaded parts %v to %s after resuming %d parts", sortedParts(api.uploaded), upload.uploadID, left)
+			}
+			if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+				t.Errorf("the checkpoint of the completed upload is left: %d files", len(files))
+			}
+		})
+	}
+}
+
+func Test_multipartUpload_resumeOtherUploads(t *testing.T) {
+	data := testData(2*s3manager.MinUploadPartSize, 0)
+	tests := []struct {
+		name        string
+		checkpoints bool
+		metadata    map[string]string
+		data        []byte
+	}{
+		{"uploads without a checkpoint", false, nil, data},
+		{"uploads with other metadata", true, map[string]string{"encryption_key": "other"}, data},
+		{"uploads of other data", true, nil, testData(2*s3manager.MinUploadPartSize, 1)},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			dir := checkpointDir(t)
+			defer os.RemoveAll(dir)
+			api := newFakeMultipartS3()
+			api.failPart = 2
+			upload := testUpload(api)
+			upload.checkpoints = dir
+			upload.input.Metadata = aws.StringMap(map[string]string{"encryption_key": "first"})
+			upload.upload(bytes.NewReader(data))
+			if !test.checkpoints {
+				os.RemoveAll(dir)
+			}
+
+			// a new upload is created, the parts and metadata of the other upload are not used
+			api.failPart = 0
+			api.uploaded = nil
+			upload = testUpload(api)
+			upload.checkpoints = dir
+			upload.input.Metadata = aws.StringMap(map[string]string{"encryption_key": "first"})
+			if test.metadata != nil {
+				upload.input.Metadata = aws.StringMap(test.metadata)
+			}
+			if err := upload.upload(bytes.NewReader(test.data)); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(api.objects["k"], test.data) {
+				t.Error("the upload does not match the stream")
+			}
+			if upload.uploadID != "upload-2" || fmt.Sprint(sortedParts(api.uploaded)) != "[1 2]" {
+				t.Errorf("uploaded parts %v to %s, want [1 2] to a new upload", api.uploaded, upload.uploadID)
+			}
+			// other uploads recorded in the checkpoint are aborted
+			if _, ok := api.uploads["upload-1"]; ok == test.checkpoints {
+				t.Errorf("the other upload is left %v, want %v", ok, !test.checkpoints)
+			}
+		})
+	}
+}
+
+func Test_s3_abortStaleUploads(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time {
+		return now
+	}
+	defer func() {
+		timeNow = time.Now
+	}()
+	dir := checkpointDir(t)
+	defer os.RemoveAll(dir)
+
+	api := newFakeMultipartS3()
+	checkpoints := []struct {
+		id, bucket string
+		updated    time.Time
+	}{
+		{"old", "b", now.Add(-25 * time.Hour)},
+		{"new", "b", now.Add(-time.Hour)},
+		{"running", "b", now.Add(-25 * time.Hour)},
+		{"other", "other", now.Add(-25 * time.Hour)},
+		{"completed", "b", now.Add(-25 * time.Hour)},
+	}
+	for _, checkpoint := range checkpoints {
+		if checkpoint.id != "completed" {
+			api.uploads[checkpoint.id] = &fakeUpload{key: "chat/" + checkpoint.id}
+		}
+		data, _ := json.Marshal(uploadCheckpoint{Bucket: checkpoint.bucket, Key: "chat/" + checkpoint.id, UploadID: checkpoint.id})
+		path := filepath.Join(dir, checkpoint.id+".json")
+		ioutil.WriteFile(path, data, 0600)
+		os.Chtimes(path, checkpoint.updated, checkpoint.updated)
+	}
+	// uploads of other servers have no checkpoint here
+	api.uploads["unknown"] = &fakeUpload{key: "chat/unknown"}
+	uploading["running"] = true
+	defer delete(uploading, "running")
+
+	s := &s3{bucket: "b", backoff: backoff{attempts: 1}}
+	if err := s.abortStaleUploads(api, dir, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(api.aborted) != "[chat/old]" || len(api.uploads) != 4 {
+		t.Errorf("aborted %v", api.aborted)
+	}
+	var left []string
+	files, _ := ioutil.ReadDir(dir)
+	for _, file := range files {
+		left = append(left, file.Name())
+	}
+	if fmt.Sprint(left) != "[new.json other.json running.json]" {
+		t.Errorf("checkpoints left %v", left)
+	}
+}
+
+func Test_multipartUpload_commits(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          []byte
+		failures      map[string]int
+		wantCommitted int64
+	}{
+		{"small streams", []byte("data"), nil, 4},
+		{"large streams", testData(2*s3manager.MinUploadPartSize+1024, 0), nil, 2*s3manager.MinUploadPartSize + 1024},
+		{"uploads which are not completed", testData(2*s3manager.MinUploadPartSize+1024, 0),
+			map[string]int{"CompleteMultipartUpload": 2}, 0},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeMultipartS3()
+			for request, failures := range test.failures {
+				api.failures[request] = failures
+			}
+			reader := &committingReader{Reader: bytes.NewReader(test.data)}
+			testUpload(api).upload(reader)
+			if reader.committed() != test.wantCommitted || len(reader.commits) > 1 {
+				t.Errorf("commits = %v, want %d once", reader.commits, test.wantCommitted)
+			}
+		})
+	}
+}
@@ -4,12 +4,16 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"reflect"
 	"testing"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
@@ -26,7 +30,33 @@ func TestNewS3Streamer(t *testing.T) {
 			os.Setenv(awsAccessKey, "awsAccessKey")
 			os.Setenv(awsAccessSecret, "awsAccessSecret")
 		}, &s3{
-			key:          getKey(0),
+			key:          defaultS3KeyTemplate.Execute(Object{}),
+			metadata:     Object{}.metadata(),
+			tags:         url.Values{},
+			encoding:     gzipContentEncoding,
+			backoff:      newBackoff(),
+			bucket:       "awsBucket",
+			region:       "awsRegion",
+			accessKey:    "awsAccessKey",
+			accessSecret: "awsAccessSecret",
+		}, false},
+		{"upload options", func() {
+			os.Setenv(awsBucket, "awsBucket")
+			os.Setenv(awsRegion, "awsRegion")
+			os.Setenv(awsAccessKey, "awsAccessKey")
+			os.Setenv(awsAccessSecret, "awsAccessSecret")
+			os.Setenv(awsSSEKMSKeyID, "alias/logs")
+			os.Setenv(awsStorageClass, "GLACIER_IR")
+			os.Setenv(awsObjectTags, "client_id={client_id}, date={date}")
+		}, &s3{
+			key:          defaultS3KeyTemplate.Execute(Object{}),
+			metadata:     Object{}.metadata(),
+			sse:          "aws:kms",
+			kmsKeyID:     "alias/logs",
+			storageClass: "GLACIER_IR",
+			tags:         url.Values{"client_id": {"unknown"}, "date": {time.Now().Format("2006-01-02")}},
+			encoding:     gzipContentEncoding,
+			backoff:      newBackoff(),
 			bucket:       "awsBucket",
 			region:       "awsRegion",
 			accessKey:    "awsAccessKey",
@@ -34,7 +64,83 @@ func TestNewS3Streamer(t *testing.T) {
 		}, false},
 		{"should call error", func() {
 		}, &s3{
-			key: getKey(0),
+			key:      defaultS3KeyTemplate.Execute(Object{}),
+			metadata: Object{}.metadata(),
+			tags:     url.Values{},
+			encoding: gzipContentEncoding,
+			backoff:  newBackoff(),
+		}, true},
+		{"should call error for unknown encryption", func() {
+			os.Setenv(awsBucket, "awsBucket")
+			os.Setenv(awsRegion, "awsRegion")
+			os.Setenv(awsAccessKey, "awsAccessKey")
+			os.Setenv(awsAccessSecret, "awsAccessSecret")
+			os.Setenv(awsSSE, "des")
+		}, &s3{
+			key:          defaultS3KeyTemplate.Execute(Object{}),
+			metadata:     Object{}.metadata(),
+			sse:          "des",
+			tags:         url.Values{},
+			encoding:     gzipContentEncoding,
+			backoff:      newBackoff(),
+			bucket:       "awsBucket",
+			region:       "awsRegion",
+			accessKey:    "awsAccessKey",
+			accessSecret: "awsAccessSecret",
+		}, true},
+		{"should call error for unknown storage class", func() {
+			os.Setenv(awsBucket, "awsBucket")
+			os.Setenv(awsRegion, "awsRegion")
+			os.Setenv(awsAccessKey, "awsAccessKey")
+			os.Setenv(awsAccessSecret, "awsAccessSecret")
+			os.Setenv(awsStorageClass, "COLD")
+		}, &s3{
+			key:          defaultS3KeyTemplate.Execute(Object{}),
+			metadata:     Object{}.metadata(),
+			storageClass: "COLD",
+			tags:         url.Values{},
+			encoding:     gzipContentEncoding,
+			backoff:      newBackoff(),
+			bucket:       "awsBucket",
+			region:       "awsRegion",
+			accessKey:    "awsAccessKey",
+			accessSecret: "awsAccessSecret",
+		}, true},
+		{"retry options", func() {
+			os.Setenv(awsBucket, "awsBucket")
+			os.Setenv(awsRegion, "awsRegion")
+			os.Setenv(awsAccessKey, "awsAccessKey")
+			os.Setenv(awsAccessSecret, "awsAccessSecret")
+			os.Setenv(awsRetryAttempts, "3")
+			os.Setenv(awsRetryBaseDelay, "1s")
+			os.Setenv(awsRetryMaxDelay, "1m")
+		}, &s3{
+			key:          defaultS3KeyTemplate.Execute(Object{}),
+			metadata:     Object{}.metadata(),
+			tags:         url.Values{},
+			encoding:     gzipContentEncoding,
+			backoff:      backoff{attempts: 3, base: time.Second, max: time.Minute},
+			bucket:       "awsBucket",
+			region:       "awsRegion",
+			accessKey:    "awsAccessKey",
+			accessSecret: "awsAccessSecret",
+		}, false},
+		{"should call error for invalid retry attempts", func() {
+			os.Setenv(awsBucket, "awsBucket")
+			os.Setenv(awsRegion, "awsRegion")
+			os.Setenv(awsAccessKey, "awsAccessKey")
+			os.Setenv(awsAccessSecret, "awsAccessSecret")
+			os.Setenv(awsRetryAttempts, "0")
+		}, &s3{
+			key:          defaultS3KeyTemplate.Execute(Object{}),
+			metadata:     Object{}.metadata(),
+			tags:         url.Values{},
+			encoding:     gzipContentEncoding,
+			backoff:      backoff{attempts: 0, base: defaultRetryBaseDelay, max: defaultRetryMaxDelay},
+			bucket:       "awsBucket",
+			region:       "awsRegion",
+			accessKey:    "awsAccessKey",
+			accessSecret: "awsAccessSecret",
 		}, true},
 	}
 	for _, tt := range tests {
@@ -52,9 +158,16 @@ func TestNewS3Streamer(t *testing.T) {
 				os.Unsetenv(awsRegion)
 				os.Unsetenv(awsAccessKey)
 				os.Unsetenv(awsAccessSecret)
+				os.Unsetenv(awsSSE)
+				os.Unsetenv(awsSSEKMSKeyID)
+				os.Unsetenv(awsStorageClass)
+				os.Unsetenv(awsObjectTags)
+				os.Unsetenv(awsRetryAttempts)
+				os.Unsetenv(awsRetryBaseDelay)
+				os.Unsetenv(awsRetryMaxDelay)
 			}()
 
-			if got := NewS3Streamer(0, 0, 0); !reflect.DeepEqual(got, test.want) {
+			if got := NewS3Streamer(Object{}, 0, 0); !reflect.DeepEqual(got, test.want) {
 				t.Errorf("NewS3Streamer() = %v, want %v", got, test.want)
 			}
 
@@ -73,10 +186,10 @@ func Test_s3_Wait(t *testing.T) {
 	fmt.Println("Does not deadlock, that's good!")
 }
 
-func Test_getKey(t *testing.T) {
+func Test_defaultS3KeyTemplate(t *testing.T) {
 	date := time.Now().Format("2006-01-02")
-	wanted := fmt.Sprintf("/chat/%s/content_logs_%s_%d", date, date, 1)
-	got := getKey(1)
+	wanted := fmt.Sprintf("chat/%s/content_logs_%s_%d_%d", date, date, 1, 7)
+	got := defaultS3KeyTemplate.Execute(Object{ClientID: "1", Partition: "1", Sequence: 7})
 
 	if got != wanted {
 		t.Errorf("wanted %v but got %v", wanted, got)
@@ -84,40 +197,155 @@ func Test_getKey(t *testing.T) {
 }
 
 func Test_s3_Stream(t *testing.T) {
+	api := newFakeMultipartS3()
+	s3NewAPI = func(*session.Session) s3iface.S3API {
+		return api
+	}
+	defer func() {
+		s3NewAPI = func(sess *session.Session) s3iface.S3API { return awss3.New(sess) }
+	}()
+
+	s := &s3{
+		key:          defaultS3KeyTemplate.Execute(Object{}),
+		bucket:       "awsBucket",
+		region:       "awsRegion",
+		accessKey:    "awsAccessKey",
+		accessSecret: "awsAccessSecret",
+	}
+	if err := s.Stream(bytes.NewBufferString("data")); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(api.objects[s.key]); got != "data" {
+		t.Errorf("uploaded %q", got)
+	}
+}
+
+func Test_s3_uploadInput(t *testing.T) {
+	var buf bytes.Buffer
 	tests := []struct {
-		name  string
-		setup func(calledUpload *bool)
+		name string
+		s    *s3
+		want *s3manager.UploadInput
 	}{
-		{"should call the upload function", func(calledUpload *bool) {
-			s3managerNewUploader = func(c client.ConfigProvider, options ...func(*s3manager.Uploader)) *s3manager.Uploader {
-				*calledUpload = true
-				return s3manager.NewUploader(c, options...)
-			}
+		{"defaults", &s3{bucket: "b", key: "k"}, &s3manager.UploadInput{
+			Bucket:      aws.String("b"),
+			Key:         aws.String("k"),
+			Body:        &buf,
+			ContentType: aws.String(contentType),
+			Metadata:    map[string]*string{},
+		}},
+		{"all options", &s3{
+			bucket:       "b",
+			key:          "k",
+			metadata:     map[string]string{metadataServerVersion: "1.0"},
+			sse:          "aws:kms",
+			kmsKeyID:     "alias/logs",
+			storageClass: "STANDARD_IA",
+			tags:         url.Values{"date": {"2026-10-19"}, "client_id": {"42"}},
+			encoding:     gzipContentEncoding,
+		}, &s3manager.UploadInput{
+			Bucket:               aws.String("b"),
+			Key:                  aws.String("k"),
+			Body:                 &buf,
+			ContentType:          aws.String(contentType),
+			ContentEncoding:      aws.String("gzip"),
+			Metadata:             map[string]*string{metadataServerVersion: aws.String("1.0")},
+			ServerSideEncryption: aws.String("aws:kms"),
+			SSEKMSKeyId:          aws.String("alias/logs"),
+			StorageClass:         aws.String("STANDARD_IA"),
+			Tagging:              aws.String("client_id=42&date=2026-10-19"),
 		}},
 	}
 	for _, tt := range tests {
 		test := tt
 		t.Run(test.name, func(t *testing.T) {
-			var buf bytes.Buffer
-			var calledUpload bool
-
-			s := &s3{
-				key:          getKey(0),
-				bucket:       "awsBucket",
-				region:       "awsRegion",
-				accessKey:    "awsAccessKey",
-				accessSecret: "awsAccessSecret",
+			if got := test.s.uploadInput(&buf); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("uploadInput() = %v, want %v", got, test.want)
 			}
+		})
+	}
+}
 
-			test.setup(&calledUpload)
-			defer func() {
-				s3managerNewUploader = s3manager.NewUploader
-			}()
+func TestNewS3Streamer_encrypted(t *testing.T) {
+	os.Setenv(awsBucket, "awsBucket")
+	os.Setenv(awsRegion, "awsRegion")
+	os.Setenv(awsAccessKey, "awsAccessKey")
+	os.Setenv(awsAccessSecret, "awsAccessSecret")
+	defer func() {
+		os.Unsetenv(awsBucket)
+		os.Unsetenv(awsRegion)
+		os.Unsetenv(awsAccessKey)
+		os.Unsetenv(awsAccessSecret)
+	}()
 
-			s.Stream(&buf)
+	s := NewS3Streamer(Object{Extension: "ndjson.gz.enc", Metadata: map[string]string{"encryption_key": "k"}}, 0, 0).(*s3)
+	if s.encoding != "" {
+		t.Errorf("encoding = %v, encrypted objects must not be marked as gzip", s.encoding)
+	}
+	if s.metadata["encryption_key"] != "k" || s.metadata[metadataServerVersion] != Version {
+		t.Errorf("unexpected metadata %v", s.metadata)
+	}
+}
+
+type fakeS3 struct {
+	s3iface.S3API
+	input *awss3.PutObjectTaggingInput
+}
+
+func (f *fakeS3) PutObjectTagging(input *awss3.PutObjectTaggingInput) (*awss3.PutObjectTaggingOutput, error) {
+	f.input = input
+	return &awss3.PutObjectTaggingOutput{}, nil
+}
 
-			if !calledUpload {
-				t.Error("did not call upload function")
+func Test_s3_tagMessageCount(t *testing.T) {
+	api := &fakeS3{}
+	s := &s3{bucket: "b", key: "k"}
+	s.tagMessageCount(api, 3)
+	want := &awss3.PutObjectTaggingInput{
+		Bucket:  aws.String("b"),
+		Key:     aws.String("k"),
+		Tagging: &awss3.Tagging{TagSet: []*awss3.Tag{{Key: aws.String(tagMessageCount), Value: aws.String("3")}}},
+	}
+	if !reflect.DeepEqual(api.input, want) {
+		t.Errorf("PutObjectTagging() = %v, want %v", api.input, want)
+	}
+
+	s.tags = url.Values{"client_id": {"42"}}
+	s.tagMessageCount(api, 3)
+	want = &awss3.PutObjectTaggingInput{
+		Bucket: aws.String("b"),
+		Key:    aws.String("k"),
+		Tagging: &awss3.Tagging{TagSet: []*awss3.Tag{
+			{Key: aws.String("client_id"), Value: aws.String("42")},
+			{Key: aws.String(tagMessageCount), Value: aws.String("3")},
+		}},
+	}
+	if !reflect.DeepEqual(api.input, want) {
+		t.Errorf("PutObjectTagging() = %v, want %v", api.input, want)
+	}
+}
+
+func Test_objectTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		tags    string
+		want    url.Values
+		wantErr bool
+	}{
+		{"empty", "", url.Values{}, false},
+		{"expands placeholders", "client_id={client_id},team=chat", url.Values{"client_id": {"42"}, "team": {"chat"}}, false},
+		{"invalid pair", "client_id", nil, true},
+		{"unknown placeholder", "a={nope}", nil, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			got, err := objectTags(test.tags, Object{ClientID: "42"})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("objectTags() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("objectTags() = %v, want %v", got, test.want)
 			}
 		})
 	}
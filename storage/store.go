@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// MetadataClientID is the name of the metadata holding the client id of an object
+const MetadataClientID = metadataClientID
+
+// ClientIDOf returns the client id in the metadata of an object, or an empty string if it is not set
+func ClientIDOf(metadata map[string]string) string {
+	id, err := url.QueryUnescape(metadata[metadataClientID])
+	if err != nil {
+		return metadata[metadataClientID]
+	}
+	return id
+}
+
+var (
+	azblobListBlobs = azblob.ContainerURL.ListBlobsFlatSegment
+	azblobDownload  = azblob.BlobURL.Download
+)
+
+// StoredObject is an object or blob listed by an ObjectStore
+type StoredObject struct {
+	// Container is the Azure container of the blob
+	Container string
+	Key       string
+	Modified  time.Time
+	// Metadata is nil if the backend only returns it when the object is opened
+	Metadata map[string]string
+}
+
+// ObjectStore lists and reads the objects streamed to a backend
+type ObjectStore interface {
+	// List returns the objects which may hold messages of the object's client created on the day of the object,
+	// the partition is left empty if it is not the client id. Keys are listed with the object's template if it has one
+	List(object Object) ([]StoredObject, error)
+	// Open returns the content of an object as it was streamed and its metadata
+	Open(object StoredObject) (io.ReadCloser, map[string]string, error)
+}
+
+// templateOf returns the object's own template, or the template of the store if it has none
+func templateOf(object Object, template KeyTemplate) KeyTemplate {
+	if object.Template != "" {
+		return object.Template
+	}
+	return template
+}
+
+// prefix returns the key of the object up to the first placeholder which is not known when listing objects, the
+// date is known but the hour, sequence number, host, codec and message fields are not
+func (t KeyTemplate) prefix(o Object) string {
+	var b strings.Builder
+	rest := string(t)
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			b.WriteString(rest)
+			break
+		}
+		b.WriteString(rest[:start])
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			break
+		}
+		name := rest[start+1 : start+end]
+		switch {
+		case name == "date", name == "yyyy", name == "mm", name == "dd":
+		case name == "client_id" && o.ClientID != "":
+		case name == "partition" && o.Partition != "":
+		default:
+			return strings.TrimLeft(b.String(), "/")
+		}
+		value, _ := placeholder(name, o)
+		b.WriteString(value)
+		rest = rest[start+end+1:]
+	}
+	return strings.TrimLeft(b.String(), "/")
+}
+
+type s3Store struct {
+	bucket   string
+	template KeyTemplate
+	api      s3iface.S3API
+}
+
+// NewS3Store returns the ObjectStore of the objects streamed to AWS_BUCKET
+func NewS3Store() ObjectStore {
+	s := &s3{
+		bucket:       os.Getenv(awsBucket),
+		region:       os.Getenv(awsRegion),
+		accessKey:    os.Getenv(awsAccessKey),
+		accessSecret: os.Getenv(awsAccessSecret),
+	}
+	if s.bucket == "" || s.region == "" || s.accessKey == "" || s.accessSecret == "" {
+		message := "Cannot create s3 store, ensure the following environment variables are set:"
+		logFatalf("%s\n%s\n%s\n%s\n%s\n", message, awsBucket, awsRegion, awsAccessKey, awsAccessSecret)
+	}
+	return &s3Store{
+		bucket:   s.bucket,
+		template: keyTemplate(awsKeyTemplate, defaultS3KeyTemplate),
+		api:      s3NewAPI(s.session()),
+	}
+}
+
+func (s *s3Store) List(object Object) ([]StoredObject, error) {
+	var objects []StoredObject
+	input := &awss3.ListObjectsV2Input{Bucket: aws.String(s.bucket), Prefix: aws.String(templateOf(object, s.template).prefix(object))}
+	err := s.api.ListObjectsV2Pages(input, func(page *awss3.ListObjectsV2Output, _ bool) bool {
+		for _, item := range page.Contents {
+			objects = append(objects, StoredObject{Key: aws.StringValue(item.Key), Modified: aws.TimeValue(item.LastModified)})
+		}
+		return true
+	})
+	return objects, err
+}
+
+// lastSequence also reads the keys of uploads which are not completed yet, as they may still be completed
+func (s *s3Store) lastSequence(object Object) (int, error) {
+	last, err := lastSequence(s, s.template, object)
+	if err != nil {
+		return 0, err
+	}
+	template := templateOf(object, s.template)
+	input := &awss3.ListMultipartUploadsInput{Bucket: aws.String(s.bucket), Prefix: aws.String(template.prefix(object))}
+	err = s.api.ListMultipartUploadsPages(input, func(page *awss3.ListMultipartUploadsOutput, _ bool) bool {
+		for _, upload := range page.Uploads {
+			if sequence, ok := template.sequenceOf(aws.StringValue(upload.Key), object); ok && sequence > last {
+				last = sequence
+			}
+		}
+		return true
+	})
+	return last, err
+}
+
+func (s *s3Store) Open(object StoredObject) (io.ReadCloser, map[string]string, error) {
+	output, err := s.api.GetObject(&awss3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(object.Key)})
+	if err != nil {
+		return nil, nil, err
+	}
+	// the SDK returns metadata names in canonical header form e.g. Client_id
+	metadata := map[string]string{}
+	for name, value := range output.Metadata {
+		metadata[strings.ToLower(name)] = aws.StringValue(value)
+	}
+	return output.Body, metadata, nil
+}
+
+type azureStore struct {
+	account   string
+	accessKey string
+	template  KeyTemplate
+}
+
+// NewAzureStore returns the ObjectStore of the blobs streamed to AZURE_STORAGE_ACCOUNT, blobs are listed from the
+// container of their day
+func NewAzureStore() ObjectStore {
+	a := &azureStore{
+		account:   os.Getenv(azureAccount),
+		accessKey: os.Getenv(azureAccessKey),
+		template:  keyTemplate(azureTemplate, defaultAzureBlobTemplate),
+	}
+	if a.account == "" || a.accessKey == "" {
+		message := "Cannot create Azure store, ensure the following environment variables are set:"
+		logFatalf("%s\n%s\n%s\n", message, azureAccount, azureAccessKey)
+	}
+	return a
+}
+
+func (a *azureStore) containerURL(container string) (azblob.ContainerURL, error) {
+	credential, err := azblobNewSharedKeyCredential(a.account, a.accessKey)
+	if err != nil {
+		return azblob.ContainerURL{}, err
+	}
+	URL, err := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/%s", a.account, container))
+	if err != nil {
+		return azblob.ContainerURL{}, err
+	}
+	return azblob.NewContainerURL(*URL, azblob.NewPipeline(credential, azblob.PipelineOptions{})), nil
+}
+
+func (a *azureStore) List(object Object) ([]StoredObject, error) {
+	container := object.Created.Format("2006-01-02")
+	containerURL, err := a.containerURL(container)
+	if err != nil {
+		return nil, err
+	}
+	var objects []StoredObject
+	options := azblob.ListBlobsSegmentOptions{Prefix: templateOf(object, a.template).prefix(object), Details: azblob.BlobListingDetails{Metadata: true}}
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		list, err := azblobListBlobs(containerURL, context.Background(), marker, options)
+		if err != nil {
+			if serr, ok := err.(azblob.StorageError); ok && serr.ServiceCode() == azblob.ServiceCodeContainerNotFound {
+				return nil, nil
+			}
+			return nil, err
+		}
+		for _, blob := range list.Segment.BlobItems {
+			objects = append(objects, StoredObject{
+				Container: container,
+				Key:       blob.Name,
+				Modified:  blob.Properties.LastModified,
+				Metadata:  blob.Metadata,
+			})
+		}
+		marker = list.NextMarker
+	}
+	return objects, nil
+}
+
+func (a *azureStore) lastSequence(object Object) (int, error) {
+	return lastSequence(a, a.template, object)
+}
+
+func (a *azureStore) Open(object StoredObject) (io.ReadCloser, map[string]string, error) {
+	containerURL, err := a.containerURL(object.Container)
+	if err != nil {
+		return nil, nil, err
+	}
+	download, err := azblobDownload(containerURL.NewBlobURL(object.Key), context.Background(), 0, azblob.CountToEnd,
+		azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return download.Body(azblob.RetryReaderOptions{}), download.NewMetadata(), nil
+}
+
+type localStore struct {
+	dir      string
+	template KeyTemplate
+}
+
+// NewLocalStore returns the ObjectStore of the files written under LOCAL_STORAGE_DIR
+func NewLocalStore() ObjectStore {
+	l := &localStore{dir: os.Getenv(localDir), template: keyTemplate(localTemplate, defaultLocalKeyTemplate)}
+	if l.dir == "" {
+		logFatalf("Cannot create local store, ensure the following environment variables are set:\n%s\n", localDir)
+	}
+	return l
+}
+
+// List walks the directory of the prefix, the metadata of files which are still being written is not known
+func (l *localStore) List(object Object) ([]StoredObject, error) {
+	prefix := filepath.FromSlash(templateOf(object, l.template).prefix(object))
+	root := filepath.Join(l.dir, prefix[:strings.LastIndexByte(prefix, filepath.Separator)+1])
+	var objects []StoredObject
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() || strings.HasSuffix(path, objectSuffix) {
+			return err
+		}
+		key, err := filepath.Rel(l.dir, path)
+		if err != nil || !strings.HasPrefix(key, prefix) {
+			return err
+		}
+		stored := StoredObject{Key: filepath.ToSlash(key), Modified: info.ModTime()}
+		if description, err := ioutil.ReadFile(path + objectSuffix); err == nil {
+			var o Object
+			if json.Unmarshal(description, &o) == nil {
+				stored.Metadata = o.metadata()
+			}
+		}
+		objects = append(objects, stored)
+		return nil
+	})
+	return objects, err
+}
+
+func (l *localStore) lastSequence(object Object) (int, error) {
+	return lastSequence(l, l.template, object)
+}
+
+func (l *localStore) Open(object StoredObject) (io.ReadCloser, map[string]string, error) {
+	file, err := os.Open(filepath.Join(l.dir, filepath.FromSlash(object.Key)))
+	return file, object.Metadata, err
+}
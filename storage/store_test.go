@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestKeyTemplate_prefix(t *testing.T) {
+	day := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		template KeyTemplate
+		object   Object
+		want     string
+	}{
+		{"default s3 template", defaultS3KeyTemplate, Object{ClientID: "42", Partition: "42", Created: day},
+			"chat/2026-10-18/content_logs_2026-10-18_42_"},
+		{"unknown partition", defaultS3KeyTemplate, Object{ClientID: "42", Created: day}, "chat/2026-10-18/content_logs_2026-10-18_"},
+		{"date parts and client", "{yyyy}/{mm}/{dd}/client={client_id}/{hh}/part-{seq:4}.{ext}", Object{ClientID: "4/2", Created: day},
+			"2026/10/18/client=4_2~0ae38aae1700244a/"},
+		{"host", "/{instance}/{date}", Object{ClientID: "42", Created: day}, ""},
+		{"no placeholders", "logs", Object{Created: day}, "logs"},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.template.prefix(test.object); got != test.want {
+				t.Errorf("prefix() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	tests := []struct {
+		name            string
+		newStore        func() ObjectStore
+		env             map[string]string
+		shouldCallFatal bool
+	}{
+		{"s3", NewS3Store, map[string]string{awsBucket: "b", awsRegion: "r", awsAccessKey: "k", awsAccessSecret: "s"}, false},
+		{"should call fatal without s3 credentials", NewS3Store, map[string]string{awsBucket: "b"}, true},
+		{"azure", NewAzureStore, map[string]string{azureAccount: "a", azureAccessKey: "k"}, false},
+		{"should call fatal without azure credentials", NewAzureStore, map[string]string{azureAccount: "a"}, true},
+		{"local", NewLocalStore, map[string]string{localDir: "data"}, false},
+		{"should call fatal without a directory", NewLocalStore, map[string]string{}, true},
+	}
+	for _, tt := range tests {
+		test := tt
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				os.Setenv(name, value)
+			}
+			fatal := false
+			logFatalf = func(format string, args ...interface{}) {
+				fatal = true
+			}
+			defer func() {
+				logFatalf = log.Fatalf
+				for name := range test.env {
+					os.Unsetenv(name)
+				}
+			}()
+
+			if test.newStore() == nil {
+				t.Error("store is nil")
+			}
+			if test.shouldCallFatal != fatal {
+				t.Errorf("wanted %v but got %v", test.shouldCallFatal, fatal)
+			}
+		})
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv(localDir, dir)
+	defer os.Unsetenv(localDir)
+
+	day := time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local)
+	for _, object := range []Object{
+		{ClientID: "42", Partition: "42", Created: day},
+		{ClientID: "42", Partition: "42", Created: day},
+		{ClientID: "420", Partition: "420", Created: day},
+		{ClientID: "42", Partition: "42", Created: day.AddDate(0, 0, 1)},
+	} {
+		if err := NewLocalStreamer(object, 0, 0).Stream(bytes.NewBufferString(object.Partition)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := NewLocalStore()
+	objects, err := store.List(Object{ClientID: "42", Partition: "42", Created: day})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	// the second object of a partition has a sequence number
+	want := []string{"2026-10-18/content_logs_2026-10-18_42_0.ndjson.gz", "2026-10-18/content_logs_2026-10-18_42_0.ndjson.gz.1"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("keys = %q, want %q", keys, want)
+	}
+
+	reader, metadata, err := store.Open(objects[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if content, _ := ioutil.ReadAll(reader); string(content) != "42" {
+		t.Errorf("content = %q, want %q", content, "42")
+	}
+	if metadata[metadataClientID] != "42" {
+		t.Errorf("metadata = %v", metadata)
+	}
+
+	// objects of other partitions match the prefix if the partition is not known
+	if objects, err := store.List(Object{ClientID: "42", Created: day}); err != nil || len(objects) != 3 {
+		t.Errorf("List() = %v, %v, want the objects of every partition", objects, err)
+	}
+	if objects, err := store.List(Object{ClientID: "42", Created: day.AddDate(0, 0, 2)}); err != nil || len(objects) != 0 {
+		t.Errorf("List() = %v, %v for a day without objects", objects, err)
+	}
+}
+
+type fakeS3Store struct {
+	s3iface.S3API
+	input   *awss3.ListObjectsV2Input
+	objects map[string]string
+}
+
+func (f *fakeS3Store) ListObjectsV2Pages(input *awss3.ListObjectsV2Input, fn func(*awss3.ListObjectsV2Output, bool) bool) error {
+	f.input = input
+	for key := range f.objects {
+		fn(&awss3.ListObjectsV2Output{Contents: []*awss3.Object{{Key: aws.String(key)}}}, false)
+	}
+	return nil
+}
+
+func (f *fakeS3Store) GetObject(input *awss3.GetObjectInput) (*awss3.GetObjectOutput, error) {
+	return &awss3.GetObjectOutput{
+		Body:     ioutil.NopCloser(bytes.NewBufferString(f.objects[*input.Key])),
+		Metadata: map[string]*string{"Client_id": aws.String("42")},
+	}, nil
+}
+
+func Test_s3Store(t *testing.T) {
+	api := &fakeS3Store{objects: map[string]string{"chat/2026-10-18/content_logs_2026-10-18_42_0": "data"}}
+	s := &s3Store{bucket: "b", template: defaultS3KeyTemplate, api: api}
+
+	objects, err := s.List(Object{ClientID: "42", Partition: "42", Created: time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)})
+	if err != nil || len(objects) != 1 {
+		t.Fatalf("List() = %v, %v", objects, err)
+	}
+	if *api.input.Bucket != "b" || *api.input.Prefix != "chat/2026-10-18/content_logs_2026-10-18_42_" {
+		t.Errorf("listed %v", api.input)
+	}
+	reader, metadata, err := s.Open(objects[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadAll(reader); string(content) != "data" {
+		t.Errorf("content = %q, want %q", content, "data")
+	}
+	if !reflect.DeepEqual(metadata, map[string]string{metadataClientID: "42"}) {
+		t.Errorf("metadata = %v", metadata)
+	}
+}
+
+func Test_azureStore_List(t *testing.T) {
+	var containers, prefixes []string
+	azblobListBlobs = func(c azblob.ContainerURL, _ context.Context, marker azblob.Marker, o azblob.ListBlobsSegmentOptions) (*azblob.ListBlobsFlatSegmentResponse, error) {
+		u := c.URL()
+		containers = append(containers, u.Path)
+		prefixes = append(prefixes, o.Prefix)
+		list := &azblob.ListBlobsFlatSegmentResponse{}
+		// the blobs are listed in two segments
+		if marker.Val == nil {
+			list.NextMarker = azblob.Marker{Val: aws.String("next")}
+			list.Segment.BlobItems = []azblob.BlobItem{{Name: "a", Metadata: azblob.Metadata{metadataClientID: "42"}}}
+		} else {
+			list.NextMarker = azblob.Marker{Val: aws.String("")}
+			list.Segment.BlobItems = []azblob.BlobItem{{Name: "b"}}
+		}
+		return list, nil
+	}
+	defer func() {
+		azblobListBlobs = azblob.ContainerURL.ListBlobsFlatSegment
+	}()
+
+	a := &azureStore{account: "account", accessKey: "a2V5", template: defaultAzureBlobTemplate}
+	objects, err := a.List(Object{ClientID: "42", Partition: "42", Created: time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []StoredObject{
+		{Container: "2026-10-18", Key: "a", Metadata: map[string]string{metadataClientID: "42"}},
+		{Container: "2026-10-18", Key: "b"},
+	}
+	if !reflect.DeepEqual(objects, want) {
+		t.Errorf("List() = %v, want %v", objects, want)
+	}
+	if !reflect.DeepEqual(containers, []string{"/2026-10-18", "/2026-10-18"}) ||
+		!reflect.DeepEqual(prefixes, []string{"content-logs-2026-10-18-42-", "content-logs-2026-10-18-42-"}) {
+		t.Errorf("listed containers %v with prefixes %v", containers, prefixes)
+	}
+}